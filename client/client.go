@@ -17,17 +17,21 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
-	"net/rpc"
 	"os"
 	"os/exec"
+	"sync"
+	"time"
 
 	"github.com/googleapis/enterprise-certificate-proxy/client/util"
 )
@@ -37,6 +41,9 @@ const certificateChainAPI = "EnterpriseCertSigner.CertificateChain"
 const publicKeyAPI = "EnterpriseCertSigner.Public"
 const encryptAPI = "EnterpriseCertSigner.Encrypt"
 const decryptAPI = "EnterpriseCertSigner.Decrypt"
+const diagnosticsAPI = "EnterpriseCertSigner.Diagnostics"
+const signMessageAPI = "EnterpriseCertSigner.SignMessage"
+const handshakeAPI = "EnterpriseCertSigner.Handshake"
 
 // A Connection wraps a pair of unidirectional streams as an io.ReadWriteCloser.
 type Connection struct {
@@ -57,6 +64,8 @@ func (c *Connection) Close() error {
 func init() {
 	gob.Register(crypto.SHA256)
 	gob.Register(&rsa.PSSOptions{})
+	gob.Register(&rsa.OAEPOptions{})
+	gob.Register(&rsa.PKCS1v15DecryptOptions{})
 }
 
 // SignArgs contains arguments to a crypto Signer.Sign method.
@@ -65,20 +74,44 @@ type SignArgs struct {
 	Opts   crypto.SignerOpts // Options for signing, such as Hash identifier.
 }
 
+// SignMessageArgs contains arguments to a SignMessage method.
+type SignMessageArgs struct {
+	Message []byte            // The message to hash and sign.
+	Opts    crypto.SignerOpts // Options for signing, such as Hash identifier.
+}
+
 type EncryptArgs struct {
 	Plaintext []byte
 }
 
+// DecryptArgs contains arguments to a crypto Decrypter.Decrypt method.
 type DecryptArgs struct {
-	Ciphertext []byte
+	Ciphertext []byte               // The content to decrypt.
+	Opts       crypto.DecrypterOpts // Options for decryption, such as the padding scheme.
 }
 
-// Key implements credential.Credential by holding the executed signer subprocess.
+// Key implements credential.Credential, crypto.Signer and crypto.Decrypter by
+// holding the executed signer subprocess.
+//
+// A Key is safe for concurrent use. Both transports multiplex calls over the
+// one connection to the signer, which serves each call in its own goroutine,
+// so concurrent Sign calls are limited only by the keystore.
 type Key struct {
-	cmd       *exec.Cmd        // Pointer to the signer subprocess.
-	client    *rpc.Client      // Pointer to the rpc client that communicates with the signer subprocess.
-	publicKey crypto.PublicKey // Public key of loaded certificate.
-	chain     [][]byte         // Certificate chain of loaded certificate.
+	mu             sync.Mutex           // Guards cmd, client, caps, job, signerCopy and closed, which change when the signer restarts.
+	closed         bool                 // Whether Close was called.
+	cmd            *exec.Cmd            // Pointer to the signer subprocess, or nil when attached to a shared signer.
+	client         rpcClient            // The rpc client that communicates with the signer subprocess.
+	caps           Capabilities         // What the signer reported it supports.
+	publicKey      crypto.PublicKey     // Public key of loaded certificate.
+	chain          [][]byte             // Certificate chain of loaded certificate.
+	signerPath     string               // Path of the signer binary.
+	integrity      util.SignerIntegrity // Checks the signer binary must pass before each start.
+	configFilePath string               // Path of the config file passed to the signer.
+	profile        string               // Credential profile selected in the config, or empty for the top-level one.
+	debugDir       string               // Directory receiving debug bundles, or empty if disabled.
+	stderr         *tailBuffer          // Trailing signer stderr output, captured only in debug mode.
+	job            io.Closer            // Ties the signer's lifetime to this process, on Windows.
+	signerCopy     string               // Directory holding the verified copy of the signer binary that cmd runs, if any.
 }
 
 // CertificateChain returns the credential as a raw X509 cert chain. This contains the public key.
@@ -86,18 +119,57 @@ func (k *Key) CertificateChain() [][]byte {
 	return k.chain
 }
 
-// Close closes the RPC connection and kills the signer subprocess.
-// Call this to free up resources when the Key object is no longer needed.
+// TLSCertificate returns the credential as a tls.Certificate for a client or
+// server tls.Config, with the chain loaded from the signer and k as its
+// private key, so that each handshake signs with the signer. Its signature
+// algorithms are limited to those using a hash the signer accepts. The Key must
+// stay open while the certificate is in use.
+func (k *Key) TLSCertificate() tls.Certificate {
+	cert := tls.Certificate{
+		Certificate:                  k.chain,
+		PrivateKey:                   k,
+		SupportedSignatureAlgorithms: signatureSchemes(k.Capabilities()),
+	}
+	if len(k.chain) > 0 {
+		// Leave Leaf nil if the leaf does not parse; crypto/tls reports
+		// that when the certificate is used.
+		if leaf, err := x509.ParseCertificate(k.chain[0]); err == nil {
+			cert.Leaf = leaf
+		}
+	}
+	return cert
+}
+
+// Close closes the RPC connection and kills the signer subprocess, if this Key
+// started one, or closes the key if it was opened in-process. Call this to free up resources when the Key object is no longer needed.
 func (k *Key) Close() error {
-	if err := k.cmd.Process.Kill(); err != nil {
-		return fmt.Errorf("failed to kill signer process: %w", err)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.closed = true
+	logger().Debug("closing credential", "config", k.configFilePath)
+	if k.cmd == nil {
+		// Attached to a shared signer, which outlives this Key, or signing
+		// in-process.
+		return k.client.Close()
 	}
-	// Wait for cmd to exit and release resources. Since the process is forcefully killed, this
-	// will return a non-nil error (varies by OS), which we will ignore.
-	_ = k.cmd.Wait()
+	// After a failed restart, the signer may never have started or may
+	// already have been reaped.
+	if k.cmd.Process != nil && k.cmd.ProcessState == nil {
+		if err := k.cmd.Process.Kill(); err != nil {
+			return fmt.Errorf("failed to kill signer process: %w", err)
+		}
+		// Wait for cmd to exit and release resources. Since the process is forcefully killed, this
+		// will return a non-nil error (varies by OS), which we will ignore.
+		_ = k.cmd.Wait()
+	}
+	if k.job != nil {
+		k.job.Close()
+		k.job = nil
+	}
+	removeSignerCopy(k.signerCopy)
 	// The Pipes connecting the RPC client should have been closed when the signer subprocess was killed.
 	// Calling `k.client.Close()` before `k.cmd.Process.Kill()` or `k.cmd.Wait()` _will_ cause a segfault.
-	if err := k.client.Close(); err.Error() != "close |0: file already closed" {
+	if err := k.client.Close(); err != nil && err.Error() != "close |0: file already closed" {
 		return fmt.Errorf("failed to close RPC connection: %w", err)
 	}
 	return nil
@@ -110,20 +182,88 @@ func (k *Key) Public() crypto.PublicKey {
 
 // Sign signs a message digest, using the specified signer options.
 func (k *Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) (signed []byte, err error) {
+	return k.SignContext(context.Background(), digest, opts)
+}
+
+// SignContext is like Sign, but gives up and returns ctx.Err() if ctx is done
+// before the signer replies, such as when a smart card stops responding.
+func (k *Key) SignContext(ctx context.Context, digest []byte, opts crypto.SignerOpts) (signed []byte, err error) {
 	if opts != nil && opts.HashFunc() != 0 && len(digest) != opts.HashFunc().Size() {
 		return nil, fmt.Errorf("Digest length of %v bytes does not match Hash function size of %v bytes", len(digest), opts.HashFunc().Size())
 	}
-	err = k.client.Call(signAPI, SignArgs{Digest: digest, Opts: opts}, &signed)
+	if err := k.Capabilities().checkSign(opts); err != nil {
+		return nil, err
+	}
+	if err = k.call(ctx, signAPI, SignArgs{Digest: digest, Opts: opts}, &signed); err != nil {
+		return nil, k.reportFailure("Sign", err)
+	}
 	return
 }
 
+// SignMessage hashes message with opts.HashFunc() and signs the digest. Signers
+// whose keystore can hash as well as sign, such as a PKCS #11 token offering
+// CKM_SHA256_RSA_PKCS, receive the whole message; others receive the digest
+// as with Sign.
+func (k *Key) SignMessage(message []byte, opts crypto.SignerOpts) (signed []byte, err error) {
+	if opts == nil || !opts.HashFunc().Available() {
+		return nil, errors.New("SignMessage requires an available hash function")
+	}
+	caps := k.Capabilities()
+	if err := caps.checkSign(opts); err != nil {
+		return nil, err
+	}
+	if caps.Version == 0 || caps.SignMessage {
+		err = k.call(context.Background(), signMessageAPI, SignMessageArgs{Message: message, Opts: opts}, &signed)
+		if err == nil {
+			return
+		}
+		if !isUnknownMethod(err) {
+			return nil, k.reportFailure("SignMessage", err)
+		}
+	}
+	// The signer does not hash messages itself.
+	h := opts.HashFunc().New()
+	h.Write(message)
+	return k.Sign(nil, h.Sum(nil), opts)
+}
+
 func (k *Key) Encrypt(plaintext []byte) (ciphertext []byte, err error) {
-	err = k.client.Call(encryptAPI, EncryptArgs{Plaintext: plaintext}, &ciphertext)
+	if err := k.Capabilities().checkDecrypt(nil); err != nil {
+		return nil, err
+	}
+	if err = k.call(context.Background(), encryptAPI, EncryptArgs{Plaintext: plaintext}, &ciphertext); err != nil {
+		return nil, k.reportFailure("Encrypt", err)
+	}
 	return
 }
 
-func (k *Key) Decrypt(ciphertext []byte) (plaintext []byte, err error) {
-	err = k.client.Call(decryptAPI, DecryptArgs{Ciphertext: ciphertext}, &plaintext)
+// Decrypt decrypts ciphertext with the private key, implementing
+// crypto.Decrypter. opts selects the padding scheme: *rsa.OAEPOptions,
+// *rsa.PKCS1v15DecryptOptions, or nil for RSA-OAEP with SHA-256.
+func (k *Key) Decrypt(_ io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) (plaintext []byte, err error) {
+	return k.DecryptContext(context.Background(), ciphertext, opts)
+}
+
+// DecryptContext is like Decrypt, but gives up and returns ctx.Err() if ctx is
+// done before the signer replies.
+func (k *Key) DecryptContext(ctx context.Context, ciphertext []byte, opts crypto.DecrypterOpts) (plaintext []byte, err error) {
+	if err := k.Capabilities().checkDecrypt(opts); err != nil {
+		return nil, err
+	}
+	if err = k.call(ctx, decryptAPI, DecryptArgs{Ciphertext: ciphertext, Opts: opts}, &plaintext); err != nil {
+		return nil, k.reportFailure("Decrypt", err)
+	}
+	return
+}
+
+// Diagnostics returns a JSON report describing the keystore holding the
+// credential, such as the token's label, flags and mechanisms and the objects
+// on it, for support engineers debugging a credential remotely. Only the Linux
+// signer supports it.
+func (k *Key) Diagnostics() (report []byte, err error) {
+	if err = k.call(context.Background(), diagnosticsAPI, struct{}{}, &report); err != nil {
+		return nil, k.reportFailure("Diagnostics", err)
+	}
 	return
 }
 
@@ -135,10 +275,38 @@ var ErrCredUnavailable = errors.New("Cred is unavailable")
 // related operations, including signing messages with the private key.
 //
 // The signer binary path is read from the specified configFilePath, if provided.
-// Otherwise, use the default config file path.
+// Otherwise, use the default config file path. If the config requires it, the
+// signer binary's SHA-256 digest or code signature is verified before it is
+// run; errors of failed checks wrap ErrSignerIntegrity.
+//
+// The config file also specifies which certificate the signer should use. If it
+// names the Unix domain socket of a shared signer that is running, Cred
+// attaches to that signer as CredFromSocket does instead.
 //
-// The config file also specifies which certificate the signer should use.
+// If the ENTERPRISE_CERTIFICATE_DEBUG_BUNDLE_DIR environment variable is set, a
+// redacted debug bundle is written to that directory whenever the signer fails.
+//
+// In programs built with the ecp_inprocess tag, Cred instead opens the
+// certificate with the platform keystore code in the calling process, for
+// environments that forbid spawning helper executables. The signer binary path
+// and socket in the config are then ignored.
 func Cred(configFilePath string) (*Key, error) {
+	return cred(configFilePath, "")
+}
+
+// CredByName is like Cred with the default config file, but uses the
+// credential profile called name in the config's "profiles", so that a
+// program talking to several backends with different certificates needs only
+// one config file. The error wraps ErrCredUnavailable if the config does not
+// define the profile. Shared signers serve only the config's top-level
+// credential, so CredByName always spawns a signer.
+func CredByName(name string) (*Key, error) {
+	return cred("", name)
+}
+
+// cred implements Cred and CredByName. An empty profile selects the config's
+// top-level credential.
+func cred(configFilePath, profile string) (*Key, error) {
 	if configFilePath == "" {
 		envFilePath := util.GetConfigFilePathFromEnv()
 		if envFilePath != "" {
@@ -147,64 +315,312 @@ func Cred(configFilePath string) (*Key, error) {
 			configFilePath = util.GetDefaultConfigFilePath()
 		}
 	}
+	logger().Debug("resolving credential", "config", configFilePath, "profile", profile)
+	if profile != "" {
+		ok, err := util.HasProfile(configFilePath, profile)
+		if err != nil {
+			if errors.Is(err, util.ErrConfigUnavailable) {
+				logger().Debug("no config file", "config", configFilePath)
+				return nil, ErrCredUnavailable
+			}
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: profile %q is not defined in %s", ErrCredUnavailable, profile, configFilePath)
+		}
+	}
+	if inProcess {
+		return credInProcess(configFilePath, profile)
+	}
+	socketPath, err := util.LoadSignerSocketPath(configFilePath)
+	if err != nil {
+		if errors.Is(err, util.ErrConfigUnavailable) {
+			logger().Debug("no config file", "config", configFilePath)
+			return nil, ErrCredUnavailable
+		}
+		return nil, err
+	}
+	if socketPath != "" && profile == "" {
+		k, err := CredFromSocket(socketPath)
+		var unavailable *errSocketUnavailable
+		if !errors.As(err, &unavailable) {
+			return k, err
+		}
+		// No shared signer is running; spawn one for this Key.
+		logger().Debug("no shared signer is running", "socket", socketPath, "error", err)
+	}
 	enterpriseCertSignerPath, err := util.LoadSignerBinaryPath(configFilePath)
 	if err != nil {
 		if errors.Is(err, util.ErrConfigUnavailable) {
+			logger().Debug("no signer binary configured", "config", configFilePath)
 			return nil, ErrCredUnavailable
 		}
 		return nil, err
 	}
+	integrity, err := util.LoadSignerIntegrity(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	logger().Debug("resolved signer binary", "signer", enterpriseCertSignerPath)
 	k := &Key{
-		cmd: exec.Command(enterpriseCertSignerPath, configFilePath),
+		signerPath:     enterpriseCertSignerPath,
+		integrity:      integrity,
+		configFilePath: configFilePath,
+		profile:        profile,
+		debugDir:       os.Getenv(debugBundleDirEnv),
+	}
+	if k.debugDir != "" {
+		k.stderr = newTailBuffer(maxStderrTail)
+	}
+	p, err := k.start()
+	if err != nil {
+		return nil, err
 	}
+	k.cmd, k.client, k.job, k.signerCopy = p.cmd, p.client, p.job, p.signerCopy
 
+	if err := k.load(); err != nil {
+		p.stop()
+		return nil, err
+	}
+	return k, nil
+}
+
+// signerProcess is a running signer subprocess and the connection to it.
+type signerProcess struct {
+	cmd    *exec.Cmd
+	client rpcClient
+	job    io.Closer // Ties the signer's lifetime to this process, on Windows.
+	// signerCopy is the directory holding the verified copy of the signer
+	// binary that cmd runs, if any.
+	signerCopy string
+}
+
+// stop kills the signer and releases the connection to it.
+func (p *signerProcess) stop() {
+	if p.cmd.ProcessState == nil {
+		_ = p.cmd.Process.Kill()
+		_ = p.cmd.Wait()
+	}
+	if p.job != nil {
+		p.job.Close()
+	}
+	removeSignerCopy(p.signerCopy)
+	// The client may only be closed once the signer is gone; see Close.
+	p.client.Close()
+}
+
+// start spawns the signer subprocess and connects to it. It leaves k
+// unchanged, so that restart can check the new signer before using it. k.mu
+// must be held once k is shared.
+func (k *Key) start() (*signerProcess, error) {
+	args := []string{k.configFilePath}
+	if k.profile != "" {
+		args = append(args, "-profile", k.profile)
+	}
+	cmd := exec.Command(k.signerPath, args...)
+	run, signerCopy, err := verifySigner(k.signerPath, k.integrity)
+	if err != nil {
+		return nil, k.reportProcess("Start", cmd, err)
+	}
+	if signerCopy != "" {
+		// Run the verified copy, keeping the original path as argv[0].
+		cmd.Path = run
+	}
+	p, err := k.startProcess(cmd)
+	if err != nil {
+		removeSignerCopy(signerCopy)
+		return nil, err
+	}
+	p.signerCopy = signerCopy
+	return p, nil
+}
+
+// startProcess starts the signer subprocess cmd and connects to it.
+func (k *Key) startProcess(cmd *exec.Cmd) (*signerProcess, error) {
 	// Redirect errors from subprocess to parent process.
-	k.cmd.Stderr = os.Stderr
+	cmd.Stderr = os.Stderr
+	if k.stderr != nil {
+		cmd.Stderr = io.MultiWriter(os.Stderr, k.stderr)
+	}
 
 	// RPC client will communicate with subprocess over stdin/stdout.
-	kin, err := k.cmd.StdinPipe()
+	kin, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, err
 	}
-	kout, err := k.cmd.StdoutPipe()
+	kout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
 	}
-	k.client = rpc.NewClient(&Connection{kout, kin})
 
-	if err := k.cmd.Start(); err != nil {
-		return nil, fmt.Errorf("starting enterprise cert signer subprocess: %w", err)
+	if err := cmd.Start(); err != nil {
+		return nil, k.reportProcess("Start", cmd, fmt.Errorf("starting enterprise cert signer subprocess: %w", err))
+	}
+	logger().Info("started signer", "signer", k.signerPath, "pid", cmd.Process.Pid)
+	job, err := killWithParent(cmd.Process)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, k.reportProcess("Start", cmd, fmt.Errorf("binding enterprise cert signer to this process: %w", err))
 	}
+	client, err := connect(&Connection{kout, kin})
+	if err != nil {
+		reap(cmd, err)
+		if job != nil {
+			job.Close()
+		}
+		return nil, k.reportProcess("Start", cmd, fmt.Errorf("connecting to enterprise cert signer: %w", err))
+	}
+	return &signerProcess{cmd: cmd, client: client, job: job}, nil
+}
 
-	if err := k.client.Call(certificateChainAPI, struct{}{}, &k.chain); err != nil {
-		return nil, fmt.Errorf("failed to retrieve certificate chain: %w", err)
+// call calls method on the signer. If the signer subprocess exited or its
+// pipe broke, call restarts the signer and retries once.
+func (k *Key) call(ctx context.Context, method string, args, reply interface{}) error {
+	k.mu.Lock()
+	client := k.client
+	k.mu.Unlock()
+	err := timeCall(ctx, client, method, args, reply)
+	if err == nil || !isBrokenConnection(err) {
+		return err
+	}
+	if client, err = k.restart(ctx, client, err); err != nil {
+		return err
 	}
+	return timeCall(ctx, client, method, args, reply)
+}
 
+// timeCall calls method on client, logging and measuring how long the signer
+// took.
+func timeCall(ctx context.Context, client rpcClient, method string, args, reply interface{}) error {
+	start := time.Now()
+	err := client.CallContext(ctx, method, args, reply)
+	latency := time.Since(start)
+	if (method == signAPI || method == signMessageAPI) && (err == nil || !isUnknownMethod(err)) {
+		metrics().ObserveSign(latency, err)
+	}
+	if err != nil {
+		logger().Debug("signer call failed", "method", method, "duration", latency, "error", err)
+		metrics().CountRPCError(method, errorKind(ctx, err))
+	} else {
+		logger().Debug("signer call", "method", method, "duration", latency)
+	}
+	return err
+}
+
+// restartGracePeriod is how long restart waits for a signer whose connection
+// broke to exit on its own before killing it.
+const restartGracePeriod = time.Second
+
+// restart replaces the signer subprocess behind broken, whose call failed with
+// err, and returns the client of its replacement.
+func (k *Key) restart(ctx context.Context, broken rpcClient, err error) (rpcClient, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.client != broken {
+		// A concurrent call restarted the signer already.
+		return k.client, nil
+	}
+	if k.cmd == nil || k.closed {
+		// Shared signers are not ours to restart, and in-process keys have
+		// no signer.
+		return nil, err
+	}
+
+	logger().Warn("restarting signer", "pid", k.cmd.Process.Pid, "error", err)
+	metrics().CountRestart()
+	cmd := k.cmd
+	timer := time.AfterFunc(restartGracePeriod, func() { _ = cmd.Process.Kill() })
+	k.reap(err)
+	timer.Stop()
+	if k.debugDir != "" {
+		_ = k.report("Restart", err)
+	}
+	broken.Close()
+	if k.job != nil {
+		k.job.Close()
+		k.job = nil
+	}
+	removeSignerCopy(k.signerCopy)
+	k.signerCopy = ""
+
+	// Until a restart succeeds, k keeps the broken client, so that every call
+	// tries again.
+	p, serr := k.start()
+	if serr != nil {
+		return nil, fmt.Errorf("%w (restarting signer: %v)", err, serr)
+	}
+	caps, cerr := k.checkRestarted(ctx, p.client)
+	if cerr != nil {
+		p.stop()
+		return nil, fmt.Errorf("%w (restarting signer: %v)", err, cerr)
+	}
+	k.cmd, k.client, k.job, k.signerCopy, k.caps = p.cmd, p.client, p.job, p.signerCopy, caps
+	return k.client, nil
+}
+
+// checkRestarted makes sure that the restarted signer behind client found the
+// same key, since callers hold on to the public key and certificate chain, and
+// returns its capabilities, which change if the signer binary was upgraded.
+func (k *Key) checkRestarted(ctx context.Context, client rpcClient) (Capabilities, error) {
 	var publicKeyBytes []byte
-	if err := k.client.Call(publicKeyAPI, struct{}{}, &publicKeyBytes); err != nil {
-		return nil, fmt.Errorf("failed to retrieve public key: %w", err)
+	if err := client.CallContext(ctx, publicKeyAPI, struct{}{}, &publicKeyBytes); err != nil {
+		return Capabilities{}, err
+	}
+	want, err := x509.MarshalPKIXPublicKey(k.publicKey)
+	if err != nil || !bytes.Equal(publicKeyBytes, want) {
+		return Capabilities{}, errors.New("the restarted signer holds a different key")
+	}
+	return handshake(ctx, client)
+}
+
+// load retrieves the certificate chain and public key from the signer.
+func (k *Key) load() error {
+	caps, err := handshake(context.Background(), k.client)
+	if err != nil {
+		if k.debugDir != "" {
+			k.reap(err)
+		}
+		return k.reportFailure("Handshake", fmt.Errorf("failed to exchange capabilities: %w", err))
+	}
+	k.caps = caps
+
+	if err := k.client.CallContext(context.Background(), certificateChainAPI, struct{}{}, &k.chain); err != nil {
+		if k.debugDir != "" {
+			k.reap(err)
+		}
+		return k.reportFailure("CertificateChain", fmt.Errorf("failed to retrieve certificate chain: %w", err))
+	}
+
+	var publicKeyBytes []byte
+	if err := k.client.CallContext(context.Background(), publicKeyAPI, struct{}{}, &publicKeyBytes); err != nil {
+		if k.debugDir != "" {
+			k.reap(err)
+		}
+		return k.reportFailure("Public", fmt.Errorf("failed to retrieve public key: %w", err))
 	}
 
 	publicKey, err := x509.ParsePKIXPublicKey(publicKeyBytes)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse public key: %w", err)
+		return fmt.Errorf("failed to parse public key: %w", err)
 	}
 
 	var ok bool
 	k.publicKey, ok = publicKey.(crypto.PublicKey)
 	if !ok {
-		return nil, fmt.Errorf("invalid public key type: %T", publicKey)
+		return fmt.Errorf("invalid public key type: %T", publicKey)
 	}
 
 	switch pub := k.publicKey.(type) {
 	case *rsa.PublicKey:
 		if pub.Size() < 256 {
-			return nil, fmt.Errorf("RSA modulus size is less than 2048 bits: %v", pub.Size()*8)
+			return fmt.Errorf("RSA modulus size is less than 2048 bits: %v", pub.Size()*8)
 		}
 	case *ecdsa.PublicKey:
 	default:
-		return nil, fmt.Errorf("unsupported public key type: %v", pub)
+		return fmt.Errorf("unsupported public key type: %v", pub)
 	}
 
-	return k, nil
+	logger().Info("loaded credential", "config", k.configFilePath, "version", k.caps.Version, "certificates", len(k.chain))
+	return nil
 }
@@ -16,14 +16,44 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/rpc"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/googleapis/enterprise-certificate-proxy/client/util"
+	"github.com/googleapis/enterprise-certificate-proxy/internal/transport"
 )
 
+// requireSigner skips tests of the signer subprocess in builds that open
+// credentials in-process.
+func requireSigner(t *testing.T) {
+	t.Helper()
+	if inProcess {
+		t.Skip("credentials are opened in-process in ecp_inprocess builds")
+	}
+}
+
 func TestClient_Cred_Success(t *testing.T) {
+	requireSigner(t)
 	_, err := Cred("testdata/certificate_config.json")
 	if err != nil {
 		t.Errorf("Cred: got %v, want nil err", err)
@@ -38,13 +68,58 @@ func TestClient_Cred_ConfigMissing(t *testing.T) {
 }
 
 func TestClient_Cred_BinaryPathMissing(t *testing.T) {
+	requireSigner(t)
 	_, err := Cred("testdata/certificate_config_missing_path.json")
 	if got, want := err, ErrCredUnavailable; !errors.Is(got, want) {
 		t.Errorf("Cred: with missing ECP path; got %v, want %v err", got, want)
 	}
 }
 
+func TestClient_Cred_SignerIntegrity(t *testing.T) {
+	requireSigner(t)
+	signer, err := filepath.Abs("testdata/signer.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+	for _, tc := range []struct {
+		name string
+		libs string
+		want error
+	}{
+		{"digest", fmt.Sprintf(`"ecp_sha256": "%x"`, digest), nil},
+		{"wrong digest", fmt.Sprintf(`"ecp_sha256": "%x"`, sha256.Sum256(nil)), ErrSignerIntegrity},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := filepath.Join(t.TempDir(), "certificate_config.json")
+			if err := os.WriteFile(config, []byte(fmt.Sprintf(`{"libs": {"ecp": %q, %s}}`, signer, tc.libs)), 0600); err != nil {
+				t.Fatal(err)
+			}
+			key, err := Cred(config)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("Cred: got %v, want %v err", err, tc.want)
+			}
+			if err != nil {
+				return
+			}
+			// The signer runs from the verified copy, which Close removes.
+			if key.cmd.Path == signer || key.signerCopy == "" {
+				t.Errorf("Cred: signer runs from %s, want a verified copy", key.cmd.Path)
+			}
+			key.Close()
+			if _, err := os.Stat(key.signerCopy); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Close: stat of the signer copy: got %v, want %v", err, os.ErrNotExist)
+			}
+		})
+	}
+}
+
 func TestClient_Cred_EnvOverride_ExplicitConfig(t *testing.T) {
+	requireSigner(t)
 	configFilePath := "testdata/certificate_config.json"
 	os.Setenv("GOOGLE_API_CERTIFICATE_CONFIG", "testdata/certificate_config_missing_path.json")
 	_, err := Cred(configFilePath)
@@ -63,7 +138,39 @@ func TestClient_Cred_EnvOverride_EmptyConfig(t *testing.T) {
 	}
 }
 
+func TestClient_CredByName(t *testing.T) {
+	requireSigner(t)
+	signer, err := filepath.Abs("testdata/signer.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(t.TempDir(), "certificate_config.json")
+	data := fmt.Sprintf(`{"libs": {"ecp": %q}, "profiles": {"backend": {"cert_configs": {}}}}`, signer)
+	if err := os.WriteFile(config, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_API_CERTIFICATE_CONFIG", config)
+
+	key, err := CredByName("backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+	report, err := key.Diagnostics()
+	if err != nil {
+		t.Fatalf("Diagnostics: got %v, want nil err", err)
+	}
+	if got, want := string(report), `{"label":"test","profile":"backend"}`; got != want {
+		t.Errorf("Diagnostics: got %s, want %s", got, want)
+	}
+
+	if _, err := CredByName("frontend"); !errors.Is(err, ErrCredUnavailable) {
+		t.Errorf("CredByName: with undefined profile; got %v, want %v err", err, ErrCredUnavailable)
+	}
+}
+
 func TestClient_Public(t *testing.T) {
+	requireSigner(t)
 	key, err := Cred("testdata/certificate_config.json")
 	if err != nil {
 		t.Fatal(err)
@@ -74,6 +181,7 @@ func TestClient_Public(t *testing.T) {
 }
 
 func TestClient_CertificateChain(t *testing.T) {
+	requireSigner(t)
 	key, err := Cred("testdata/certificate_config.json")
 	if err != nil {
 		t.Fatal(err)
@@ -83,7 +191,27 @@ func TestClient_CertificateChain(t *testing.T) {
 	}
 }
 
+func TestClient_TLSCertificate(t *testing.T) {
+	requireSigner(t)
+	key, err := Cred("testdata/certificate_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+	cert := key.TLSCertificate()
+	if got, want := cert.Certificate, key.CertificateChain(); !reflect.DeepEqual(got, want) {
+		t.Errorf("TLSCertificate: got chain %v, want %v", got, want)
+	}
+	if got, want := cert.PrivateKey, crypto.PrivateKey(key); got != want {
+		t.Errorf("TLSCertificate: got private key %v, want %v", got, want)
+	}
+	if cert.Leaf == nil || !bytes.Equal(cert.Leaf.Raw, cert.Certificate[0]) {
+		t.Errorf("TLSCertificate: got leaf %v, want parsed first certificate", cert.Leaf)
+	}
+}
+
 func TestClient_Sign(t *testing.T) {
+	requireSigner(t)
 	key, err := Cred("testdata/certificate_config.json")
 	if err != nil {
 		t.Fatal(err)
@@ -97,27 +225,65 @@ func TestClient_Sign(t *testing.T) {
 	}
 }
 
+func TestClient_SignMessage(t *testing.T) {
+	requireSigner(t)
+	key, err := Cred("testdata/certificate_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := []byte("testMessage")
+	// The test signer has no SignMessage method, so the client hashes the
+	// message itself and the test signer echoes the digest.
+	signed, err := key.SignMessage(message, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("SignMessage: got %v, want nil err", err)
+	}
+	if got, want := signed, sha256.Sum256(message); !bytes.Equal(got, want[:]) {
+		t.Errorf("SignMessage: got %x, want %x", got, want)
+	}
+	if _, err := key.SignMessage(message, nil); err == nil {
+		t.Error("SignMessage without a hash: got nil err, want error")
+	}
+}
+
 func TestClient_Encrypt(t *testing.T) {
+	requireSigner(t)
 	key, err := Cred("testdata/certificate_config.json")
 	if err != nil {
 		t.Fatal(err)
 	}
 	plaintext := []byte("Plain text to encrypt")
-	_, err = key.Encrypt(plaintext)
+	ciphertext, err := key.Encrypt(plaintext)
 	if err != nil {
 		t.Errorf("Universal Client API encryption: got %v, want nil err", err)
 		return
 	}
+	data, err := os.ReadFile("testdata/testcert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := rsa.DecryptOAEP(sha256.New(), nil, cert.PrivateKey.(*rsa.PrivateKey), ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Encrypt: ciphertext does not decrypt with RSA-OAEP and SHA-256: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Encrypt: decrypted ciphertext got %q, want %q", got, plaintext)
+	}
 }
 
 func TestClient_Decrypt(t *testing.T) {
+	requireSigner(t)
 	key, err := Cred("testdata/certificate_config.json")
 	if err != nil {
 		t.Fatal(err)
 	}
 	byteSlice := []byte("Plain text to encrypt")
 	ciphertext, _ := key.Encrypt(byteSlice)
-	plaintext, err := key.Decrypt(ciphertext)
+	plaintext, err := key.Decrypt(nil, ciphertext, nil)
 	if err != nil {
 		t.Errorf("Universal Client API decryption: got %v, want nil err", err)
 		return
@@ -127,7 +293,23 @@ func TestClient_Decrypt(t *testing.T) {
 	}
 }
 
+func TestClient_Diagnostics(t *testing.T) {
+	requireSigner(t)
+	key, err := Cred("testdata/certificate_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := key.Diagnostics()
+	if err != nil {
+		t.Fatalf("Diagnostics: got %v, want nil err", err)
+	}
+	if got, want := string(report), `{"label":"test"}`; got != want {
+		t.Errorf("Diagnostics: got %s, want %s", got, want)
+	}
+}
+
 func TestClient_Sign_HashSizeMismatch(t *testing.T) {
+	requireSigner(t)
 	key, err := Cred("testdata/certificate_config.json")
 	if err != nil {
 		t.Fatal(err)
@@ -139,6 +321,7 @@ func TestClient_Sign_HashSizeMismatch(t *testing.T) {
 }
 
 func TestClient_Close(t *testing.T) {
+	requireSigner(t)
 	key, err := Cred("testdata/certificate_config.json")
 	if err != nil {
 		t.Fatal(err)
@@ -148,3 +331,439 @@ func TestClient_Close(t *testing.T) {
 		t.Errorf("Close: got %v, want nil err", err)
 	}
 }
+
+func TestClient_GRPC(t *testing.T) {
+	requireSigner(t)
+	t.Setenv(signerTransportEnv, "grpc")
+	key, err := Cred("testdata/certificate_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+	if _, ok := key.client.(*grpcClient); !ok {
+		t.Fatalf("Cred: got client %T, want *grpcClient", key.client)
+	}
+	if key.CertificateChain() == nil || key.Public() == nil {
+		t.Error("Cred: got nil certificate chain or public key")
+	}
+	signed, err := key.Sign(nil, []byte("testDigest"), nil)
+	if err != nil {
+		t.Fatalf("Sign: got %v, want nil err", err)
+	}
+	if got, want := signed, []byte("testDigest"); !bytes.Equal(got, want) {
+		t.Errorf("Sign: got %c, want %c", got, want)
+	}
+	message := []byte("testMessage")
+	signed, err = key.SignMessage(message, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("SignMessage: got %v, want nil err", err)
+	}
+	if got, want := signed, sha256.Sum256(message); !bytes.Equal(got, want[:]) {
+		t.Errorf("SignMessage: got %x, want %x", got, want)
+	}
+	plaintext := []byte("Plain text to encrypt")
+	ciphertext, err := key.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt: got %v, want nil err", err)
+	}
+	decrypted, err := key.Decrypt(nil, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Decrypt: got %v, want nil err", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Decrypt: got %s, want %s", decrypted, plaintext)
+	}
+}
+
+// pipeKey returns a Key connected to signer, served in-process over a pipe in
+// the transport selected by signerTransportEnv.
+func pipeKey(t *testing.T, signer interface{}) *Key {
+	t.Helper()
+	server := rpc.NewServer()
+	if err := server.RegisterName("EnterpriseCertSigner", signer); err != nil {
+		t.Fatal(err)
+	}
+	cconn, sconn := net.Pipe()
+	go transport.Serve(server, sconn)
+	client, err := connect(cconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &Key{client: client}
+	t.Cleanup(func() { key.client.Close() })
+	caps, err := handshake(context.Background(), key.client)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	key.caps = caps
+	return key
+}
+
+// hungSigner is a signer whose Sign and Decrypt never return until released.
+type hungSigner struct {
+	release chan struct{}
+}
+
+func (s *hungSigner) Sign(args SignArgs, signed *[]byte) error {
+	<-s.release
+	*signed = args.Digest
+	return nil
+}
+
+func (s *hungSigner) Decrypt(args DecryptArgs, plaintext *[]byte) error {
+	<-s.release
+	*plaintext = args.Ciphertext
+	return nil
+}
+
+func TestClient_Context(t *testing.T) {
+	for _, protocol := range []string{"", "grpc"} {
+		t.Run("transport="+protocol, func(t *testing.T) {
+			t.Setenv(signerTransportEnv, protocol)
+			signer := &hungSigner{release: make(chan struct{})}
+			key := pipeKey(t, signer)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if _, err := key.SignContext(ctx, []byte("digest"), nil); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("SignContext: got %v, want %v", err, context.DeadlineExceeded)
+			}
+			ctx, cancel = context.WithCancel(context.Background())
+			cancel()
+			if _, err := key.DecryptContext(ctx, []byte("ciphertext"), nil); !errors.Is(err, context.Canceled) {
+				t.Errorf("DecryptContext: got %v, want %v", err, context.Canceled)
+			}
+
+			// Once the signer recovers, the Key remains usable.
+			close(signer.release)
+			signed, err := key.SignContext(context.Background(), []byte("digest"), nil)
+			if err != nil {
+				t.Fatalf("SignContext: got %v, want nil err", err)
+			}
+			if got, want := signed, []byte("digest"); !bytes.Equal(got, want) {
+				t.Errorf("SignContext: got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestClient_Restart(t *testing.T) {
+	requireSigner(t)
+	key, err := Cred("testdata/certificate_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+	cmd := key.cmd
+	// Break the connection to the signer, which then exits.
+	key.client.Close()
+
+	signed, err := key.Sign(nil, []byte("testDigest"), nil)
+	if err != nil {
+		t.Fatalf("Sign after the connection broke: got %v, want nil err", err)
+	}
+	if got, want := signed, []byte("testDigest"); !bytes.Equal(got, want) {
+		t.Errorf("Sign: got %c, want %c", got, want)
+	}
+	if key.cmd == cmd {
+		t.Error("Sign after the connection broke: signer was not restarted")
+	}
+	if cmd.ProcessState == nil {
+		t.Error("Sign after the connection broke: old signer was not reaped")
+	}
+
+	// Closed Keys stay closed.
+	key.Close()
+	if _, err := key.Sign(nil, []byte("testDigest"), nil); err == nil {
+		t.Error("Sign after Close: got nil err, want error")
+	}
+}
+
+func TestClient_Restart_Fails(t *testing.T) {
+	requireSigner(t)
+	key, err := Cred("testdata/certificate_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The signer binary no longer passes verification, as if it had been
+	// replaced, so the restart fails before starting a new signer.
+	key.integrity = util.SignerIntegrity{SHA256: make([]byte, sha256.Size)}
+	key.client.Close()
+
+	if _, err := key.Sign(nil, []byte("testDigest"), nil); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("Sign after a failed restart: got %v, want %v err", err, rpc.ErrShutdown)
+	}
+	// Later calls try to restart the signer again.
+	if _, err := key.Sign(nil, []byte("testDigest"), nil); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("Sign after two failed restarts: got %v, want %v err", err, rpc.ErrShutdown)
+	}
+	key.Close()
+	if _, err := key.Sign(nil, []byte("testDigest"), nil); err == nil {
+		t.Error("Sign after Close: got nil err, want error")
+	}
+}
+
+// writeOtherSigner writes a signer script that serves a freshly generated key,
+// rather than the one in testdata/testcert.pem, and returns its path.
+func writeOtherSigner(t *testing.T) string {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Other Key"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	pemPath := filepath.Join(dir, "othercert.pem")
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	if err := os.WriteFile(pemPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	signerPath := filepath.Join(dir, "signer.sh")
+	script := fmt.Sprintf("#!/bin/bash\ngo run ../internal/signer/test/signer.go %q\n", pemPath)
+	if err := os.WriteFile(signerPath, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return signerPath
+}
+
+func TestClient_Restart_DifferentKey(t *testing.T) {
+	requireSigner(t)
+	key, err := Cred("testdata/certificate_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+	// The restarted signer finds another key, as if the credential had been
+	// replaced in the keystore.
+	key.signerPath = writeOtherSigner(t)
+	key.client.Close()
+
+	if _, err := key.Sign(nil, []byte("testDigest"), nil); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("Sign after restarting with a different key: got %v, want %v err", err, rpc.ErrShutdown)
+	}
+	// The Key must not go on to sign with the other key.
+	if _, err := key.Sign(nil, []byte("testDigest"), nil); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("Sign after two restarts with a different key: got %v, want %v err", err, rpc.ErrShutdown)
+	}
+}
+
+// barrierSigner is a signer whose Sign calls block until released, reporting
+// each arrival.
+type barrierSigner struct {
+	arrived chan struct{}
+	release chan struct{}
+}
+
+func (s *barrierSigner) Sign(args SignArgs, signed *[]byte) error {
+	s.arrived <- struct{}{}
+	<-s.release
+	*signed = args.Digest
+	return nil
+}
+
+func TestClient_ConcurrentSign(t *testing.T) {
+	for _, protocol := range []string{"", "grpc"} {
+		t.Run("transport="+protocol, func(t *testing.T) {
+			t.Setenv(signerTransportEnv, protocol)
+			const n = 8
+			signer := &barrierSigner{arrived: make(chan struct{}), release: make(chan struct{})}
+			key := pipeKey(t, signer)
+
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				go func() {
+					_, err := key.SignContext(context.Background(), []byte("digest"), nil)
+					errs <- err
+				}()
+			}
+			timeout := time.After(10 * time.Second)
+			for i := 0; i < n; i++ {
+				select {
+				case <-signer.arrived:
+				case <-timeout:
+					t.Fatalf("Sign: %d of %d calls reached the signer concurrently", i, n)
+				}
+			}
+			close(signer.release)
+			for i := 0; i < n; i++ {
+				if err := <-errs; err != nil {
+					t.Errorf("Sign: got %v, want nil err", err)
+				}
+			}
+		})
+	}
+}
+
+var _ crypto.Decrypter = (*Key)(nil)
+
+// optsSigner is a signer whose Decrypt describes the options it received.
+type optsSigner struct{}
+
+func (optsSigner) Decrypt(args DecryptArgs, plaintext *[]byte) error {
+	*plaintext = []byte(fmt.Sprintf("%T %v", args.Opts, args.Opts))
+	return nil
+}
+
+func (optsSigner) Handshake(args HandshakeArgs, caps *Capabilities) error {
+	*caps = Capabilities{Version: signerAPIVersion, Decrypt: true}
+	return nil
+}
+
+func TestClient_DecryptOpts(t *testing.T) {
+	tests := []crypto.DecrypterOpts{
+		nil,
+		&rsa.OAEPOptions{Hash: crypto.SHA384, Label: []byte("label")},
+		&rsa.PKCS1v15DecryptOptions{SessionKeyLen: 16},
+	}
+	for _, protocol := range []string{"", "grpc"} {
+		t.Run("transport="+protocol, func(t *testing.T) {
+			t.Setenv(signerTransportEnv, protocol)
+			key := pipeKey(t, optsSigner{})
+
+			for _, opts := range tests {
+				got, err := key.Decrypt(nil, []byte("ciphertext"), opts)
+				if err != nil {
+					t.Errorf("Decrypt(%v): got %v, want nil err", opts, err)
+					continue
+				}
+				if want := fmt.Sprintf("%T %v", opts, opts); string(got) != want {
+					t.Errorf("Decrypt(%v): signer got %s, want %s", opts, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestClient_Handshake(t *testing.T) {
+	requireSigner(t)
+	for _, protocol := range []string{"", "grpc"} {
+		t.Run("transport="+protocol, func(t *testing.T) {
+			t.Setenv(signerTransportEnv, protocol)
+			key, err := Cred("testdata/certificate_config.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer key.Close()
+			want := Capabilities{Version: 1, Decrypt: true, Hashes: []crypto.Hash{crypto.SHA256}}
+			if got := key.Capabilities(); !reflect.DeepEqual(got, want) {
+				t.Errorf("Capabilities: got %+v, want %+v", got, want)
+			}
+			digest := make([]byte, crypto.SHA384.Size())
+			if _, err := key.Sign(nil, digest, crypto.SHA384); !errors.Is(err, ErrUnsupported) {
+				t.Errorf("Sign with SHA-384: got %v, want %v", err, ErrUnsupported)
+			}
+		})
+	}
+}
+
+// limitedSigner reports that it only signs SHA-256 digests.
+type limitedSigner struct{}
+
+func (limitedSigner) Handshake(args HandshakeArgs, caps *Capabilities) error {
+	*caps = Capabilities{Version: signerAPIVersion, Hashes: []crypto.Hash{crypto.SHA256}}
+	return nil
+}
+
+func (limitedSigner) Sign(args SignArgs, signed *[]byte) error {
+	*signed = args.Digest
+	return nil
+}
+
+func (limitedSigner) SignMessage(args SignMessageArgs, signed *[]byte) error {
+	return errors.New("SignMessage was not reported as supported")
+}
+
+func (limitedSigner) Decrypt(args DecryptArgs, plaintext *[]byte) error {
+	return errors.New("Decrypt was not reported as supported")
+}
+
+// echoMessageSigner signs whole messages, like the platform signers, by
+// echoing them.
+type echoMessageSigner struct{}
+
+func (echoMessageSigner) Handshake(args HandshakeArgs, caps *Capabilities) error {
+	*caps = Capabilities{Version: signerAPIVersion, SignMessage: true, Hashes: []crypto.Hash{crypto.SHA256}}
+	return nil
+}
+
+func (echoMessageSigner) SignMessage(args SignMessageArgs, signed *[]byte) error {
+	if args.Opts == nil || args.Opts.HashFunc() != crypto.SHA256 {
+		return fmt.Errorf("SignMessage: got opts %v, want %v", args.Opts, crypto.SHA256)
+	}
+	*signed = args.Message
+	return nil
+}
+
+func TestClient_SignMessage_Signer(t *testing.T) {
+	for _, protocol := range []string{"", "grpc"} {
+		t.Run("transport="+protocol, func(t *testing.T) {
+			t.Setenv(signerTransportEnv, protocol)
+			key := pipeKey(t, echoMessageSigner{})
+			// A signer advertising SignMessage is given the whole message.
+			message := []byte("message")
+			signed, err := key.SignMessage(message, crypto.SHA256)
+			if err != nil {
+				t.Fatalf("SignMessage: got %v, want nil err", err)
+			}
+			if !bytes.Equal(signed, message) {
+				t.Errorf("SignMessage: got %x, want %x", signed, message)
+			}
+		})
+	}
+}
+
+// legacySigner predates the handshake.
+type legacySigner struct{}
+
+func (legacySigner) Decrypt(args DecryptArgs, plaintext *[]byte) error {
+	*plaintext = args.Ciphertext
+	return nil
+}
+
+func TestClient_Capabilities(t *testing.T) {
+	for _, protocol := range []string{"", "grpc"} {
+		t.Run("transport="+protocol, func(t *testing.T) {
+			t.Setenv(signerTransportEnv, protocol)
+			key := pipeKey(t, limitedSigner{})
+			message := []byte("message")
+			signed, err := key.SignMessage(message, crypto.SHA256)
+			if err != nil {
+				t.Fatalf("SignMessage: got %v, want nil err", err)
+			}
+			if got, want := signed, sha256.Sum256(message); !bytes.Equal(got, want[:]) {
+				t.Errorf("SignMessage: got %x, want %x", got, want)
+			}
+			if _, err := key.SignMessage(message, crypto.SHA512); !errors.Is(err, ErrUnsupported) {
+				t.Errorf("SignMessage with SHA-512: got %v, want %v", err, ErrUnsupported)
+			}
+			if _, err := key.Decrypt(nil, []byte("ciphertext"), nil); !errors.Is(err, ErrUnsupported) {
+				t.Errorf("Decrypt: got %v, want %v", err, ErrUnsupported)
+			}
+
+			key = pipeKey(t, legacySigner{})
+			if got := key.Capabilities(); !reflect.DeepEqual(got, legacyCapabilities) {
+				t.Errorf("Capabilities of a legacy signer: got %+v, want %+v", got, legacyCapabilities)
+			}
+			if _, err := key.Decrypt(nil, []byte("ciphertext"), nil); err != nil {
+				t.Errorf("Decrypt with a legacy signer: got %v, want nil err", err)
+			}
+			if _, err := key.Decrypt(nil, []byte("ciphertext"), &rsa.OAEPOptions{Hash: crypto.SHA256}); !errors.Is(err, ErrUnsupported) {
+				t.Errorf("Decrypt with options and a legacy signer: got %v, want %v", err, ErrUnsupported)
+			}
+		})
+	}
+}
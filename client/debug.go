@@ -0,0 +1,280 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugBundleDirEnv names the environment variable that enables debug bundles.
+// When set, a redacted bundle describing each signer failure is written to the
+// directory it points to.
+const debugBundleDirEnv = "ENTERPRISE_CERTIFICATE_DEBUG_BUNDLE_DIR"
+
+// maxStderrTail is the number of trailing signer stderr bytes kept for debug bundles.
+const maxStderrTail = 64 * 1024
+
+// redactedValue replaces sensitive values in debug bundles.
+const redactedValue = "REDACTED"
+
+// sensitiveKeyFragments identify config keys whose values must never leave the machine.
+var sensitiveKeyFragments = []string{"pin", "password", "secret"}
+
+// debugEnvVars are the environment variables summarized in debug bundles.
+var debugEnvVars = []string{
+	"GOOGLE_API_CERTIFICATE_CONFIG",
+	"ENABLE_ENTERPRISE_CERTIFICATE_LOGS",
+	debugBundleDirEnv,
+	signerTransportEnv,
+}
+
+// tailBuffer is an io.Writer that retains only the last max bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+// Write appends p to the buffer, discarding the oldest bytes beyond the limit.
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.max:]...)
+	}
+	return len(p), nil
+}
+
+// String returns the retained bytes.
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
+
+// debugBundle is the redacted failure report written in debug mode.
+type debugBundle struct {
+	Time        time.Time         `json:"time"`
+	Operation   string            `json:"operation"`
+	Error       string            `json:"error"`
+	ErrorChain  []string          `json:"error_chain"`
+	ExitStatus  string            `json:"exit_status"`
+	ExitCode    *int              `json:"exit_code,omitempty"`
+	Stderr      string            `json:"stderr"`
+	SignerPath  string            `json:"signer_path"`
+	ConfigPath  string            `json:"config_path"`
+	Profile     string            `json:"profile,omitempty"`
+	Config      interface{}       `json:"config,omitempty"`
+	OS          string            `json:"os"`
+	Arch        string            `json:"arch"`
+	GoVersion   string            `json:"go_version"`
+	Environment map[string]string `json:"environment"`
+}
+
+// reportFailure writes a debug bundle describing err when debug bundles are
+// enabled, and returns err annotated with the location of the bundle.
+// Otherwise err is returned unchanged.
+func (k *Key) reportFailure(op string, err error) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.report(op, err)
+}
+
+// report is reportFailure for callers that hold k.mu, or that have not shared
+// k yet.
+func (k *Key) report(op string, err error) error {
+	return k.reportProcess(op, k.cmd, err)
+}
+
+// reportProcess is report for a failure of the signer subprocess cmd, which
+// need not be k's yet, such as one being started.
+func (k *Key) reportProcess(op string, cmd *exec.Cmd, err error) error {
+	logger().Error("signer operation failed", "op", op, "error", err)
+	if k.debugDir == "" {
+		return err
+	}
+	bundle := debugBundle{
+		Time:        time.Now().UTC(),
+		Operation:   op,
+		Error:       redactHome(err.Error()),
+		ErrorChain:  errorChain(err),
+		ExitStatus:  "running",
+		SignerPath:  redactHome(k.signerPath),
+		ConfigPath:  redactHome(k.configFilePath),
+		Profile:     k.profile,
+		Config:      loadRedactedConfig(k.configFilePath),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		GoVersion:   runtime.Version(),
+		Environment: environmentSummary(),
+	}
+	if k.stderr != nil {
+		bundle.Stderr = redactHome(k.stderr.String())
+	}
+	if cmd == nil {
+		bundle.ExitStatus = "shared"
+	} else if state := cmd.ProcessState; state != nil {
+		code := state.ExitCode()
+		bundle.ExitStatus = state.String()
+		bundle.ExitCode = &code
+	} else if cmd.Process == nil {
+		bundle.ExitStatus = "not started"
+	}
+	path, werr := writeDebugBundle(k.debugDir, bundle)
+	if werr != nil {
+		return fmt.Errorf("%w (failed to write debug bundle: %v)", err, werr)
+	}
+	return fmt.Errorf("%w (debug bundle written to %s)", err, path)
+}
+
+// reap terminates the signer subprocess after an unrecoverable failure and
+// waits for it, so that its exit status is available to reportFailure. The
+// caller must hold k.mu, or not have shared k yet.
+func (k *Key) reap(err error) {
+	reap(k.cmd, err)
+}
+
+// reap terminates the signer subprocess cmd, if it is running, and waits for
+// it.
+func reap(cmd *exec.Cmd, err error) {
+	if cmd == nil || cmd.Process == nil || cmd.ProcessState != nil {
+		return
+	}
+	// A broken connection means the signer is already on its way out; wait for it
+	// to exit on its own so that its real exit status is preserved.
+	if !isBrokenConnection(err) {
+		_ = cmd.Process.Kill()
+	}
+	_ = cmd.Wait()
+	logger().Warn("signer exited", "pid", cmd.Process.Pid, "status", cmd.ProcessState)
+}
+
+// isBrokenConnection reports whether err indicates that the signer closed its end of the pipe.
+func isBrokenConnection(err error) bool {
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// errorChain returns the messages and types of every error wrapped by err.
+func errorChain(err error) []string {
+	var chain []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		desc := fmt.Sprintf("%T: %s", err, redactHome(err.Error()))
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			desc += fmt.Sprintf(" (exit code %d)", exitErr.ExitCode())
+		}
+		chain = append(chain, desc)
+	}
+	return chain
+}
+
+// environmentSummary reports which ECP related environment variables are set.
+// Their values may contain paths and are redacted.
+func environmentSummary() map[string]string {
+	env := make(map[string]string)
+	for _, name := range debugEnvVars {
+		if v, ok := os.LookupEnv(name); ok {
+			env[name] = redactHome(v)
+		}
+	}
+	return env
+}
+
+// loadRedactedConfig reads the config file and redacts sensitive values.
+// A config that cannot be read or parsed is omitted from the bundle.
+func loadRedactedConfig(configFilePath string) interface{} {
+	data, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return nil
+	}
+	var config interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil
+	}
+	return redactValue("", config)
+}
+
+// redactValue recursively replaces values of sensitive keys and strips the home
+// directory from strings.
+func redactValue(key string, v interface{}) interface{} {
+	lower := strings.ToLower(key)
+	for _, fragment := range sensitiveKeyFragments {
+		if strings.Contains(lower, fragment) {
+			return redactedValue
+		}
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = redactValue(k, child)
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactValue(key, child)
+		}
+		return v
+	case string:
+		return redactHome(v)
+	default:
+		return v
+	}
+}
+
+// redactHome replaces the user's home directory in s with "~".
+func redactHome(s string) string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" || home == "/" {
+		return s
+	}
+	return strings.ReplaceAll(s, home, "~")
+}
+
+// writeDebugBundle writes bundle as JSON into dir and returns the path of the created file.
+func writeDebugBundle(dir string, bundle debugBundle) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, fmt.Sprintf("ecp-debug-%s-*.json", bundle.Time.Format("20060102T150405Z")))
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return filepath.Clean(f.Name()), nil
+}
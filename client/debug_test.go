@@ -0,0 +1,95 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTailBuffer(t *testing.T) {
+	b := newTailBuffer(4)
+	b.Write([]byte("abc"))
+	b.Write([]byte("defg"))
+	if got, want := b.String(), "defg"; got != want {
+		t.Errorf("tailBuffer: got %q, want %q", got, want)
+	}
+}
+
+func TestRedactValue(t *testing.T) {
+	config := map[string]interface{}{
+		"pkcs11": map[string]interface{}{
+			"label":    "gecc",
+			"user_pin": "0000",
+		},
+	}
+	redacted := redactValue("", config).(map[string]interface{})
+	pkcs11 := redacted["pkcs11"].(map[string]interface{})
+	if got, want := pkcs11["user_pin"], redactedValue; got != want {
+		t.Errorf("redactValue user_pin: got %v, want %v", got, want)
+	}
+	if got, want := pkcs11["label"], "gecc"; got != want {
+		t.Errorf("redactValue label: got %v, want %v", got, want)
+	}
+}
+
+func TestClient_Cred_DebugBundle(t *testing.T) {
+	requireSigner(t)
+	dir := t.TempDir()
+	t.Setenv(debugBundleDirEnv, dir)
+	_, err := Cred("testdata/certificate_config_failing_signer.json")
+	if err == nil {
+		t.Fatal("Cred: got nil err, want signer failure")
+	}
+	if !strings.Contains(err.Error(), "debug bundle written to") {
+		t.Errorf("Cred: got err %v, want debug bundle location", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "ecp-debug-*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Glob: got %v (err %v), want exactly one debug bundle", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bundle debugBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		t.Fatal(err)
+	}
+	if bundle.ExitCode == nil || *bundle.ExitCode != 3 {
+		t.Errorf("debug bundle exit code: got %v, want 3", bundle.ExitCode)
+	}
+	if !strings.Contains(bundle.Stderr, "keystore unavailable") {
+		t.Errorf("debug bundle stderr: got %q, want signer output", bundle.Stderr)
+	}
+	var config struct {
+		CertConfigs struct {
+			PKCS11 struct {
+				UserPin string `json:"user_pin"`
+			} `json:"pkcs11"`
+		} `json:"cert_configs"`
+	}
+	if err := json.Unmarshal(data, &struct {
+		Config interface{} `json:"config"`
+	}{&config}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.CertConfigs.PKCS11.UserPin, redactedValue; got != want {
+		t.Errorf("debug bundle user pin: got %q, want %q", got, want)
+	}
+}
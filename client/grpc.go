@@ -0,0 +1,181 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"reflect"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/transport"
+	"github.com/googleapis/enterprise-certificate-proxy/internal/transport/signerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// signerTransportEnv names the environment variable that selects the protocol
+// spoken to the signer. Set it to "grpc" to negotiate gRPC, falling back to
+// net/rpc gob with signers that do not support it. By default the client
+// speaks gob without negotiating.
+const signerTransportEnv = "ENTERPRISE_CERTIFICATE_SIGNER_TRANSPORT"
+
+// rpcClient is the connection to the signer, over either transport.
+type rpcClient interface {
+	// CallContext calls serviceMethod, returning ctx.Err() if ctx is done
+	// before the signer replies.
+	CallContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error
+	Close() error
+}
+
+// gobClient implements rpcClient with net/rpc.
+type gobClient struct {
+	*rpc.Client
+}
+
+func (c gobClient) CallContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	// Decode into a copy of reply, which an abandoned call may still write to
+	// after CallContext returns.
+	v := reflect.New(reflect.TypeOf(reply).Elem())
+	call := c.Go(serviceMethod, args, v.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return call.Error
+		}
+		reflect.ValueOf(reply).Elem().Set(v.Elem())
+		return nil
+	case <-ctx.Done():
+		// net/rpc cannot cancel a call; the signer's eventual reply is
+		// discarded.
+		return ctx.Err()
+	}
+}
+
+// connect returns a client for the signer on conn, negotiating the protocol
+// selected by signerTransportEnv.
+func connect(conn io.ReadWriteCloser) (rpcClient, error) {
+	if os.Getenv(signerTransportEnv) != transport.ProtocolGRPC {
+		return gobClient{rpc.NewClient(conn)}, nil
+	}
+	c, err := transport.Connect(conn, []string{transport.ProtocolGRPC, transport.ProtocolGob})
+	if err != nil {
+		return nil, err
+	}
+	if c.Protocol == transport.ProtocolGob {
+		return gobClient{c.RPC}, nil
+	}
+	cc, err := transport.DialGRPC(c.GRPC)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcClient{conn: cc, signer: signerpb.NewSignerClient(cc)}, nil
+}
+
+// grpcClient implements rpcClient with the gRPC Signer service.
+type grpcClient struct {
+	conn   *grpc.ClientConn
+	signer signerpb.SignerClient
+}
+
+func (c *grpcClient) CallContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	var err error
+	switch serviceMethod {
+	case handshakeAPI:
+		var resp *signerpb.HandshakeResponse
+		if resp, err = c.signer.Handshake(ctx, &signerpb.HandshakeRequest{Version: int32(args.(HandshakeArgs).Version)}); err == nil {
+			*reply.(*Capabilities) = Capabilities(transport.CapabilitiesFromProto(resp))
+		}
+	case certificateChainAPI:
+		var resp *signerpb.CertificateChainResponse
+		if resp, err = c.signer.CertificateChain(ctx, &signerpb.CertificateChainRequest{}); err == nil {
+			*reply.(*[][]byte) = resp.GetCertificates()
+		}
+	case publicKeyAPI:
+		var resp *signerpb.PublicResponse
+		if resp, err = c.signer.Public(ctx, &signerpb.PublicRequest{}); err == nil {
+			*reply.(*[]byte) = resp.GetPublicKey()
+		}
+	case signAPI:
+		a := args.(SignArgs)
+		var opts *signerpb.SignerOpts
+		if opts, err = transport.OptsToProto(a.Opts); err != nil {
+			return err
+		}
+		var resp *signerpb.SignResponse
+		if resp, err = c.signer.Sign(ctx, &signerpb.SignRequest{Digest: a.Digest, Opts: opts}); err == nil {
+			*reply.(*[]byte) = resp.GetSignature()
+		}
+	case signMessageAPI:
+		a := args.(SignMessageArgs)
+		var opts *signerpb.SignerOpts
+		if opts, err = transport.OptsToProto(a.Opts); err != nil {
+			return err
+		}
+		var resp *signerpb.SignResponse
+		if resp, err = c.signer.SignMessage(ctx, &signerpb.SignMessageRequest{Message: a.Message, Opts: opts}); err == nil {
+			*reply.(*[]byte) = resp.GetSignature()
+		}
+	case encryptAPI:
+		var resp *signerpb.EncryptResponse
+		if resp, err = c.signer.Encrypt(ctx, &signerpb.EncryptRequest{Plaintext: args.(EncryptArgs).Plaintext}); err == nil {
+			*reply.(*[]byte) = resp.GetCiphertext()
+		}
+	case decryptAPI:
+		a := args.(DecryptArgs)
+		var opts *signerpb.DecrypterOpts
+		if opts, err = transport.DecrypterOptsToProto(a.Opts); err != nil {
+			return err
+		}
+		var resp *signerpb.DecryptResponse
+		if resp, err = c.signer.Decrypt(ctx, &signerpb.DecryptRequest{Ciphertext: a.Ciphertext, Opts: opts}); err == nil {
+			*reply.(*[]byte) = resp.GetPlaintext()
+		}
+	case diagnosticsAPI:
+		var resp *signerpb.DiagnosticsResponse
+		if resp, err = c.signer.Diagnostics(ctx, &signerpb.DiagnosticsRequest{}); err == nil {
+			*reply.(*[]byte) = resp.GetReport()
+		}
+	default:
+		return fmt.Errorf("rpc: can't find method %s", serviceMethod)
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return rpcError(err)
+}
+
+// rpcError converts a gRPC error to the error net/rpc would have returned, so
+// that callers handle both transports alike.
+func rpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st := status.Convert(err)
+	switch st.Code() {
+	case codes.Unimplemented, codes.Unknown:
+		return rpc.ServerError(st.Message())
+	case codes.Unavailable:
+		return fmt.Errorf("%w: %s", rpc.ErrShutdown, st.Message())
+	default:
+		return err
+	}
+}
+
+func (c *grpcClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// signerAPIVersion is the version of the signer API this client speaks.
+const signerAPIVersion = 1
+
+// ErrUnsupported is wrapped by the errors of Key methods that the signer
+// reported it does not support in its handshake, so that callers can fall back
+// without parsing signer error messages.
+var ErrUnsupported = errors.New("not supported by the signer")
+
+// HandshakeArgs contains arguments to the Handshake method.
+type HandshakeArgs struct {
+	Version int // The signer API version the client speaks.
+}
+
+// Capabilities describes what the signer behind a Key supports, as the signer
+// reported when the Key connected to it.
+type Capabilities struct {
+	// Version is the signer API version the signer speaks. Signers that
+	// predate the handshake are version 0, and are assumed to support
+	// decryption without options and every hash function.
+	Version     int
+	Decrypt     bool          // Whether Encrypt and Decrypt are supported.
+	SignMessage bool          // Whether the signer hashes messages for SignMessage itself.
+	Batch       bool          // Whether several digests can be signed in one call.
+	Hashes      []crypto.Hash // The hash functions Sign accepts.
+}
+
+// legacyCapabilities are assumed for signers that predate the handshake.
+var legacyCapabilities = Capabilities{Decrypt: true}
+
+// supportsHash reports whether the signer accepts digests made with h.
+func (c Capabilities) supportsHash(h crypto.Hash) bool {
+	if c.Version == 0 || h == 0 {
+		return true
+	}
+	for _, supported := range c.Hashes {
+		if supported == h {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities returns what the signer supports.
+func (k *Key) Capabilities() Capabilities {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.caps
+}
+
+// handshake exchanges the signer API version with the signer behind client
+// and returns its capabilities.
+func handshake(ctx context.Context, client rpcClient) (Capabilities, error) {
+	var caps Capabilities
+	err := client.CallContext(ctx, handshakeAPI, HandshakeArgs{Version: signerAPIVersion}, &caps)
+	if err != nil && isUnknownMethod(err) {
+		return legacyCapabilities, nil
+	}
+	return caps, err
+}
+
+// checkSign returns an error if the signer cannot sign with opts.
+func (c Capabilities) checkSign(opts crypto.SignerOpts) error {
+	if opts != nil && !c.supportsHash(opts.HashFunc()) {
+		return fmt.Errorf("%w: %v signatures", ErrUnsupported, opts.HashFunc())
+	}
+	return nil
+}
+
+// checkDecrypt returns an error if the signer cannot encrypt and decrypt with
+// opts.
+func (c Capabilities) checkDecrypt(opts crypto.DecrypterOpts) error {
+	if !c.Decrypt {
+		return fmt.Errorf("%w: encryption", ErrUnsupported)
+	}
+	if c.Version == 0 && opts != nil {
+		// Older signers fail to decode options they do not know.
+		return fmt.Errorf("%w: decryption options %T, the signer predates them", ErrUnsupported, opts)
+	}
+	return nil
+}
+
+// isUnknownMethod reports whether err is net/rpc's error for a method the
+// signer does not implement.
+func isUnknownMethod(err error) bool {
+	return strings.HasPrefix(err.Error(), "rpc: can't find method")
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build ecp_inprocess && (darwin || windows || (linux && cgo))
+// +build ecp_inprocess
+// +build darwin windows linux,cgo
+
+package client
+
+import (
+	"errors"
+	"os"
+
+	signerutil "github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+)
+
+// inProcess reports whether Cred opens credentials in this process instead
+// of spawning the signer binary.
+const inProcess = true
+
+// credInProcess opens the credential that the config at configFilePath, or
+// its named profile, selects with the platform keystore code, as the signer
+// would. The config's resource limits are not applied, since they would limit
+// the calling process.
+func credInProcess(configFilePath, profile string) (*Key, error) {
+	logger().Debug("opening credential in-process", "config", configFilePath, "profile", profile)
+	config, err := signerutil.LoadConfigProfile(configFilePath, profile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrCredUnavailable
+		}
+		return nil, err
+	}
+	key, caps, err := openLocalKey(config)
+	if err != nil {
+		return nil, err
+	}
+	k := &Key{
+		configFilePath: configFilePath,
+		profile:        profile,
+		client:         &localClient{key: key, caps: caps},
+	}
+	if err := k.load(); err != nil {
+		key.Close()
+		return nil, err
+	}
+	return k, nil
+}
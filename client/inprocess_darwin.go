@@ -0,0 +1,47 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build ecp_inprocess && darwin
+// +build ecp_inprocess,darwin
+
+package client
+
+import (
+	"crypto"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/darwin/keychain"
+	signerutil "github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+)
+
+// openLocalKey opens the keychain identity that config selects. Without cgo
+// only its public key can be used, and it reports no capabilities.
+func openLocalKey(config signerutil.EnterpriseCertificateConfig) (localKey, Capabilities, error) {
+	key, err := keychain.CredWithOptions(keychain.ConfigOptions(config.CertConfigs.MacOSKeychain))
+	if err != nil {
+		return nil, Capabilities{}, err
+	}
+	if !keychain.PrivateKeyOperations {
+		return key, Capabilities{Version: signerAPIVersion}, nil
+	}
+	// These match what the signer's Handshake reports.
+	caps := Capabilities{
+		Version:     signerAPIVersion,
+		Decrypt:     true,
+		SignMessage: true,
+		Hashes:      []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512},
+	}
+	if config.CertConfigs.MacOSKeychain.AllowLegacyHashes {
+		caps.Hashes = append(caps.Hashes, crypto.SHA1)
+	}
+	return key, caps, nil
+}
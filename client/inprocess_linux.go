@@ -0,0 +1,61 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build ecp_inprocess && linux && cgo
+// +build ecp_inprocess,linux,cgo
+
+package client
+
+import (
+	"crypto"
+	"encoding/json"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/linux/pkcs11"
+	signerutil "github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+)
+
+// pkcs11Key adapts a pkcs11.Key to localKey.
+type pkcs11Key struct {
+	*pkcs11.Key
+}
+
+func (k pkcs11Key) Close() error {
+	k.Key.Close()
+	return nil
+}
+
+func (k pkcs11Key) Diagnostics() ([]byte, error) {
+	d, err := k.Key.Diagnostics()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(d)
+}
+
+// openLocalKey opens the PKCS #11 credential that config selects.
+func openLocalKey(config signerutil.EnterpriseCertificateConfig) (localKey, Capabilities, error) {
+	opts, err := pkcs11.ConfigOptions(config.CertConfigs.PKCS11)
+	if err != nil {
+		return nil, Capabilities{}, err
+	}
+	key, err := pkcs11.CredWithOptions(opts)
+	if err != nil {
+		return nil, Capabilities{}, err
+	}
+	return pkcs11Key{key}, Capabilities{
+		Version:     signerAPIVersion,
+		Decrypt:     true,
+		SignMessage: true,
+		Hashes:      []crypto.Hash{crypto.SHA1, crypto.SHA224, crypto.SHA256, crypto.SHA384, crypto.SHA512},
+	}, nil
+}
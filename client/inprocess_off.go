@@ -0,0 +1,29 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !ecp_inprocess
+// +build !ecp_inprocess
+
+package client
+
+import "errors"
+
+// inProcess reports whether Cred opens credentials in this process instead
+// of spawning the signer binary, which requires the ecp_inprocess build tag.
+const inProcess = false
+
+// credInProcess fails in builds without the ecp_inprocess tag, which leave the
+// platform keystore code out of the client.
+func credInProcess(string, string) (*Key, error) {
+	return nil, errors.New("in-process signing requires building with the ecp_inprocess tag")
+}
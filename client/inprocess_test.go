@@ -0,0 +1,187 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build ecp_inprocess && linux && cgo
+// +build ecp_inprocess,linux,cgo
+
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/googleapis/enterprise-certificate-proxy/linux"
+)
+
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+}
+
+// softHSMConfig provisions an ECDSA identity into a new SoftHSM2 token and
+// returns the path of a config selecting it. It skips t when SoftHSM2 is not
+// installed; SOFTHSM2_MODULE overrides the path of libsofthsm2.so.
+func softHSMConfig(t *testing.T) string {
+	t.Helper()
+	module := os.Getenv("SOFTHSM2_MODULE")
+	for _, path := range softHSMModules {
+		if module != "" {
+			break
+		}
+		if _, err := os.Stat(path); err == nil {
+			module = path
+		}
+	}
+	if _, err := exec.LookPath("softhsm2-util"); err != nil || module == "" {
+		t.Skip("SoftHSM2 is not installed")
+	}
+
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := os.WriteFile(conf, []byte("directories.tokendir = "+tokens+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+	cmd := exec.Command("softhsm2-util", "--init-token", "--free", "--label", "ecp-test", "--pin", "1234", "--so-pin", "123456")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("softhsm2-util --init-token: %v: %s", err, out)
+	}
+
+	key, err := linux.GenerateKey(linux.KeyGenOptions{
+		Module:    module,
+		Token:     "ecp-test",
+		PIN:       "1234",
+		Label:     "ec",
+		ID:        []byte{1},
+		Algorithm: "ECDSA",
+	})
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	defer key.Close()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ec"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.StoreCertificate(der); err != nil {
+		t.Fatalf("StoreCertificate: %v", err)
+	}
+
+	// The signer binary is never run in-process, so the config names none.
+	data, err := json.Marshal(map[string]interface{}{
+		"cert_configs": map[string]interface{}{
+			"pkcs11": map[string]interface{}{
+				"module":      module,
+				"token_label": "ecp-test",
+				"label":       "ec",
+				"user_pin":    "1234",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "certificate_config.json")
+	if err := os.WriteFile(config, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestCredInProcess(t *testing.T) {
+	if _, err := Cred(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, ErrCredUnavailable) {
+		t.Errorf("Cred with a missing config: got %v, want %v", err, ErrCredUnavailable)
+	}
+
+	key, err := Cred(softHSMConfig(t))
+	if err != nil {
+		t.Fatalf("Cred: %v", err)
+	}
+	defer key.Close()
+	if _, ok := key.client.(*localClient); !ok {
+		t.Fatalf("Cred: got client %T, want *localClient", key.client)
+	}
+	if got := len(key.CertificateChain()); got != 1 {
+		t.Errorf("CertificateChain: got %d certificates, want 1", got)
+	}
+	pub, ok := key.Public().(*ecdsa.PublicKey)
+	if !ok {
+		t.Fatalf("Public: got %T, want *ecdsa.PublicKey", key.Public())
+	}
+	if caps := key.Capabilities(); !caps.SignMessage || !caps.Decrypt {
+		t.Errorf("Capabilities: got %+v, want SignMessage and Decrypt", caps)
+	}
+
+	message := []byte("message")
+	digest := sha256.Sum256(message)
+	sig, err := key.Sign(nil, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		t.Error("Sign: signature does not verify")
+	}
+	sig, err = key.SignMessage(message, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		t.Error("SignMessage: signature does not verify")
+	}
+
+	plaintext := []byte("Plain text to encrypt")
+	ciphertext, err := key.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	decrypted, err := key.Decrypt(nil, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Decrypt: got %q, want %q", decrypted, plaintext)
+	}
+
+	if err := key.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, err := key.Sign(nil, digest[:], crypto.SHA256); err == nil {
+		t.Error("Sign after Close: got nil err, want error")
+	}
+}
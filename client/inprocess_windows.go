@@ -0,0 +1,42 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build ecp_inprocess && windows
+// +build ecp_inprocess,windows
+
+package client
+
+import (
+	"crypto"
+
+	signerutil "github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/windows/ncrypt"
+)
+
+// openLocalKey opens the certificate in the Windows certificate store that
+// config selects.
+func openLocalKey(config signerutil.EnterpriseCertificateConfig) (localKey, Capabilities, error) {
+	key, err := ncrypt.CredWithOptions(ncrypt.ConfigOptions(config.CertConfigs.WindowsStore))
+	if err != nil {
+		return nil, Capabilities{}, err
+	}
+	caps := Capabilities{
+		Version: signerAPIVersion,
+		Decrypt: true,
+		Hashes:  []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512},
+	}
+	if config.CertConfigs.WindowsStore.AllowLegacyHashes {
+		caps.Hashes = append(caps.Hashes, crypto.SHA1)
+	}
+	return key, caps, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"reflect"
+)
+
+// localKey is a credential opened with the platform keystore code in this
+// process, as the signer would open it.
+type localKey interface {
+	crypto.Signer
+	crypto.Decrypter
+	CertificateChain() [][]byte
+	Encrypt(plaintext []byte, opts crypto.DecrypterOpts) ([]byte, error)
+	Close() error
+}
+
+// messageSigner is implemented by local keys whose keystore can hash as well
+// as sign.
+type messageSigner interface {
+	SignMessage(message []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+// diagnoser is implemented by local keys that can describe their keystore, in
+// the JSON report of the signer's Diagnostics method.
+type diagnoser interface {
+	Diagnostics() ([]byte, error)
+}
+
+// localClient implements rpcClient by calling a localKey directly, so that a
+// Key signing in-process behaves like one talking to a signer.
+type localClient struct {
+	key  localKey
+	caps Capabilities // Reported by the Handshake method.
+}
+
+func (c *localClient) CallContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	type result struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := c.call(serviceMethod, args)
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.value))
+		return nil
+	case <-ctx.Done():
+		// Keystore calls cannot be cancelled; the eventual result is
+		// discarded.
+		return ctx.Err()
+	}
+}
+
+// call performs serviceMethod and returns the value the signer would reply
+// with.
+func (c *localClient) call(serviceMethod string, args interface{}) (interface{}, error) {
+	switch serviceMethod {
+	case handshakeAPI:
+		return c.caps, nil
+	case certificateChainAPI:
+		return c.key.CertificateChain(), nil
+	case publicKeyAPI:
+		return x509.MarshalPKIXPublicKey(c.key.Public())
+	case signAPI:
+		a := args.(SignArgs)
+		return c.key.Sign(nil, a.Digest, a.Opts)
+	case signMessageAPI:
+		if s, ok := c.key.(messageSigner); ok {
+			a := args.(SignMessageArgs)
+			return s.SignMessage(a.Message, a.Opts)
+		}
+	case encryptAPI:
+		return c.key.Encrypt(args.(EncryptArgs).Plaintext, nil)
+	case decryptAPI:
+		a := args.(DecryptArgs)
+		return c.key.Decrypt(nil, a.Ciphertext, a.Opts)
+	case diagnosticsAPI:
+		if d, ok := c.key.(diagnoser); ok {
+			return d.Diagnostics()
+		}
+	}
+	return nil, fmt.Errorf("rpc: can't find method %s", serviceMethod)
+}
+
+func (c *localClient) Close() error {
+	return c.key.Close()
+}
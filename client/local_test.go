@@ -0,0 +1,154 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// memoryKey is a localKey holding the test certificate's private key in
+// memory.
+type memoryKey struct {
+	*rsa.PrivateKey
+	chain   [][]byte
+	closed  bool
+	release chan struct{} // If not nil, Sign waits for it to be closed.
+}
+
+func newMemoryKey(t *testing.T) *memoryKey {
+	t.Helper()
+	data, err := os.ReadFile("testdata/testcert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &memoryKey{PrivateKey: cert.PrivateKey.(*rsa.PrivateKey), chain: cert.Certificate}
+}
+
+func (k *memoryKey) CertificateChain() [][]byte {
+	return k.chain
+}
+
+func (k *memoryKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if k.release != nil {
+		<-k.release
+	}
+	// Like keystores, ignore the caller's randomness source, which the
+	// signers leave nil.
+	return k.PrivateKey.Sign(rand.Reader, digest, opts)
+}
+
+func (k *memoryKey) Encrypt(plaintext []byte, _ crypto.DecrypterOpts) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, &k.PublicKey, plaintext, nil)
+}
+
+func (k *memoryKey) Decrypt(rand io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if opts == nil {
+		opts = &rsa.OAEPOptions{Hash: crypto.SHA256}
+	}
+	return k.PrivateKey.Decrypt(rand, ciphertext, opts)
+}
+
+func (k *memoryKey) Close() error {
+	k.closed = true
+	return nil
+}
+
+// localTestKey returns a Key signing in-process with a memoryKey.
+func localTestKey(t *testing.T, mk *memoryKey) *Key {
+	t.Helper()
+	k := &Key{client: &localClient{key: mk, caps: Capabilities{
+		Version: signerAPIVersion,
+		Decrypt: true,
+		Hashes:  []crypto.Hash{crypto.SHA256},
+	}}}
+	if err := k.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	return k
+}
+
+func TestLocalClient(t *testing.T) {
+	mk := newMemoryKey(t)
+	k := localTestKey(t, mk)
+	if got := k.CertificateChain(); len(got) != len(mk.chain) || !bytes.Equal(got[0], mk.chain[0]) {
+		t.Errorf("CertificateChain: got %d certificates, want %d", len(got), len(mk.chain))
+	}
+	if !mk.PublicKey.Equal(k.Public()) {
+		t.Errorf("Public: got %v, want the test certificate's key", k.Public())
+	}
+
+	message := []byte("message to sign")
+	digest := sha256.Sum256(message)
+	signed, err := k.SignMessage(message, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	if err := rsa.VerifyPKCS1v15(&mk.PublicKey, crypto.SHA256, digest[:], signed); err != nil {
+		t.Errorf("SignMessage: signature does not verify: %v", err)
+	}
+	if _, err := k.Sign(nil, make([]byte, 48), crypto.SHA384); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Sign with SHA-384: got %v, want ErrUnsupported", err)
+	}
+
+	plaintext := []byte("Plain text to encrypt")
+	ciphertext, err := k.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	got, err := k.Decrypt(nil, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Decrypt: got %q, want %q", got, plaintext)
+	}
+
+	if _, err := k.Diagnostics(); err == nil || !strings.Contains(err.Error(), "can't find method") {
+		t.Errorf("Diagnostics: got %v, want a can't find method error", err)
+	}
+	if err := k.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if !mk.closed {
+		t.Error("Close: the local key was not closed")
+	}
+}
+
+func TestLocalClient_Context(t *testing.T) {
+	mk := newMemoryKey(t)
+	k := localTestKey(t, mk)
+	mk.release = make(chan struct{})
+	defer close(mk.release)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	digest := sha256.Sum256([]byte("message to sign"))
+	if _, err := k.SignContext(ctx, digest[:], crypto.SHA256); !errors.Is(err, context.Canceled) {
+		t.Errorf("SignContext: got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Logger receives the client's structured logs: how credentials are resolved,
+// the lifecycle of signer subprocesses, the latency of signer calls, and
+// errors. keysAndValues alternate between string keys and their values, as
+// with log/slog, so that a *slog.Logger can be passed to SetLogger as is.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// loggingEnv names the environment variable that, when set, makes the client
+// write its logs to the standard logger unless SetLogger was called. The
+// signers honor it too.
+const loggingEnv = "ENABLE_ENTERPRISE_CERTIFICATE_LOGS"
+
+var (
+	loggerMu      sync.RWMutex
+	currentLogger Logger
+)
+
+// SetLogger routes the client's logs to l, so that applications can collect
+// them with their own. A nil l restores the default, which discards the logs
+// unless the ENABLE_ENTERPRISE_CERTIFICATE_LOGS environment variable is set.
+func SetLogger(l Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	currentLogger = l
+}
+
+// logger returns the Logger set with SetLogger, or the default.
+func logger() Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	if currentLogger != nil {
+		return currentLogger
+	}
+	if os.Getenv(loggingEnv) != "" {
+		return stdLogger{}
+	}
+	return nopLogger{}
+}
+
+// nopLogger discards logs.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// stdLogger writes logs to the standard logger as key=value pairs.
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	stdLog("DEBUG", msg, keysAndValues)
+}
+
+func (stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	stdLog("INFO", msg, keysAndValues)
+}
+
+func (stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	stdLog("WARN", msg, keysAndValues)
+}
+
+func (stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	stdLog("ERROR", msg, keysAndValues)
+}
+
+func stdLog(level, msg string, keysAndValues []interface{}) {
+	log.Print(formatLog(level, msg, keysAndValues))
+}
+
+// formatLog renders a log as "ecp: LEVEL msg key=value ...", quoting values
+// that contain spaces.
+func formatLog(level, msg string, keysAndValues []interface{}) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ecp: %s %s", level, msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key, value := keysAndValues[i], interface{}("MISSING")
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		s := fmt.Sprint(value)
+		if strings.ContainsAny(s, " \t\n\"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		fmt.Fprintf(&b, " %v=%s", key, s)
+	}
+	return b.String()
+}
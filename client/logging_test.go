@@ -0,0 +1,125 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger records logs as formatted by formatLog.
+type recordingLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *recordingLogger) record(level, msg string, keysAndValues []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, formatLog(level, msg, keysAndValues))
+}
+
+func (l *recordingLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.record("DEBUG", msg, keysAndValues)
+}
+
+func (l *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.record("INFO", msg, keysAndValues)
+}
+
+func (l *recordingLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.record("WARN", msg, keysAndValues)
+}
+
+func (l *recordingLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.record("ERROR", msg, keysAndValues)
+}
+
+// contains reports whether a log starts with prefix.
+func (l *recordingLogger) contains(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.logs {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSetLogger(t *testing.T) {
+	requireSigner(t)
+	l := &recordingLogger{}
+	SetLogger(l)
+	t.Cleanup(func() { SetLogger(nil) })
+
+	key, err := Cred("testdata/certificate_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("message to sign"))
+	if _, err := key.Sign(nil, digest[:], crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Cred("testdata/certificate_config_missing_path.json"); err == nil {
+		t.Fatal("Cred with a missing signer path: got nil err, want error")
+	}
+	for _, want := range []string{
+		"ecp: DEBUG resolving credential config=testdata/certificate_config.json",
+		"ecp: INFO started signer signer=./testdata/signer.sh pid=",
+		"ecp: INFO loaded credential config=testdata/certificate_config.json version=1 certificates=1",
+		"ecp: DEBUG signer call method=EnterpriseCertSigner.Sign duration=",
+		"ecp: DEBUG closing credential",
+		"ecp: DEBUG no signer binary configured config=testdata/certificate_config_missing_path.json",
+	} {
+		if !l.contains(want) {
+			t.Errorf("SetLogger: no log starting with %q in\n%s", want, strings.Join(l.logs, "\n"))
+		}
+	}
+}
+
+func TestSetLogger_Default(t *testing.T) {
+	SetLogger(nil)
+	t.Setenv(loggingEnv, "")
+	if _, ok := logger().(nopLogger); !ok {
+		t.Errorf("logger: got %T, want nopLogger", logger())
+	}
+	t.Setenv(loggingEnv, "1")
+	if _, ok := logger().(stdLogger); !ok {
+		t.Errorf("logger with %s set: got %T, want stdLogger", loggingEnv, logger())
+	}
+}
+
+func TestFormatLog(t *testing.T) {
+	for _, tc := range []struct {
+		keysAndValues []interface{}
+		want          string
+	}{
+		{nil, "ecp: INFO msg"},
+		{[]interface{}{"pid", 42}, "ecp: INFO msg pid=42"},
+		{[]interface{}{"error", fmt.Errorf("signer exited")}, `ecp: INFO msg error="signer exited"`},
+		{[]interface{}{"odd"}, "ecp: INFO msg odd=MISSING"},
+	} {
+		if got := formatLog("INFO", "msg", tc.keysAndValues); got != tc.want {
+			t.Errorf("formatLog(%v): got %q, want %q", tc.keysAndValues, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Kinds of signer call failures passed to Metrics.CountRPCError.
+const (
+	ErrorKindCanceled   = "canceled"   // The context was done before the signer replied.
+	ErrorKindConnection = "connection" // The connection to the signer broke.
+	ErrorKindSigner     = "signer"     // The signer or its keystore returned an error.
+)
+
+// Metrics receives measurements of the client, so that signing degradation
+// can be alerted on before users report authentication failures. Its methods
+// are called synchronously from Key methods, and must be safe for concurrent
+// use.
+type Metrics interface {
+	// ObserveSign records a signature by the signer, for Sign, SignContext
+	// or SignMessage, with how long the signer took and the error it
+	// returned, or nil. Counting the calls gives the signing rate.
+	ObserveSign(latency time.Duration, err error)
+	// CountRPCError counts a failed call to the signer, such as
+	// "EnterpriseCertSigner.Sign", by kind: one of the ErrorKind constants.
+	CountRPCError(method, kind string)
+	// CountRestart counts a restart of the signer subprocess after its
+	// connection broke.
+	CountRestart()
+}
+
+var (
+	metricsMu      sync.RWMutex
+	currentMetrics Metrics
+)
+
+// SetMetrics sends the client's measurements to m, such as an adapter to
+// Prometheus or OpenTelemetry instruments. A nil m discards them, which is
+// the default.
+func SetMetrics(m Metrics) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	currentMetrics = m
+}
+
+// metrics returns the Metrics set with SetMetrics, or one that discards
+// measurements.
+func metrics() Metrics {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	if currentMetrics != nil {
+		return currentMetrics
+	}
+	return nopMetrics{}
+}
+
+// nopMetrics discards measurements.
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveSign(time.Duration, error) {}
+func (nopMetrics) CountRPCError(string, string)     {}
+func (nopMetrics) CountRestart()                    {}
+
+// errorKind classifies the error of a call made with ctx.
+func errorKind(ctx context.Context, err error) string {
+	switch {
+	case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+		return ErrorKindCanceled
+	case isBrokenConnection(err):
+		return ErrorKindConnection
+	default:
+		return ErrorKindSigner
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics records the measurements it receives.
+type recordingMetrics struct {
+	mu         sync.Mutex
+	signs      int
+	signErrors int
+	rpcErrors  []string // "method kind"
+	restarts   int
+}
+
+func (m *recordingMetrics) ObserveSign(latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signs++
+	if err != nil {
+		m.signErrors++
+	}
+}
+
+func (m *recordingMetrics) CountRPCError(method, kind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rpcErrors = append(m.rpcErrors, method+" "+kind)
+}
+
+func (m *recordingMetrics) CountRestart() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restarts++
+}
+
+func TestSetMetrics(t *testing.T) {
+	requireSigner(t)
+	m := &recordingMetrics{}
+	SetMetrics(m)
+	t.Cleanup(func() { SetMetrics(nil) })
+
+	key, err := Cred("testdata/certificate_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+	if _, err := key.Sign(nil, []byte("testDigest"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Break the connection to the signer, which is then restarted.
+	key.client.Close()
+	if _, err := key.Sign(nil, []byte("testDigest"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	hung := pipeKey(t, &hungSigner{release: make(chan struct{})})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := hung.SignContext(ctx, []byte("digest"), nil); err == nil {
+		t.Fatal("SignContext with a canceled context: got nil err, want error")
+	}
+
+	if m.signs != 4 || m.signErrors != 2 {
+		t.Errorf("ObserveSign: got %d signatures with %d errors, want 4 with 2", m.signs, m.signErrors)
+	}
+	if m.restarts != 1 {
+		t.Errorf("CountRestart: got %d restarts, want 1", m.restarts)
+	}
+	want := []string{signAPI + " " + ErrorKindConnection, signAPI + " " + ErrorKindCanceled}
+	if !reflect.DeepEqual(m.rpcErrors, want) {
+		t.Errorf("CountRPCError: got %q, want %q", m.rpcErrors, want)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/windows/namedpipe"
+)
+
+// pipeDialTimeout bounds how long CredFromPipe waits for a free pipe instance.
+const pipeDialTimeout = 5 * time.Second
+
+// CredFromPipe attaches to a shared signer that is serving on the named pipe
+// called name, such as one started with `ecp.exe <config> -pipe <name>`. Only
+// the user that started the signer can attach. Closing the returned Key
+// disconnects from the signer without stopping it.
+func CredFromPipe(name string) (*Key, error) {
+	conn, err := namedpipe.Dial(name, pipeDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("attaching to shared signer: %w", err)
+	}
+	client, err := connect(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("attaching to shared signer: %w", err)
+	}
+	k := &Key{client: client}
+	if err := k.load(); err != nil {
+		k.client.Close()
+		return nil, err
+	}
+	logger().Info("attached to shared signer", "pipe", name)
+	return k, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// socketDialTimeout bounds how long CredFromSocket waits to connect.
+const socketDialTimeout = 5 * time.Second
+
+// errSocketUnavailable wraps failures to reach a shared signer's socket, after
+// which Cred falls back to spawning a signer.
+type errSocketUnavailable struct {
+	err error
+}
+
+func (e *errSocketUnavailable) Error() string {
+	return fmt.Sprintf("attaching to shared signer: %v", e.err)
+}
+
+func (e *errSocketUnavailable) Unwrap() error {
+	return e.err
+}
+
+// CredFromSocket attaches to a shared signer that is serving on the Unix
+// domain socket at path, such as one started with `ecp <config> -socket <path>`.
+// Only the user that started the signer can attach. Closing the returned Key
+// disconnects from the signer without stopping it.
+func CredFromSocket(path string) (*Key, error) {
+	conn, err := net.DialTimeout("unix", path, socketDialTimeout)
+	if err != nil {
+		return nil, &errSocketUnavailable{err}
+	}
+	client, err := connect(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("attaching to shared signer: %w", err)
+	}
+	k := &Key{client: client}
+	if err := k.load(); err != nil {
+		k.client.Close()
+		return nil, err
+	}
+	logger().Info("attached to shared signer", "socket", path)
+	return k, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/transport"
+)
+
+// socketSigner serves the certificate in testdata/testcert.pem.
+type socketSigner struct {
+	cert tls.Certificate
+}
+
+func (s *socketSigner) CertificateChain(ignored struct{}, chain *[][]byte) error {
+	*chain = s.cert.Certificate
+	return nil
+}
+
+func (s *socketSigner) Public(ignored struct{}, pub *[]byte) (err error) {
+	cert, err := x509.ParseCertificate(s.cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	*pub, err = x509.MarshalPKIXPublicKey(cert.PublicKey)
+	return err
+}
+
+// serveSocket starts a shared signer on a socket in a temporary directory
+// and returns the socket's path.
+func serveSocket(t *testing.T) string {
+	t.Helper()
+	data, err := os.ReadFile("testdata/testcert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("EnterpriseCertSigner", &socketSigner{cert}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ecp.sock")
+	l, err := transport.ListenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go transport.ServeListener(server, l)
+	return path
+}
+
+func TestClient_CredFromSocket(t *testing.T) {
+	path := serveSocket(t)
+	for i := 0; i < 2; i++ {
+		key, err := CredFromSocket(path)
+		if err != nil {
+			t.Fatalf("CredFromSocket: got %v, want nil err", err)
+		}
+		if key.Public() == nil || len(key.CertificateChain()) == 0 {
+			t.Error("CredFromSocket: got nil public key or certificate chain")
+		}
+		if err := key.Close(); err != nil {
+			t.Errorf("Close: got %v, want nil err", err)
+		}
+	}
+}
+
+func TestClient_Cred_Socket(t *testing.T) {
+	requireSigner(t)
+	write := func(config string) string {
+		path := filepath.Join(t.TempDir(), "certificate_config.json")
+		if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	key, err := Cred(write(`{"libs": {"ecp_socket": "` + serveSocket(t) + `"}}`))
+	if err != nil {
+		t.Fatalf("Cred with a running shared signer: got %v, want nil err", err)
+	}
+	if key.cmd != nil {
+		t.Error("Cred with a running shared signer: spawned a signer")
+	}
+	key.Close()
+
+	// Without a shared signer, Cred spawns one.
+	signer, err := filepath.Abs("testdata/signer.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.sock")
+	key, err = Cred(write(`{"libs": {"ecp": "` + signer + `", "ecp_socket": "` + missing + `"}}`))
+	if err != nil {
+		t.Fatalf("Cred without a shared signer: got %v, want nil err", err)
+	}
+	if key.cmd == nil {
+		t.Error("Cred without a shared signer: did not spawn a signer")
+	}
+	key.Close()
+}
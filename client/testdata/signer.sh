@@ -13,4 +13,4 @@
 # See the License for the specific language governing permissions and
 # limitations under the License.
 
-go run ../internal/signer/test/signer.go testdata/testcert.pem
\ No newline at end of file
+go run ../internal/signer/test/signer.go testdata/testcert.pem "${@:2}"
\ No newline at end of file
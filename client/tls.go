@@ -0,0 +1,78 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto"
+	"crypto/tls"
+)
+
+// TLSConfig returns a tls.Config for clients that presents k's certificate
+// when the server asks for one, so that adopting ECP in an HTTP client takes
+// only:
+//
+//	key, err := client.Cred("")
+//	// ...
+//	transport := &http.Transport{TLSClientConfig: key.TLSConfig()}
+//
+// The config requires TLS 1.2 or later and refuses renegotiation, under which
+// the signer could be asked to sign again mid-connection. Callers may adjust
+// the returned config, such as setting RootCAs, before first use.
+func (k *Key) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		Renegotiation:        tls.RenegotiateNever,
+		GetClientCertificate: k.GetClientCertificate,
+	}
+}
+
+// GetClientCertificate returns k's certificate, for use as the
+// GetClientCertificate callback of a tls.Config. Unlike a certificate placed
+// in tls.Config.Certificates, it reflects the capabilities of the current
+// signer, which may have been upgraded by a restart.
+func (k *Key) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert := k.TLSCertificate()
+	return &cert, nil
+}
+
+// signatureSchemes returns the TLS signature schemes whose hash the signer
+// accepts, or nil if it accepts every hash.
+func signatureSchemes(caps Capabilities) []tls.SignatureScheme {
+	if caps.Version == 0 {
+		return nil
+	}
+	var schemes []tls.SignatureScheme
+	for _, s := range []struct {
+		scheme tls.SignatureScheme
+		hash   crypto.Hash
+	}{
+		{tls.ECDSAWithP256AndSHA256, crypto.SHA256},
+		{tls.ECDSAWithP384AndSHA384, crypto.SHA384},
+		{tls.ECDSAWithP521AndSHA512, crypto.SHA512},
+		{tls.PSSWithSHA256, crypto.SHA256},
+		{tls.PSSWithSHA384, crypto.SHA384},
+		{tls.PSSWithSHA512, crypto.SHA512},
+		{tls.PKCS1WithSHA256, crypto.SHA256},
+		{tls.PKCS1WithSHA384, crypto.SHA384},
+		{tls.PKCS1WithSHA512, crypto.SHA512},
+		{tls.PKCS1WithSHA1, crypto.SHA1},
+		{tls.ECDSAWithSHA1, crypto.SHA1},
+		{tls.Ed25519, 0},
+	} {
+		if caps.supportsHash(s.hash) {
+			schemes = append(schemes, s.scheme)
+		}
+	}
+	return schemes
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestKey_TLSConfig(t *testing.T) {
+	k := localTestKey(t, newMemoryKey(t))
+	config := k.TLSConfig()
+	if got, want := config.MinVersion, uint16(tls.VersionTLS12); got != want {
+		t.Errorf("TLSConfig: got MinVersion %x, want %x", got, want)
+	}
+	if got, want := config.Renegotiation, tls.RenegotiateNever; got != want {
+		t.Errorf("TLSConfig: got Renegotiation %v, want %v", got, want)
+	}
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		serverConn, clientConn := net.Pipe()
+		server := tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{k.TLSCertificate()},
+			ClientAuth:   tls.RequireAnyClientCert,
+			MaxVersion:   version,
+		})
+		config := k.TLSConfig()
+		// The server presents the self-signed test certificate.
+		config.InsecureSkipVerify = true
+		client := tls.Client(clientConn, config)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- client.Handshake()
+		}()
+		if err := server.Handshake(); err != nil {
+			t.Fatalf("Handshake with TLS version %x: got %v, want nil err", version, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("Handshake with TLS version %x: client got %v, want nil err", version, err)
+		}
+		peer := server.ConnectionState().PeerCertificates
+		if len(peer) == 0 || !bytes.Equal(peer[0].Raw, k.CertificateChain()[0]) {
+			t.Errorf("Handshake with TLS version %x: server did not receive the client certificate", version)
+		}
+		// Close the pipe itself, since nothing reads the close_notify alerts
+		// that closing the TLS connections would send.
+		serverConn.Close()
+		clientConn.Close()
+	}
+}
+
+func TestSignatureSchemes(t *testing.T) {
+	if got := signatureSchemes(legacyCapabilities); got != nil {
+		t.Errorf("signatureSchemes(legacy): got %v, want nil", got)
+	}
+	caps := Capabilities{Version: signerAPIVersion, Hashes: []crypto.Hash{crypto.SHA256}}
+	want := []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256, tls.PKCS1WithSHA256, tls.Ed25519}
+	if got := signatureSchemes(caps); !reflect.DeepEqual(got, want) {
+		t.Errorf("signatureSchemes(SHA-256): got %v, want %v", got, want)
+	}
+}
@@ -15,10 +15,13 @@
 package util
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
 	"runtime"
@@ -30,11 +33,37 @@ const configFileName = "certificate_config.json"
 // EnterpriseCertificateConfig contains parameters for initializing signer.
 type EnterpriseCertificateConfig struct {
 	Libs Libs `json:"libs"`
+	// Profiles holds the named credentials of the config, which the signer
+	// reads.
+	Profiles map[string]json.RawMessage `json:"profiles"`
 }
 
 // Libs specifies the locations of helper libraries.
 type Libs struct {
 	ECP string `json:"ecp"`
+	// ECPSocket is the Unix domain socket of an already-running signer, which
+	// the client uses instead of spawning one.
+	ECPSocket string `json:"ecp_socket"`
+	// ECPSHA256 is the hex-encoded SHA-256 digest that the signer binary
+	// must have, so that a substituted binary is not run.
+	ECPSHA256 string `json:"ecp_sha256"`
+	// ECPCodeSignature requires the signer binary to carry a valid code
+	// signature: Authenticode on Windows, or one by an Apple-issued
+	// certificate, such as a Developer ID, on MacOS.
+	ECPCodeSignature bool `json:"ecp_code_signature"`
+	// ECPCodeSigner pins who must have signed the signer binary: the team
+	// identifier of the Developer ID certificate on MacOS, or the subject
+	// common name of the Authenticode signing certificate on Windows. It
+	// implies ECPCodeSignature.
+	ECPCodeSigner string `json:"ecp_code_signer"`
+}
+
+// SignerIntegrity describes the checks that the signer binary must pass
+// before it is run.
+type SignerIntegrity struct {
+	SHA256        []byte // The binary's expected SHA-256 digest, or nil.
+	CodeSignature bool   // Whether the binary must carry a valid code signature.
+	CodeSigner    string // Who must have signed the binary, or empty for anyone the platform trusts.
 }
 
 // ErrConfigUnavailable is a sentinel error that indicates ECP config is unavailable,
@@ -42,32 +71,158 @@ type Libs struct {
 var ErrConfigUnavailable = errors.New("Config is unavailable")
 
 // LoadSignerBinaryPath retrieves the path of the signer binary from the config file.
+// A bare file name, such as "ecp", is searched for in the directory of the
+// config file, then in PATH, then where the Google Cloud SDK installs the
+// signer.
 func LoadSignerBinaryPath(configFilePath string) (path string, err error) {
-	jsonFile, err := os.Open(configFilePath)
+	config, err := loadConfig(configFilePath)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return "", ErrConfigUnavailable
-		}
 		return "", err
 	}
+	if config.Libs.ECP == "" {
+		return "", ErrConfigUnavailable
+	}
+	path = expandHome(config.Libs.ECP)
+	if strings.ContainsRune(path, '/') || strings.ContainsRune(path, filepath.Separator) {
+		return path, nil
+	}
+	return findSigner(path, filepath.Dir(configFilePath))
+}
 
-	byteValue, err := io.ReadAll(jsonFile)
+// HasProfile reports whether the config file defines the named credential
+// profile.
+func HasProfile(configFilePath, profile string) (bool, error) {
+	config, err := loadConfig(configFilePath)
 	if err != nil {
-		return "", err
+		return false, err
 	}
-	var config EnterpriseCertificateConfig
-	err = json.Unmarshal(byteValue, &config)
+	_, ok := config.Profiles[profile]
+	return ok, nil
+}
+
+// LoadSignerIntegrity retrieves the checks that the signer binary must pass
+// from the config file.
+func LoadSignerIntegrity(configFilePath string) (SignerIntegrity, error) {
+	config, err := loadConfig(configFilePath)
+	if err != nil {
+		return SignerIntegrity{}, err
+	}
+	integrity := SignerIntegrity{
+		CodeSignature: config.Libs.ECPCodeSignature || config.Libs.ECPCodeSigner != "",
+		CodeSigner:    config.Libs.ECPCodeSigner,
+	}
+	if config.Libs.ECPSHA256 != "" {
+		integrity.SHA256, err = hex.DecodeString(config.Libs.ECPSHA256)
+		if err != nil || len(integrity.SHA256) != 32 {
+			return SignerIntegrity{}, fmt.Errorf("ecp_sha256 %q is not a hex-encoded SHA-256 digest", config.Libs.ECPSHA256)
+		}
+	}
+	return integrity, nil
+}
+
+// findSigner searches for the signer binary called name.
+func findSigner(name, configDir string) (string, error) {
+	if path, ok := executableIn(configDir, name); ok {
+		return path, nil
+	}
+	if path, err := exec.LookPath(name); err == nil {
+		return path, nil
+	}
+	for _, dir := range signerInstallDirs() {
+		if path, ok := executableIn(dir, name); ok {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("signer binary %q not found next to the config, in PATH or in the Google Cloud SDK: %w", name, exec.ErrNotFound)
+}
+
+// executableIn returns the path of the executable file called name in dir,
+// adding the .exe extension on Windows.
+func executableIn(dir, name string) (string, bool) {
+	names := []string{name}
+	if runtime.GOOS == "windows" && filepath.Ext(name) == "" {
+		names = append(names, name+".exe")
+	}
+	for _, n := range names {
+		path, err := filepath.Abs(filepath.Join(dir, n))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		return path, true
+	}
+	return "", false
+}
+
+// signerInstallDirs returns the directories where the Google Cloud SDK
+// installs the signer on this platform.
+func signerInstallDirs() []string {
+	const platformDir = "platform/enterprise_cert"
+	var sdks []string
+	switch runtime.GOOS {
+	case "windows":
+		for _, env := range []string{"LOCALAPPDATA", "ProgramFiles(x86)", "ProgramFiles"} {
+			if dir := os.Getenv(env); dir != "" {
+				sdks = append(sdks, filepath.Join(dir, "Google", "Cloud SDK", "google-cloud-sdk"))
+			}
+		}
+	case "darwin":
+		sdks = []string{
+			filepath.Join(guessHomeDir(), "google-cloud-sdk"),
+			"/opt/homebrew/share/google-cloud-sdk",
+			"/usr/local/share/google-cloud-sdk",
+		}
+	default:
+		sdks = []string{
+			filepath.Join(guessHomeDir(), "google-cloud-sdk"),
+			"/usr/lib/google-cloud-sdk",
+			"/snap/google-cloud-cli/current",
+		}
+	}
+	dirs := make([]string, len(sdks))
+	for i, sdk := range sdks {
+		dirs[i] = filepath.Join(sdk, filepath.FromSlash(platformDir))
+	}
+	return dirs
+}
+
+// LoadSignerSocketPath retrieves the path of a running signer's Unix domain
+// socket from the config file, or the empty string if the config names none.
+func LoadSignerSocketPath(configFilePath string) (path string, err error) {
+	config, err := loadConfig(configFilePath)
 	if err != nil {
 		return "", err
 	}
-	signerBinaryPath := config.Libs.ECP
-	if signerBinaryPath == "" {
-		return "", ErrConfigUnavailable
+	return expandHome(config.Libs.ECPSocket), nil
+}
+
+func loadConfig(configFilePath string) (config EnterpriseCertificateConfig, err error) {
+	jsonFile, err := os.Open(configFilePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return config, ErrConfigUnavailable
+		}
+		return config, err
 	}
+	defer jsonFile.Close()
+
+	byteValue, err := io.ReadAll(jsonFile)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(byteValue, &config)
+	return config, err
+}
 
-	signerBinaryPath = strings.ReplaceAll(signerBinaryPath, "~", guessHomeDir())
-	signerBinaryPath = strings.ReplaceAll(signerBinaryPath, "$HOME", guessHomeDir())
-	return signerBinaryPath, nil
+func expandHome(path string) string {
+	path = strings.ReplaceAll(path, "~", guessHomeDir())
+	return strings.ReplaceAll(path, "$HOME", guessHomeDir())
 }
 
 func guessHomeDir() string {
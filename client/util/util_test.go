@@ -14,7 +14,12 @@
 package util
 
 import (
+	"bytes"
+	"errors"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -51,6 +56,24 @@ func TestLoadSignerBinaryPathTilde(t *testing.T) {
 	}
 }
 
+func TestLoadSignerSocketPath(t *testing.T) {
+	path, err := LoadSignerSocketPath("./test_data/certificate_config_socket.json")
+	if err != nil {
+		t.Errorf("LoadSignerSocketPath error: %q", err)
+	}
+	want := guessHomeDir() + "/.config/gcloud/ecp.sock"
+	if path != want {
+		t.Errorf("Expected path is %q, got: %q", want, path)
+	}
+	path, err = LoadSignerSocketPath("./test_data/certificate_config.json")
+	if err != nil {
+		t.Errorf("LoadSignerSocketPath error: %q", err)
+	}
+	if path != "" {
+		t.Errorf("Expected no socket path, got: %q", path)
+	}
+}
+
 func TestGetConfigFilePathFromEnv(t *testing.T) {
 	want := "/testpath"
 	os.Setenv("GOOGLE_API_CERTIFICATE_CONFIG", want)
@@ -59,3 +82,104 @@ func TestGetConfigFilePathFromEnv(t *testing.T) {
 		t.Errorf("Expected path is %q, got: %q", want, path)
 	}
 }
+
+func TestLoadSignerBinaryPathSearch(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "certificate_config.json")
+	if err := os.WriteFile(config, []byte(`{"libs": {"ecp": "ecp"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", "")
+	t.Setenv("HOME", dir)
+	if _, err := LoadSignerBinaryPath(config); !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("LoadSignerBinaryPath without a signer: got %v, want exec.ErrNotFound", err)
+	}
+
+	// The Google Cloud SDK in the home directory.
+	sdk := filepath.Join(dir, "google-cloud-sdk", "platform", "enterprise_cert")
+	if err := os.MkdirAll(sdk, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sdk, "ecp"), nil, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path, err := LoadSignerBinaryPath(config)
+	if err != nil {
+		t.Fatalf("LoadSignerBinaryPath error: %q", err)
+	}
+	if want := filepath.Join(sdk, "ecp"); path != want {
+		t.Errorf("Expected path is %q, got: %q", want, path)
+	}
+
+	// The config directory is searched first.
+	if err := os.WriteFile(filepath.Join(dir, "ecp"), nil, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path, err = LoadSignerBinaryPath(config)
+	if err != nil {
+		t.Fatalf("LoadSignerBinaryPath error: %q", err)
+	}
+	if want := filepath.Join(dir, "ecp"); path != want {
+		t.Errorf("Expected path is %q, got: %q", want, path)
+	}
+}
+
+func TestLoadSignerIntegrity(t *testing.T) {
+	integrity, err := LoadSignerIntegrity("./test_data/certificate_config_integrity.json")
+	if err != nil {
+		t.Fatalf("LoadSignerIntegrity error: %q", err)
+	}
+	want := SignerIntegrity{
+		SHA256:        bytes.Repeat([]byte{0xab}, 32),
+		CodeSignature: true,
+		CodeSigner:    "ABCDE12345",
+	}
+	if !reflect.DeepEqual(integrity, want) {
+		t.Errorf("Expected integrity is %+v, got: %+v", want, integrity)
+	}
+	integrity, err = LoadSignerIntegrity("./test_data/certificate_config.json")
+	if err != nil {
+		t.Fatalf("LoadSignerIntegrity error: %q", err)
+	}
+	if !reflect.DeepEqual(integrity, SignerIntegrity{}) {
+		t.Errorf("Expected no integrity checks, got: %+v", integrity)
+	}
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "certificate_config.json")
+	if err := os.WriteFile(config, []byte(`{"libs": {"ecp": "ecp", "ecp_sha256": "abcd"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSignerIntegrity(config); err == nil {
+		t.Error("LoadSignerIntegrity with a short digest: got nil err, want error")
+	}
+
+	// Naming the code signer implies checking the code signature.
+	if err := os.WriteFile(config, []byte(`{"libs": {"ecp": "ecp", "ecp_code_signer": "ABCDE12345"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	integrity, err = LoadSignerIntegrity(config)
+	if err != nil {
+		t.Fatalf("LoadSignerIntegrity error: %q", err)
+	}
+	if want := (SignerIntegrity{CodeSignature: true, CodeSigner: "ABCDE12345"}); !reflect.DeepEqual(integrity, want) {
+		t.Errorf("Expected integrity is %+v, got: %+v", want, integrity)
+	}
+}
+
+func TestHasProfile(t *testing.T) {
+	ok, err := HasProfile("./test_data/certificate_config_profiles.json", "backend")
+	if err != nil {
+		t.Fatalf("HasProfile error: %q", err)
+	}
+	if !ok {
+		t.Error("Expected profile backend to be defined")
+	}
+	ok, err = HasProfile("./test_data/certificate_config_profiles.json", "frontend")
+	if err != nil {
+		t.Fatalf("HasProfile error: %q", err)
+	}
+	if ok {
+		t.Error("Expected profile frontend not to be defined")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/googleapis/enterprise-certificate-proxy/client/util"
+)
+
+// ErrSignerIntegrity is wrapped by the errors of Cred when the signer binary
+// fails the checks that the config requires, such as a SHA-256 digest.
+var ErrSignerIntegrity = errors.New("signer binary failed verification")
+
+// verifySigner checks the signer binary at path as integrity requires. It is
+// called before every start of the signer, so that a binary substituted
+// while a Key is in use is not run when the signer restarts.
+//
+// The checks apply to a copy of the binary in a new private directory, dir,
+// and the copy at run is what the caller must run, so that a binary
+// substituted between the checks and the start of the signer is not run
+// either. The caller removes dir with removeSignerCopy once the signer has
+// exited. Without checks, run is path and dir is empty.
+func verifySigner(path string, integrity util.SignerIntegrity) (run, dir string, err error) {
+	if integrity.SHA256 == nil && !integrity.CodeSignature {
+		return path, "", nil
+	}
+	dir, err = os.MkdirTemp("", "ecp-signer-")
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrSignerIntegrity, err)
+	}
+	run = filepath.Join(dir, filepath.Base(path))
+	if err := copySigner(run, path, integrity); err != nil {
+		removeSignerCopy(dir)
+		return "", "", fmt.Errorf("%w: %v", ErrSignerIntegrity, err)
+	}
+	return run, dir, nil
+}
+
+// copySigner copies the signer binary at path to the new file dst and checks
+// the copy as integrity requires.
+func copySigner(dst, path string, integrity util.SignerIntegrity) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0700)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if integrity.SHA256 != nil {
+		if got := h.Sum(nil); !bytes.Equal(got, integrity.SHA256) {
+			return fmt.Errorf("%s has SHA-256 digest %x, want %x", path, got, integrity.SHA256)
+		}
+	}
+	if integrity.CodeSignature {
+		if err := verifyCodeSignature(dst, integrity.CodeSigner); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// removeSignerCopy removes the directory holding a verified copy of the
+// signer binary, if any.
+func removeSignerCopy(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		logger().Warn("failed to remove signer copy", "dir", dir, "error", err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// codesignPath is the code signing tool shipped with macOS.
+const codesignPath = "/usr/bin/codesign"
+
+// codeRequirement accepts code signed with a certificate issued by Apple,
+// such as a Developer ID certificate, and rejects ad hoc signatures.
+const codeRequirement = "anchor apple generic"
+
+// teamID matches a team identifier, such as the organizational unit of a
+// Developer ID certificate.
+var teamID = regexp.MustCompile(`^[A-Z0-9]{10}$`)
+
+// verifyCodeSignature checks that the file at path carries a valid code
+// signature satisfying codeRequirement and, unless it is empty, made with a
+// certificate of the team identified by signer.
+func verifyCodeSignature(path, signer string) error {
+	requirement := codeRequirement
+	if signer != "" {
+		// The team identifier is checked so that it cannot change the
+		// meaning of the requirement.
+		if !teamID.MatchString(signer) {
+			return fmt.Errorf("%q is not a team identifier", signer)
+		}
+		requirement += ` and certificate leaf[subject.OU] = "` + signer + `"`
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(codesignPath, "--verify", "--strict", "-R="+requirement, path)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
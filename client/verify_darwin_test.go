@@ -0,0 +1,34 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyCodeSignature_Signer(t *testing.T) {
+	// A team identifier cannot extend the code requirement.
+	err := verifyCodeSignature("/usr/bin/true", `ABCDE12345" or anchor trusted or "`)
+	if err == nil || !strings.Contains(err.Error(), "not a team identifier") {
+		t.Errorf("verifyCodeSignature with an invalid team identifier: got %v, want error", err)
+	}
+	// Apple's own binaries are not signed by a Developer ID team.
+	if err := verifyCodeSignature("/usr/bin/true", "ABCDE12345"); err == nil {
+		t.Error("verifyCodeSignature with another team: got nil err, want error")
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package client
+
+import "errors"
+
+// verifyCodeSignature fails, since Linux binaries carry no code signature
+// that the platform verifies. Use a SHA-256 digest instead.
+func verifyCodeSignature(string, string) error {
+	return errors.New("code signatures can only be verified on Windows and MacOS")
+}
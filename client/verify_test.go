@@ -0,0 +1,67 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/googleapis/enterprise-certificate-proxy/client/util"
+)
+
+func TestVerifySigner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ecp")
+	data := []byte("signer binary")
+	if err := os.WriteFile(path, data, 0700); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+
+	run, dir, err := verifySigner(path, util.SignerIntegrity{})
+	if err != nil || run != path || dir != "" {
+		t.Errorf("verifySigner without checks: got (%q, %q, %v), want (%q, \"\", nil)", run, dir, err, path)
+	}
+
+	run, dir, err = verifySigner(path, util.SignerIntegrity{SHA256: digest[:]})
+	if err != nil {
+		t.Fatalf("verifySigner: got %v, want nil err", err)
+	}
+	if filepath.Dir(run) != dir || filepath.Base(run) != "ecp" {
+		t.Errorf("verifySigner: got copy %s, want ecp in %s", run, dir)
+	}
+	if info, err := os.Stat(dir); err != nil || runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		t.Errorf("verifySigner: got copy directory %v, %v, want one private to the user", info, err)
+	}
+	// Replacing the binary after the checks leaves the copy that is run alone.
+	if err := os.WriteFile(path, []byte("substituted binary"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(run); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("verifySigner: got copy %q, %v, want %q", got, err, data)
+	}
+	removeSignerCopy(dir)
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("removeSignerCopy: stat: got %v, want %v", err, os.ErrNotExist)
+	}
+
+	run, dir, err = verifySigner(path, util.SignerIntegrity{SHA256: digest[:]})
+	if !errors.Is(err, ErrSignerIntegrity) || run != "" || dir != "" {
+		t.Errorf("verifySigner with a substituted binary: got (%q, %q, %v), want %v err", run, dir, err, ErrSignerIntegrity)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package client
+
+import (
+	"crypto/x509"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	crypt32          = windows.NewLazySystemDLL("crypt32.dll")
+	cryptMsgGetParam = crypt32.NewProc("CryptMsgGetParam")
+	cryptMsgClose    = crypt32.NewProc("CryptMsgClose")
+)
+
+// cmsgSignerCertInfoParam is CMSG_SIGNER_CERT_INFO_PARAM, which selects the
+// issuer and serial number of a signer of a message.
+const cmsgSignerCertInfoParam = 7
+
+// verifyCodeSignature checks that the file at path carries a valid
+// Authenticode signature chaining to a trusted root, without showing any UI,
+// and, unless signer is empty, that the subject common name of the signing
+// certificate is signer.
+func verifyCodeSignature(path, signer string) error {
+	if err := verifyAuthenticode(path); err != nil {
+		return err
+	}
+	if signer == "" {
+		return nil
+	}
+	name, err := authenticodeSigner(path)
+	if err != nil {
+		return fmt.Errorf("reading the Authenticode signer: %v", err)
+	}
+	if name != signer {
+		return fmt.Errorf("signed by %q, want %q", name, signer)
+	}
+	return nil
+}
+
+// verifyAuthenticode checks that the file at path carries a valid
+// Authenticode signature chaining to a trusted root.
+func verifyAuthenticode(path string) error {
+	path16, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	data := &windows.WinTrustData{
+		Size:             uint32(unsafe.Sizeof(windows.WinTrustData{})),
+		UIChoice:         windows.WTD_UI_NONE,
+		RevocationChecks: windows.WTD_REVOKE_NONE,
+		UnionChoice:      windows.WTD_CHOICE_FILE,
+		StateAction:      windows.WTD_STATEACTION_VERIFY,
+		FileOrCatalogOrBlobOrSgnrOrCert: unsafe.Pointer(&windows.WinTrustFileInfo{
+			Size:     uint32(unsafe.Sizeof(windows.WinTrustFileInfo{})),
+			FilePath: path16,
+		}),
+	}
+	verifyErr := windows.WinVerifyTrustEx(windows.InvalidHWND, &windows.WINTRUST_ACTION_GENERIC_VERIFY_V2, data)
+	// Free the state that verification allocated.
+	data.StateAction = windows.WTD_STATEACTION_CLOSE
+	_ = windows.WinVerifyTrustEx(windows.InvalidHWND, &windows.WINTRUST_ACTION_GENERIC_VERIFY_V2, data)
+	return verifyErr
+}
+
+// authenticodeSigner returns the subject common name of the certificate that
+// made the Authenticode signature embedded in the file at path.
+func authenticodeSigner(path string) (string, error) {
+	path16, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	var encoding, contentType, formatType uint32
+	var store, msg windows.Handle
+	if err := windows.CryptQueryObject(
+		windows.CERT_QUERY_OBJECT_FILE,
+		unsafe.Pointer(path16),
+		windows.CERT_QUERY_CONTENT_FLAG_PKCS7_SIGNED_EMBED,
+		windows.CERT_QUERY_FORMAT_FLAG_BINARY,
+		0,
+		&encoding,
+		&contentType,
+		&formatType,
+		&store,
+		&msg,
+		nil,
+	); err != nil {
+		return "", err
+	}
+	defer windows.CertCloseStore(store, 0)
+	defer cryptMsgClose.Call(uintptr(msg))
+
+	// The signer is identified by the issuer and serial number of its
+	// certificate, which the signature carries along with its chain.
+	var size uint32
+	if r, _, err := cryptMsgGetParam.Call(uintptr(msg), cmsgSignerCertInfoParam, 0, 0, uintptr(unsafe.Pointer(&size))); r == 0 {
+		return "", err
+	}
+	info := make([]byte, size)
+	if r, _, err := cryptMsgGetParam.Call(uintptr(msg), cmsgSignerCertInfoParam, 0, uintptr(unsafe.Pointer(&info[0])), uintptr(unsafe.Pointer(&size))); r == 0 {
+		return "", err
+	}
+	cert, err := windows.CertFindCertificateInStore(store, windows.X509_ASN_ENCODING|windows.PKCS_7_ASN_ENCODING, 0, windows.CERT_FIND_SUBJECT_CERT, unsafe.Pointer(&info[0]), nil)
+	if err != nil {
+		return "", err
+	}
+	defer windows.CertFreeCertificateContext(cert)
+	parsed, err := x509.ParseCertificate(unsafe.Slice(cert.EncodedCert, cert.Length))
+	if err != nil {
+		return "", err
+	}
+	return parsed.Subject.CommonName, nil
+}
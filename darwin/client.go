@@ -11,8 +11,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build darwin && cgo
-// +build darwin,cgo
+//go:build darwin
+// +build darwin
 
 // Package darwin contains a darwin-specific client for accessing the keychain APIs directly,
 // bypassing the RPC mechanism of the universal client.
@@ -20,12 +20,15 @@ package darwin
 
 import (
 	"crypto"
+	"crypto/x509"
 	"io"
+	"time"
 
 	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/darwin/keychain"
 )
 
 // SecureKey is a public wrapper for the internal keychain implementation.
+// It is safe for concurrent use; operations on smart card keys are serialized.
 type SecureKey struct {
 	key *keychain.Key
 }
@@ -45,12 +48,36 @@ func (sk *SecureKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) (s
 	return sk.key.Sign(nil, digest, opts)
 }
 
+// SignMessage signs a whole message, letting the key hash it. Use it for
+// smart card keys whose Sign fails because they cannot sign digests.
+func (sk *SecureKey) SignMessage(message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return sk.key.SignMessage(message, opts)
+}
+
+// Verify checks that sig is a valid signature of digest by the key, so that
+// health checks can confirm a signing round trip with the Security framework.
+func (sk *SecureKey) Verify(digest, sig []byte, opts crypto.SignerOpts) error {
+	return sk.key.Verify(digest, sig, opts)
+}
+
 func (sk *SecureKey) Encrypt(plaintext []byte) ([]byte, error) {
-	return sk.key.Encrypt(plaintext)
+	return sk.key.Encrypt(plaintext, nil)
 }
 
 func (sk *SecureKey) Decrypt(ciphertext []byte) ([]byte, error) {
-	return sk.key.Decrypt(ciphertext)
+	return sk.key.Decrypt(nil, ciphertext, nil)
+}
+
+// Attributes describes the private key, such as its size and whether it is
+// held by the Secure Enclave or a smart card.
+func (sk *SecureKey) Attributes() (KeyAttributes, error) {
+	return sk.key.Attributes()
+}
+
+// CertificateRequest returns a DER-encoded PKCS #10 certificate signing
+// request based on template and signed by the key.
+func (sk *SecureKey) CertificateRequest(template *x509.CertificateRequest) ([]byte, error) {
+	return sk.key.CertificateRequest(template)
 }
 
 // Close frees up resources associated with the underlying key.
@@ -68,3 +95,69 @@ func NewSecureKey(issuerCN string) (*SecureKey, error) {
 	}
 	return &SecureKey{key: k}, nil
 }
+
+// CredentialInfo describes a signing-capable identity in the MacOS Keychain.
+type CredentialInfo = keychain.CredentialInfo
+
+// KeyAttributes describes a private key in the MacOS Keychain.
+type KeyAttributes = keychain.KeyAttributes
+
+// ListCredentials describes every signing-capable identity that NewSecureKey
+// and the signer can select from, without prompting the user.
+func ListCredentials() ([]CredentialInfo, error) {
+	return keychain.ListCredentials()
+}
+
+// KeyGenOptions describe a private key to generate with GenerateKey.
+type KeyGenOptions = keychain.KeyGenOptions
+
+// GenerateKey generates a private key in the MacOS Keychain, optionally in the
+// Secure Enclave, so that enrollment tooling can request a certificate for it
+// with CertificateRequest.
+func GenerateKey(opts KeyGenOptions) (*SecureKey, error) {
+	k, err := keychain.GenerateKey(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureKey{key: k}, nil
+}
+
+// ImportOptions describe where and how ImportIdentity installs an identity.
+type ImportOptions = keychain.ImportOptions
+
+// ImportIdentity installs the identity in a PKCS #12 bundle into the MacOS
+// Keychain, so that NewSecureKey and the signer can select it right away.
+func ImportIdentity(data []byte, opts ImportOptions) (CredentialInfo, error) {
+	return keychain.ImportIdentity(data, opts)
+}
+
+// SecureKeyWatcher keeps a SecureKey current as its certificate is renewed.
+type SecureKeyWatcher struct {
+	w *keychain.Watcher
+}
+
+// WatchSecureKey is like NewSecureKey, but checks every interval whether a
+// renewed certificate from the issuer has been installed, and if so calls
+// onChange with a SecureKey for it, so that TLS configs can rotate without a
+// restart. A zero interval checks once a minute.
+func WatchSecureKey(issuerCN string, interval time.Duration, onChange func(*SecureKey)) (*SecureKeyWatcher, error) {
+	var notify func(*keychain.Key)
+	if onChange != nil {
+		notify = func(k *keychain.Key) { onChange(&SecureKey{key: k}) }
+	}
+	w, err := keychain.Watch(keychain.Options{IssuerCN: issuerCN}, interval, notify)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureKeyWatcher{w: w}, nil
+}
+
+// SecureKey returns the SecureKey for the currently installed certificate.
+func (sw *SecureKeyWatcher) SecureKey() *SecureKey {
+	return &SecureKey{key: sw.w.Key()}
+}
+
+// Close stops watching for renewals.
+func (sw *SecureKeyWatcher) Close() error {
+	return sw.w.Close()
+}
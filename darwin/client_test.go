@@ -16,14 +16,12 @@ package darwin
 import (
 	"bytes"
 	"testing"
-
-	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/darwin/keychain"
 )
 
 const TEST_CREDENTIALS = "TestIssuer"
 
 func TestClient_Encrypt(t *testing.T) {
-	secureKey, err := keychain.Cred(TEST_CREDENTIALS)
+	secureKey, err := NewSecureKey(TEST_CREDENTIALS)
 	if err != nil {
 		t.Errorf("Cred: got %v, want nil err", err)
 		return
@@ -37,7 +35,7 @@ func TestClient_Encrypt(t *testing.T) {
 }
 
 func TestClient_Decrypt(t *testing.T) {
-	secureKey, err := keychain.Cred(TEST_CREDENTIALS)
+	secureKey, err := NewSecureKey(TEST_CREDENTIALS)
 	if err != nil {
 		t.Errorf("Cred: got %v, want nil err", err)
 		return
@@ -6,4 +6,13 @@ require (
 	github.com/google/go-pkcs11 v0.2.0
 	golang.org/x/crypto v0.10.0
 	golang.org/x/sys v0.9.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
 )
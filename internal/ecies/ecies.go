@@ -0,0 +1,156 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ecies implements the elliptic curve integrated encryption scheme
+// that Apple's Security framework calls
+// kSecKeyAlgorithmECIESEncryptionCofactorVariableIVX963SHA256AESGCM, so that
+// EC credentials on every platform encrypt and decrypt payloads alike.
+//
+// A ciphertext is the sender's ephemeral public key, as an uncompressed point,
+// followed by the AES-GCM encryption of the plaintext and its 16-byte tag. The
+// AES key and the 16-byte GCM nonce are derived from the ECDH shared secret
+// with the ANSI X9.63 KDF and SHA-256, using the ephemeral public key as the
+// shared info. The AES key is 128 bits long for P-256 and 256 bits long for
+// larger curves.
+package ecies
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+const (
+	nonceSize = 16
+	tagSize   = 16
+)
+
+// Encrypt encrypts plaintext for the holder of the private key of pub.
+func Encrypt(rand io.Reader, pub *ecdsa.PublicKey, plaintext []byte) ([]byte, error) {
+	if err := checkCurve(pub.Curve); err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdsa.GenerateKey(pub.Curve, rand)
+	if err != nil {
+		return nil, err
+	}
+	x, _ := pub.Curve.ScalarMult(pub.X, pub.Y, ephemeral.D.Bytes())
+	ephemeralPoint := elliptic.Marshal(pub.Curve, ephemeral.X, ephemeral.Y)
+	aead, nonce, err := deriveAEAD(pub.Curve, secretBytes(pub.Curve, x), ephemeralPoint)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(ephemeralPoint, nonce, plaintext, nil), nil
+}
+
+// Decrypt decrypts a ciphertext that Encrypt produced for pub. agree
+// performs ECDH between the private key of pub and a peer public key, and
+// returns the shared secret, the big-endian x-coordinate of the shared point,
+// such as a keystore computes it without revealing the private key.
+func Decrypt(pub *ecdsa.PublicKey, ciphertext []byte, agree func(peer *ecdsa.PublicKey) ([]byte, error)) ([]byte, error) {
+	if err := checkCurve(pub.Curve); err != nil {
+		return nil, err
+	}
+	pointSize := 1 + 2*byteSize(pub.Curve)
+	if len(ciphertext) < pointSize+tagSize {
+		return nil, errors.New("ecies: ciphertext too short")
+	}
+	ephemeralPoint := ciphertext[:pointSize]
+	x, y := elliptic.Unmarshal(pub.Curve, ephemeralPoint)
+	if x == nil {
+		return nil, errors.New("ecies: invalid ephemeral public key")
+	}
+	secret, err := agree(&ecdsa.PublicKey{Curve: pub.Curve, X: x, Y: y})
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) != byteSize(pub.Curve) {
+		return nil, fmt.Errorf("ecies: shared secret of length %d, want %d", len(secret), byteSize(pub.Curve))
+	}
+	aead, nonce, err := deriveAEAD(pub.Curve, secret, ephemeralPoint)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext[pointSize:], nil)
+	if err != nil {
+		return nil, errors.New("ecies: decryption failed")
+	}
+	return plaintext, nil
+}
+
+// SharedSecret performs ECDH in Go between priv and peer, for credentials
+// whose private key is in memory.
+func SharedSecret(priv *ecdsa.PrivateKey, peer *ecdsa.PublicKey) ([]byte, error) {
+	if peer.Curve != priv.Curve || !peer.Curve.IsOnCurve(peer.X, peer.Y) {
+		return nil, errors.New("ecies: peer public key is not on the key's curve")
+	}
+	x, _ := priv.Curve.ScalarMult(peer.X, peer.Y, priv.D.Bytes())
+	return secretBytes(priv.Curve, x), nil
+}
+
+func checkCurve(curve elliptic.Curve) error {
+	switch curve {
+	case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		return nil
+	default:
+		return fmt.Errorf("ecies: unsupported curve %s", curve.Params().Name)
+	}
+}
+
+func byteSize(curve elliptic.Curve) int {
+	return (curve.Params().BitSize + 7) / 8
+}
+
+func secretBytes(curve elliptic.Curve, x *big.Int) []byte {
+	return x.FillBytes(make([]byte, byteSize(curve)))
+}
+
+// deriveAEAD derives the AES-GCM key and nonce from the shared secret.
+func deriveAEAD(curve elliptic.Curve, secret, sharedInfo []byte) (cipher.AEAD, []byte, error) {
+	keySize := 32
+	if curve == elliptic.P256() {
+		keySize = 16
+	}
+	material := x963KDF(secret, sharedInfo, keySize+nonceSize)
+	block, err := aes.NewCipher(material[:keySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCMWithNonceSize(block, nonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, material[keySize:], nil
+}
+
+// x963KDF is the ANSI X9.63 key derivation function with SHA-256.
+func x963KDF(secret, sharedInfo []byte, size int) []byte {
+	var out []byte
+	var counter [4]byte
+	for i := uint32(1); len(out) < size; i++ {
+		binary.BigEndian.PutUint32(counter[:], i)
+		h := sha256.New()
+		h.Write(secret)
+		h.Write(counter[:])
+		h.Write(sharedInfo)
+		out = h.Sum(out)
+	}
+	return out[:size]
+}
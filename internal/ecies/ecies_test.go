@@ -0,0 +1,67 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ecies
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agree := func(peer *ecdsa.PublicKey) ([]byte, error) {
+			return SharedSecret(priv, peer)
+		}
+		plaintext := []byte("enterprise certificate proxy")
+		ciphertext, err := Encrypt(rand.Reader, &priv.PublicKey, plaintext)
+		if err != nil {
+			t.Fatalf("Encrypt(%s): %v", curve.Params().Name, err)
+		}
+		if want := 1 + 2*byteSize(curve) + len(plaintext) + tagSize; len(ciphertext) != want {
+			t.Errorf("Encrypt(%s): got ciphertext of length %d, want %d", curve.Params().Name, len(ciphertext), want)
+		}
+		got, err := Decrypt(&priv.PublicKey, ciphertext, agree)
+		if err != nil {
+			t.Fatalf("Decrypt(%s): %v", curve.Params().Name, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("Decrypt(%s): got %q, want %q", curve.Params().Name, got, plaintext)
+		}
+
+		ciphertext[len(ciphertext)-1] ^= 1
+		if _, err := Decrypt(&priv.PublicKey, ciphertext, agree); err == nil {
+			t.Errorf("Decrypt(%s) of a tampered ciphertext: got nil error, want error", curve.Params().Name)
+		}
+		if _, err := Decrypt(&priv.PublicKey, ciphertext[:10], agree); err == nil {
+			t.Errorf("Decrypt(%s) of a short ciphertext: got nil error, want error", curve.Params().Name)
+		}
+	}
+}
+
+func TestX963KDF(t *testing.T) {
+	// From the NIST CAVS ANSI X9.63 KDF test vectors for SHA-256.
+	secret, _ := hex.DecodeString("96c05619d56c328ab95fe84b18264b08725b85e33fd34f08")
+	want, _ := hex.DecodeString("443024c3dae66b95e6f5670601558f71")
+	if got := x963KDF(secret, nil, 16); !bytes.Equal(got, want) {
+		t.Errorf("x963KDF: got %x, want %x", got, want)
+	}
+}
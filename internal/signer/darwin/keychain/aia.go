@@ -0,0 +1,135 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// aiaFetchTimeout bounds each download of an issuing certificate.
+	aiaFetchTimeout = 5 * time.Second
+	// maxAIAFetches bounds how many issuers are appended to a chain.
+	maxAIAFetches = 4
+	// maxAIACertSize bounds the size of a downloaded certificate.
+	maxAIACertSize = 1 << 20
+)
+
+var (
+	aiaClient = &http.Client{Timeout: aiaFetchTimeout}
+
+	aiaCacheMu sync.Mutex
+	aiaCache   = make(map[string]*x509.Certificate) // Issuing certificates by URL.
+)
+
+// completeChain appends issuing certificates downloaded from the Authority
+// Information Access URLs of the last certificate in chain, until the chain
+// ends in a self-signed certificate or no issuer can be downloaded.
+func completeChain(chain []*x509.Certificate) []*x509.Certificate {
+	for i := 0; i < maxAIAFetches; i++ {
+		last := chain[len(chain)-1]
+		if isSelfSigned(last) {
+			break
+		}
+		issuer := fetchIssuer(last)
+		if issuer == nil {
+			break
+		}
+		chain = append(chain, issuer)
+	}
+	return chain
+}
+
+// withoutRoot returns chain without its final certificate if that is a
+// self-signed root. A self-signed leaf is kept.
+func withoutRoot(chain []*x509.Certificate) []*x509.Certificate {
+	if len(chain) > 1 && isSelfSigned(chain[len(chain)-1]) {
+		return chain[:len(chain)-1]
+	}
+	return chain
+}
+
+// isSelfSigned reports whether xc is a root certificate.
+func isSelfSigned(xc *x509.Certificate) bool {
+	return bytes.Equal(xc.RawIssuer, xc.RawSubject) && xc.CheckSignatureFrom(xc) == nil
+}
+
+// fetchIssuer downloads the certificate that issued xc, or returns nil if none
+// of its Authority Information Access URLs yields a valid issuer.
+func fetchIssuer(xc *x509.Certificate) *x509.Certificate {
+	for _, url := range xc.IssuingCertificateURL {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			continue
+		}
+		issuer, err := fetchCertificate(url)
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(xc.RawIssuer, issuer.RawSubject) || xc.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		if n := time.Now(); n.Before(issuer.NotBefore) || n.After(issuer.NotAfter) {
+			continue
+		}
+		return issuer
+	}
+	return nil
+}
+
+// fetchCertificate downloads a DER or PEM encoded certificate from url. Results
+// are cached for the lifetime of the process.
+func fetchCertificate(url string) (*x509.Certificate, error) {
+	aiaCacheMu.Lock()
+	xc, ok := aiaCache[url]
+	aiaCacheMu.Unlock()
+	if ok {
+		return xc, nil
+	}
+
+	resp, err := aiaClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAIACertSize))
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil && block.Type == "CERTIFICATE" {
+		data = block.Bytes
+	}
+	xc, err = x509.ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate from %s: %w", url, err)
+	}
+
+	aiaCacheMu.Lock()
+	aiaCache[url] = xc
+	aiaCacheMu.Unlock()
+	return xc, nil
+}
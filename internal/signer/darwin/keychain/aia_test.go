@@ -0,0 +1,116 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// issueTestCert returns a certificate for template signed by parent and
+// parentKey, or a self-signed certificate if parent is nil.
+func issueTestCert(t *testing.T, template, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, priv
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &priv.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xc, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return xc, priv
+}
+
+func TestCompleteChain(t *testing.T) {
+	var fetches int
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ca := &x509.Certificate{Subject: pkix.Name{CommonName: "Root CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	root, rootKey := issueTestCert(t, ca, nil, nil)
+	intermediate, intermediateKey := issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Issuing CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		IssuingCertificateURL: []string{srv.URL + "/root.cer"},
+	}, root, rootKey)
+	leaf, _ := issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "device-1234"},
+		IssuingCertificateURL: []string{"ldap://ldap.example.com/ca", srv.URL + "/missing.cer", srv.URL + "/issuing.cer"},
+	}, intermediate, intermediateKey)
+
+	mux.HandleFunc("/issuing.cer", func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(intermediate.Raw)
+	})
+	mux.HandleFunc("/root.cer", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(root.Raw)
+	})
+
+	for i := 0; i < 2; i++ {
+		chain := completeChain([]*x509.Certificate{leaf})
+		if len(chain) != 3 || !chain[1].Equal(intermediate) || !chain[2].Equal(root) {
+			t.Fatalf("completeChain: got %d certificates, want leaf, intermediate and root", len(chain))
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("completeChain: fetched the issuing certificate %d times, want 1", fetches)
+	}
+
+	// A complete chain is left alone.
+	if chain := completeChain([]*x509.Certificate{root}); len(chain) != 1 {
+		t.Errorf("completeChain(root): got %d certificates, want 1", len(chain))
+	}
+}
+
+func TestWithoutRoot(t *testing.T) {
+	ca := &x509.Certificate{Subject: pkix.Name{CommonName: "Root CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	root, rootKey := issueTestCert(t, ca, nil, nil)
+	leaf, _ := issueTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "device-1234"}}, root, rootKey)
+
+	if chain := withoutRoot([]*x509.Certificate{leaf, root}); len(chain) != 1 || !chain[0].Equal(leaf) {
+		t.Errorf("withoutRoot(leaf, root): got %d certificates, want the leaf", len(chain))
+	}
+	if chain := withoutRoot([]*x509.Certificate{leaf}); len(chain) != 1 {
+		t.Errorf("withoutRoot(leaf): got %d certificates, want 1", len(chain))
+	}
+	if chain := withoutRoot([]*x509.Certificate{root}); len(chain) != 1 {
+		t.Errorf("withoutRoot(root): got %d certificates, want the self-signed leaf kept", len(chain))
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin && cgo
+// +build darwin,cgo
+
+package keychain
+
+/*
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+
+// keychainGeneration counts keychain change events seen by this process.
+static volatile int64_t keychainGeneration;
+
+static OSStatus keychainChanged(SecKeychainEvent event, SecKeychainCallbackInfo *info, void *context) {
+	__sync_fetch_and_add(&keychainGeneration, 1);
+	return errSecSuccess;
+}
+
+static int64_t currentKeychainGeneration() {
+	return __sync_fetch_and_add(&keychainGeneration, 0);
+}
+
+// watchKeychain registers for item and search list changes in the file-based
+// keychains. Events are delivered on the run loop of the calling thread.
+static OSStatus watchKeychain() {
+	SecKeychainEventMask mask = kSecAddEventMask | kSecDeleteEventMask | kSecUpdateEventMask |
+		kSecDefaultChangedEventMask | kSecKeychainListChangedMask;
+	return SecKeychainAddCallback(keychainChanged, mask, NULL);
+}
+*/
+import "C"
+
+import (
+	"crypto/x509"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// identityCacheTTL bounds how long a cached lookup is used. Changes to the
+// data protection keychain are not reported by keychain events, so entries
+// also expire on their own.
+const identityCacheTTL = 5 * time.Minute
+
+// cachedLookup is the result of a previous findIdentity call.
+type cachedLookup struct {
+	persistentRef []byte // Persistent reference to the selected identity.
+	certs         []*x509.Certificate
+	generation    C.int64_t
+	expiry        time.Time
+}
+
+var (
+	identityCacheMu sync.Mutex
+	identityCache   = make(map[string]cachedLookup)
+
+	watchOnce sync.Once
+	watching  bool // Whether keychain change events are delivered.
+)
+
+// startKeychainWatch starts delivering keychain change events to a run loop on
+// a dedicated thread. It reports whether events will be delivered.
+func startKeychainWatch() bool {
+	watchOnce.Do(func() {
+		started := make(chan bool)
+		go func() {
+			runtime.LockOSThread()
+			if C.watchKeychain() != C.errSecSuccess {
+				started <- false
+				return
+			}
+			started <- true
+			for {
+				if C.CFRunLoopRunInMode(C.kCFRunLoopDefaultMode, 3600, 0) == C.kCFRunLoopRunFinished {
+					// The run loop has no sources yet; avoid spinning.
+					time.Sleep(time.Second)
+				}
+			}
+		}()
+		watching = <-started
+	})
+	return watching
+}
+
+// cacheKey identifies the lookups that opts selects.
+func cacheKey(opts Options) string {
+	return fmt.Sprintf("%#v", opts)
+}
+
+// cachedIdentity returns the identity and chain found by an earlier lookup with
+// the same opts, if the keychains have not changed since. The identity is
+// looked up again with authContext so that it authorizes the new Key. The
+// caller owns the returned identity.
+func cachedIdentity(opts Options, authContext C.CFTypeRef) (C.SecIdentityRef, []*x509.Certificate, bool) {
+	if !startKeychainWatch() {
+		return 0, nil, false
+	}
+	key := cacheKey(opts)
+	identityCacheMu.Lock()
+	entry, ok := identityCache[key]
+	if ok && (entry.generation != C.currentKeychainGeneration() || time.Now().After(entry.expiry)) {
+		delete(identityCache, key)
+		ok = false
+	}
+	identityCacheMu.Unlock()
+	if !ok {
+		return 0, nil, false
+	}
+	ident, err := identityFromPersistentRef(entry.persistentRef, authContext, opts.NonInteractive)
+	if err != nil {
+		identityCacheMu.Lock()
+		delete(identityCache, key)
+		identityCacheMu.Unlock()
+		return 0, nil, false
+	}
+	return ident, entry.certs, true
+}
+
+// cacheIdentity remembers the identity and chain selected for opts.
+func cacheIdentity(opts Options, ident C.SecIdentityRef, certs []*x509.Certificate) {
+	if !startKeychainWatch() {
+		return
+	}
+	// Read the generation before the persistent reference, so that a change
+	// racing with this call invalidates the entry.
+	generation := C.currentKeychainGeneration()
+	ref, err := persistentRef(ident)
+	if err != nil {
+		return
+	}
+	identityCacheMu.Lock()
+	defer identityCacheMu.Unlock()
+	identityCache[cacheKey(opts)] = cachedLookup{
+		persistentRef: ref,
+		certs:         certs,
+		generation:    generation,
+		expiry:        time.Now().Add(identityCacheTTL),
+	}
+}
+
+// persistentRef returns a persistent reference to ident.
+func persistentRef(ident C.SecIdentityRef) ([]byte, error) {
+	query := C.CFDictionaryCreateMutable(C.kCFAllocatorDefault, 2, &C.kCFTypeDictionaryKeyCallBacks, &C.kCFTypeDictionaryValueCallBacks)
+	defer C.CFRelease(C.CFTypeRef(query))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecValueRef), unsafe.Pointer(ident))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecReturnPersistentRef), unsafe.Pointer(C.kCFBooleanTrue))
+	var ref C.CFTypeRef
+	if errno := C.SecItemCopyMatching(C.CFDictionaryRef(query), &ref); errno != C.errSecSuccess {
+		return nil, keychainError(errno)
+	}
+	defer C.CFRelease(ref)
+	return cfDataToBytes(C.CFDataRef(ref)), nil
+}
+
+// identityFromPersistentRef looks up the identity that ref refers to. The
+// caller owns the returned identity.
+func identityFromPersistentRef(ref []byte, authContext C.CFTypeRef, nonInteractive bool) (C.SecIdentityRef, error) {
+	cfRef := bytesToCFData(ref)
+	defer C.CFRelease(C.CFTypeRef(cfRef))
+	query := C.CFDictionaryCreateMutable(C.kCFAllocatorDefault, 5, &C.kCFTypeDictionaryKeyCallBacks, &C.kCFTypeDictionaryValueCallBacks)
+	defer C.CFRelease(C.CFTypeRef(query))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecClass), unsafe.Pointer(C.kSecClassIdentity))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecValuePersistentRef), unsafe.Pointer(cfRef))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecReturnRef), unsafe.Pointer(C.kCFBooleanTrue))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecUseAuthenticationContext), unsafe.Pointer(authContext))
+	if nonInteractive {
+		C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecUseAuthenticationUI), unsafe.Pointer(C.kSecUseAuthenticationUIFail))
+	}
+	var ident C.CFTypeRef
+	if errno := C.SecItemCopyMatching(C.CFDictionaryRef(query), &ident); errno != C.errSecSuccess {
+		return 0, keychainError(errno)
+	}
+	return C.SecIdentityRef(ident), nil
+}
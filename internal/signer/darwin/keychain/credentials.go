@@ -0,0 +1,102 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// CredentialInfo describes a signing-capable identity in the Keychain. Its
+// fields use the formats accepted by the matching Options fields.
+type CredentialInfo struct {
+	Subject     string // Common name of the subject.
+	Issuer      string // Common name of the issuer.
+	Serial      string // Hex-encoded serial number.
+	Fingerprint string // Hex-encoded SHA-256 fingerprint of the certificate.
+	KeyType     string // Public key algorithm and size, such as "RSA 2048" or "ECDSA P-256".
+	NotAfter    time.Time
+	// TokenID identifies the token that holds the private key, such as
+	// "com.apple.setoken" for the Secure Enclave. It is empty for software keys.
+	TokenID string
+}
+
+// KeyAttributes describes a private key in the Keychain, so that monitoring
+// can check that keys are hardware-bound and of an acceptable size.
+type KeyAttributes struct {
+	Algorithm string // "RSA" or "ECDSA".
+	BitSize   int
+	Curve     string // Name of the curve of ECDSA keys, such as "P-256".
+	// TokenID identifies the token that holds the key, such as
+	// "com.apple.setoken" for the Secure Enclave. It is empty for software keys.
+	TokenID     string
+	Extractable bool // Whether the key may be exported from the Keychain.
+	Sensitive   bool // Whether the key may only be exported in wrapped form.
+	// AccessControlled reports whether use of the key is subject to an access
+	// control, such as requiring biometry. The Security framework does not
+	// expose the individual access control flags.
+	AccessControlled bool
+}
+
+// HardwareBound reports whether the key is held by a token rather than in software.
+func (a KeyAttributes) HardwareBound() bool {
+	return a.TokenID != ""
+}
+
+// publicKeyAttributes returns the attributes that can be derived from pub.
+func publicKeyAttributes(pub interface{}) KeyAttributes {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return KeyAttributes{Algorithm: "RSA", BitSize: pub.N.BitLen()}
+	case *ecdsa.PublicKey:
+		return KeyAttributes{Algorithm: "ECDSA", BitSize: pub.Curve.Params().BitSize, Curve: pub.Curve.Params().Name}
+	default:
+		return KeyAttributes{Algorithm: fmt.Sprintf("%T", pub)}
+	}
+}
+
+// newCredentialInfo describes the identity with certificate xc whose private
+// key is held by the token tokenID.
+func newCredentialInfo(xc *x509.Certificate, tokenID string) CredentialInfo {
+	fp := sha256.Sum256(xc.Raw)
+	return CredentialInfo{
+		Subject:     xc.Subject.CommonName,
+		Issuer:      xc.Issuer.CommonName,
+		Serial:      hex.EncodeToString(xc.SerialNumber.Bytes()),
+		Fingerprint: hex.EncodeToString(fp[:]),
+		KeyType:     keyType(xc.PublicKey),
+		NotAfter:    xc.NotAfter,
+		TokenID:     tokenID,
+	}
+}
+
+// keyType describes the algorithm and size of pub.
+func keyType(pub interface{}) string {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + pub.Curve.Params().Name
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+)
+
+func TestNewCredentialInfo(t *testing.T) {
+	xc := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(0x1fa0),
+		Subject:      pkix.Name{CommonName: "device-1234"},
+	})
+	info := newCredentialInfo(xc, "com.apple.setoken")
+
+	if info.Subject != "device-1234" || info.Issuer != "device-1234" {
+		t.Errorf("newCredentialInfo: got subject %q and issuer %q, want device-1234", info.Subject, info.Issuer)
+	}
+	if got, want := info.Serial, "1fa0"; got != want {
+		t.Errorf("newCredentialInfo serial: got %q, want %q", got, want)
+	}
+	if got, want := info.KeyType, "ECDSA P-256"; got != want {
+		t.Errorf("newCredentialInfo key type: got %q, want %q", got, want)
+	}
+	if got, want := info.TokenID, "com.apple.setoken"; got != want {
+		t.Errorf("newCredentialInfo token ID: got %q, want %q", got, want)
+	}
+	// The listed values must select the listed certificate.
+	opts := Options{Fingerprint: info.Fingerprint, Serial: info.Serial, IssuerCN: info.Issuer}
+	if err := opts.validate(); err != nil {
+		t.Fatalf("validate: got %v, want nil err", err)
+	}
+	if !opts.matches(xc) {
+		t.Error("matches: got false for options built from CredentialInfo, want true")
+	}
+}
+
+func TestPublicKeyAttributes(t *testing.T) {
+	tests := []struct {
+		pub  interface{}
+		want KeyAttributes
+	}{
+		{
+			pub:  &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 3071), E: 65537},
+			want: KeyAttributes{Algorithm: "RSA", BitSize: 3072},
+		},
+		{
+			pub:  &ecdsa.PublicKey{Curve: elliptic.P384()},
+			want: KeyAttributes{Algorithm: "ECDSA", BitSize: 384, Curve: "P-384"},
+		},
+	}
+	for _, test := range tests {
+		if got := publicKeyAttributes(test.pub); got != test.want {
+			t.Errorf("publicKeyAttributes(%T): got %+v, want %+v", test.pub, got, test.want)
+		}
+	}
+	if (KeyAttributes{}).HardwareBound() {
+		t.Error("HardwareBound: got true for a software key, want false")
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import "errors"
+
+// Security framework result codes that map to the sentinel errors below.
+const (
+	errSecAuthFailed            = -25293
+	errSecNoSuchKeychain        = -25294
+	errSecItemNotFound          = -25300
+	errSecInteractionNotAllowed = -25308
+)
+
+// ErrCredUnavailable matches errors caused by no identity in the Keychain
+// satisfying the selection criteria, such as when no certificate is installed.
+var ErrCredUnavailable = errors.New("keychain: no matching credential available")
+
+// ErrKeychainLocked matches errors caused by a keychain that is locked and that
+// the user did not unlock.
+var ErrKeychainLocked = errors.New("keychain: keychain is locked")
+
+// ErrAuthenticationTimeout is returned by Sign when the user does not complete
+// the authentication required by an access-controlled key in time. The Key can
+// no longer be used afterwards and must be obtained again.
+var ErrAuthenticationTimeout = errors.New("keychain: user authentication timed out")
+
+// ErrInteractionRequired matches errors from operations that needed to show a
+// keychain or Touch ID prompt while running non-interactively.
+var ErrInteractionRequired = errors.New("keychain: user interaction required")
+
+// ErrMessageSigningRequired is returned by Sign for keys that cannot sign a
+// precomputed digest, but can sign a message they hash themselves.
+var ErrMessageSigningRequired = errors.New("keychain: key only signs whole messages, use SignMessage")
+
+// statusError returns the sentinel error that the OSStatus result code status
+// maps to, or nil if there is none.
+func statusError(status int64) error {
+	switch status {
+	case errSecItemNotFound, errSecNoSuchKeychain:
+		return ErrCredUnavailable
+	case errSecAuthFailed:
+		return ErrKeychainLocked
+	case errSecInteractionNotAllowed:
+		return ErrInteractionRequired
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import "testing"
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		status int64
+		want   error
+	}{
+		{status: -25300, want: ErrCredUnavailable},
+		{status: -25294, want: ErrCredUnavailable},
+		{status: -25293, want: ErrKeychainLocked},
+		{status: -25308, want: ErrInteractionRequired},
+		{status: 0, want: nil},
+		{status: -4, want: nil},
+	}
+	for _, test := range tests {
+		if got := statusError(test.status); got != test.want {
+			t.Errorf("statusError(%d): got %v, want %v", test.status, got, test.want)
+		}
+	}
+}
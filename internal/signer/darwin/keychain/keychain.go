@@ -18,29 +18,75 @@
 package keychain
 
 /*
-#cgo CFLAGS: -mmacosx-version-min=10.14
-#cgo LDFLAGS: -framework CoreFoundation -framework Security
+#cgo CFLAGS: -mmacosx-version-min=10.15 -x objective-c
+#cgo LDFLAGS: -framework CoreFoundation -framework Security -framework Foundation -framework LocalAuthentication
 
 #include <CoreFoundation/CoreFoundation.h>
 #include <Security/Security.h>
+#import <LocalAuthentication/LocalAuthentication.h>
+
+// newAuthenticationContext returns a new LAContext owned by the caller. The
+// context is attached to keychain queries so that keys protected by access
+// control, such as Secure Enclave keys, are authorized once per Key rather
+// than on every operation. A positive reuseDuration lets a recent Touch ID
+// unlock authorize the key without another prompt, and a non-NULL reason is
+// shown in the Touch ID dialog. If interactionNotAllowed is set, operations
+// that would need to prompt the user fail instead.
+static CFTypeRef newAuthenticationContext(double reuseDuration, const char *reason, Boolean interactionNotAllowed) {
+	LAContext *context = [[LAContext alloc] init];
+	context.interactionNotAllowed = interactionNotAllowed;
+	if (reuseDuration > 0) {
+		context.touchIDAuthenticationAllowableReuseDuration = reuseDuration;
+	}
+	if (reason != NULL) {
+		context.localizedReason = [NSString stringWithUTF8String:reason];
+	}
+	return (CFTypeRef)context;
+}
+
+// invalidateAuthenticationContext cancels any evaluation pending on the
+// LAContext. The context cannot authorize anything afterwards.
+static void invalidateAuthenticationContext(CFTypeRef context) {
+	[(LAContext *)context invalidate];
+}
+
+// isOSStatusError reports whether the code of err is an OSStatus.
+static Boolean isOSStatusError(CFErrorRef err) {
+	return CFEqual(CFErrorGetDomain(err), kCFErrorDomainOSStatus);
+}
+
+// isNotInteractiveError reports whether err is the LocalAuthentication error
+// for an evaluation that needed to show UI while interaction was not allowed.
+static Boolean isNotInteractiveError(CFErrorRef err) {
+	return CFEqual(CFErrorGetDomain(err), (CFStringRef)LAErrorDomain) && CFErrorGetCode(err) == LAErrorNotInteractive;
+}
 */
 import "C"
 
 import (
-	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 	"unsafe"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/ecies"
 )
 
+// PrivateKeyOperations reports whether Keys can sign and decrypt, which
+// requires the Security framework and so cgo.
+const PrivateKeyOperations = true
+
 // Maps for translating from crypto.Hash to SecKeyAlgorithm.
 // https://developer.apple.com/documentation/security/seckeyalgorithm
 var (
@@ -67,9 +113,40 @@ var (
 		crypto.SHA384: C.kSecKeyAlgorithmRSAEncryptionOAEPSHA384,
 		crypto.SHA512: C.kSecKeyAlgorithmRSAEncryptionOAEPSHA512,
 	}
+	rsaPKCS1v15EncryptionAlgorithm = C.kSecKeyAlgorithmRSAEncryptionPKCS1
+
+	// SHA-1 signatures are only produced for Keys that allow legacy hashes.
+	legacyECDSAAlgorithms = map[crypto.Hash]C.CFStringRef{
+		crypto.SHA1: C.kSecKeyAlgorithmECDSASignatureDigestX962SHA1,
+	}
+	legacyRSAPKCS1v15Algorithms = map[crypto.Hash]C.CFStringRef{
+		crypto.SHA1: C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15SHA1,
+	}
+
+	// Message variants hash the input on the key's token before signing.
+	ecdsaMessageAlgorithms = map[crypto.Hash]C.CFStringRef{
+		crypto.SHA256: C.kSecKeyAlgorithmECDSASignatureMessageX962SHA256,
+		crypto.SHA384: C.kSecKeyAlgorithmECDSASignatureMessageX962SHA384,
+		crypto.SHA512: C.kSecKeyAlgorithmECDSASignatureMessageX962SHA512,
+	}
+	rsaPKCS1v15MessageAlgorithms = map[crypto.Hash]C.CFStringRef{
+		crypto.SHA256: C.kSecKeyAlgorithmRSASignatureMessagePKCS1v15SHA256,
+		crypto.SHA384: C.kSecKeyAlgorithmRSASignatureMessagePKCS1v15SHA384,
+		crypto.SHA512: C.kSecKeyAlgorithmRSASignatureMessagePKCS1v15SHA512,
+	}
+	rsaPSSMessageAlgorithms = map[crypto.Hash]C.CFStringRef{
+		crypto.SHA256: C.kSecKeyAlgorithmRSASignatureMessagePSSSHA256,
+		crypto.SHA384: C.kSecKeyAlgorithmRSASignatureMessagePSSSHA384,
+		crypto.SHA512: C.kSecKeyAlgorithmRSASignatureMessagePSSSHA512,
+	}
+	legacyECDSAMessageAlgorithms = map[crypto.Hash]C.CFStringRef{
+		crypto.SHA1: C.kSecKeyAlgorithmECDSASignatureMessageX962SHA1,
+	}
+	legacyRSAPKCS1v15MessageAlgorithms = map[crypto.Hash]C.CFStringRef{
+		crypto.SHA1: C.kSecKeyAlgorithmRSASignatureMessagePKCS1v15SHA1,
+	}
 )
 
-const UNKNOWN_SECKEY_ALGORITHM = C.CFStringRef(0)
 const INVALID_KEY = C.SecKeyRef(0)
 
 // cfStringToString returns a Go string given a CFString.
@@ -119,6 +196,19 @@ func (e *cfError) Error() string {
 	return cfStringToString(s)
 }
 
+// Is lets errors.Is match e against ErrCredUnavailable, ErrKeychainLocked
+// and ErrInteractionRequired.
+func (e *cfError) Is(target error) bool {
+	if C.isNotInteractiveError(e.e) != 0 {
+		return target == ErrInteractionRequired
+	}
+	if C.isOSStatusError(e.e) == 0 {
+		return false
+	}
+	sentinel := statusError(int64(C.CFErrorGetCode(e.e)))
+	return sentinel != nil && sentinel == target
+}
+
 // keychainError is an error type that is based on an OSStatus return code, and
 // obtains the error string with SecCopyErrorMessageString.
 type keychainError C.OSStatus
@@ -129,6 +219,13 @@ func (e keychainError) Error() string {
 	return cfStringToString(s)
 }
 
+// Is lets errors.Is match e against ErrCredUnavailable, ErrKeychainLocked
+// and ErrInteractionRequired.
+func (e keychainError) Is(target error) bool {
+	sentinel := statusError(int64(e))
+	return sentinel != nil && sentinel == target
+}
+
 // cfDataToBytes turns a CFDataRef into a byte slice.
 func cfDataToBytes(cfData C.CFDataRef) []byte {
 	return C.GoBytes(unsafe.Pointer(C.CFDataGetBytePtr(cfData)), C.int(C.CFDataGetLength(cfData)))
@@ -137,6 +234,9 @@ func cfDataToBytes(cfData C.CFDataRef) []byte {
 // bytesToCFData turns a byte slice into a CFDataRef. Caller then "owns" the
 // CFDataRef and must CFRelease the CFDataRef when done.
 func bytesToCFData(buf []byte) C.CFDataRef {
+	if len(buf) == 0 {
+		return C.CFDataCreate(C.kCFAllocatorDefault, nil, 0)
+	}
 	return C.CFDataCreate(C.kCFAllocatorDefault, (*C.UInt8)(unsafe.Pointer(&buf[0])), C.CFIndex(len(buf)))
 }
 
@@ -148,12 +248,27 @@ func int32ToCFNumber(n int32) C.CFNumberRef {
 
 // Key is a wrapper around the Keychain reference that uses it to
 // implement signing-related methods with Keychain functionality.
+//
+// A Key is safe for concurrent use by multiple goroutines. Software and Secure
+// Enclave keys sign and decrypt in parallel, since SecKeyCreateSignature is
+// thread safe. Operations on keys held by other tokens, such as smart cards,
+// are serialized, because CryptoTokenKit drivers may not handle concurrent
+// requests to the same card.
 type Key struct {
 	privateKeyRef C.SecKeyRef
 	certs         []*x509.Certificate
+	publicKey     crypto.PublicKey
 	once          sync.Once
 	publicKeyRef  C.SecKeyRef
 	hash          crypto.Hash
+	authContext   C.CFTypeRef // LAContext used to authorize access to the private key.
+	secureEnclave bool        // Whether the private key is bound to the Secure Enclave.
+	authTimeout   time.Duration
+	// allowLegacyHashes permits signing SHA-1 digests.
+	allowLegacyHashes bool
+	// serialize makes private key operations hold tokenMu.
+	serialize bool
+	tokenMu   sync.Mutex
 }
 
 // newKey makes a new Key wrapper around the key reference,
@@ -166,6 +281,9 @@ func newKey(privateKeyRef C.SecKeyRef, certs []*x509.Certificate, publicKeyRef C
 		publicKeyRef:  publicKeyRef,
 		hash:          crypto.SHA256,
 	}
+	if len(certs) > 0 {
+		k.publicKey = certs[0].PublicKey
+	}
 
 	// This struct now owns the key reference. Retain now and release on
 	// finalise in case the credential gets forgotten about.
@@ -191,8 +309,16 @@ func (k *Key) CertificateChain() [][]byte {
 func (k *Key) Close() error {
 	// Don't double-release references.
 	k.once.Do(func() {
-		C.CFRelease(C.CFTypeRef(k.privateKeyRef))
-		C.CFRelease(C.CFTypeRef(k.publicKeyRef))
+		// CFRelease must not be passed NULL, which a zero Key holds.
+		if k.privateKeyRef != 0 {
+			C.CFRelease(C.CFTypeRef(k.privateKeyRef))
+		}
+		if k.publicKeyRef != 0 {
+			C.CFRelease(C.CFTypeRef(k.publicKeyRef))
+		}
+		if k.authContext != 0 {
+			C.CFRelease(k.authContext)
+		}
 	})
 	return nil
 }
@@ -200,51 +326,171 @@ func (k *Key) Close() error {
 // Public returns the corresponding public key for this Key. Good
 // thing we extracted it when we created it.
 func (k *Key) Public() crypto.PublicKey {
-	return k.certs[0].PublicKey
+	return k.publicKey
 }
 
 // Sign signs a message digest. Here, we pass off the signing to Keychain library.
+// Keys on tokens that can only hash the message themselves fail with an error
+// matching ErrMessageSigningRequired; use SignMessage for those.
 func (k *Key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (signature []byte, err error) {
+	algorithm, err := k.signatureAlgorithm(opts, false)
+	if err != nil {
+		return nil, err
+	}
+	if !k.supportsSignature(algorithm) {
+		if messageAlgorithm, err := k.signatureAlgorithm(opts, true); err == nil && k.supportsSignature(messageAlgorithm) {
+			return nil, fmt.Errorf("%w for %v", ErrMessageSigningRequired, opts.HashFunc())
+		}
+	}
+	return k.sign(algorithm, digest)
+}
+
+// SignMessage signs message, leaving the hashing to the key. This works with
+// smart cards that only support the message variants of SecKeyAlgorithm.
+func (k *Key) SignMessage(message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, err := k.signatureAlgorithm(opts, true)
+	if err != nil {
+		return nil, err
+	}
+	return k.sign(algorithm, message)
+}
+
+// signatureAlgorithm maps the key type and hash function in opts to a
+// SecKeyAlgorithm that signs either a digest or a whole message.
+func (k *Key) signatureAlgorithm(opts crypto.SignerOpts, message bool) (C.CFStringRef, error) {
+	// The Secure Enclave only holds NIST P-256 keys and only produces ECDSA signatures.
+	if k.secureEnclave {
+		if pub, ok := k.Public().(*ecdsa.PublicKey); !ok || pub.Curve != elliptic.P256() {
+			return 0, fmt.Errorf("Secure Enclave keys only support ECDSA P-256 signatures")
+		}
+	}
+
 	// Map the signing algorithm and hash function to a SecKeyAlgorithm constant.
-	var algorithms map[crypto.Hash]C.CFStringRef
+	var algorithms, legacyAlgorithms map[crypto.Hash]C.CFStringRef
 	switch pub := k.Public().(type) {
 	case *ecdsa.PublicKey:
-		algorithms = ecdsaAlgorithms
+		algorithms, legacyAlgorithms = ecdsaAlgorithms, legacyECDSAAlgorithms
+		if message {
+			algorithms, legacyAlgorithms = ecdsaMessageAlgorithms, legacyECDSAMessageAlgorithms
+		}
 	case *rsa.PublicKey:
 		if _, ok := opts.(*rsa.PSSOptions); ok {
 			algorithms = rsaPSSAlgorithms
+			if message {
+				algorithms = rsaPSSMessageAlgorithms
+			}
 			break
 		}
-		algorithms = rsaPKCS1v15Algorithms
+		algorithms, legacyAlgorithms = rsaPKCS1v15Algorithms, legacyRSAPKCS1v15Algorithms
+		if message {
+			algorithms, legacyAlgorithms = rsaPKCS1v15MessageAlgorithms, legacyRSAPKCS1v15MessageAlgorithms
+		}
 	default:
-		return nil, fmt.Errorf("unsupported algorithm %T", pub)
+		return 0, fmt.Errorf("unsupported algorithm %T", pub)
 	}
 	algorithm, ok := algorithms[opts.HashFunc()]
+	if !ok && k.allowLegacyHashes {
+		algorithm, ok = legacyAlgorithms[opts.HashFunc()]
+	}
 	if !ok {
-		return nil, fmt.Errorf("unsupported hash function %T", opts.HashFunc())
+		return 0, fmt.Errorf("unsupported hash function %T", opts.HashFunc())
 	}
+	return algorithm, nil
+}
 
+// supportsSignature reports whether the private key can sign with algorithm.
+func (k *Key) supportsSignature(algorithm C.CFStringRef) bool {
+	return C.SecKeyIsAlgorithmSupported(k.privateKeyRef, C.kSecKeyOperationTypeSign, algorithm) != 0
+}
+
+// sign signs data, a digest or a message depending on algorithm.
+func (k *Key) sign(algorithm C.CFStringRef, data []byte) ([]byte, error) {
 	// Copy input over into CF-land.
-	cfDigest := bytesToCFData(digest)
-	defer C.CFRelease(C.CFTypeRef(cfDigest))
+	cfData := bytesToCFData(data)
+	defer C.CFRelease(C.CFTypeRef(cfData))
+
+	if k.serialize {
+		k.tokenMu.Lock()
+		defer k.tokenMu.Unlock()
+	}
+	sig, err := k.createSignature(algorithm, cfData)
+	if err != nil {
+		return nil, err
+	}
+	defer C.CFRelease(C.CFTypeRef(sig))
+
+	return cfDataToBytes(sig), nil
+}
+
+// createSignature signs data with the private key. Access-controlled keys may
+// prompt for Touch ID here; if the Key has an authentication timeout, the
+// prompt is cancelled once it expires. The caller owns the returned data.
+func (k *Key) createSignature(algorithm C.CFStringRef, data C.CFDataRef) (C.CFDataRef, error) {
+	if k.authTimeout <= 0 || k.authContext == 0 {
+		return secKeyCreateSignature(k.privateKeyRef, algorithm, data)
+	}
+	type result struct {
+		sig C.CFDataRef
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		sig, err := secKeyCreateSignature(k.privateKeyRef, algorithm, data)
+		done <- result{sig, err}
+	}()
+	timer := time.NewTimer(k.authTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.sig, r.err
+	case <-timer.C:
+	}
+	C.invalidateAuthenticationContext(k.authContext)
+	// Wait for the cancelled operation so that data outlives it.
+	if r := <-done; r.err == nil {
+		return r.sig, nil
+	}
+	return 0, fmt.Errorf("%w after %v", ErrAuthenticationTimeout, k.authTimeout)
+}
 
+// secKeyCreateSignature wraps SecKeyCreateSignature. The caller owns the
+// returned data.
+func secKeyCreateSignature(key C.SecKeyRef, algorithm C.CFStringRef, data C.CFDataRef) (C.CFDataRef, error) {
 	var cfErr C.CFErrorRef
-	sig := C.SecKeyCreateSignature(C.SecKeyRef(k.privateKeyRef), algorithm, C.CFDataRef(cfDigest), &cfErr)
+	sig := C.SecKeyCreateSignature(key, algorithm, data, &cfErr)
 	if cfErr != 0 {
-		return nil, cfErrorFromRef(cfErr)
+		return 0, cfErrorFromRef(cfErr)
 	}
-	defer C.CFRelease(C.CFTypeRef(sig))
+	return sig, nil
+}
 
-	return cfDataToBytes(C.CFDataRef(sig)), nil
+// Verify checks that sig is a valid signature of digest by the key, using the
+// SecKeyAlgorithm that Sign would use for opts. It returns nil if and only if
+// the signature is valid.
+func (k *Key) Verify(digest, sig []byte, opts crypto.SignerOpts) error {
+	algorithm, err := k.signatureAlgorithm(opts, false)
+	if err != nil {
+		return err
+	}
+	cfDigest := bytesToCFData(digest)
+	defer C.CFRelease(C.CFTypeRef(cfDigest))
+	cfSig := bytesToCFData(sig)
+	defer C.CFRelease(C.CFTypeRef(cfSig))
+	var cfErr C.CFErrorRef
+	if C.SecKeyVerifySignature(k.publicKeyRef, algorithm, cfDigest, cfSig, &cfErr) == 0 {
+		if cfErr != 0 {
+			return cfErrorFromRef(cfErr)
+		}
+		return errors.New("keychain: invalid signature")
+	}
+	return nil
 }
 
-// Cred gets the first Credential (filtering on issuer) corresponding to
-// available certificate and private key pairs (i.e. identities) available in
-// the Keychain. This includes both the current login keychain for the user,
-// and the system keychain.
-func Cred(issuerCN string) (*Key, error) {
-	leafSearch := C.CFDictionaryCreateMutable(C.kCFAllocatorDefault, 5, &C.kCFTypeDictionaryKeyCallBacks, &C.kCFTypeDictionaryValueCallBacks)
-	defer C.CFRelease(C.CFTypeRef(unsafe.Pointer(leafSearch)))
+// identitySearch returns a query matching all signing-capable identities,
+// either in the file-based keychains or in the data protection keychain. The
+// caller owns the returned dictionary.
+func identitySearch(dataProtection bool, authContext C.CFTypeRef, searchList, issuers C.CFArrayRef, accessGroup C.CFStringRef, nonInteractive bool) C.CFMutableDictionaryRef {
+	leafSearch := C.CFDictionaryCreateMutable(C.kCFAllocatorDefault, 11, &C.kCFTypeDictionaryKeyCallBacks, &C.kCFTypeDictionaryValueCallBacks)
 	// Get identities (certificate + private key pairs).
 	C.CFDictionaryAddValue(leafSearch, unsafe.Pointer(C.kSecClass), unsafe.Pointer(C.kSecClassIdentity))
 	// Get identities that are signing capable.
@@ -253,91 +499,511 @@ func Cred(issuerCN string) (*Key, error) {
 	C.CFDictionaryAddValue(leafSearch, unsafe.Pointer(C.kSecReturnRef), unsafe.Pointer(C.kCFBooleanTrue))
 	// Be sure to list out all the matches.
 	C.CFDictionaryAddValue(leafSearch, unsafe.Pointer(C.kSecMatchLimit), unsafe.Pointer(C.kSecMatchLimitAll))
-	// Do the matching-item copy.
-	var leafMatches C.CFTypeRef
-	if errno := C.SecItemCopyMatching((C.CFDictionaryRef)(leafSearch), &leafMatches); errno != C.errSecSuccess {
-		return nil, keychainError(errno)
+	// Secure Enclave keys are only stored in the data protection keychain.
+	if dataProtection {
+		C.CFDictionaryAddValue(leafSearch, unsafe.Pointer(C.kSecUseDataProtectionKeychain), unsafe.Pointer(C.kCFBooleanTrue))
+		// Only search the items of one access group instead of all groups the
+		// binary is entitled to.
+		if accessGroup != 0 {
+			C.CFDictionaryAddValue(leafSearch, unsafe.Pointer(C.kSecAttrAccessGroup), unsafe.Pointer(accessGroup))
+		}
 	}
-	defer C.CFRelease(leafMatches)
-	signingIdents := C.CFArrayRef(leafMatches)
-	// Dump the certs into golang x509 Certificates.
-	var (
-		leafIdent C.SecIdentityRef
-		leaf      *x509.Certificate
-	)
-	// Find the first valid leaf whose issuer (CA) matches the name in filter.
-	// Validation in identityToX509 covers Not Before, Not After and key alg.
-	for i := 0; i < int(C.CFArrayGetCount(signingIdents)) && leaf == nil; i++ {
-		identDict := C.CFArrayGetValueAtIndex(signingIdents, C.CFIndex(i))
-		xc, err := identityToX509(C.SecIdentityRef(identDict))
+	// Only search the given keychains instead of the user's search list.
+	if searchList != 0 {
+		C.CFDictionaryAddValue(leafSearch, unsafe.Pointer(C.kSecMatchSearchList), unsafe.Pointer(searchList))
+	}
+	// Only return identities issued by one of the given subjects.
+	if issuers != 0 {
+		C.CFDictionaryAddValue(leafSearch, unsafe.Pointer(C.kSecMatchIssuers), unsafe.Pointer(issuers))
+	}
+	// Authorize access to the returned keys with the Key's authentication context.
+	if authContext != 0 {
+		C.CFDictionaryAddValue(leafSearch, unsafe.Pointer(C.kSecUseAuthenticationContext), unsafe.Pointer(authContext))
+	}
+	// Fail with errSecInteractionNotAllowed rather than showing a password dialog.
+	if nonInteractive {
+		C.CFDictionaryAddValue(leafSearch, unsafe.Pointer(C.kSecUseAuthenticationUI), unsafe.Pointer(C.kSecUseAuthenticationUIFail))
+	}
+	return leafSearch
+}
+
+// copyIdentities returns arrays of all signing-capable identities from the
+// file-based keychains and from the data protection keychain. A keychain that
+// holds no identities, or that the binary is not entitled to access, is
+// skipped. If searchList is set, only the file-based keychains it holds are
+// searched, and if issuers is set, only identities issued by one of the
+// subjects it holds are returned. If accessGroup is set, only the data
+// protection keychain items in that access group are searched, and a missing
+// entitlement to it is an error. If nonInteractive is set, a keychain that
+// would prompt the user fails the search with an error matching
+// ErrInteractionRequired. The caller owns the returned arrays.
+func copyIdentities(authContext C.CFTypeRef, searchList, issuers C.CFArrayRef, accessGroup string, nonInteractive bool) ([]C.CFArrayRef, error) {
+	sources := []bool{false, true}
+	var cfAccessGroup C.CFStringRef
+	switch {
+	case accessGroup != "":
+		sources = []bool{true}
+		cfAccessGroup = stringToCFString(accessGroup)
+		defer C.CFRelease(C.CFTypeRef(cfAccessGroup))
+	case searchList != 0:
+		sources = []bool{false}
+	}
+	var arrays []C.CFArrayRef
+	for _, dataProtection := range sources {
+		leafSearch := identitySearch(dataProtection, authContext, searchList, issuers, cfAccessGroup, nonInteractive)
+		// Do the matching-item copy.
+		var leafMatches C.CFTypeRef
+		errno := C.SecItemCopyMatching((C.CFDictionaryRef)(leafSearch), &leafMatches)
+		C.CFRelease(C.CFTypeRef(leafSearch))
+		switch errno {
+		case C.errSecSuccess:
+			arrays = append(arrays, C.CFArrayRef(leafMatches))
+		case C.errSecItemNotFound:
+		case C.errSecMissingEntitlement:
+			if accessGroup != "" {
+				releaseArrays(arrays)
+				return nil, fmt.Errorf("access group %q: %w", accessGroup, keychainError(errno))
+			}
+		default:
+			releaseArrays(arrays)
+			return nil, keychainError(errno)
+		}
+	}
+	if len(arrays) == 0 {
+		return nil, keychainError(C.errSecItemNotFound)
+	}
+	return arrays, nil
+}
+
+// keychainSearchList opens the keychain file at path and returns a search list
+// holding only that keychain. The caller owns the returned array.
+func keychainSearchList(path string) (C.CFArrayRef, error) {
+	keychain, err := openKeychain(path)
+	if err != nil {
+		return 0, err
+	}
+	defer C.CFRelease(C.CFTypeRef(keychain))
+	values := []unsafe.Pointer{unsafe.Pointer(keychain)}
+	return C.CFArrayCreate(C.kCFAllocatorDefault, &values[0], 1, &C.kCFTypeArrayCallBacks), nil
+}
+
+// openKeychain opens the keychain file at path. The caller owns the returned
+// keychain.
+func openKeychain(path string) (C.SecKeychainRef, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	var keychain C.SecKeychainRef
+	if errno := C.SecKeychainOpen(cPath, &keychain); errno != C.errSecSuccess {
+		return 0, fmt.Errorf("opening keychain %s: %w", path, keychainError(errno))
+	}
+	// SecKeychainOpen succeeds for missing files; the status check does not.
+	var status C.SecKeychainStatus
+	if errno := C.SecKeychainGetStatus(keychain, &status); errno != C.errSecSuccess {
+		C.CFRelease(C.CFTypeRef(keychain))
+		return 0, fmt.Errorf("opening keychain %s: %w", path, keychainError(errno))
+	}
+	return keychain, nil
+}
+
+// releaseArrays releases every array returned by copyIdentities.
+func releaseArrays(arrays []C.CFArrayRef) {
+	for _, array := range arrays {
+		C.CFRelease(C.CFTypeRef(array))
+	}
+}
+
+// isHardwareBackedKey reports whether the private key is bound to a token,
+// such as the Secure Enclave or a smart card, rather than stored in software.
+func isHardwareBackedKey(key C.SecKeyRef) bool {
+	return keyTokenID(key) != ""
+}
+
+// keyTokenID returns the identifier of the token holding the private key, or
+// "" for keys stored in software.
+func keyTokenID(key C.SecKeyRef) string {
+	attrs := C.SecKeyCopyAttributes(key)
+	if attrs == 0 {
+		return ""
+	}
+	defer C.CFRelease(C.CFTypeRef(attrs))
+	return dictString(attrs, C.kSecAttrTokenID)
+}
+
+// dictString returns the string value of key in dict, or "" if it is missing.
+func dictString(dict C.CFDictionaryRef, key C.CFStringRef) string {
+	v := C.CFDictionaryGetValue(dict, unsafe.Pointer(key))
+	if v == nil {
+		return ""
+	}
+	return cfStringToString(C.CFStringRef(v))
+}
+
+// dictInt returns the integer value of key in dict, or 0 if it is missing.
+func dictInt(dict C.CFDictionaryRef, key C.CFStringRef) int {
+	v := C.CFDictionaryGetValue(dict, unsafe.Pointer(key))
+	if v == nil {
+		return 0
+	}
+	var n C.int
+	C.CFNumberGetValue(C.CFNumberRef(v), C.kCFNumberIntType, unsafe.Pointer(&n))
+	return int(n)
+}
+
+// dictBool returns the boolean value of key in dict, or false if it is missing.
+func dictBool(dict C.CFDictionaryRef, key C.CFStringRef) bool {
+	v := C.CFDictionaryGetValue(dict, unsafe.Pointer(key))
+	return v != nil && C.CFBooleanGetValue(C.CFBooleanRef(v)) != 0
+}
+
+// Attributes describes the private key as reported by the Keychain.
+func (k *Key) Attributes() (KeyAttributes, error) {
+	attrs := C.SecKeyCopyAttributes(k.privateKeyRef)
+	if attrs == 0 {
+		return KeyAttributes{}, fmt.Errorf("key attributes are not available")
+	}
+	defer C.CFRelease(C.CFTypeRef(attrs))
+	a := publicKeyAttributes(k.Public())
+	if bits := dictInt(attrs, C.kSecAttrKeySizeInBits); bits != 0 {
+		a.BitSize = bits
+	}
+	a.TokenID = dictString(attrs, C.kSecAttrTokenID)
+	a.Extractable = dictBool(attrs, C.kSecAttrIsExtractable)
+	a.Sensitive = dictBool(attrs, C.kSecAttrIsSensitive)
+	a.AccessControlled = C.CFDictionaryGetValue(attrs, unsafe.Pointer(C.kSecAttrAccessControl)) != nil
+	return a, nil
+}
+
+// isSecureEnclaveKey reports whether the private key is bound to the Secure Enclave.
+func isSecureEnclaveKey(key C.SecKeyRef) bool {
+	attrs := C.SecKeyCopyAttributes(key)
+	if attrs == 0 {
+		return false
+	}
+	defer C.CFRelease(C.CFTypeRef(attrs))
+	tokenID := C.CFDictionaryGetValue(attrs, unsafe.Pointer(C.kSecAttrTokenID))
+	return tokenID != nil && C.CFEqual(C.CFTypeRef(tokenID), C.CFTypeRef(C.kSecAttrTokenIDSecureEnclave)) != 0
+}
+
+// Cred gets the first Credential (filtering on issuer) corresponding to
+// available certificate and private key pairs (i.e. identities) available in
+// the Keychain. This includes both the current login keychain for the user,
+// the system keychain, and the data protection keychain, which holds
+// identities whose private keys live in the Secure Enclave.
+func Cred(issuerCN string) (*Key, error) {
+	return CredWithOptions(Options{IssuerCN: issuerCN})
+}
+
+// CredWithOptions is like Cred, but selects an identity whose leaf
+// certificate satisfies every criterion set in opts. When several identities
+// match, opts.Policy decides between them. The selected identity and chain
+// are cached per opts until a keychain change event is seen, so repeated
+// calls avoid enumerating every keychain.
+func CredWithOptions(opts Options) (*Key, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	var searchList C.CFArrayRef
+	if path, _ := keychainPath(opts.Keychain); path != "" {
+		list, err := keychainSearchList(path)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		if xc.Issuer.CommonName == issuerCN {
-			leaf = xc
-			leafIdent = C.SecIdentityRef(identDict)
+		defer C.CFRelease(C.CFTypeRef(list))
+		searchList = list
+	}
+	var cPrompt *C.char
+	if opts.AuthenticationPrompt != "" {
+		cPrompt = C.CString(opts.AuthenticationPrompt)
+		defer C.free(unsafe.Pointer(cPrompt))
+	}
+	nonInteractive := C.Boolean(0)
+	if opts.NonInteractive {
+		nonInteractive = 1
+	}
+	authContext := C.newAuthenticationContext(C.double(opts.AuthenticationReuseDuration.Seconds()), cPrompt, nonInteractive)
+	defer C.CFRelease(authContext)
+	leafIdent, certs, ok := cachedIdentity(opts, authContext)
+	if !ok {
+		var err error
+		leafIdent, certs, err = findIdentity(opts, authContext, searchList)
+		if err != nil {
+			return nil, err
 		}
+		cacheIdentity(opts, leafIdent, certs)
 	}
+	defer C.CFRelease(C.CFTypeRef(leafIdent))
 
-	caSearch := C.CFDictionaryCreateMutable(C.kCFAllocatorDefault, 0, &C.kCFTypeDictionaryKeyCallBacks, &C.kCFTypeDictionaryValueCallBacks)
-	defer C.CFRelease(C.CFTypeRef(unsafe.Pointer(caSearch)))
-	// Get identities (certificates).
-	C.CFDictionaryAddValue(caSearch, unsafe.Pointer(C.kSecClass), unsafe.Pointer(C.kSecClassCertificate))
-	// For each identity, give us the reference to it.
-	C.CFDictionaryAddValue(caSearch, unsafe.Pointer(C.kSecReturnRef), unsafe.Pointer(C.kCFBooleanTrue))
-	// Be sure to list out all the matches.
-	C.CFDictionaryAddValue(caSearch, unsafe.Pointer(C.kSecMatchLimit), unsafe.Pointer(C.kSecMatchLimitAll))
-	// Do the matching-item copy.
-	var caMatches C.CFTypeRef
-	if errno := C.SecItemCopyMatching((C.CFDictionaryRef)(caSearch), &caMatches); errno != C.errSecSuccess {
-		return nil, keychainError(errno)
+	skr, err := identityToPrivateSecKeyRef(leafIdent)
+	if err != nil {
+		return nil, err
 	}
-	defer C.CFRelease(caMatches)
-	certRefs := C.CFArrayRef(caMatches)
-	// Validate and dump the certs into golang x509 Certificates.
-	var allCerts []*x509.Certificate
-	for i := 0; i < int(C.CFArrayGetCount(certRefs)); i++ {
-		refDict := C.CFArrayGetValueAtIndex(certRefs, C.CFIndex(i))
-		if xc, err := certRefToX509(C.SecCertificateRef(refDict)); err == nil {
-			allCerts = append(allCerts, xc)
+	defer C.CFRelease(C.CFTypeRef(skr))
+	pubKey, err := identityToPublicSecKeyRef(leafIdent)
+	if err != nil {
+		return nil, err
+	}
+	defer C.CFRelease(C.CFTypeRef(pubKey))
+	k, err := newKey(skr, certs, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	// The Key shares the authentication context used to look up its private key.
+	C.CFRetain(authContext)
+	k.authContext = authContext
+	k.authTimeout = opts.AuthenticationTimeout
+	k.allowLegacyHashes = opts.AllowLegacyHashes
+	k.secureEnclave = isSecureEnclaveKey(skr)
+	k.serialize = isHardwareBackedKey(skr) && !k.secureEnclave
+	return k, nil
+}
+
+// ListCredentials describes every valid signing-capable identity in the
+// user's keychain search list and the data protection keychain, so that users
+// can see which credentials are available before writing a config.
+func ListCredentials() ([]CredentialInfo, error) {
+	authContext := C.newAuthenticationContext(0, nil, 1)
+	defer C.CFRelease(authContext)
+	identArrays, err := copyIdentities(authContext, 0, 0, "", true)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseArrays(identArrays)
+	var creds []CredentialInfo
+	for _, signingIdents := range identArrays {
+		for i := 0; i < int(C.CFArrayGetCount(signingIdents)); i++ {
+			ident := C.SecIdentityRef(C.CFArrayGetValueAtIndex(signingIdents, C.CFIndex(i)))
+			xc, err := identityToX509(ident)
+			if err != nil {
+				continue
+			}
+			var tokenID string
+			if skr, err := identityToPrivateSecKeyRef(ident); err == nil {
+				tokenID = keyTokenID(skr)
+				C.CFRelease(C.CFTypeRef(skr))
+			}
+			creds = append(creds, newCredentialInfo(xc, tokenID))
 		}
 	}
+	return creds, nil
+}
+
+// findIdentity searches the Keychain for the identity preferred by opts and
+// builds its certificate chain. The caller owns the returned identity.
+func findIdentity(opts Options, authContext C.CFTypeRef, searchList C.CFArrayRef) (C.SecIdentityRef, []*x509.Certificate, error) {
+	leafIdent, err := preferredIdentity(opts)
+	if leafIdent == 0 && err == nil {
+		leafIdent, err = matchingIdentity(opts, authContext, searchList)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	certs, err := trustChain(leafIdent)
+	if err != nil {
+		C.CFRelease(C.CFTypeRef(leafIdent))
+		return 0, nil, err
+	}
+	if opts.FetchIntermediates {
+		certs = completeChain(certs)
+	}
+	if opts.ExcludeRoot {
+		certs = withoutRoot(certs)
+	}
+	return leafIdent, certs, nil
+}
 
-	// Build a certificate chain from leaf by matching prev.RawIssuer to
-	// next.RawSubject across all valid certificates in the keychain.
+// preferredIdentity returns the identity that the identity preference named
+// by opts.PreferredIdentity refers to, if its certificate is valid and
+// satisfies opts. It returns 0 if there is no such identity and opts has other
+// criteria to select one by. The caller owns the returned identity.
+func preferredIdentity(opts Options) (C.SecIdentityRef, error) {
+	if opts.PreferredIdentity == "" {
+		return 0, nil
+	}
+	name := stringToCFString(opts.PreferredIdentity)
+	defer C.CFRelease(C.CFTypeRef(name))
+	ident := C.SecIdentityCopyPreferred(name, 0, 0)
+	if ident != 0 {
+		xc, err := identityToX509(ident)
+		if err == nil && opts.matches(xc) {
+			return ident, nil
+		}
+		C.CFRelease(C.CFTypeRef(ident))
+		if errors.Is(err, errEd25519Unsupported) && opts.matches(xc) {
+			return 0, fmt.Errorf("identity preference %q: %v: %w", opts.PreferredIdentity, err, ErrCredUnavailable)
+		}
+	}
+	if !opts.hasAttributeCriteria() {
+		return 0, fmt.Errorf("no usable identity preference %q: %w", opts.PreferredIdentity, ErrCredUnavailable)
+	}
+	return 0, nil
+}
+
+// matchingIdentity searches the Keychain for the identity preferred by opts
+// among those whose certificates match it. The caller owns the returned
+// identity.
+func matchingIdentity(opts Options, authContext C.CFTypeRef, searchList C.CFArrayRef) (C.SecIdentityRef, error) {
+	// Let the Security framework skip identities from other issuers, so that
+	// fewer certificates are parsed in Go.
+	var issuers C.CFArrayRef
+	if cns := opts.exactIssuerCNs(); len(cns) > 0 {
+		if issuers = issuerNames(cns); issuers != 0 {
+			defer C.CFRelease(C.CFTypeRef(issuers))
+		}
+	}
+	leafIdent, err := selectIdentity(opts, authContext, searchList, issuers)
+	if issuers != 0 && errors.Is(err, ErrCredUnavailable) {
+		// The issuer certificates found by name need not be the ones that
+		// issued the identities, so fall back to matching issuers in Go.
+		leafIdent, err = selectIdentity(opts, authContext, searchList, 0)
+	}
+	return leafIdent, err
+}
+
+// selectIdentity returns the identity preferred by opts among those issued by
+// one of issuers, or among all identities if issuers is 0. The caller owns the
+// returned identity.
+func selectIdentity(opts Options, authContext C.CFTypeRef, searchList, issuers C.CFArrayRef) (C.SecIdentityRef, error) {
+	identArrays, err := copyIdentities(authContext, searchList, issuers, opts.AccessGroup, opts.NonInteractive)
+	if err != nil {
+		return 0, err
+	}
+	defer releaseArrays(identArrays)
+	// Dump the certs into golang x509 Certificates.
 	var (
-		certs      []*x509.Certificate
-		prev, next *x509.Certificate
+		idents      []C.SecIdentityRef
+		candidates  []candidate
+		unsupported error // Why a matching identity was skipped, if it was.
 	)
-	for prev = leaf; prev != nil; prev, next = next, nil {
-		certs = append(certs, prev)
-		for _, xc := range allCerts {
-			if certIn(xc, certs) {
-				continue // finite chains only, mmmmkay.
+	// Collect every valid leaf that matches the filter in opts.
+	// Validation in identityToX509 covers Not Before, Not After and key alg.
+	for _, signingIdents := range identArrays {
+		for i := 0; i < int(C.CFArrayGetCount(signingIdents)); i++ {
+			identDict := C.CFArrayGetValueAtIndex(signingIdents, C.CFIndex(i))
+			xc, err := identityToX509(C.SecIdentityRef(identDict))
+			if errors.Is(err, errEd25519Unsupported) && opts.matches(xc) {
+				unsupported = err
+			}
+			if err != nil {
+				continue
+			}
+			if !opts.matches(xc) {
+				continue
 			}
-			if bytes.Equal(prev.RawIssuer, xc.RawSubject) && prev.CheckSignatureFrom(xc) == nil {
-				// Prefer certificates with later expirations.
-				if next == nil || xc.NotAfter.After(next.NotAfter) {
-					next = xc
+			c := candidate{cert: xc}
+			if opts.Policy == SelectHardwareBacked {
+				if skr, err := identityToPrivateSecKeyRef(C.SecIdentityRef(identDict)); err == nil {
+					c.hardware = isHardwareBackedKey(skr)
+					C.CFRelease(C.CFTypeRef(skr))
 				}
 			}
+			idents = append(idents, C.SecIdentityRef(identDict))
+			candidates = append(candidates, c)
 		}
 	}
-	if len(certs) == 0 {
-		return nil, fmt.Errorf("no key found with issuer common name %q", issuerCN)
+	i := opts.preferred(candidates)
+	if i < 0 && unsupported != nil {
+		return 0, fmt.Errorf("no usable key found with %v: %v: %w", opts, unsupported, ErrCredUnavailable)
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("no key found with %v: %w", opts, ErrCredUnavailable)
 	}
+	C.CFRetain(C.CFTypeRef(idents[i]))
+	return idents[i], nil
+}
 
-	skr, err := identityToPrivateSecKeyRef(leafIdent)
+// issuerNames returns the normalized DER-encoded subjects of the certificates
+// in the Keychain named by each of cns, for use with kSecMatchIssuers. It
+// returns 0 if no certificate is found for one of the names, since identities
+// from that issuer could not be matched. The caller owns the returned array.
+func issuerNames(cns []string) C.CFArrayRef {
+	names := C.CFArrayCreateMutable(C.kCFAllocatorDefault, 0, &C.kCFTypeArrayCallBacks)
+	for _, cn := range cns {
+		found := false
+		for _, name := range issuerSubjects(cn) {
+			C.CFArrayAppendValue(names, unsafe.Pointer(name))
+			C.CFRelease(C.CFTypeRef(name))
+			found = true
+		}
+		if !found {
+			C.CFRelease(C.CFTypeRef(names))
+			return 0
+		}
+	}
+	return C.CFArrayRef(names)
+}
 
-	if err != nil {
-		return nil, err
+// issuerSubjects returns the normalized subjects of the certificates in the
+// Keychain whose common name is cn. Certificates are labelled with their
+// common name when added, so the lookup does not enumerate the Keychain. The
+// caller owns the returned data.
+func issuerSubjects(cn string) []C.CFDataRef {
+	label := stringToCFString(cn)
+	defer C.CFRelease(C.CFTypeRef(label))
+	query := C.CFDictionaryCreateMutable(C.kCFAllocatorDefault, 4, &C.kCFTypeDictionaryKeyCallBacks, &C.kCFTypeDictionaryValueCallBacks)
+	defer C.CFRelease(C.CFTypeRef(query))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecClass), unsafe.Pointer(C.kSecClassCertificate))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecAttrLabel), unsafe.Pointer(label))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecReturnRef), unsafe.Pointer(C.kCFBooleanTrue))
+	C.CFDictionaryAddValue(query, unsafe.Pointer(C.kSecMatchLimit), unsafe.Pointer(C.kSecMatchLimitAll))
+	var matches C.CFTypeRef
+	if C.SecItemCopyMatching(C.CFDictionaryRef(query), &matches) != C.errSecSuccess {
+		return nil
 	}
-	pubKey, err := identityToPublicSecKeyRef(leafIdent)
-	if err != nil {
-		return nil, err
+	defer C.CFRelease(matches)
+	var subjects []C.CFDataRef
+	certRefs := C.CFArrayRef(matches)
+	for i := 0; i < int(C.CFArrayGetCount(certRefs)); i++ {
+		certRef := C.SecCertificateRef(C.CFArrayGetValueAtIndex(certRefs, C.CFIndex(i)))
+		if xc, err := certRefToX509(certRef); err != nil || xc.Subject.CommonName != cn {
+			continue
+		}
+		if subject := C.SecCertificateCopyNormalizedSubjectSequence(certRef); subject != 0 {
+			subjects = append(subjects, subject)
+		}
 	}
-	defer C.CFRelease(C.CFTypeRef(skr))
-	return newKey(skr, certs, pubKey)
+	return subjects
+}
+
+// trustChain builds the certificate chain of the identity with SecTrust, so
+// that trust settings, cross-signed intermediates and policy constraints are
+// honored. The chain is returned even if it is not trusted on this machine,
+// since only the server decides whether to accept it.
+func trustChain(ident C.SecIdentityRef) ([]*x509.Certificate, error) {
+	var certRef C.SecCertificateRef
+	if errno := C.SecIdentityCopyCertificate(ident, &certRef); errno != 0 {
+		return nil, keychainError(errno)
+	}
+	defer C.CFRelease(C.CFTypeRef(certRef))
+	policy := C.SecPolicyCreateSSL(0, 0)
+	defer C.CFRelease(C.CFTypeRef(policy))
+	var trust C.SecTrustRef
+	if errno := C.SecTrustCreateWithCertificates(C.CFTypeRef(certRef), C.CFTypeRef(policy), &trust); errno != C.errSecSuccess {
+		return nil, keychainError(errno)
+	}
+	defer C.CFRelease(C.CFTypeRef(trust))
+	// Only certificates already on this machine are used.
+	if errno := C.SecTrustSetNetworkFetchAllowed(trust, 0); errno != C.errSecSuccess {
+		return nil, keychainError(errno)
+	}
+	// Evaluation builds the chain; its verdict is deliberately ignored.
+	C.SecTrustEvaluateWithError(trust, nil)
+
+	var certs []*x509.Certificate
+	for i := 0; i < int(C.SecTrustGetCertificateCount(trust)); i++ {
+		xc, err := certRefToX509(C.SecTrustGetCertificateAtIndex(trust, C.CFIndex(i)))
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			// Stop at the first invalid certificate, such as an expired root.
+			break
+		}
+		certs = append(certs, xc)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate chain built")
+	}
+	return certs, nil
 }
 
 // identityToX509 converts a single CFDictionary that contains the item ref and
@@ -352,47 +1018,43 @@ func identityToX509(ident C.SecIdentityRef) (*x509.Certificate, error) {
 	return certRefToX509(certRef)
 }
 
+// errEd25519Unsupported reports a certificate with an Ed25519 key.
+// SecKeyAlgorithm has no EdDSA variant, so the Security framework cannot sign
+// with Ed25519 keys even when the identity is in the Keychain.
+var errEd25519Unsupported = errors.New("Ed25519 keys are not supported by the macOS Security framework")
+
 // certRefToX509 converts a single C.SecCertificateRef into an *x509.Certificate.
+// For a valid certificate with an Ed25519 key, it returns the certificate
+// together with errEd25519Unsupported, so that selection can explain why an
+// identity matching the config was skipped.
 func certRefToX509(certRef C.SecCertificateRef) (*x509.Certificate, error) {
-	// Export the PEM-encoded certificate to a CFDataRef.
-	var certPEMData C.CFDataRef
-	if errno := C.SecItemExport(C.CFTypeRef(certRef), C.kSecFormatUnknown, C.kSecItemPemArmour, nil, &certPEMData); errno != 0 {
-		return nil, keychainError(errno)
-	}
-	defer C.CFRelease(C.CFTypeRef(certPEMData))
-	certPEM := cfDataToBytes(certPEMData)
-
-	// This part based on crypto/tls.
-	var certDERBlock *pem.Block
-	for {
-		certDERBlock, certPEM = pem.Decode(certPEM)
-		if certDERBlock == nil {
-			return nil, fmt.Errorf("failed to parse certificate PEM data")
-		}
-		if certDERBlock.Type == "CERTIFICATE" {
-			// found it
-			break
-		}
+	// Copy the DER-encoded certificate to a CFDataRef.
+	certData := C.SecCertificateCopyData(certRef)
+	if certData == 0 {
+		return nil, fmt.Errorf("failed to copy certificate data")
 	}
+	defer C.CFRelease(C.CFTypeRef(certData))
 
 	// Check the certificate is OK by the x509 library, and obtain the
 	// public key algorithm (which I assume is the same as the private key
 	// algorithm). This also filters out certs missing critical extensions.
-	xc, err := x509.ParseCertificate(certDERBlock.Bytes)
+	xc, err := x509.ParseCertificate(cfDataToBytes(certData))
 	if err != nil {
 		return nil, err
 	}
+	// Check the certificate is valid
+	if n := time.Now(); n.Before(xc.NotBefore) || n.After(xc.NotAfter) {
+		return nil, fmt.Errorf("certificate not valid")
+	}
+
 	switch xc.PublicKey.(type) {
 	case *rsa.PublicKey, *ecdsa.PublicKey:
+	case ed25519.PublicKey:
+		return xc, errEd25519Unsupported
 	default:
 		return nil, fmt.Errorf("unsupported key type %T", xc.PublicKey)
 	}
 
-	// Check the certificate is valid
-	if n := time.Now(); n.Before(xc.NotBefore) || n.After(xc.NotAfter) {
-		return nil, fmt.Errorf("certificate not valid")
-	}
-
 	return xc, nil
 }
 
@@ -426,140 +1088,222 @@ func identityToPublicSecKeyRef(ident C.SecIdentityRef) (C.SecKeyRef, error) {
 	return key, nil
 }
 
-func stringIn(s string, ss []string) bool {
-	for _, s2 := range ss {
-		if s == s2 {
-			return true
-		}
-	}
-	return false
+// encryptionScheme is an RSA padding scheme supported by
+// SecKeyCreateEncryptedData and SecKeyCreateDecryptedData.
+type encryptionScheme struct {
+	algorithm C.CFStringRef
+	name      string
+	overhead  int // Bytes of the key's block size taken up by padding.
 }
 
-func certIn(xc *x509.Certificate, xcs []*x509.Certificate) bool {
-	for _, xc2 := range xcs {
-		if xc.Equal(xc2) {
-			return true
-		}
-	}
-	return false
-}
-
-func (k *Key) getPaddingSize() int {
-	algorithms, algoErr := k.getEncryptAlgorithm()
-	if algoErr != nil {
-		fmt.Printf("algorithm is unsupported. only RSA algorithms are supported. %v", algoErr)
-	}
-	// Each padding scheme has varying number of bytes.
-	pssPaddingBytes := 20
-	oaepPaddingBytes := 130
-	pkcsPaddingBytes := 11
-	switch algorithms {
-	case C.kSecKeyAlgorithmRSASignatureDigestPSSSHA256,
-		C.kSecKeyAlgorithmRSASignatureDigestPSSSHA384,
-		C.kSecKeyAlgorithmRSASignatureDigestPSSSHA512:
-		return pssPaddingBytes
-	case C.kSecKeyAlgorithmRSAEncryptionOAEPSHA256,
-		C.kSecKeyAlgorithmRSAEncryptionOAEPSHA384,
-		C.kSecKeyAlgorithmRSAEncryptionOAEPSHA512:
-		return oaepPaddingBytes
-	case C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15SHA256,
-		C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15SHA384,
-		C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15SHA512:
-		return pkcsPaddingBytes
-	default:
-		return int(UNKNOWN_SECKEY_ALGORITHM)
+// oaepScheme returns the RSA-OAEP scheme using hash for both OAEP and MGF1.
+func oaepScheme(hash crypto.Hash) (encryptionScheme, error) {
+	algorithm, ok := rsaOAEPAlgorithms[hash]
+	if !ok {
+		return encryptionScheme{}, fmt.Errorf("unsupported OAEP hash function %v", hash)
 	}
+	return encryptionScheme{algorithm: algorithm, name: "RSA-OAEP with " + hash.String(), overhead: 2*hash.Size() + 2}, nil
 }
 
-func (k *Key) checkDataSize(plaintext []byte) error {
-	// Plaintext data must be smaller than the key's block size minus padding space.
-	sizeLim := uint64(C.SecKeyGetBlockSize(k.publicKeyRef)) - uint64(k.getPaddingSize())
-	if uint64(len(plaintext)) >= sizeLim {
-		return fmt.Errorf("plaintext is too long")
-	}
-	return nil
+// pkcs1v15Scheme returns the RSA PKCS#1 v1.5 encryption scheme.
+func pkcs1v15Scheme() encryptionScheme {
+	return encryptionScheme{algorithm: rsaPKCS1v15EncryptionAlgorithm, name: "RSA PKCS#1 v1.5", overhead: 11}
 }
 
-func (k *Key) getRSAEncryptAlgorithm() (C.SecKeyAlgorithm, error) {
-	var algorithms map[crypto.Hash]C.CFStringRef
-	switch pub := k.Public().(type) {
-	case *rsa.PublicKey:
-		if C.SecKeyIsAlgorithmSupported(k.publicKeyRef, C.kSecKeyOperationTypeEncrypt, C.kSecKeyAlgorithmRSASignatureDigestPSSSHA256) == 1 {
-			algorithms = rsaPSSAlgorithms
-		} else if C.SecKeyIsAlgorithmSupported(k.publicKeyRef, C.kSecKeyOperationTypeEncrypt, C.kSecKeyAlgorithmRSAEncryptionOAEPSHA256) == 1 {
-			algorithms = rsaOAEPAlgorithms
-		} else if C.SecKeyIsAlgorithmSupported(k.publicKeyRef, C.kSecKeyOperationTypeEncrypt, C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15SHA256) == 1 {
-			algorithms = rsaPKCS1v15Algorithms
+// rsaEncryptionSchemes maps crypto.DecrypterOpts onto the acceptable
+// encryption schemes, in order of preference. opts may be *rsa.OAEPOptions,
+// *rsa.PKCS1v15DecryptOptions or nil, which prefers RSA-OAEP with the Key's
+// hash function and accepts RSA-OAEP with any other supported hash.
+//
+// The Keychain uses the OAEP hash for MGF1 and does not support labels, so
+// OAEP options with a non-empty Label are rejected.
+func (k *Key) rsaEncryptionSchemes(opts crypto.DecrypterOpts) ([]encryptionScheme, error) {
+	if _, ok := k.Public().(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("unsupported key type %T for RSA encryption", k.Public())
+	}
+	switch opts := opts.(type) {
+	case nil:
+		var schemes []encryptionScheme
+		for _, hash := range []crypto.Hash{k.hash, crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+			if scheme, err := oaepScheme(hash); err == nil {
+				schemes = append(schemes, scheme)
+			}
+		}
+		return schemes, nil
+	case *rsa.OAEPOptions:
+		if len(opts.Label) != 0 {
+			return nil, fmt.Errorf("OAEP labels are not supported")
+		}
+		scheme, err := oaepScheme(opts.Hash)
+		if err != nil {
+			return nil, err
 		}
+		return []encryptionScheme{scheme}, nil
+	case *rsa.PKCS1v15DecryptOptions:
+		if opts.SessionKeyLen != 0 {
+			return nil, fmt.Errorf("PKCS#1 v1.5 session key decryption is not supported")
+		}
+		return []encryptionScheme{pkcs1v15Scheme()}, nil
 	default:
-		return UNKNOWN_SECKEY_ALGORITHM, fmt.Errorf("algorithm is unsupported. only RSA algorithms are supported. %T", pub)
+		return nil, fmt.Errorf("unsupported encryption options %T", opts)
 	}
-	return algorithms[k.hash], nil
 }
 
-func (k *Key) getEncryptAlgorithm() (C.SecKeyAlgorithm, error) {
-	if k.hash == 0 {
-		k.hash = crypto.SHA256
+// negotiateScheme returns the first of schemes that key supports for
+// operation, which is kSecKeyOperationTypeEncrypt or kSecKeyOperationTypeDecrypt.
+func negotiateScheme(key C.SecKeyRef, operation C.SecKeyOperationType, schemes []encryptionScheme) (encryptionScheme, error) {
+	var names []string
+	for _, scheme := range schemes {
+		if C.SecKeyIsAlgorithmSupported(key, operation, scheme.algorithm) != 0 {
+			return scheme, nil
+		}
+		names = append(names, scheme.name)
 	}
-	return k.getRSAEncryptAlgorithm()
+	return encryptionScheme{}, fmt.Errorf("key does not support %s", strings.Join(names, " or "))
 }
 
-func (k *Key) getRSADecryptAlgorithm() (C.SecKeyAlgorithm, error) {
-	var algorithms map[crypto.Hash]C.CFStringRef
-	switch pub := k.Public().(type) {
-	case *rsa.PublicKey:
-		if C.SecKeyIsAlgorithmSupported(k.publicKeyRef, C.kSecKeyOperationTypeDecrypt, C.kSecKeyAlgorithmRSASignatureDigestPSSSHA256) == 1 {
-			algorithms = rsaPSSAlgorithms
-		} else if C.SecKeyIsAlgorithmSupported(k.publicKeyRef, C.kSecKeyOperationTypeDecrypt, C.kSecKeyAlgorithmRSAEncryptionOAEPSHA256) == 1 {
-			algorithms = rsaOAEPAlgorithms
-		} else if C.SecKeyIsAlgorithmSupported(k.publicKeyRef, C.kSecKeyOperationTypeDecrypt, C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15SHA256) == 1 {
-			algorithms = rsaPKCS1v15Algorithms
+// Encrypt encrypts plaintext with the public key. For RSA keys opts selects the
+// padding scheme in the same way as for Decrypt, so a ciphertext produced with
+// a given opts is decrypted by passing the same opts to Decrypt, and the
+// plaintext must fit in the key's block size once padded. EC keys use ECIES,
+// as described in the ecies package, and opts must be nil.
+func (k *Key) Encrypt(plaintext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if pub, ok := k.Public().(*ecdsa.PublicKey); ok {
+		if opts != nil {
+			return nil, fmt.Errorf("unsupported encryption options %T for an EC key", opts)
 		}
-	default:
-		return UNKNOWN_SECKEY_ALGORITHM, fmt.Errorf("algorithm is unsupported. only RSA algorithms are supported. %T", pub)
+		return ecies.Encrypt(rand.Reader, pub, plaintext)
 	}
-	return algorithms[k.hash], nil
-}
-
-func (k *Key) getDecryptAlgorithm() (C.SecKeyAlgorithm, error) {
-	return k.getRSADecryptAlgorithm()
-}
-
-func (k *Key) Encrypt(plaintext []byte) ([]byte, error) {
-	pub := k.publicKeyRef
-	algorithm, err := k.getEncryptAlgorithm()
+	schemes, err := k.rsaEncryptionSchemes(opts)
 	if err != nil {
 		return nil, err
 	}
-	if err := k.checkDataSize(plaintext); err != nil {
+	scheme, err := negotiateScheme(k.publicKeyRef, C.kSecKeyOperationTypeEncrypt, schemes)
+	if err != nil {
 		return nil, err
 	}
-	msg := bytesToCFData(plaintext)
-	var cfErr C.CFErrorRef
-	bytes := C.SecKeyCreateEncryptedData(pub, algorithm, msg, &cfErr)
+	blockSize := int(C.SecKeyGetBlockSize(k.publicKeyRef))
+	if max := blockSize - scheme.overhead; len(plaintext) > max {
+		return nil, fmt.Errorf("plaintext is %d bytes, but %s with a %d-bit key encrypts at most %d bytes", len(plaintext), scheme.name, 8*blockSize, max)
+	}
+
+	// Copy input over into CF-land.
+	cfPlaintext := bytesToCFData(plaintext)
+	defer C.CFRelease(C.CFTypeRef(cfPlaintext))
 
+	var cfErr C.CFErrorRef
+	ciphertext := C.SecKeyCreateEncryptedData(C.SecKeyRef(k.publicKeyRef), scheme.algorithm, C.CFDataRef(cfPlaintext), &cfErr)
 	if cfErr != 0 {
 		return nil, cfErrorFromRef(cfErr)
 	}
+	if ciphertext == 0 {
+		return nil, fmt.Errorf("%s encryption failed", scheme.name)
+	}
+	defer C.CFRelease(C.CFTypeRef(ciphertext))
+
+	return cfDataToBytes(C.CFDataRef(ciphertext)), nil
+}
+
+// EncryptOAEP encrypts plaintext with the public key using RSA-OAEP with the
+// given hash function, without a label. The result is decrypted by DecryptOAEP
+// with the same hash function.
+func (k *Key) EncryptOAEP(hash crypto.Hash, plaintext []byte) ([]byte, error) {
+	return k.Encrypt(plaintext, &rsa.OAEPOptions{Hash: hash})
+}
 
-	ciphertext := cfDataToBytes(bytes)
-	return ciphertext, cfErrorFromRef(cfErr)
+// EncryptPKCS1v15 encrypts plaintext with the public key using RSA PKCS#1 v1.5
+// padding. The result is decrypted by DecryptPKCS1v15.
+func (k *Key) EncryptPKCS1v15(plaintext []byte) ([]byte, error) {
+	return k.Encrypt(plaintext, &rsa.PKCS1v15DecryptOptions{})
 }
 
-func (k *Key) Decrypt(ciphertext []byte) ([]byte, error) {
-	priv := k.privateKeyRef
-	algorithm, err := k.getDecryptAlgorithm()
+// Decrypt implements crypto.Decrypter. For RSA keys opts may be
+// *rsa.OAEPOptions, *rsa.PKCS1v15DecryptOptions or nil, which selects RSA-OAEP
+// with the Key's hash function, or another OAEP hash function if the key does
+// not support it. EC keys decrypt ECIES ciphertexts, and opts must be nil.
+func (k *Key) Decrypt(_ io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if _, ok := k.Public().(*ecdsa.PublicKey); ok {
+		if opts != nil {
+			return nil, fmt.Errorf("unsupported decryption options %T for an EC key", opts)
+		}
+		return k.decryptECIES(ciphertext)
+	}
+	schemes, err := k.rsaEncryptionSchemes(opts)
 	if err != nil {
 		return nil, err
 	}
-	msg := bytesToCFData(ciphertext)
-	var cfErr C.CFErrorRef
-	bytes := C.SecKeyCreateDecryptedData(priv, algorithm, msg, &cfErr)
+	return k.decrypt(schemes, ciphertext)
+}
+
+// DecryptOAEP decrypts ciphertext with the private key using RSA-OAEP with the
+// given hash function. SHA-256, SHA-384 and SHA-512 are supported.
+func (k *Key) DecryptOAEP(hash crypto.Hash, ciphertext []byte) ([]byte, error) {
+	scheme, err := oaepScheme(hash)
+	if err != nil {
+		return nil, err
+	}
+	return k.decrypt([]encryptionScheme{scheme}, ciphertext)
+}
 
+// DecryptPKCS1v15 decrypts ciphertext with the private key using RSA PKCS#1 v1.5 padding.
+func (k *Key) DecryptPKCS1v15(ciphertext []byte) ([]byte, error) {
+	return k.decrypt([]encryptionScheme{pkcs1v15Scheme()}, ciphertext)
+}
+
+// decrypt passes the decryption off to the Keychain library using the first of
+// schemes that the private key supports.
+func (k *Key) decrypt(schemes []encryptionScheme, ciphertext []byte) ([]byte, error) {
+	if _, ok := k.Public().(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("unsupported key type %T for RSA decryption", k.Public())
+	}
+	if len(ciphertext) == 0 {
+		return nil, fmt.Errorf("ciphertext is empty")
+	}
+	scheme, err := negotiateScheme(k.privateKeyRef, C.kSecKeyOperationTypeDecrypt, schemes)
+	if err != nil {
+		return nil, err
+	}
+	if blockSize := int(C.SecKeyGetBlockSize(k.privateKeyRef)); len(ciphertext) != blockSize {
+		return nil, fmt.Errorf("ciphertext is %d bytes, want %d bytes for a %d-bit key", len(ciphertext), blockSize, 8*blockSize)
+	}
+	return k.createDecryptedData(scheme, ciphertext)
+}
+
+// eciesScheme is the ECIES variant that the ecies package implements, so that
+// the Keychain decrypts what Encrypt and the other platforms' signers produce.
+var eciesScheme = encryptionScheme{algorithm: C.kSecKeyAlgorithmECIESEncryptionCofactorVariableIVX963SHA256AESGCM, name: "ECIES"}
+
+// decryptECIES decrypts an ECIES ciphertext with the private EC key.
+func (k *Key) decryptECIES(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, fmt.Errorf("ciphertext is empty")
+	}
+	if C.SecKeyIsAlgorithmSupported(k.privateKeyRef, C.kSecKeyOperationTypeDecrypt, eciesScheme.algorithm) == 0 {
+		return nil, fmt.Errorf("key does not support %s", eciesScheme.name)
+	}
+	return k.createDecryptedData(eciesScheme, ciphertext)
+}
+
+// createDecryptedData passes the decryption of ciphertext with scheme off to
+// the Keychain library.
+func (k *Key) createDecryptedData(scheme encryptionScheme, ciphertext []byte) ([]byte, error) {
+	// Copy input over into CF-land.
+	cfCiphertext := bytesToCFData(ciphertext)
+	defer C.CFRelease(C.CFTypeRef(cfCiphertext))
+
+	if k.serialize {
+		k.tokenMu.Lock()
+		defer k.tokenMu.Unlock()
+	}
+	var cfErr C.CFErrorRef
+	plaintext := C.SecKeyCreateDecryptedData(C.SecKeyRef(k.privateKeyRef), scheme.algorithm, C.CFDataRef(cfCiphertext), &cfErr)
 	if cfErr != 0 {
 		return nil, cfErrorFromRef(cfErr)
 	}
+	if plaintext == 0 {
+		return nil, fmt.Errorf("%s decryption failed", scheme.name)
+	}
+	defer C.CFRelease(C.CFTypeRef(plaintext))
 
-	plaintext := cfDataToBytes(bytes)
-	return plaintext, cfErrorFromRef(cfErr)
+	return cfDataToBytes(C.CFDataRef(plaintext)), nil
 }
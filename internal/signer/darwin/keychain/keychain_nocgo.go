@@ -0,0 +1,398 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin && !cgo
+// +build darwin,!cgo
+
+// This file implements the package without cgo by running /usr/bin/security.
+// It can resolve credentials and encrypt with their public keys, but the
+// Security framework is required for any private key operation.
+
+package keychain
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/ecies"
+)
+
+// securityPath is the keychain command line tool shipped with macOS.
+const securityPath = "/usr/bin/security"
+
+// PrivateKeyOperations reports whether Keys can sign and decrypt, which
+// requires the Security framework and so cgo.
+const PrivateKeyOperations = false
+
+// errNoCgo is returned for private key operations in builds without cgo.
+var errNoCgo = errors.New("keychain: private key operations require a build with cgo enabled")
+
+// identityLine matches an identity listed by "security find-identity", such as
+// `  1) 3A7B...C0 "device-1234"`, capturing its SHA-1 hash.
+var identityLine = regexp.MustCompile(`^\s*\d+\)\s+([0-9A-Fa-f]{40})\s`)
+
+// preferenceHash matches the SHA-1 hash line printed by
+// "security get-identity-preference -Z".
+var preferenceHash = regexp.MustCompile(`SHA-1 hash:\s*([0-9A-Fa-f]{40})`)
+
+// Key is a certificate chain found in the Keychain. Without cgo only its
+// public key can be used.
+type Key struct {
+	certs []*x509.Certificate
+	hash  crypto.Hash
+}
+
+// CertificateChain returns the credential as a raw X509 cert chain. This
+// contains the public key.
+func (k *Key) CertificateChain() [][]byte {
+	rv := make([][]byte, len(k.certs))
+	for i, c := range k.certs {
+		rv[i] = c.Raw
+	}
+	return rv
+}
+
+// Close releases nothing; it exists for parity with cgo builds.
+func (k *Key) Close() error {
+	return nil
+}
+
+// Public returns the public key of the leaf certificate.
+func (k *Key) Public() crypto.PublicKey {
+	return k.certs[0].PublicKey
+}
+
+// Sign always fails without cgo.
+func (k *Key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return nil, errNoCgo
+}
+
+// SignMessage always fails without cgo.
+func (k *Key) SignMessage(message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return nil, errNoCgo
+}
+
+// Verify checks in Go that sig is a valid signature of digest by the key.
+func (k *Key) Verify(digest, sig []byte, opts crypto.SignerOpts) error {
+	switch pub := k.Public().(type) {
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			return rsa.VerifyPSS(pub, opts.HashFunc(), digest, sig, pssOpts)
+		}
+		return rsa.VerifyPKCS1v15(pub, opts.HashFunc(), digest, sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			return errors.New("keychain: invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %T", pub)
+	}
+}
+
+// Encrypt encrypts plaintext with the public key in Go. For RSA keys opts
+// selects the padding scheme as in cgo builds: *rsa.OAEPOptions,
+// *rsa.PKCS1v15DecryptOptions or nil for RSA-OAEP with SHA-256. EC keys use
+// ECIES, and opts must be nil.
+func (k *Key) Encrypt(plaintext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if pub, ok := k.Public().(*ecdsa.PublicKey); ok {
+		if opts != nil {
+			return nil, fmt.Errorf("unsupported encryption options %T for an EC key", opts)
+		}
+		return ecies.Encrypt(rand.Reader, pub, plaintext)
+	}
+	pub, ok := k.Public().(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", k.Public())
+	}
+	hash := k.hash
+	switch opts := opts.(type) {
+	case nil:
+	case *rsa.OAEPOptions:
+		if len(opts.Label) != 0 {
+			return nil, fmt.Errorf("OAEP labels are not supported")
+		}
+		hash = opts.Hash
+	case *rsa.PKCS1v15DecryptOptions:
+		return rsa.EncryptPKCS1v15(rand.Reader, pub, plaintext)
+	default:
+		return nil, fmt.Errorf("unsupported encryption options %T", opts)
+	}
+	if _, err := oaepHash(hash); err != nil {
+		return nil, err
+	}
+	return rsa.EncryptOAEP(hash.New(), rand.Reader, pub, plaintext, nil)
+}
+
+// EncryptOAEP encrypts plaintext with the public key using RSA-OAEP with the
+// given hash function, without a label.
+func (k *Key) EncryptOAEP(hash crypto.Hash, plaintext []byte) ([]byte, error) {
+	return k.Encrypt(plaintext, &rsa.OAEPOptions{Hash: hash})
+}
+
+// EncryptPKCS1v15 encrypts plaintext with the public key using RSA PKCS#1 v1.5 padding.
+func (k *Key) EncryptPKCS1v15(plaintext []byte) ([]byte, error) {
+	return k.Encrypt(plaintext, &rsa.PKCS1v15DecryptOptions{})
+}
+
+// oaepHash checks that hash is an OAEP hash function supported in cgo builds.
+func oaepHash(hash crypto.Hash) (crypto.Hash, error) {
+	switch hash {
+	case crypto.SHA256, crypto.SHA384, crypto.SHA512:
+		return hash, nil
+	default:
+		return 0, fmt.Errorf("unsupported OAEP hash function %v", hash)
+	}
+}
+
+// Attributes always fails without cgo.
+func (k *Key) Attributes() (KeyAttributes, error) {
+	return KeyAttributes{}, errNoCgo
+}
+
+// Decrypt always fails without cgo.
+func (k *Key) Decrypt(_ io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return nil, errNoCgo
+}
+
+// DecryptOAEP always fails without cgo.
+func (k *Key) DecryptOAEP(hash crypto.Hash, ciphertext []byte) ([]byte, error) {
+	return nil, errNoCgo
+}
+
+// DecryptPKCS1v15 always fails without cgo.
+func (k *Key) DecryptPKCS1v15(ciphertext []byte) ([]byte, error) {
+	return nil, errNoCgo
+}
+
+// GenerateKey always fails without cgo.
+func GenerateKey(opts KeyGenOptions) (*Key, error) {
+	return nil, errNoCgo
+}
+
+// ImportIdentity always fails without cgo.
+func ImportIdentity(data []byte, opts ImportOptions) (CredentialInfo, error) {
+	return CredentialInfo{}, errNoCgo
+}
+
+// Cred gets the first Credential (filtering on issuer) corresponding to
+// available certificate and private key pairs (i.e. identities) available in
+// the user's keychain search list.
+func Cred(issuerCN string) (*Key, error) {
+	return CredWithOptions(Options{IssuerCN: issuerCN})
+}
+
+// CredWithOptions is like Cred, but selects an identity whose leaf
+// certificate satisfies every criterion set in opts. Without cgo the data
+// protection keychain cannot be searched, and the chain is built from the
+// certificates in the searched keychains.
+func CredWithOptions(opts Options) (*Key, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.AccessGroup != "" {
+		return nil, fmt.Errorf("keychain: access groups require a build with cgo enabled")
+	}
+	path, _ := keychainPath(opts.Keychain)
+	leaves, all, err := securityIdentities(path)
+	if err != nil {
+		return nil, err
+	}
+	leaf := preferredCertificate(opts, leaves)
+	if leaf == nil && opts.PreferredIdentity != "" && !opts.hasAttributeCriteria() {
+		return nil, fmt.Errorf("no usable identity preference %q: %w", opts.PreferredIdentity, ErrCredUnavailable)
+	}
+	if leaf == nil {
+		var candidates []candidate
+		for _, xc := range leaves {
+			if opts.matches(xc) {
+				candidates = append(candidates, candidate{cert: xc})
+			}
+		}
+		i := opts.preferred(candidates)
+		if i < 0 {
+			return nil, fmt.Errorf("no key found with %v: %w", opts, ErrCredUnavailable)
+		}
+		leaf = candidates[i].cert
+	}
+	certs := buildChain(leaf, all)
+	if opts.FetchIntermediates {
+		certs = completeChain(certs)
+	}
+	if opts.ExcludeRoot {
+		certs = withoutRoot(certs)
+	}
+	return &Key{certs: certs, hash: crypto.SHA256}, nil
+}
+
+// ListCredentials describes every valid identity in the user's keychain search
+// list. Token IDs are unknown without cgo and are left empty.
+func ListCredentials() ([]CredentialInfo, error) {
+	leaves, _, err := securityIdentities("")
+	if err != nil {
+		return nil, err
+	}
+	var creds []CredentialInfo
+	for _, xc := range leaves {
+		creds = append(creds, newCredentialInfo(xc, ""))
+	}
+	return creds, nil
+}
+
+// securityIdentities returns the valid certificates that have a private key in
+// the keychain at path, or in the search list if path is empty, along with
+// every valid certificate in the same keychains.
+func securityIdentities(path string) (leaves, all []*x509.Certificate, err error) {
+	var keychains []string
+	if path != "" {
+		keychains = []string{path}
+	}
+	idOut, err := runSecurity(append([]string{"find-identity", "-v"}, keychains...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	certOut, err := runSecurity(append([]string{"find-certificate", "-a", "-p"}, keychains...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	identities := parseIdentityHashes(idOut)
+	for _, xc := range parseCertificates(certOut) {
+		if n := time.Now(); n.Before(xc.NotBefore) || n.After(xc.NotAfter) {
+			continue
+		}
+		all = append(all, xc)
+		sum := sha1.Sum(xc.Raw)
+		if identities[hex.EncodeToString(sum[:])] {
+			leaves = append(leaves, xc)
+		}
+	}
+	return leaves, all, nil
+}
+
+// preferredCertificate returns the certificate among leaves of the identity
+// preference named by opts.PreferredIdentity, if it satisfies opts.
+func preferredCertificate(opts Options, leaves []*x509.Certificate) *x509.Certificate {
+	if opts.PreferredIdentity == "" {
+		return nil
+	}
+	out, err := runSecurity("get-identity-preference", "-s", opts.PreferredIdentity, "-Z")
+	if err != nil {
+		return nil
+	}
+	hash := parsePreferenceHash(out)
+	for _, xc := range leaves {
+		sum := sha1.Sum(xc.Raw)
+		if hex.EncodeToString(sum[:]) == hash && opts.matches(xc) {
+			return xc
+		}
+	}
+	return nil
+}
+
+// parsePreferenceHash returns the lowercase SHA-1 hash of the certificate
+// printed by "security get-identity-preference -Z", or "" if there is none.
+func parsePreferenceHash(out []byte) string {
+	if m := preferenceHash.FindSubmatch(out); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+	return ""
+}
+
+// runSecurity runs the security tool with args and returns its output.
+func runSecurity(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(securityPath, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("security %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// parseIdentityHashes returns the lowercase SHA-1 hashes of the certificates
+// listed by "security find-identity".
+func parseIdentityHashes(out []byte) map[string]bool {
+	hashes := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := identityLine.FindStringSubmatch(line); m != nil {
+			hashes[strings.ToLower(m[1])] = true
+		}
+	}
+	return hashes
+}
+
+// parseCertificates returns the certificates in the PEM output of
+// "security find-certificate -p", skipping any that fail to parse.
+func parseCertificates(out []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, out = pem.Decode(out)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if xc, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, xc)
+		}
+	}
+}
+
+// buildChain builds a certificate chain from leaf by matching prev.RawIssuer
+// to next.RawSubject across all, preferring issuers with later expirations.
+func buildChain(leaf *x509.Certificate, all []*x509.Certificate) []*x509.Certificate {
+	var (
+		certs      []*x509.Certificate
+		prev, next *x509.Certificate
+	)
+	for prev = leaf; prev != nil; prev, next = next, nil {
+		certs = append(certs, prev)
+		for _, xc := range all {
+			if certIn(xc, certs) {
+				continue
+			}
+			if bytes.Equal(prev.RawIssuer, xc.RawSubject) && prev.CheckSignatureFrom(xc) == nil {
+				if next == nil || xc.NotAfter.After(next.NotAfter) {
+					next = xc
+				}
+			}
+		}
+	}
+	return certs
+}
+
+func certIn(xc *x509.Certificate, xcs []*x509.Certificate) bool {
+	for _, xc2 := range xcs {
+		if xc.Equal(xc2) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin && !cgo
+// +build darwin,!cgo
+
+package keychain
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"testing"
+)
+
+func TestParseIdentityHashes(t *testing.T) {
+	out := []byte(`
+Policy: X.509 Basic
+  Matching identities
+  1) 3A7B9C00112233445566778899AABBCCDDEEFF00 "device-1234"
+  2) 0123456789abcdef0123456789abcdef01234567 "Apple Development: dev@example.com (ABCDE12345)"
+     2 valid identities found
+`)
+	got := parseIdentityHashes(out)
+	for _, want := range []string{"3a7b9c00112233445566778899aabbccddeeff00", "0123456789abcdef0123456789abcdef01234567"} {
+		if !got[want] {
+			t.Errorf("parseIdentityHashes: missing %s in %v", want, got)
+		}
+	}
+	if len(got) != 2 {
+		t.Errorf("parseIdentityHashes: got %d hashes, want 2", len(got))
+	}
+}
+
+func TestParsePreferenceHash(t *testing.T) {
+	out := []byte("SHA-1 hash: 3A7B9C00112233445566778899AABBCCDDEEFF00\n")
+	if got, want := parsePreferenceHash(out), "3a7b9c00112233445566778899aabbccddeeff00"; got != want {
+		t.Errorf("parsePreferenceHash: got %q, want %q", got, want)
+	}
+	if got := parsePreferenceHash([]byte("")); got != "" {
+		t.Errorf("parsePreferenceHash(no preference): got %q, want empty", got)
+	}
+}
+
+func TestParseCertificatesAndBuildChain(t *testing.T) {
+	root, rootKey := issueTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Root CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil, nil)
+	leaf, _ := issueTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "device-1234"}}, root, rootKey)
+
+	var out []byte
+	for _, xc := range []*x509.Certificate{root, leaf} {
+		out = append(out, "keychain: \"/Users/ci/Library/Keychains/login.keychain-db\"\n"...)
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: xc.Raw})...)
+	}
+	certs := parseCertificates(out)
+	if len(certs) != 2 {
+		t.Fatalf("parseCertificates: got %d certificates, want 2", len(certs))
+	}
+	sum := sha1.Sum(certs[1].Raw)
+	if !parseIdentityHashes([]byte("  1) " + hex.EncodeToString(sum[:]) + " \"device-1234\"\n"))[hex.EncodeToString(sum[:])] {
+		t.Error("parseIdentityHashes: the identity hash does not match the certificate's SHA-1 hash")
+	}
+	chain := buildChain(certs[1], certs)
+	if len(chain) != 2 || !chain[0].Equal(leaf) || !chain[1].Equal(root) {
+		t.Errorf("buildChain: got %d certificates, want leaf and root", len(chain))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	xc, priv := issueTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "device-1234"}}, nil, nil)
+	key := &Key{certs: []*x509.Certificate{xc}, hash: crypto.SHA256}
+	digest := sha256.Sum256([]byte("health check"))
+	sig, err := priv.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Verify(digest[:], sig, crypto.SHA256); err != nil {
+		t.Errorf("Verify: got %v, want nil err", err)
+	}
+	sig[len(sig)-1] ^= 1
+	if err := key.Verify(digest[:], sig, crypto.SHA256); err == nil {
+		t.Error("Verify with a corrupted signature: got nil err, want error")
+	}
+}
@@ -18,6 +18,15 @@ package keychain
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"testing"
 	"unsafe"
 )
@@ -56,7 +65,7 @@ func TestEncrypt(t *testing.T) {
 		return
 	}
 	plaintext := []byte("Plain text to encrypt")
-	_, err = key.Encrypt(plaintext)
+	_, err = key.Encrypt(plaintext, nil)
 	if err != nil {
 		t.Errorf("Encrypt: got %v, want nil err", err)
 		return
@@ -71,7 +80,7 @@ func BenchmarkEncrypt(b *testing.B) {
 	}
 	plaintext := []byte("Plain text to encrypt")
 	for i := 0; i < b.N; i++ {
-		_, err := key.Encrypt(plaintext)
+		_, err := key.Encrypt(plaintext, nil)
 		if err != nil {
 			b.Errorf("Encrypt: got %v, want nil err", err)
 		}
@@ -85,8 +94,8 @@ func TestDecrypt(t *testing.T) {
 		return
 	}
 	byteSlice := []byte("Plain text to encrypt")
-	ciphertext, _ := key.Encrypt(byteSlice)
-	plaintext, err := key.Decrypt(ciphertext)
+	ciphertext, _ := key.Encrypt(byteSlice, nil)
+	plaintext, err := key.Decrypt(nil, ciphertext, nil)
 	if err != nil {
 		t.Errorf("Decrypt: got %v, want nil err", err)
 		return
@@ -103,11 +112,428 @@ func BenchmarkDecrypt(b *testing.B) {
 		return
 	}
 	byteSlice := []byte("Plain text to encrypt")
-	ciphertext, _ := key.Encrypt(byteSlice)
+	ciphertext, _ := key.Encrypt(byteSlice, nil)
 	for i := 0; i < b.N; i++ {
-		_, err := key.Decrypt(ciphertext)
+		_, err := key.Decrypt(nil, ciphertext, nil)
 		if err != nil {
 			b.Errorf("Decrypt: got %v, want nil err", err)
 		}
 	}
 }
+
+func TestDecryptOAEP(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	want := []byte("Plain text to encrypt")
+	for _, hash := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		ciphertext, err := rsa.EncryptOAEP(hash.New(), rand.Reader, key.Public().(*rsa.PublicKey), want, nil)
+		if err != nil {
+			t.Fatalf("EncryptOAEP(%v): got %v, want nil err", hash, err)
+		}
+		got, err := key.DecryptOAEP(hash, ciphertext)
+		if err != nil {
+			t.Errorf("DecryptOAEP(%v): got %v, want nil err", hash, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("DecryptOAEP(%v): got %v, want %v", hash, got, want)
+		}
+	}
+}
+
+func TestDecryptPKCS1v15(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	want := []byte("Plain text to encrypt")
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, key.Public().(*rsa.PublicKey), want)
+	if err != nil {
+		t.Fatalf("EncryptPKCS1v15: got %v, want nil err", err)
+	}
+	got, err := key.DecryptPKCS1v15(ciphertext)
+	if err != nil {
+		t.Fatalf("DecryptPKCS1v15: got %v, want nil err", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("DecryptPKCS1v15: got %v, want %v", got, want)
+	}
+}
+
+func TestDecrypter(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	var decrypter crypto.Decrypter = key
+	want := []byte("Plain text to encrypt")
+	pub := decrypter.Public().(*rsa.PublicKey)
+
+	oaepCiphertext, err := rsa.EncryptOAEP(crypto.SHA384.New(), rand.Reader, pub, want, nil)
+	if err != nil {
+		t.Fatalf("EncryptOAEP: got %v, want nil err", err)
+	}
+	got, err := decrypter.Decrypt(nil, oaepCiphertext, &rsa.OAEPOptions{Hash: crypto.SHA384})
+	if err != nil {
+		t.Errorf("Decrypt with OAEP options: got %v, want nil err", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Decrypt with OAEP options: got %v, want %v", got, want)
+	}
+
+	pkcs1Ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, pub, want)
+	if err != nil {
+		t.Fatalf("EncryptPKCS1v15: got %v, want nil err", err)
+	}
+	got, err = decrypter.Decrypt(nil, pkcs1Ciphertext, &rsa.PKCS1v15DecryptOptions{})
+	if err != nil {
+		t.Errorf("Decrypt with PKCS#1 v1.5 options: got %v, want nil err", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Decrypt with PKCS#1 v1.5 options: got %v, want %v", got, want)
+	}
+
+	if _, err := decrypter.Decrypt(nil, oaepCiphertext, &rsa.OAEPOptions{Hash: crypto.SHA384, Label: []byte("label")}); err == nil {
+		t.Error("Decrypt with OAEP label: got nil err, want error")
+	}
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	want := []byte("Plain text to encrypt")
+	for _, opts := range []crypto.DecrypterOpts{
+		nil,
+		&rsa.OAEPOptions{Hash: crypto.SHA256},
+		&rsa.OAEPOptions{Hash: crypto.SHA512},
+		&rsa.PKCS1v15DecryptOptions{},
+	} {
+		ciphertext, err := key.Encrypt(want, opts)
+		if err != nil {
+			t.Errorf("Encrypt(%#v): got %v, want nil err", opts, err)
+			continue
+		}
+		got, err := key.Decrypt(nil, ciphertext, opts)
+		if err != nil {
+			t.Errorf("Decrypt(%#v): got %v, want nil err", opts, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Decrypt(%#v): got %v, want %v", opts, got, want)
+		}
+	}
+}
+
+func TestCredSoftwareKeyIsNotSecureEnclave(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	if key.secureEnclave {
+		t.Error("Cred: got Secure Enclave key, want software key for test credentials")
+	}
+}
+
+func TestSignSHA1RequiresAllowLegacyHashes(t *testing.T) {
+	digest := sha1.Sum([]byte("legacy endpoint"))
+
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	if _, err := key.Sign(nil, digest[:], crypto.SHA1); err == nil {
+		t.Error("Sign(SHA1): got nil err, want error without AllowLegacyHashes")
+	}
+
+	legacyKey, err := CredWithOptions(Options{IssuerCN: TEST_CREDENTIALS, AllowLegacyHashes: true})
+	if err != nil {
+		t.Fatalf("CredWithOptions: got %v, want nil err", err)
+	}
+	sig, err := legacyKey.Sign(nil, digest[:], crypto.SHA1)
+	if err != nil {
+		t.Fatalf("Sign(SHA1): got %v, want nil err", err)
+	}
+	if err := rsa.VerifyPKCS1v15(legacyKey.Public().(*rsa.PublicKey), crypto.SHA1, digest[:], sig); err != nil {
+		t.Errorf("VerifyPKCS1v15: got %v, want nil err", err)
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	message := []byte("message hashed by the key")
+	digest := sha256.Sum256(message)
+	for _, opts := range []crypto.SignerOpts{crypto.SHA256, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}} {
+		sig, err := key.SignMessage(message, opts)
+		if err != nil {
+			t.Errorf("SignMessage(%v): got %v, want nil err", opts, err)
+			continue
+		}
+		pub := key.Public().(*rsa.PublicKey)
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			err = rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, pss)
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+		}
+		if err != nil {
+			t.Errorf("verifying SignMessage(%v): got %v, want nil err", opts, err)
+		}
+	}
+}
+
+func TestCredCached(t *testing.T) {
+	first, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	defer first.Close()
+	second, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred from cache: got %v, want nil err", err)
+	}
+	defer second.Close()
+	want, got := first.CertificateChain(), second.CertificateChain()
+	if len(got) != len(want) || !bytes.Equal(got[0], want[0]) {
+		t.Errorf("Cred from cache: got a different chain than the first lookup")
+	}
+	digest := sha256.Sum256([]byte("cached identity"))
+	if _, err := second.Sign(nil, digest[:], crypto.SHA256); err != nil {
+		t.Errorf("Sign with cached identity: got %v, want nil err", err)
+	}
+}
+
+func TestEncryptPlaintextTooLong(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	// A 2048-bit key encrypts at most 256-2*32-2 bytes with RSA-OAEP and
+	// SHA-256, and 256-11 bytes with PKCS#1 v1.5.
+	tests := []struct {
+		opts    crypto.DecrypterOpts
+		size    int
+		wantErr bool
+	}{
+		{opts: nil, size: 190},
+		{opts: nil, size: 191, wantErr: true},
+		{opts: &rsa.PKCS1v15DecryptOptions{}, size: 245},
+		{opts: &rsa.PKCS1v15DecryptOptions{}, size: 246, wantErr: true},
+	}
+	for _, test := range tests {
+		_, err := key.Encrypt(make([]byte, test.size), test.opts)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("Encrypt(%d bytes, %#v): got err %v, want error %v", test.size, test.opts, err, test.wantErr)
+		}
+	}
+}
+
+func TestDecryptWrongCiphertextLength(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	if _, err := key.Decrypt(nil, make([]byte, 255), nil); err == nil {
+		t.Error("Decrypt(255 bytes): got nil err, want error for a 2048-bit key")
+	}
+}
+
+func TestEncryptOAEP(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	want := []byte("Plain text to encrypt")
+	for _, hash := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		ciphertext, err := key.EncryptOAEP(hash, want)
+		if err != nil {
+			t.Errorf("EncryptOAEP(%v): got %v, want nil err", hash, err)
+			continue
+		}
+		got, err := key.DecryptOAEP(hash, ciphertext)
+		if err != nil {
+			t.Errorf("DecryptOAEP(%v): got %v, want nil err", hash, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("DecryptOAEP(%v): got %v, want %v", hash, got, want)
+		}
+	}
+	if _, err := key.EncryptOAEP(crypto.SHA1, want); err == nil {
+		t.Error("EncryptOAEP(SHA1): got nil err, want unsupported hash error")
+	}
+}
+
+func TestEncryptPKCS1v15(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	want := []byte("Plain text to encrypt")
+	ciphertext, err := key.EncryptPKCS1v15(want)
+	if err != nil {
+		t.Fatalf("EncryptPKCS1v15: got %v, want nil err", err)
+	}
+	got, err := key.DecryptPKCS1v15(ciphertext)
+	if err != nil {
+		t.Fatalf("DecryptPKCS1v15: got %v, want nil err", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("DecryptPKCS1v15: got %v, want %v", got, want)
+	}
+}
+
+func TestEncryptOAEPLabel(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	opts := &rsa.OAEPOptions{Hash: crypto.SHA256, Label: []byte("label")}
+	if _, err := key.Encrypt([]byte("Plain text to encrypt"), opts); err == nil {
+		t.Error("Encrypt with OAEP label: got nil err, want error")
+	}
+	// A labelled ciphertext from another implementation cannot be decrypted either.
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.Public().(*rsa.PublicKey), []byte("Plain text to encrypt"), opts.Label)
+	if err != nil {
+		t.Fatalf("rsa.EncryptOAEP: got %v, want nil err", err)
+	}
+	if _, err := key.Decrypt(nil, ciphertext, opts); err == nil {
+		t.Error("Decrypt with OAEP label: got nil err, want error")
+	}
+}
+
+func TestCredUnavailable(t *testing.T) {
+	_, err := Cred("No Such Issuer")
+	if !errors.Is(err, ErrCredUnavailable) {
+		t.Errorf("Cred: got %v, want an error matching ErrCredUnavailable", err)
+	}
+	if errors.Is(keychainError(-25300), ErrKeychainLocked) {
+		t.Error("errSecItemNotFound: got a match for ErrKeychainLocked, want none")
+	}
+	if !errors.Is(keychainError(-25293), ErrKeychainLocked) {
+		t.Error("errSecAuthFailed: want a match for ErrKeychainLocked")
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	attrs, err := key.Attributes()
+	if err != nil {
+		t.Fatalf("Attributes: got %v, want nil err", err)
+	}
+	if attrs.Algorithm != "RSA" || attrs.BitSize != 2048 {
+		t.Errorf("Attributes: got %s %d, want RSA 2048", attrs.Algorithm, attrs.BitSize)
+	}
+	if attrs.HardwareBound() {
+		t.Errorf("Attributes: got token %q, want a software key", attrs.TokenID)
+	}
+}
+
+func TestGenerateKeyCertificateRequest(t *testing.T) {
+	key, err := GenerateKey(KeyGenOptions{Algorithm: "ECDSA"})
+	if err != nil {
+		t.Fatalf("GenerateKey: got %v, want nil err", err)
+	}
+	defer key.Close()
+	der, err := key.CertificateRequest(&x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device-1234"},
+	})
+	if err != nil {
+		t.Fatalf("CertificateRequest: got %v, want nil err", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("ParseCertificateRequest: got %v, want nil err", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Errorf("CheckSignature: got %v, want nil err", err)
+	}
+	if pub, ok := csr.PublicKey.(*ecdsa.PublicKey); !ok || !pub.Equal(key.Public()) {
+		t.Errorf("CertificateRequest: got public key %v, want %v", csr.PublicKey, key.Public())
+	}
+	if len(key.CertificateChain()) != 0 {
+		t.Errorf("CertificateChain: got %d certificates, want none", len(key.CertificateChain()))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	digest := sha256.Sum256([]byte("health check"))
+	for _, opts := range []crypto.SignerOpts{crypto.SHA256, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}} {
+		sig, err := key.Sign(nil, digest[:], opts)
+		if err != nil {
+			t.Fatalf("Sign(%v): got %v, want nil err", opts, err)
+		}
+		if err := key.Verify(digest[:], sig, opts); err != nil {
+			t.Errorf("Verify(%v): got %v, want nil err", opts, err)
+		}
+		sig[len(sig)-1] ^= 1
+		if err := key.Verify(digest[:], sig, opts); err == nil {
+			t.Errorf("Verify(%v) with a corrupted signature: got nil err, want error", opts)
+		}
+	}
+}
+
+func TestSignConcurrent(t *testing.T) {
+	key, err := Cred(TEST_CREDENTIALS)
+	if err != nil {
+		t.Fatalf("Cred: got %v, want nil err", err)
+	}
+	digest := sha256.Sum256([]byte("concurrent signing"))
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			sig, err := key.Sign(nil, digest[:], crypto.SHA256)
+			if err == nil {
+				err = rsa.VerifyPKCS1v15(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Sign: got %v, want nil err", err)
+		}
+	}
+}
+
+// benchmarkSignParallel measures signing throughput with b.RunParallel.
+func benchmarkSignParallel(b *testing.B, key *Key) {
+	digest := sha256.Sum256([]byte("benchmark"))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := key.Sign(nil, digest[:], crypto.SHA256); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkSignParallelRSA2048(b *testing.B) {
+	key, err := GenerateKey(KeyGenOptions{Algorithm: "RSA", BitSize: 2048})
+	if err != nil {
+		b.Fatalf("GenerateKey: got %v, want nil err", err)
+	}
+	defer key.Close()
+	benchmarkSignParallel(b, key)
+}
+
+func BenchmarkSignParallelP256(b *testing.B) {
+	key, err := GenerateKey(KeyGenOptions{Algorithm: "ECDSA", BitSize: 256})
+	if err != nil {
+		b.Fatalf("GenerateKey: got %v, want nil err", err)
+	}
+	defer key.Close()
+	benchmarkSignParallel(b, key)
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin && cgo
+// +build darwin,cgo
+
+package keychain
+
+/*
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// GenerateKey generates a private key in the Keychain as described by opts,
+// for enrollment tooling to request a certificate for with
+// Key.CertificateRequest. The returned Key has no certificate chain.
+func GenerateKey(opts KeyGenOptions) (*Key, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	privateAttrs := C.CFDictionaryCreateMutable(C.kCFAllocatorDefault, 3, &C.kCFTypeDictionaryKeyCallBacks, &C.kCFTypeDictionaryValueCallBacks)
+	defer C.CFRelease(C.CFTypeRef(privateAttrs))
+	permanent := C.kCFBooleanFalse
+	if opts.Permanent {
+		permanent = C.kCFBooleanTrue
+	}
+	C.CFDictionaryAddValue(privateAttrs, unsafe.Pointer(C.kSecAttrIsPermanent), unsafe.Pointer(permanent))
+	if opts.Label != "" {
+		label := stringToCFString(opts.Label)
+		defer C.CFRelease(C.CFTypeRef(label))
+		C.CFDictionaryAddValue(privateAttrs, unsafe.Pointer(C.kSecAttrLabel), unsafe.Pointer(label))
+	}
+	if opts.AccessControl != 0 || opts.SecureEnclave {
+		access, err := newAccessControl(opts.AccessControl, opts.SecureEnclave)
+		if err != nil {
+			return nil, err
+		}
+		defer C.CFRelease(C.CFTypeRef(access))
+		C.CFDictionaryAddValue(privateAttrs, unsafe.Pointer(C.kSecAttrAccessControl), unsafe.Pointer(access))
+	}
+
+	attrs := C.CFDictionaryCreateMutable(C.kCFAllocatorDefault, 5, &C.kCFTypeDictionaryKeyCallBacks, &C.kCFTypeDictionaryValueCallBacks)
+	defer C.CFRelease(C.CFTypeRef(attrs))
+	keyType := C.kSecAttrKeyTypeRSA
+	if opts.Algorithm == "ECDSA" {
+		keyType = C.kSecAttrKeyTypeECSECPrimeRandom
+	}
+	C.CFDictionaryAddValue(attrs, unsafe.Pointer(C.kSecAttrKeyType), unsafe.Pointer(keyType))
+	bits := int32ToCFNumber(int32(opts.bitSize()))
+	defer C.CFRelease(C.CFTypeRef(bits))
+	C.CFDictionaryAddValue(attrs, unsafe.Pointer(C.kSecAttrKeySizeInBits), unsafe.Pointer(bits))
+	C.CFDictionaryAddValue(attrs, unsafe.Pointer(C.kSecPrivateKeyAttrs), unsafe.Pointer(privateAttrs))
+	if opts.SecureEnclave {
+		C.CFDictionaryAddValue(attrs, unsafe.Pointer(C.kSecAttrTokenID), unsafe.Pointer(C.kSecAttrTokenIDSecureEnclave))
+	}
+	// Access control is only enforced on keys stored in the data protection keychain.
+	if opts.Permanent && (opts.AccessControl != 0 || opts.SecureEnclave) {
+		C.CFDictionaryAddValue(attrs, unsafe.Pointer(C.kSecUseDataProtectionKeychain), unsafe.Pointer(C.kCFBooleanTrue))
+	}
+
+	var cfErr C.CFErrorRef
+	privateKeyRef := C.SecKeyCreateRandomKey(C.CFDictionaryRef(attrs), &cfErr)
+	if privateKeyRef == 0 {
+		return nil, cfErrorFromRef(cfErr)
+	}
+	defer C.CFRelease(C.CFTypeRef(privateKeyRef))
+	publicKeyRef := C.SecKeyCopyPublicKey(privateKeyRef)
+	if publicKeyRef == INVALID_KEY {
+		return nil, fmt.Errorf("public key of the generated key is not available")
+	}
+	defer C.CFRelease(C.CFTypeRef(publicKeyRef))
+	data := C.SecKeyCopyExternalRepresentation(publicKeyRef, &cfErr)
+	if data == 0 {
+		return nil, cfErrorFromRef(cfErr)
+	}
+	defer C.CFRelease(C.CFTypeRef(data))
+	pub, err := parsePublicKey(opts, cfDataToBytes(data))
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := newKey(privateKeyRef, nil, publicKeyRef)
+	if err != nil {
+		return nil, err
+	}
+	k.publicKey = pub
+	k.secureEnclave = opts.SecureEnclave
+	return k, nil
+}
+
+// newAccessControl returns an access control requiring one of flags to use
+// the private key on this device. The caller owns the returned reference.
+func newAccessControl(flags AccessControlFlags, secureEnclave bool) (C.SecAccessControlRef, error) {
+	var secFlags C.SecAccessControlCreateFlags
+	constraints := 0
+	for _, f := range []struct {
+		flag    AccessControlFlags
+		secFlag C.SecAccessControlCreateFlags
+	}{
+		{AccessControlUserPresence, C.kSecAccessControlUserPresence},
+		{AccessControlBiometryAny, C.kSecAccessControlBiometryAny},
+		{AccessControlBiometryCurrentSet, C.kSecAccessControlBiometryCurrentSet},
+		{AccessControlDevicePasscode, C.kSecAccessControlDevicePasscode},
+	} {
+		if flags&f.flag != 0 {
+			secFlags |= f.secFlag
+			constraints++
+		}
+	}
+	if constraints > 1 {
+		secFlags |= C.kSecAccessControlOr
+	}
+	if secureEnclave {
+		secFlags |= C.kSecAccessControlPrivateKeyUsage
+	}
+	var cfErr C.CFErrorRef
+	access := C.SecAccessControlCreateWithFlags(C.kCFAllocatorDefault, C.CFTypeRef(C.kSecAttrAccessibleWhenUnlockedThisDeviceOnly), secFlags, &cfErr)
+	if access == 0 {
+		return 0, cfErrorFromRef(cfErr)
+	}
+	return access, nil
+}
+
+// stringToCFString turns a Go string into a CFStringRef. Caller then "owns"
+// the CFStringRef and must CFRelease the CFStringRef when done.
+func stringToCFString(s string) C.CFStringRef {
+	b := []byte(s)
+	if len(b) == 0 {
+		return C.CFStringCreateWithBytes(C.kCFAllocatorDefault, nil, 0, C.kCFStringEncodingUTF8, 0)
+	}
+	return C.CFStringCreateWithBytes(C.kCFAllocatorDefault, (*C.UInt8)(unsafe.Pointer(&b[0])), C.CFIndex(len(b)), C.kCFStringEncodingUTF8, 0)
+}
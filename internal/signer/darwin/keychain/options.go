@@ -0,0 +1,566 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+var (
+	oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidUserPrincipalName       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+)
+
+// Names of keychains that Options.Keychain accepts in place of a path.
+const (
+	LoginKeychain  = "login"
+	SystemKeychain = "system"
+)
+
+// systemKeychainPath is the location of the System keychain.
+const systemKeychainPath = "/Library/Keychains/System.keychain"
+
+// maxAuthenticationReuseDuration is LATouchIDAuthenticationMaximumAllowableReuseDuration.
+const maxAuthenticationReuseDuration = 5 * time.Minute
+
+// SelectionPolicy decides which identity CredWithOptions selects when several
+// identities from equally preferred issuers match.
+type SelectionPolicy string
+
+const (
+	// SelectFirst selects the first matching identity returned by the Keychain.
+	SelectFirst SelectionPolicy = ""
+	// SelectLatestNotAfter selects the certificate that expires last.
+	SelectLatestNotAfter SelectionPolicy = "latest_not_after"
+	// SelectLatestNotBefore selects the most recently issued certificate.
+	SelectLatestNotBefore SelectionPolicy = "latest_not_before"
+	// SelectLargestKey selects the certificate with the largest public key.
+	SelectLargestKey SelectionPolicy = "largest_key"
+	// SelectHardwareBacked selects an identity whose private key lives on a
+	// token, such as the Secure Enclave or a smart card, over a software key.
+	SelectHardwareBacked SelectionPolicy = "hardware_backed"
+)
+
+// candidate is a matching identity considered by Options.preferred.
+type candidate struct {
+	cert     *x509.Certificate
+	hardware bool // The private key is backed by a token.
+}
+
+// Options configures which identity CredWithOptions selects from the Keychain.
+// Empty fields are ignored; a leaf certificate must satisfy every field that
+// is set.
+type Options struct {
+	IssuerCN  string   // Common name of the issuer of the leaf certificate.
+	IssuerCNs []string // Additional acceptable issuer common names, in decreasing order of preference after IssuerCN.
+	// IssuerGlob is an acceptable issuer common name pattern in which "*"
+	// matches any run of characters and "?" matches a single character, such as
+	// "Corp Issuing CA *". Pattern matches are preferred after exact names.
+	IssuerGlob string
+	// IssuerRegexp is an acceptable issuer common name regular expression. It
+	// must match the whole common name. Pattern matches are preferred after
+	// exact names.
+	IssuerRegexp string
+	SubjectCN    string // Common name of the subject of the leaf certificate.
+	Fingerprint  string // Hex-encoded SHA-256 fingerprint of the leaf certificate. Colons are ignored.
+	Serial       string // Hex-encoded serial number of the leaf certificate. Colons are ignored.
+	SANDNSName   string // DNS name Subject Alternative Name, compared case-insensitively.
+	SANEmail     string // RFC 822 email Subject Alternative Name, compared case-insensitively.
+	SANURI       string // URI Subject Alternative Name.
+	SANUPN       string // Microsoft User Principal Name otherName Subject Alternative Name, compared case-insensitively.
+
+	// PreferredIdentity names an identity preference, usually a hostname or
+	// URL, that a user or MDM set in the Keychain. The preferred identity is
+	// selected before any other identity, provided its certificate satisfies
+	// the remaining criteria. Without a usable preference, the remaining
+	// criteria select the identity as usual.
+	PreferredIdentity string
+
+	// RequireClientAuth skips leaf certificates that lack the TLS client
+	// authentication extended key usage, such as code-signing or S/MIME
+	// certificates from the same issuer.
+	RequireClientAuth bool
+
+	// Policy breaks ties between matching identities. Issuer preference is
+	// applied first; remaining ties go to the first identity found.
+	Policy SelectionPolicy
+
+	// Keychain restricts the identity search to a single keychain: the user's
+	// login keychain (LoginKeychain), the System keychain (SystemKeychain), or
+	// the keychain file at an absolute path. By default the user's keychain
+	// search list and the data protection keychain are searched.
+	Keychain string
+	// AccessGroup restricts the identity search to the data protection
+	// keychain items of a single keychain access group, such as the one an MDM
+	// agent provisions identities into. The binary must be entitled to the
+	// group. It cannot be combined with Keychain.
+	AccessGroup string
+
+	// AuthenticationReuseDuration lets a Touch ID unlock of the device within
+	// this duration authorize keys that require biometry without another
+	// prompt. It may be at most five minutes.
+	AuthenticationReuseDuration time.Duration
+	// AuthenticationTimeout bounds how long Sign waits for the user to
+	// complete a Touch ID prompt. Zero waits indefinitely.
+	AuthenticationTimeout time.Duration
+	// AuthenticationPrompt explains in the Touch ID prompt why the key is used.
+	AuthenticationPrompt string
+
+	// NonInteractive makes lookups and key operations that would show a
+	// keychain password dialog or Touch ID prompt fail with an error matching
+	// ErrInteractionRequired, for headless and CI environments.
+	NonInteractive bool
+
+	// AllowLegacyHashes lets the Key sign SHA-1 digests with ECDSA and RSA
+	// PKCS #1 v1.5, for endpoints that still negotiate SHA-1 signatures.
+	AllowLegacyHashes bool
+
+	// FetchIntermediates downloads issuing certificates that are missing from
+	// the Keychain from the Authority Information Access URLs in the chain.
+	FetchIntermediates bool
+	// ExcludeRoot ends the certificate chain at the last intermediate, for
+	// servers that reject client chains containing the self-signed root.
+	ExcludeRoot bool
+}
+
+// validate checks that opts selects at least one identity attribute and that
+// every attribute is well formed.
+func (opts Options) validate() error {
+	if len(opts.criteria()) == 0 {
+		return errors.New("no certificate selection criteria specified")
+	}
+	if _, err := opts.issuerPatterns(); err != nil {
+		return err
+	}
+	if _, err := keychainPath(opts.Keychain); err != nil {
+		return err
+	}
+	if opts.Keychain != "" && opts.AccessGroup != "" {
+		return errors.New("keychain and access group cannot both be specified")
+	}
+	if opts.AuthenticationReuseDuration < 0 || opts.AuthenticationReuseDuration > maxAuthenticationReuseDuration {
+		return fmt.Errorf("authentication reuse duration %v is not between 0 and %v", opts.AuthenticationReuseDuration, maxAuthenticationReuseDuration)
+	}
+	if opts.AuthenticationTimeout < 0 {
+		return fmt.Errorf("negative authentication timeout %v", opts.AuthenticationTimeout)
+	}
+	switch opts.Policy {
+	case SelectFirst, SelectLatestNotAfter, SelectLatestNotBefore, SelectLargestKey, SelectHardwareBacked:
+	default:
+		return fmt.Errorf("unknown selection policy %q", opts.Policy)
+	}
+	if opts.Fingerprint != "" {
+		fp, err := hex.DecodeString(normalizeFingerprint(opts.Fingerprint))
+		if err != nil || len(fp) != sha256.Size {
+			return fmt.Errorf("invalid SHA-256 fingerprint %q", opts.Fingerprint)
+		}
+	}
+	if opts.Serial != "" {
+		if _, ok := parseSerial(opts.Serial); !ok {
+			return fmt.Errorf("invalid serial number %q", opts.Serial)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the leaf certificate xc satisfies opts.
+func (opts Options) matches(xc *x509.Certificate) bool {
+	if opts.hasIssuerFilter() && opts.issuerRank(xc) < 0 {
+		return false
+	}
+	if opts.SubjectCN != "" && xc.Subject.CommonName != opts.SubjectCN {
+		return false
+	}
+	if opts.Fingerprint != "" {
+		fp := sha256.Sum256(xc.Raw)
+		if hex.EncodeToString(fp[:]) != normalizeFingerprint(opts.Fingerprint) {
+			return false
+		}
+	}
+	if opts.Serial != "" {
+		serial, ok := parseSerial(opts.Serial)
+		if !ok || xc.SerialNumber == nil || xc.SerialNumber.Cmp(serial) != 0 {
+			return false
+		}
+	}
+	if opts.SANDNSName != "" && !containsFold(xc.DNSNames, opts.SANDNSName) {
+		return false
+	}
+	if opts.SANEmail != "" && !containsFold(xc.EmailAddresses, opts.SANEmail) {
+		return false
+	}
+	if opts.SANURI != "" {
+		var uris []string
+		for _, uri := range xc.URIs {
+			uris = append(uris, uri.String())
+		}
+		if !stringIn(opts.SANURI, uris) {
+			return false
+		}
+	}
+	if opts.SANUPN != "" && !containsFold(userPrincipalNames(xc), opts.SANUPN) {
+		return false
+	}
+	if opts.RequireClientAuth && !hasClientAuth(xc) {
+		return false
+	}
+	return true
+}
+
+// String describes the selection criteria in opts for error messages.
+func (opts Options) String() string {
+	criteria := opts.criteria()
+	if opts.RequireClientAuth {
+		criteria = append(criteria, "client authentication extended key usage")
+	}
+	return strings.Join(criteria, ", ")
+}
+
+// criteria describes the attributes opts uses to identify a certificate.
+func (opts Options) criteria() []string {
+	var criteria []string
+	if opts.PreferredIdentity != "" {
+		criteria = append(criteria, fmt.Sprintf("identity preference %q", opts.PreferredIdentity))
+	}
+	if issuers := opts.issuerCNs(); len(issuers) == 1 {
+		criteria = append(criteria, fmt.Sprintf("issuer common name %q", issuers[0]))
+	} else if len(issuers) > 1 {
+		criteria = append(criteria, fmt.Sprintf("issuer common name in %q", issuers))
+	}
+	if opts.IssuerGlob != "" {
+		criteria = append(criteria, fmt.Sprintf("issuer common name like %q", opts.IssuerGlob))
+	}
+	if opts.IssuerRegexp != "" {
+		criteria = append(criteria, fmt.Sprintf("issuer common name matching %q", opts.IssuerRegexp))
+	}
+	if opts.SubjectCN != "" {
+		criteria = append(criteria, fmt.Sprintf("subject common name %q", opts.SubjectCN))
+	}
+	if opts.Fingerprint != "" {
+		criteria = append(criteria, fmt.Sprintf("SHA-256 fingerprint %q", opts.Fingerprint))
+	}
+	if opts.Serial != "" {
+		criteria = append(criteria, fmt.Sprintf("serial number %q", opts.Serial))
+	}
+	if opts.SANDNSName != "" {
+		criteria = append(criteria, fmt.Sprintf("DNS name %q", opts.SANDNSName))
+	}
+	if opts.SANEmail != "" {
+		criteria = append(criteria, fmt.Sprintf("email address %q", opts.SANEmail))
+	}
+	if opts.SANURI != "" {
+		criteria = append(criteria, fmt.Sprintf("URI %q", opts.SANURI))
+	}
+	if opts.SANUPN != "" {
+		criteria = append(criteria, fmt.Sprintf("user principal name %q", opts.SANUPN))
+	}
+	return criteria
+}
+
+// normalizeFingerprint strips separators from a hex fingerprint and lowercases it.
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fp))
+}
+
+// issuerCNs returns the acceptable issuer common names in order of preference.
+func (opts Options) issuerCNs() []string {
+	var issuers []string
+	if opts.IssuerCN != "" {
+		issuers = append(issuers, opts.IssuerCN)
+	}
+	for _, issuer := range opts.IssuerCNs {
+		if issuer != "" {
+			issuers = append(issuers, issuer)
+		}
+	}
+	return issuers
+}
+
+// hasIssuerFilter reports whether opts restricts the issuer of the leaf certificate.
+func (opts Options) hasIssuerFilter() bool {
+	return len(opts.issuerCNs()) > 0 || opts.IssuerGlob != "" || opts.IssuerRegexp != ""
+}
+
+// hasAttributeCriteria reports whether opts selects identities by the
+// attributes of their certificates, and not only by identity preference.
+func (opts Options) hasAttributeCriteria() bool {
+	opts.PreferredIdentity = ""
+	return len(opts.criteria()) > 0
+}
+
+// exactIssuerCNs returns the issuer common names that every acceptable leaf
+// certificate is issued by, or nil if issuers are also matched by pattern.
+func (opts Options) exactIssuerCNs() []string {
+	if opts.IssuerGlob != "" || opts.IssuerRegexp != "" {
+		return nil
+	}
+	return opts.issuerCNs()
+}
+
+// issuerPatterns compiles IssuerGlob and IssuerRegexp into anchored regular expressions.
+func (opts Options) issuerPatterns() ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	if opts.IssuerGlob != "" {
+		patterns = append(patterns, globToRegexp(opts.IssuerGlob))
+	}
+	if opts.IssuerRegexp != "" {
+		re, err := regexp.Compile("^(?:" + opts.IssuerRegexp + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid issuer regular expression %q: %w", opts.IssuerRegexp, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// issuerRank returns the preference rank of the issuer of xc, where lower is
+// more preferred, or -1 if the issuer is not acceptable. Exact issuer names
+// rank by position, followed by pattern matches.
+func (opts Options) issuerRank(xc *x509.Certificate) int {
+	issuers := opts.issuerCNs()
+	for r, issuer := range issuers {
+		if xc.Issuer.CommonName == issuer {
+			return r
+		}
+	}
+	patterns, err := opts.issuerPatterns()
+	if err != nil {
+		return -1
+	}
+	for _, pattern := range patterns {
+		if pattern.MatchString(xc.Issuer.CommonName) {
+			return len(issuers)
+		}
+	}
+	return -1
+}
+
+// preferred returns the index of the preferred candidate among candidates
+// that all match opts, or -1 if there are no candidates. Certificates from
+// issuers earlier in the preference order win, then opts.Policy decides; any
+// remaining ties go to the first candidate.
+func (opts Options) preferred(candidates []candidate) int {
+	best, bestRank := -1, 0
+	for i, c := range candidates {
+		rank := opts.issuerRank(c.cert)
+		if best < 0 || rank < bestRank || rank == bestRank && opts.Policy.better(c, candidates[best]) {
+			best, bestRank = i, rank
+		}
+	}
+	return best
+}
+
+// better reports whether policy strictly prefers a over b.
+func (policy SelectionPolicy) better(a, b candidate) bool {
+	switch policy {
+	case SelectLatestNotAfter:
+		return a.cert.NotAfter.After(b.cert.NotAfter)
+	case SelectLatestNotBefore:
+		return a.cert.NotBefore.After(b.cert.NotBefore)
+	case SelectLargestKey:
+		return publicKeyBits(a.cert) > publicKeyBits(b.cert)
+	case SelectHardwareBacked:
+		return a.hardware && !b.hardware
+	default:
+		return false
+	}
+}
+
+// publicKeyBits returns the size in bits of the public key in xc, or 0 if the
+// key type is unknown.
+func publicKeyBits(xc *x509.Certificate) int {
+	switch pub := xc.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return pub.N.BitLen()
+	case *ecdsa.PublicKey:
+		return pub.Curve.Params().BitSize
+	default:
+		return 0
+	}
+}
+
+// keychainPath resolves the keychain named by Options.Keychain to the path of
+// its file. It returns "" when no keychain is named.
+func keychainPath(keychain string) (string, error) {
+	switch keychain {
+	case "":
+		return "", nil
+	case LoginKeychain:
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("locating login keychain: %w", err)
+		}
+		return filepath.Join(home, "Library", "Keychains", "login.keychain-db"), nil
+	case SystemKeychain:
+		return systemKeychainPath, nil
+	}
+	if !filepath.IsAbs(keychain) {
+		return "", fmt.Errorf("keychain %q is neither %q, %q nor an absolute path", keychain, LoginKeychain, SystemKeychain)
+	}
+	return filepath.Clean(keychain), nil
+}
+
+// globToRegexp converts a glob pattern, in which "*" matches any run of
+// characters and "?" matches a single character, into an anchored regular
+// expression.
+func globToRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// parseSerial parses a hex-encoded certificate serial number, optionally
+// prefixed with "0x" and separated by colons.
+func parseSerial(serial string) (*big.Int, bool) {
+	hexSerial := strings.TrimPrefix(normalizeFingerprint(serial), "0x")
+	if hexSerial == "" {
+		return nil, false
+	}
+	return new(big.Int).SetString(hexSerial, 16)
+}
+
+// hasClientAuth reports whether xc may be used for TLS client authentication.
+func hasClientAuth(xc *x509.Certificate) bool {
+	for _, eku := range xc.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageClientAuth || eku == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether s is in ss under Unicode case-folding.
+func containsFold(ss []string, s string) bool {
+	for _, s2 := range ss {
+		if strings.EqualFold(s, s2) {
+			return true
+		}
+	}
+	return false
+}
+
+// userPrincipalNames returns the Microsoft UPN otherName entries of the
+// Subject Alternative Name extension, which crypto/x509 does not expose.
+func userPrincipalNames(xc *x509.Certificate) []string {
+	var upns []string
+	for _, ext := range xc.Extensions {
+		if !ext.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+		input := cryptobyte.String(ext.Value)
+		var names cryptobyte.String
+		if !input.ReadASN1(&names, cbasn1.SEQUENCE) {
+			return nil
+		}
+		for !names.Empty() {
+			var (
+				name cryptobyte.String
+				tag  cbasn1.Tag
+			)
+			if !names.ReadAnyASN1(&name, &tag) {
+				return upns
+			}
+			// otherName [0] { type-id OBJECT IDENTIFIER, value [0] EXPLICIT ANY }
+			if tag != cbasn1.Tag(0).ContextSpecific().Constructed() {
+				continue
+			}
+			var typeID asn1.ObjectIdentifier
+			if !name.ReadASN1ObjectIdentifier(&typeID) || !typeID.Equal(oidUserPrincipalName) {
+				continue
+			}
+			var value, upn cryptobyte.String
+			if !name.ReadASN1(&value, cbasn1.Tag(0).ContextSpecific().Constructed()) || !value.ReadASN1(&upn, cbasn1.UTF8String) {
+				continue
+			}
+			upns = append(upns, string(upn))
+		}
+	}
+	return upns
+}
+
+func stringIn(s string, ss []string) bool {
+	for _, s2 := range ss {
+		if s == s2 {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigOptions converts the macOS keychain section of the ECP config into
+// identity selection options.
+func ConfigOptions(config util.MacOSKeychain) Options {
+	return Options{
+		IssuerCN:  config.Issuer,
+		IssuerCNs: config.Issuers,
+
+		IssuerGlob:   config.IssuerGlob,
+		IssuerRegexp: config.IssuerRegexp,
+
+		SubjectCN:   config.Subject,
+		Fingerprint: config.Fingerprint,
+		Serial:      config.Serial,
+		SANDNSName:  config.SANDNSName,
+		SANEmail:    config.SANEmail,
+		SANURI:      config.SANURI,
+		SANUPN:      config.SANUPN,
+
+		PreferredIdentity: config.PreferredIdentity,
+
+		RequireClientAuth: config.RequireClientAuth,
+		Policy:            SelectionPolicy(config.SelectionPolicy),
+		Keychain:          config.Keychain,
+		AccessGroup:       config.AccessGroup,
+
+		AuthenticationReuseDuration: time.Duration(config.AuthReuseSeconds) * time.Second,
+		AuthenticationTimeout:       time.Duration(config.AuthTimeoutSeconds) * time.Second,
+		AuthenticationPrompt:        config.AuthPrompt,
+		NonInteractive:              config.NonInteractive,
+
+		AllowLegacyHashes:  config.AllowLegacyHashes,
+		FetchIntermediates: config.FetchIntermediates,
+		ExcludeRoot:        config.ExcludeRoot,
+	}
+}
@@ -0,0 +1,416 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// certCandidates wraps certs as software-backed candidates.
+func certCandidates(certs ...*x509.Certificate) []candidate {
+	var candidates []candidate
+	for _, xc := range certs {
+		candidates = append(candidates, candidate{cert: xc})
+	}
+	return candidates
+}
+
+// newTestCert returns a self-signed certificate based on template.
+func newTestCert(t *testing.T, template *x509.Certificate) *x509.Certificate {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(1)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xc, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return xc
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts    Options
+		wantErr bool
+	}{
+		{opts: Options{}, wantErr: true},
+		{opts: Options{RequireClientAuth: true}, wantErr: true},
+		{opts: Options{IssuerCN: "TestIssuer"}},
+		{opts: Options{SubjectCN: "TestSubject"}},
+		{opts: Options{IssuerCNs: []string{"OldIssuer", "NewIssuer"}}},
+		{opts: Options{IssuerGlob: "Corp Issuing CA *"}},
+		{opts: Options{IssuerRegexp: "Corp Issuing CA [0-9]+"}},
+		{opts: Options{IssuerRegexp: "Corp Issuing CA ("}, wantErr: true},
+		{opts: Options{IssuerCN: "TestIssuer", Policy: SelectLatestNotAfter}},
+		{opts: Options{IssuerCN: "TestIssuer", Policy: "newest"}, wantErr: true},
+		{opts: Options{IssuerCN: "TestIssuer", Keychain: SystemKeychain}},
+		{opts: Options{IssuerCN: "TestIssuer", Keychain: "/tmp/ci.keychain-db"}},
+		{opts: Options{IssuerCN: "TestIssuer", Keychain: "ci.keychain-db"}, wantErr: true},
+		{opts: Options{IssuerCN: "TestIssuer", AccessGroup: "ABCDE12345.com.example.mdm"}},
+		{opts: Options{IssuerCN: "TestIssuer", AccessGroup: "ABCDE12345.com.example.mdm", Keychain: LoginKeychain}, wantErr: true},
+		{opts: Options{IssuerCN: "TestIssuer", AuthenticationReuseDuration: time.Minute, AuthenticationTimeout: 30 * time.Second}},
+		{opts: Options{IssuerCN: "TestIssuer", AuthenticationReuseDuration: time.Hour}, wantErr: true},
+		{opts: Options{IssuerCN: "TestIssuer", AuthenticationTimeout: -time.Second}, wantErr: true},
+		{opts: Options{Fingerprint: "zz"}, wantErr: true},
+		{opts: Options{Fingerprint: "00:11"}, wantErr: true},
+		{opts: Options{IssuerCN: "TestIssuer", Serial: "0x1f:a0"}},
+		{opts: Options{IssuerCN: "TestIssuer", Serial: "xyz"}, wantErr: true},
+		{opts: Options{PreferredIdentity: "https://example.com"}},
+	}
+	for i, test := range tests {
+		if err := test.opts.validate(); (err != nil) != test.wantErr {
+			t.Errorf("test %d: %+v.validate() = %v, want error %v", i, test.opts, err, test.wantErr)
+		}
+	}
+}
+
+func TestOptionsMatchesFingerprint(t *testing.T) {
+	xc := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "TestIssuer"}})
+	fp := sha256.Sum256(xc.Raw)
+	hexFP := hex.EncodeToString(fp[:])
+
+	var colonFP string
+	for i := 0; i < len(hexFP); i += 2 {
+		if i > 0 {
+			colonFP += ":"
+		}
+		colonFP += hexFP[i : i+2]
+	}
+
+	tests := []struct {
+		opts Options
+		want bool
+	}{
+		{opts: Options{Fingerprint: hexFP}, want: true},
+		{opts: Options{Fingerprint: colonFP}, want: true},
+		{opts: Options{IssuerCN: "TestIssuer", Fingerprint: hexFP}, want: true},
+		{opts: Options{IssuerCN: "OtherIssuer", Fingerprint: hexFP}, want: false},
+		{opts: Options{Fingerprint: hex.EncodeToString(make([]byte, sha256.Size))}, want: false},
+	}
+	for i, test := range tests {
+		if err := test.opts.validate(); err != nil {
+			t.Fatalf("test %d: validate: %v", i, err)
+		}
+		if got := test.opts.matches(xc); got != test.want {
+			t.Errorf("test %d: %+v.matches() = %v, want %v", i, test.opts, got, test.want)
+		}
+	}
+}
+
+func TestOptionsMatchesSubjectCN(t *testing.T) {
+	template := &x509.Certificate{Subject: pkix.Name{CommonName: "TestSubject"}}
+	xc := newTestCert(t, template)
+
+	tests := []struct {
+		opts Options
+		want bool
+	}{
+		{opts: Options{SubjectCN: "TestSubject"}, want: true},
+		{opts: Options{SubjectCN: "OtherSubject"}, want: false},
+		{opts: Options{IssuerCN: "TestSubject", SubjectCN: "TestSubject"}, want: true},
+		{opts: Options{IssuerCN: "OtherIssuer", SubjectCN: "TestSubject"}, want: false},
+	}
+	for i, test := range tests {
+		if got := test.opts.matches(xc); got != test.want {
+			t.Errorf("test %d: %+v.matches() = %v, want %v", i, test.opts, got, test.want)
+		}
+	}
+}
+
+func TestOptionsMatchesSAN(t *testing.T) {
+	uri, err := url.Parse("spiffe://corp.example.com/device/1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xc := newTestCert(t, &x509.Certificate{
+		DNSNames:       []string{"host-1234.corp.example.com"},
+		EmailAddresses: []string{"user@example.com"},
+		URIs:           []*url.URL{uri},
+	})
+
+	tests := []struct {
+		opts Options
+		want bool
+	}{
+		{opts: Options{SANDNSName: "HOST-1234.corp.example.com"}, want: true},
+		{opts: Options{SANDNSName: "host-5678.corp.example.com"}, want: false},
+		{opts: Options{SANEmail: "User@Example.com"}, want: true},
+		{opts: Options{SANEmail: "other@example.com"}, want: false},
+		{opts: Options{SANURI: "spiffe://corp.example.com/device/1234"}, want: true},
+		{opts: Options{SANURI: "spiffe://corp.example.com/device/5678"}, want: false},
+		{opts: Options{SANDNSName: "host-1234.corp.example.com", SANEmail: "other@example.com"}, want: false},
+	}
+	for i, test := range tests {
+		if got := test.opts.matches(xc); got != test.want {
+			t.Errorf("test %d: %+v.matches() = %v, want %v", i, test.opts, got, test.want)
+		}
+	}
+}
+
+func TestOptionsMatchesUPN(t *testing.T) {
+	// Build a SAN extension holding a dNSName and a UPN otherName.
+	var b cryptobyte.Builder
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1(cbasn1.Tag(2).ContextSpecific(), func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte("host.example.com"))
+		})
+		b.AddASN1(cbasn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+			b.AddASN1ObjectIdentifier(oidUserPrincipalName)
+			b.AddASN1(cbasn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+				b.AddASN1(cbasn1.UTF8String, func(b *cryptobyte.Builder) {
+					b.AddBytes([]byte("user@corp.example.com"))
+				})
+			})
+		})
+	})
+	san, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	xc := newTestCert(t, &x509.Certificate{
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: san}},
+	})
+
+	if got := (Options{SANUPN: "USER@corp.example.com"}).matches(xc); !got {
+		t.Error("matches UPN: got false, want true")
+	}
+	if got := (Options{SANUPN: "other@corp.example.com"}).matches(xc); got {
+		t.Error("matches other UPN: got true, want false")
+	}
+	if got := (Options{SANDNSName: "host.example.com"}).matches(xc); !got {
+		t.Error("matches DNS name next to UPN: got false, want true")
+	}
+}
+
+func TestOptionsMatchesSerial(t *testing.T) {
+	xc := newTestCert(t, &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "TestIssuer"},
+		SerialNumber: big.NewInt(0x1fa0),
+	})
+
+	tests := []struct {
+		opts Options
+		want bool
+	}{
+		{opts: Options{IssuerCN: "TestIssuer", Serial: "1fa0"}, want: true},
+		{opts: Options{IssuerCN: "TestIssuer", Serial: "1F:A0"}, want: true},
+		{opts: Options{IssuerCN: "TestIssuer", Serial: "0x00:1f:a0"}, want: true},
+		{opts: Options{IssuerCN: "TestIssuer", Serial: "1fa1"}, want: false},
+		{opts: Options{IssuerCN: "OtherIssuer", Serial: "1fa0"}, want: false},
+	}
+	for i, test := range tests {
+		if got := test.opts.matches(xc); got != test.want {
+			t.Errorf("test %d: %+v.matches() = %v, want %v", i, test.opts, got, test.want)
+		}
+	}
+}
+
+func TestOptionsMatchesClientAuth(t *testing.T) {
+	subject := pkix.Name{CommonName: "TestIssuer"}
+	clientAuth := newTestCert(t, &x509.Certificate{
+		Subject:     subject,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	codeSigning := newTestCert(t, &x509.Certificate{
+		Subject:     subject,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	noEKU := newTestCert(t, &x509.Certificate{Subject: subject})
+
+	opts := Options{IssuerCN: "TestIssuer", RequireClientAuth: true}
+	if !opts.matches(clientAuth) {
+		t.Error("matches clientAuth certificate: got false, want true")
+	}
+	if opts.matches(codeSigning) {
+		t.Error("matches codeSigning certificate: got true, want false")
+	}
+	if opts.matches(noEKU) {
+		t.Error("matches certificate without EKU: got true, want false")
+	}
+	if !(Options{IssuerCN: "TestIssuer"}).matches(codeSigning) {
+		t.Error("matches codeSigning certificate without RequireClientAuth: got false, want true")
+	}
+}
+
+func TestOptionsMultipleIssuers(t *testing.T) {
+	oldCA := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "OldIssuer"}})
+	newCA := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "NewIssuer"}})
+	other := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "OtherIssuer"}})
+	opts := Options{IssuerCN: "NewIssuer", IssuerCNs: []string{"OldIssuer"}}
+
+	if !opts.matches(oldCA) || !opts.matches(newCA) {
+		t.Error("matches: got false for an acceptable issuer, want true")
+	}
+	if opts.matches(other) {
+		t.Error("matches: got true for an unlisted issuer, want false")
+	}
+	if got, want := opts.preferred(certCandidates(oldCA, newCA)), 1; got != want {
+		t.Errorf("preferred: got %d, want %d", got, want)
+	}
+	if got, want := opts.preferred(certCandidates(oldCA)), 0; got != want {
+		t.Errorf("preferred with only the fallback issuer: got %d, want %d", got, want)
+	}
+	if got, want := opts.preferred(nil), -1; got != want {
+		t.Errorf("preferred with no candidates: got %d, want %d", got, want)
+	}
+}
+
+func TestOptionsIssuerPatterns(t *testing.T) {
+	ca2023 := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Corp Issuing CA 2023"}})
+	ca2024 := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Corp Issuing CA 2024"}})
+	other := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Other Corp Issuing CA 2024"}})
+
+	tests := []struct {
+		opts Options
+		xc   *x509.Certificate
+		want bool
+	}{
+		{opts: Options{IssuerGlob: "Corp Issuing CA *"}, xc: ca2023, want: true},
+		{opts: Options{IssuerGlob: "Corp Issuing CA 202?"}, xc: ca2024, want: true},
+		{opts: Options{IssuerGlob: "Corp Issuing CA *"}, xc: other, want: false},
+		{opts: Options{IssuerGlob: "Corp Issuing CA (*)"}, xc: ca2023, want: false},
+		{opts: Options{IssuerRegexp: "Corp Issuing CA [0-9]{4}"}, xc: ca2024, want: true},
+		{opts: Options{IssuerRegexp: "Corp Issuing CA [0-9]{4}"}, xc: other, want: false},
+		{opts: Options{IssuerCN: "Unrelated", IssuerGlob: "Corp *"}, xc: ca2023, want: true},
+	}
+	for i, test := range tests {
+		if got := test.opts.matches(test.xc); got != test.want {
+			t.Errorf("test %d: %+v.matches(%q) = %v, want %v", i, test.opts, test.xc.Issuer.CommonName, got, test.want)
+		}
+	}
+
+	// Exact issuer names are preferred over pattern matches.
+	opts := Options{IssuerCN: "Corp Issuing CA 2024", IssuerGlob: "Corp Issuing CA *"}
+	if got, want := opts.preferred(certCandidates(ca2023, ca2024)), 1; got != want {
+		t.Errorf("preferred: got %d, want %d", got, want)
+	}
+}
+
+func TestOptionsHasAttributeCriteria(t *testing.T) {
+	if (Options{PreferredIdentity: "example.com"}).hasAttributeCriteria() {
+		t.Error("hasAttributeCriteria(preference only): got true, want false")
+	}
+	if !(Options{PreferredIdentity: "example.com", IssuerCN: "Corp CA"}).hasAttributeCriteria() {
+		t.Error("hasAttributeCriteria(preference and issuer): got false, want true")
+	}
+}
+
+func TestOptionsExactIssuerCNs(t *testing.T) {
+	tests := []struct {
+		opts Options
+		want []string
+	}{
+		{opts: Options{IssuerCN: "Corp CA", IssuerCNs: []string{"Corp CA 2"}}, want: []string{"Corp CA", "Corp CA 2"}},
+		{opts: Options{IssuerCN: "Corp CA", IssuerGlob: "Corp CA *"}},
+		{opts: Options{IssuerRegexp: "Corp CA [0-9]+"}},
+		{opts: Options{SubjectCN: "device-1234"}},
+	}
+	for _, test := range tests {
+		if got := test.opts.exactIssuerCNs(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("exactIssuerCNs(%v): got %q, want %q", test.opts, got, test.want)
+		}
+	}
+}
+
+func TestOptionsSelectionPolicy(t *testing.T) {
+	now := time.Now()
+	older := candidate{cert: &x509.Certificate{
+		NotBefore: now.Add(-48 * time.Hour),
+		NotAfter:  now.Add(48 * time.Hour),
+		PublicKey: &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 4095), E: 65537},
+	}}
+	newer := candidate{cert: &x509.Certificate{
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(24 * time.Hour),
+		PublicKey: &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 2047), E: 65537},
+	}}
+	hardware := candidate{cert: &x509.Certificate{
+		NotBefore: now.Add(-24 * time.Hour),
+		NotAfter:  now.Add(time.Hour),
+		PublicKey: &ecdsa.PublicKey{Curve: elliptic.P256()},
+	}, hardware: true}
+	candidates := []candidate{older, newer, hardware}
+
+	tests := []struct {
+		policy SelectionPolicy
+		want   int
+	}{
+		{policy: SelectFirst, want: 0},
+		{policy: SelectLatestNotAfter, want: 0},
+		{policy: SelectLatestNotBefore, want: 1},
+		{policy: SelectLargestKey, want: 0},
+		{policy: SelectHardwareBacked, want: 2},
+	}
+	for _, test := range tests {
+		opts := Options{IssuerCN: "TestIssuer", Policy: test.policy}
+		if got := opts.preferred(candidates); got != test.want {
+			t.Errorf("preferred with policy %q: got %d, want %d", test.policy, got, test.want)
+		}
+	}
+}
+
+func TestKeychainPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	tests := []struct {
+		keychain string
+		want     string
+		wantErr  bool
+	}{
+		{keychain: "", want: ""},
+		{keychain: LoginKeychain, want: home + "/Library/Keychains/login.keychain-db"},
+		{keychain: SystemKeychain, want: "/Library/Keychains/System.keychain"},
+		{keychain: "/Users/ci/Library/Keychains/../Keychains/build.keychain-db", want: "/Users/ci/Library/Keychains/build.keychain-db"},
+		{keychain: "build.keychain-db", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := keychainPath(test.keychain)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("keychainPath(%q): got error %v, want error %v", test.keychain, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("keychainPath(%q): got %q, want %q", test.keychain, got, test.want)
+		}
+	}
+}
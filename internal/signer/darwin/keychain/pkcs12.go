@@ -0,0 +1,112 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin && cgo
+// +build darwin,cgo
+
+package keychain
+
+/*
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// accessDescriptor names imported private keys in keychain access prompts.
+const accessDescriptor = "Enterprise Certificate Proxy"
+
+// ImportIdentity installs the identity in the PKCS #12 bundle data into the
+// keychain chosen by opts, so that provisioning scripts can resolve it with
+// Cred right away instead of running the security tool. It describes the
+// imported identity.
+func ImportIdentity(data []byte, opts ImportOptions) (CredentialInfo, error) {
+	if err := opts.validate(); err != nil {
+		return CredentialInfo{}, err
+	}
+	cfData := bytesToCFData(data)
+	defer C.CFRelease(C.CFTypeRef(cfData))
+	password := stringToCFString(opts.Password)
+	defer C.CFRelease(C.CFTypeRef(password))
+	access, err := newAccess(opts.TrustedApplications)
+	if err != nil {
+		return CredentialInfo{}, err
+	}
+	defer C.CFRelease(C.CFTypeRef(access))
+
+	options := C.CFDictionaryCreateMutable(C.kCFAllocatorDefault, 3, &C.kCFTypeDictionaryKeyCallBacks, &C.kCFTypeDictionaryValueCallBacks)
+	defer C.CFRelease(C.CFTypeRef(options))
+	C.CFDictionaryAddValue(options, unsafe.Pointer(C.kSecImportExportPassphrase), unsafe.Pointer(password))
+	C.CFDictionaryAddValue(options, unsafe.Pointer(C.kSecImportExportAccess), unsafe.Pointer(access))
+	if path, _ := keychainPath(opts.Keychain); path != "" {
+		keychain, err := openKeychain(path)
+		if err != nil {
+			return CredentialInfo{}, err
+		}
+		defer C.CFRelease(C.CFTypeRef(keychain))
+		C.CFDictionaryAddValue(options, unsafe.Pointer(C.kSecImportExportKeychain), unsafe.Pointer(keychain))
+	}
+
+	var items C.CFArrayRef
+	if errno := C.SecPKCS12Import(cfData, C.CFDictionaryRef(options), &items); errno != C.errSecSuccess {
+		return CredentialInfo{}, keychainError(errno)
+	}
+	defer C.CFRelease(C.CFTypeRef(items))
+	for i := 0; i < int(C.CFArrayGetCount(items)); i++ {
+		item := C.CFDictionaryRef(C.CFArrayGetValueAtIndex(items, C.CFIndex(i)))
+		ident := C.CFDictionaryGetValue(item, unsafe.Pointer(C.kSecImportItemIdentity))
+		if ident == nil {
+			continue
+		}
+		xc, err := identityToX509(C.SecIdentityRef(ident))
+		if err != nil {
+			return CredentialInfo{}, err
+		}
+		return newCredentialInfo(xc, ""), nil
+	}
+	return CredentialInfo{}, errors.New("keychain: PKCS #12 bundle holds no identity")
+}
+
+// newAccess returns an access that lets the calling application and the
+// applications at paths use an imported private key without prompting. The
+// caller owns the returned access.
+func newAccess(paths []string) (C.SecAccessRef, error) {
+	apps := C.CFArrayCreateMutable(C.kCFAllocatorDefault, 0, &C.kCFTypeArrayCallBacks)
+	defer C.CFRelease(C.CFTypeRef(apps))
+	// A NULL path stands for the calling application.
+	for _, path := range append([]string{""}, paths...) {
+		var cPath *C.char
+		if path != "" {
+			cPath = C.CString(path)
+			defer C.free(unsafe.Pointer(cPath))
+		}
+		var app C.SecTrustedApplicationRef
+		if errno := C.SecTrustedApplicationCreateFromPath(cPath, &app); errno != C.errSecSuccess {
+			return 0, keychainError(errno)
+		}
+		C.CFArrayAppendValue(apps, unsafe.Pointer(app))
+		C.CFRelease(C.CFTypeRef(app))
+	}
+	descriptor := stringToCFString(accessDescriptor)
+	defer C.CFRelease(C.CFTypeRef(descriptor))
+	var access C.SecAccessRef
+	if errno := C.SecAccessCreate(descriptor, C.CFArrayRef(apps), &access); errno != C.errSecSuccess {
+		return 0, keychainError(errno)
+	}
+	return access, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+)
+
+// AccessControlFlags are the user authentication requirements placed on a
+// generated private key. When several are set, satisfying any one of them
+// authorizes use of the key.
+type AccessControlFlags uint
+
+const (
+	// AccessControlUserPresence accepts Touch ID or the device passcode.
+	AccessControlUserPresence AccessControlFlags = 1 << iota
+	// AccessControlBiometryAny accepts Touch ID with any enrolled finger.
+	AccessControlBiometryAny
+	// AccessControlBiometryCurrentSet accepts Touch ID with the fingers enrolled
+	// when the key was generated.
+	AccessControlBiometryCurrentSet
+	// AccessControlDevicePasscode accepts the device passcode.
+	AccessControlDevicePasscode
+)
+
+// KeyGenOptions describe a private key to generate with GenerateKey.
+type KeyGenOptions struct {
+	// Algorithm is "RSA" or "ECDSA".
+	Algorithm string
+	// BitSize is the RSA modulus size, between 2048 and 4096 and 2048 by
+	// default, or the ECDSA curve size, one of 256, 384 or 521 and 256 by default.
+	BitSize int
+	// SecureEnclave generates the key in the Secure Enclave, which only
+	// supports ECDSA P-256 keys.
+	SecureEnclave bool
+	AccessControl AccessControlFlags
+	// Permanent stores the key in the Keychain, so that the certificate issued
+	// for it forms an identity once imported. Otherwise the key only lives as
+	// long as the Key returned for it.
+	Permanent bool
+	Label     string // Label of the stored key.
+}
+
+// bitSize returns the key size, applying the default for the algorithm.
+func (o KeyGenOptions) bitSize() int {
+	switch {
+	case o.BitSize != 0:
+		return o.BitSize
+	case o.Algorithm == "RSA":
+		return 2048
+	default:
+		return 256
+	}
+}
+
+// validate checks that the options describe a key the Keychain can generate.
+func (o KeyGenOptions) validate() error {
+	bits := o.bitSize()
+	switch o.Algorithm {
+	case "RSA":
+		if bits < 2048 || bits > 4096 {
+			return fmt.Errorf("unsupported RSA key size %d, want 2048 to 4096 bits", bits)
+		}
+	case "ECDSA":
+		if _, err := curveForBitSize(bits); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported key algorithm %q, want RSA or ECDSA", o.Algorithm)
+	}
+	if o.SecureEnclave && (o.Algorithm != "ECDSA" || bits != 256) {
+		return fmt.Errorf("the Secure Enclave only generates ECDSA P-256 keys")
+	}
+	if o.AccessControl >= AccessControlDevicePasscode<<1 {
+		return fmt.Errorf("unknown access control flags %#x", uint(o.AccessControl))
+	}
+	return nil
+}
+
+// curveForBitSize returns the NIST curve of the given size.
+func curveForBitSize(bits int) (elliptic.Curve, error) {
+	switch bits {
+	case 256:
+		return elliptic.P256(), nil
+	case 384:
+		return elliptic.P384(), nil
+	case 521:
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("unsupported ECDSA key size %d, want 256, 384 or 521 bits", bits)
+	}
+}
+
+// parsePublicKey parses the external representation of a public key generated
+// with opts: a PKCS #1 RSAPublicKey, or an uncompressed ANSI X9.63 point.
+func parsePublicKey(opts KeyGenOptions, data []byte) (interface{}, error) {
+	if opts.Algorithm == "RSA" {
+		return x509.ParsePKCS1PublicKey(data)
+	}
+	curve, err := curveForBitSize(opts.bitSize())
+	if err != nil {
+		return nil, err
+	}
+	x, y := elliptic.Unmarshal(curve, data)
+	if x == nil {
+		return nil, fmt.Errorf("invalid %s public key", curve.Params().Name)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// ImportOptions describe where and how ImportIdentity installs an identity.
+type ImportOptions struct {
+	// Keychain is the keychain to import into: LoginKeychain, SystemKeychain
+	// or the keychain file at an absolute path. By default the user's default
+	// keychain is used.
+	Keychain string
+	// Password decrypts the PKCS #12 bundle.
+	Password string
+	// TrustedApplications are the absolute paths of applications, such as the
+	// signer binary, allowed to use the private key without a keychain
+	// prompt, in addition to the calling application.
+	TrustedApplications []string
+}
+
+// validate checks that the options name a keychain and trusted applications
+// by absolute path.
+func (o ImportOptions) validate() error {
+	if _, err := keychainPath(o.Keychain); err != nil {
+		return err
+	}
+	for _, app := range o.TrustedApplications {
+		if !filepath.IsAbs(app) {
+			return fmt.Errorf("trusted application %q is not an absolute path", app)
+		}
+	}
+	return nil
+}
+
+// CertificateRequest returns a DER-encoded PKCS #10 certificate signing
+// request for the key, based on template and signed by the key.
+func (k *Key) CertificateRequest(template *x509.CertificateRequest) ([]byte, error) {
+	return x509.CreateCertificateRequest(rand.Reader, template, k)
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+)
+
+func TestKeyGenOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts    KeyGenOptions
+		wantErr bool
+	}{
+		{opts: KeyGenOptions{Algorithm: "RSA"}},
+		{opts: KeyGenOptions{Algorithm: "RSA", BitSize: 4096}},
+		{opts: KeyGenOptions{Algorithm: "RSA", BitSize: 1024}, wantErr: true},
+		{opts: KeyGenOptions{Algorithm: "ECDSA"}},
+		{opts: KeyGenOptions{Algorithm: "ECDSA", BitSize: 384}},
+		{opts: KeyGenOptions{Algorithm: "ECDSA", BitSize: 224}, wantErr: true},
+		{opts: KeyGenOptions{Algorithm: "Ed25519"}, wantErr: true},
+		{opts: KeyGenOptions{Algorithm: "ECDSA", SecureEnclave: true, AccessControl: AccessControlBiometryAny | AccessControlDevicePasscode}},
+		{opts: KeyGenOptions{Algorithm: "ECDSA", BitSize: 384, SecureEnclave: true}, wantErr: true},
+		{opts: KeyGenOptions{Algorithm: "RSA", SecureEnclave: true}, wantErr: true},
+		{opts: KeyGenOptions{Algorithm: "ECDSA", AccessControl: 1 << 8}, wantErr: true},
+	}
+	for _, test := range tests {
+		if err := test.opts.validate(); (err != nil) != test.wantErr {
+			t.Errorf("validate(%+v): got %v, want error %v", test.opts, err, test.wantErr)
+		}
+	}
+}
+
+func TestImportOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts    ImportOptions
+		wantErr bool
+	}{
+		{opts: ImportOptions{}},
+		{opts: ImportOptions{Keychain: LoginKeychain, TrustedApplications: []string{"/usr/local/bin/ecp"}}},
+		{opts: ImportOptions{Keychain: "ci.keychain-db"}, wantErr: true},
+		{opts: ImportOptions{TrustedApplications: []string{"ecp"}}, wantErr: true},
+	}
+	for _, test := range tests {
+		if err := test.opts.validate(); (err != nil) != test.wantErr {
+			t.Errorf("validate(%+v): got %v, want error %v", test.opts, err, test.wantErr)
+		}
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := parsePublicKey(KeyGenOptions{Algorithm: "ECDSA", BitSize: 384}, elliptic.Marshal(elliptic.P384(), ecKey.X, ecKey.Y))
+	if err != nil {
+		t.Fatalf("parsePublicKey: got %v, want nil err", err)
+	}
+	if !ecKey.PublicKey.Equal(pub) {
+		t.Errorf("parsePublicKey: got %v, want %v", pub, ecKey.Public())
+	}
+	if _, err := parsePublicKey(KeyGenOptions{Algorithm: "ECDSA"}, []byte{4, 1, 2}); err == nil {
+		t.Error("parsePublicKey with a truncated point: got nil err, want error")
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err = parsePublicKey(KeyGenOptions{Algorithm: "RSA"}, x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey))
+	if err != nil {
+		t.Fatalf("parsePublicKey: got %v, want nil err", err)
+	}
+	if !rsaKey.PublicKey.Equal(pub) {
+		t.Errorf("parsePublicKey: got %v, want %v", pub, rsaKey.Public())
+	}
+}
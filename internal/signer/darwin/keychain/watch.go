@@ -0,0 +1,142 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultWatchInterval is how often a Watcher checks for a renewed certificate
+// when no interval is given.
+const DefaultWatchInterval = time.Minute
+
+// Watcher keeps the Key selected by a set of Options current, so that
+// long-running processes pick up a certificate renewed by MDM without a
+// restart. Lookups are served from the identity cache until a keychain change
+// is seen, so frequent checks are cheap.
+type Watcher struct {
+	opts     Options
+	onChange func(*Key)
+	resolve  func(Options) (*Key, error)
+
+	mu  sync.Mutex
+	key *Key
+	err error // Error of the last check, if it failed.
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Watch resolves the Key selected by opts and checks every interval whether a
+// different certificate is selected, such as after a renewal. When it is,
+// Watcher.Key returns the new Key and onChange, if not nil, is called with it,
+// for example to rotate a TLS configuration. Keys that are replaced are not
+// closed, since they may still be in use; they are released once unreachable.
+func Watch(opts Options, interval time.Duration, onChange func(*Key)) (*Watcher, error) {
+	return watch(opts, interval, onChange, CredWithOptions)
+}
+
+func watch(opts Options, interval time.Duration, onChange func(*Key), resolve func(Options) (*Key, error)) (*Watcher, error) {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	key, err := resolve(opts)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		opts:     opts,
+		onChange: onChange,
+		resolve:  resolve,
+		key:      key,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run(interval)
+	return w, nil
+}
+
+// Key returns the Key for the currently selected certificate.
+func (w *Watcher) Key() *Key {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.key
+}
+
+// Err returns the error of the last check, or nil if it succeeded. The
+// previous Key stays in use while checks fail.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops watching. The current Key remains usable.
+func (w *Watcher) Close() error {
+	err := errors.New("keychain: watcher already closed")
+	w.stopOnce.Do(func() {
+		close(w.stop)
+		err = nil
+	})
+	<-w.done
+	return err
+}
+
+func (w *Watcher) run(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check resolves the Key again and swaps it in if its leaf certificate differs.
+// A Key for the same certificate is closed at once, so that its keychain
+// references are not held until a finalizer runs.
+func (w *Watcher) check() {
+	key, err := w.resolve(w.opts)
+	w.mu.Lock()
+	w.err = err
+	if err != nil || sameLeaf(key, w.key) {
+		w.mu.Unlock()
+		if key != nil {
+			key.Close()
+		}
+		return
+	}
+	w.key = key
+	w.mu.Unlock()
+	if w.onChange != nil {
+		w.onChange(key)
+	}
+}
+
+// sameLeaf reports whether a and b hold the same leaf certificate.
+func sameLeaf(a, b *Key) bool {
+	ac, bc := a.CertificateChain(), b.CertificateChain()
+	return len(ac) > 0 && len(bc) > 0 && bytes.Equal(ac[0], bc[0])
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package keychain
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	old, _ := issueTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "device-1234"}}, nil, nil)
+	renewed, _ := issueTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "device-1234"}}, nil, nil)
+	results := []struct {
+		cert *x509.Certificate
+		err  error
+	}{
+		{cert: old},
+		{cert: old},
+		{err: errors.New("keychain locked")},
+		{cert: renewed},
+	}
+	resolve := func(Options) (*Key, error) {
+		r := results[0]
+		results = results[1:]
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &Key{certs: []*x509.Certificate{r.cert}}, nil
+	}
+	var changes []*Key
+	w, err := watch(Options{SubjectCN: "device-1234"}, time.Hour, func(k *Key) { changes = append(changes, k) }, resolve)
+	if err != nil {
+		t.Fatalf("watch: got %v, want nil err", err)
+	}
+	defer w.Close()
+	initial := w.Key()
+
+	w.check()
+	if w.Key() != initial || len(changes) != 0 {
+		t.Error("check with the same certificate: got a new Key, want the initial one")
+	}
+	w.check()
+	if w.Err() == nil || w.Key() != initial {
+		t.Errorf("check with a failed lookup: got err %v, want an error and the initial Key", w.Err())
+	}
+	w.check()
+	if w.Err() != nil {
+		t.Errorf("Err: got %v, want nil", w.Err())
+	}
+	if len(changes) != 1 || changes[0] != w.Key() || !w.Key().certs[0].Equal(renewed) {
+		t.Errorf("check with a renewed certificate: got %d changes, want the renewed Key", len(changes))
+	}
+}
+
+func TestWatcher_ConcurrentClose(t *testing.T) {
+	cert, _ := issueTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "device-1234"}}, nil, nil)
+	resolve := func(Options) (*Key, error) {
+		return &Key{certs: []*x509.Certificate{cert}}, nil
+	}
+	w, err := watch(Options{SubjectCN: "device-1234"}, time.Hour, nil, resolve)
+	if err != nil {
+		t.Fatalf("watch: got %v, want nil err", err)
+	}
+	const n = 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { errs <- w.Close() }()
+	}
+	closed := 0
+	for i := 0; i < n; i++ {
+		if <-errs == nil {
+			closed++
+		}
+	}
+	if closed != 1 {
+		t.Errorf("concurrent Close: got %d nil errors, want 1", closed)
+	}
+}
@@ -30,6 +30,7 @@ import (
 
 	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/darwin/keychain"
 	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+	"github.com/googleapis/enterprise-certificate-proxy/internal/transport"
 )
 
 // If ECP Logging is enabled return true
@@ -48,6 +49,8 @@ func init() {
 	gob.Register(crypto.SHA384)
 	gob.Register(crypto.SHA512)
 	gob.Register(&rsa.PSSOptions{})
+	gob.Register(&rsa.OAEPOptions{})
+	gob.Register(&rsa.PKCS1v15DecryptOptions{})
 }
 
 // SignArgs contains arguments to a crypto Signer.Sign method.
@@ -56,17 +59,25 @@ type SignArgs struct {
 	Opts   crypto.SignerOpts // Options for signing, such as Hash identifier.
 }
 
+// SignMessageArgs contains arguments to a SignMessage method.
+type SignMessageArgs struct {
+	Message []byte            // The message to hash and sign.
+	Opts    crypto.SignerOpts // Options for signing, such as Hash identifier.
+}
+
 type EncryptArgs struct {
 	Plaintext []byte
 }
 
 type DecryptArgs struct {
 	Ciphertext []byte
+	Opts       crypto.DecrypterOpts // nil selects RSA-OAEP.
 }
 
 // A EnterpriseCertSigner exports RPC methods for signing.
 type EnterpriseCertSigner struct {
-	key *keychain.Key
+	key               *keychain.Key
+	allowLegacyHashes bool // Whether key signs SHA-1 digests.
 }
 
 // A Connection wraps a pair of unidirectional streams as an io.ReadWriteCloser.
@@ -85,6 +96,16 @@ func (c *Connection) Close() error {
 	return werr
 }
 
+// Handshake reports the signer API version and what this signer supports.
+func (k *EnterpriseCertSigner) Handshake(args transport.HandshakeArgs, caps *transport.Capabilities) error {
+	hashes := []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512}
+	if k.allowLegacyHashes {
+		hashes = append(hashes, crypto.SHA1)
+	}
+	*caps = transport.Capabilities{Version: transport.APIVersion, Decrypt: true, SignMessage: true, Hashes: hashes}
+	return nil
+}
+
 // CertificateChain returns the credential as a raw X509 cert chain. This
 // contains the public key.
 func (k *EnterpriseCertSigner) CertificateChain(ignored struct{}, certificateChain *[][]byte) error {
@@ -104,37 +125,66 @@ func (k *EnterpriseCertSigner) Sign(args SignArgs, resp *[]byte) (err error) {
 	return
 }
 
+// SignMessage signs a whole message, letting the key hash it, for smart cards
+// that cannot sign digests.
+func (k *EnterpriseCertSigner) SignMessage(args SignMessageArgs, resp *[]byte) (err error) {
+	*resp, err = k.key.SignMessage(args.Message, args.Opts)
+	return
+}
+
 func (k *EnterpriseCertSigner) Encrypt(args EncryptArgs, plaintext *[]byte) (err error) {
-	*plaintext, err = k.key.Encrypt(args.Plaintext)
+	*plaintext, err = k.key.Encrypt(args.Plaintext, nil)
 	return
 }
 
 func (k *EnterpriseCertSigner) Decrypt(args DecryptArgs, ciphertext *[]byte) (err error) {
-	*ciphertext, err = k.key.Decrypt(args.Ciphertext)
+	*ciphertext, err = k.key.Decrypt(nil, args.Ciphertext, args.Opts)
 	return
 }
 
 func main() {
 	enableECPLogging()
-	if len(os.Args) != 2 {
+	// The signer is invoked as `ecp <config>` by a client, which talks to it
+	// over stdin/stdout, or as `ecp <config> -socket <path>` to serve every
+	// client of the current user on a Unix domain socket. Either may add
+	// `-profile <name>` to use a named credential of the config.
+	args, err := util.ParseArgs(os.Args[1:], "-socket")
+	if err != nil {
 		log.Fatalln("Signer is not meant to be invoked manually, exiting...")
 	}
-	configFilePath := os.Args[1]
-	config, err := util.LoadConfig(configFilePath)
+	config, err := util.LoadConfigProfile(args.ConfigFilePath, args.Profile)
 	if err != nil {
 		log.Fatalf("Failed to load enterprise cert config: %v", err)
 	}
+	if err := util.ApplyResourceLimits(config.ResourceLimits); err != nil {
+		log.Fatalf("Failed to apply signer resource limits: %v", err)
+	}
+
+	// Without cgo the keychain package can find the credential but cannot
+	// sign with it, so fail now rather than on the client's first signature.
+	if !keychain.PrivateKeyOperations {
+		log.Fatalln("The enterprise cert signer was built without cgo and cannot sign with keychain keys; rebuild it with CGO_ENABLED=1")
+	}
 
 	enterpriseCertSigner := new(EnterpriseCertSigner)
-	enterpriseCertSigner.key, err = keychain.Cred(config.CertConfigs.MacOSKeychain.Issuer)
+	enterpriseCertSigner.key, err = keychain.CredWithOptions(keychain.ConfigOptions(config.CertConfigs.MacOSKeychain))
 	if err != nil {
 		log.Fatalf("Failed to initialize enterprise cert signer using keychain: %v", err)
 	}
+	enterpriseCertSigner.allowLegacyHashes = config.CertConfigs.MacOSKeychain.AllowLegacyHashes
 
 	if err := rpc.Register(enterpriseCertSigner); err != nil {
 		log.Fatalf("Failed to register enterprise cert signer with net/rpc: %v", err)
 	}
 
+	if args.Listen != "" {
+		// A shared signer outlives the process that started it.
+		if err := transport.ServeUnix(rpc.DefaultServer, args.Listen); err != nil {
+			log.Fatalf("Failed to serve on Unix domain socket: %v", err)
+		}
+		return
+	}
+
 	// If the parent process dies, we should exit.
 	// We can detect this by periodically checking if the PID of the parent
 	// process is 1 (https://stackoverflow.com/a/2035683).
@@ -147,5 +197,5 @@ func main() {
 		}
 	}()
 
-	rpc.ServeConn(&Connection{os.Stdin, os.Stdout})
+	transport.Serve(rpc.DefaultServer, &Connection{os.Stdin, os.Stdout})
 }
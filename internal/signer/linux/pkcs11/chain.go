@@ -0,0 +1,120 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// tokenCertificates returns the X.509 certificates stored on the token,
+// skipping any that cannot be read or parsed.
+func tokenCertificates(s *session) ([]*x509.Certificate, error) {
+	handles, err := s.findObjects([]attribute{
+		ulongAttribute(attrClass, classCertificate),
+		ulongAttribute(attrCertificateType, certificateX509),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, h := range handles {
+		der, err := s.attributeValue(h, attrValue)
+		if err != nil {
+			continue
+		}
+		if xc, err := x509.ParseCertificate(der); err == nil {
+			certs = append(certs, xc)
+		}
+	}
+	return certs, nil
+}
+
+// readCertificates returns the certificates in a PEM bundle.
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate chain: %w", err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		xc, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate chain %s: %w", path, err)
+		}
+		certs = append(certs, xc)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates were found in %s", path)
+	}
+	return certs, nil
+}
+
+// buildChain returns leaf followed by its issuers among all, as far as they
+// go. Where several certificates could have issued one, the one valid for
+// longest is used.
+func buildChain(leaf *x509.Certificate, all []*x509.Certificate) []*x509.Certificate {
+	var (
+		certs      []*x509.Certificate
+		prev, next *x509.Certificate
+	)
+	for prev = leaf; prev != nil; prev, next = next, nil {
+		certs = append(certs, prev)
+		for _, xc := range all {
+			if certIn(xc, certs) {
+				continue
+			}
+			if bytes.Equal(prev.RawIssuer, xc.RawSubject) && prev.CheckSignatureFrom(xc) == nil {
+				if next == nil || xc.NotAfter.After(next.NotAfter) {
+					next = xc
+				}
+			}
+		}
+	}
+	return certs
+}
+
+func certIn(xc *x509.Certificate, xcs []*x509.Certificate) bool {
+	for _, xc2 := range xcs {
+		if xc.Equal(xc2) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutRoot returns chain without its last certificate if that is a
+// self-signed root.
+func withoutRoot(chain []*x509.Certificate) []*x509.Certificate {
+	if len(chain) > 1 && isSelfSigned(chain[len(chain)-1]) {
+		return chain[:len(chain)-1]
+	}
+	return chain
+}
+
+// isSelfSigned reports whether xc is a root certificate.
+func isSelfSigned(xc *x509.Certificate) bool {
+	return bytes.Equal(xc.RawIssuer, xc.RawSubject) && xc.CheckSignatureFrom(xc) == nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newCert returns a certificate for name issued by parent and parentKey, or
+// a self-signed one if parent is nil.
+func newCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil || name != "leaf",
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xc, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return xc, key
+}
+
+func TestBuildChain(t *testing.T) {
+	root, rootKey := newCert(t, "root", nil, nil)
+	intermediate, intermediateKey := newCert(t, "intermediate", root, rootKey)
+	leaf, _ := newCert(t, "leaf", intermediate, intermediateKey)
+	unrelated, _ := newCert(t, "unrelated", nil, nil)
+
+	chain := buildChain(leaf, []*x509.Certificate{unrelated, root, leaf, intermediate})
+	want := []*x509.Certificate{leaf, intermediate, root}
+	if len(chain) != len(want) {
+		t.Fatalf("buildChain: got %d certificates, want %d", len(chain), len(want))
+	}
+	for i := range want {
+		if !chain[i].Equal(want[i]) {
+			t.Errorf("buildChain: certificate %d is %s, want %s", i, chain[i].Subject.CommonName, want[i].Subject.CommonName)
+		}
+	}
+
+	if got := withoutRoot(chain); len(got) != 2 {
+		t.Errorf("withoutRoot: got %d certificates, want 2", len(got))
+	}
+	if got := withoutRoot([]*x509.Certificate{root}); len(got) != 1 {
+		t.Errorf("withoutRoot of a lone root: got %d certificates, want 1", len(got))
+	}
+	if got := buildChain(leaf, nil); len(got) != 1 {
+		t.Errorf("buildChain without issuers: got %d certificates, want 1", len(got))
+	}
+}
+
+func TestReadCertificates(t *testing.T) {
+	root, rootKey := newCert(t, "root", nil, nil)
+	intermediate, _ := newCert(t, "intermediate", root, rootKey)
+	var data []byte
+	for _, xc := range []*x509.Certificate{intermediate, root} {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: xc.Raw})...)
+	}
+	path := filepath.Join(t.TempDir(), "chain.pem")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := readCertificates(path)
+	if err != nil {
+		t.Fatalf("readCertificates: %v", err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(intermediate) || !certs[1].Equal(root) {
+		t.Errorf("readCertificates: got %d certificates, want intermediate and root", len(certs))
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("no certificates here"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCertificates(empty); err == nil {
+		t.Error("readCertificates of a file without certificates: got nil error, want error")
+	}
+}
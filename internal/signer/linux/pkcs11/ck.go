@@ -0,0 +1,890 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+/*
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+
+#define CK_PTR *
+#define CK_DECLARE_FUNCTION(returnType, name) \
+  returnType name
+#define CK_DECLARE_FUNCTION_POINTER(returnType, name) \
+  returnType (* name)
+#define CK_CALLBACK_FUNCTION(returnType, name) \
+  returnType (* name)
+#ifndef NULL_PTR
+#define NULL_PTR 0
+#endif
+
+#include "third_party/pkcs11/pkcs11.h"
+
+// Go can't call a C function pointer directly, so these wrappers perform the
+// dereference in C. They are static so as not to clash with go-pkcs11's.
+
+static CK_RV p11_get_function_list(CK_C_GetFunctionList fn, CK_FUNCTION_LIST_PTR_PTR p) {
+	return (*fn)(p);
+}
+
+// p11_initialize initializes the module with library parameters in the
+// reserved field of its arguments, where NSS softoken expects its
+// configuration.
+static CK_RV p11_initialize(CK_FUNCTION_LIST_PTR fl, char *params) {
+	CK_C_INITIALIZE_ARGS args;
+	memset(&args, 0, sizeof(args));
+	args.flags = CKF_OS_LOCKING_OK;
+	args.pReserved = params;
+	return (*fl->C_Initialize)(&args);
+}
+
+static CK_RV p11_finalize(CK_FUNCTION_LIST_PTR fl) {
+	return (*fl->C_Finalize)(NULL_PTR);
+}
+
+static CK_RV p11_get_slot_list(CK_FUNCTION_LIST_PTR fl, CK_SLOT_ID_PTR pSlotList, CK_ULONG_PTR pulCount) {
+	return (*fl->C_GetSlotList)(CK_TRUE, pSlotList, pulCount);
+}
+
+static CK_RV p11_get_token_info(CK_FUNCTION_LIST_PTR fl, CK_SLOT_ID slotID, CK_TOKEN_INFO_PTR pInfo) {
+	return (*fl->C_GetTokenInfo)(slotID, pInfo);
+}
+
+static CK_RV p11_get_mechanism_list(CK_FUNCTION_LIST_PTR fl, CK_SLOT_ID slotID, CK_MECHANISM_TYPE_PTR pMechanismList, CK_ULONG_PTR pulCount) {
+	return (*fl->C_GetMechanismList)(slotID, pMechanismList, pulCount);
+}
+
+static CK_RV p11_open_session(CK_FUNCTION_LIST_PTR fl, CK_SLOT_ID slotID, CK_FLAGS flags, CK_SESSION_HANDLE_PTR phSession) {
+	return (*fl->C_OpenSession)(slotID, flags, NULL_PTR, NULL_PTR, phSession);
+}
+
+static CK_RV p11_close_session(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession) {
+	return (*fl->C_CloseSession)(hSession);
+}
+
+static CK_RV p11_get_session_info(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_SESSION_INFO_PTR pInfo) {
+	return (*fl->C_GetSessionInfo)(hSession, pInfo);
+}
+
+static CK_RV p11_login(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_UTF8CHAR_PTR pPin, CK_ULONG ulPinLen) {
+	return (*fl->C_Login)(hSession, CKU_USER, pPin, ulPinLen);
+}
+
+static CK_RV p11_login_context(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_UTF8CHAR_PTR pPin, CK_ULONG ulPinLen) {
+	return (*fl->C_Login)(hSession, CKU_CONTEXT_SPECIFIC, pPin, ulPinLen);
+}
+
+static CK_RV p11_find_objects_init(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_ATTRIBUTE_PTR pTemplate, CK_ULONG ulCount) {
+	return (*fl->C_FindObjectsInit)(hSession, pTemplate, ulCount);
+}
+
+static CK_RV p11_find_objects(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_OBJECT_HANDLE_PTR phObject, CK_ULONG ulMaxObjectCount, CK_ULONG_PTR pulObjectCount) {
+	return (*fl->C_FindObjects)(hSession, phObject, ulMaxObjectCount, pulObjectCount);
+}
+
+static CK_RV p11_find_objects_final(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession) {
+	return (*fl->C_FindObjectsFinal)(hSession);
+}
+
+static CK_RV p11_get_attribute_value(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_OBJECT_HANDLE hObject, CK_ATTRIBUTE_PTR pTemplate, CK_ULONG ulCount) {
+	return (*fl->C_GetAttributeValue)(hSession, hObject, pTemplate, ulCount);
+}
+
+static CK_RV p11_generate_key_pair(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_MECHANISM_PTR pMechanism, CK_ATTRIBUTE_PTR pPublicKeyTemplate, CK_ULONG ulPublicKeyAttributeCount, CK_ATTRIBUTE_PTR pPrivateKeyTemplate, CK_ULONG ulPrivateKeyAttributeCount, CK_OBJECT_HANDLE_PTR phPublicKey, CK_OBJECT_HANDLE_PTR phPrivateKey) {
+	return (*fl->C_GenerateKeyPair)(hSession, pMechanism, pPublicKeyTemplate, ulPublicKeyAttributeCount, pPrivateKeyTemplate, ulPrivateKeyAttributeCount, phPublicKey, phPrivateKey);
+}
+
+static CK_RV p11_create_object(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_ATTRIBUTE_PTR pTemplate, CK_ULONG ulCount, CK_OBJECT_HANDLE_PTR phObject) {
+	return (*fl->C_CreateObject)(hSession, pTemplate, ulCount, phObject);
+}
+
+static CK_RV p11_destroy_object(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_OBJECT_HANDLE hObject) {
+	return (*fl->C_DestroyObject)(hSession, hObject);
+}
+
+static CK_RV p11_derive_key(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_MECHANISM_PTR pMechanism, CK_OBJECT_HANDLE hBaseKey, CK_ATTRIBUTE_PTR pTemplate, CK_ULONG ulAttributeCount, CK_OBJECT_HANDLE_PTR phKey) {
+	return (*fl->C_DeriveKey)(hSession, pMechanism, hBaseKey, pTemplate, ulAttributeCount, phKey);
+}
+
+static CK_RV p11_decrypt_init(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_MECHANISM_PTR pMechanism, CK_OBJECT_HANDLE hKey) {
+	return (*fl->C_DecryptInit)(hSession, pMechanism, hKey);
+}
+
+static CK_RV p11_decrypt(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_BYTE_PTR pEncryptedData, CK_ULONG ulEncryptedDataLen, CK_BYTE_PTR pData, CK_ULONG_PTR pulDataLen) {
+	return (*fl->C_Decrypt)(hSession, pEncryptedData, ulEncryptedDataLen, pData, pulDataLen);
+}
+
+static CK_RV p11_sign_init(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_MECHANISM_PTR pMechanism, CK_OBJECT_HANDLE hKey) {
+	return (*fl->C_SignInit)(hSession, pMechanism, hKey);
+}
+
+static CK_RV p11_sign(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE hSession, CK_BYTE_PTR pData, CK_ULONG ulDataLen, CK_BYTE_PTR pSignature, CK_ULONG_PTR pulSignatureLen) {
+	return (*fl->C_Sign)(hSession, pData, ulDataLen, pSignature, pulSignatureLen);
+}
+
+// p11_new_mechanism returns a mechanism with a copy of its parameter in the
+// same allocation, to be released with free.
+static CK_MECHANISM_PTR p11_new_mechanism(CK_MECHANISM_TYPE type, CK_VOID_PTR param, CK_ULONG paramLen) {
+	CK_MECHANISM_PTR m = malloc(sizeof(CK_MECHANISM) + paramLen);
+	if (m == NULL_PTR) {
+		return NULL_PTR;
+	}
+	m->mechanism = type;
+	m->pParameter = NULL_PTR;
+	m->ulParameterLen = paramLen;
+	if (paramLen > 0) {
+		m->pParameter = m + 1;
+		memcpy(m->pParameter, param, paramLen);
+	}
+	return m;
+}
+
+// p11_oaep_mechanism returns a CKM_RSA_PKCS_OAEP mechanism whose parameters
+// and label share its allocation, to be released with free.
+static CK_MECHANISM_PTR p11_oaep_mechanism(CK_MECHANISM_TYPE hashAlg, CK_RSA_PKCS_MGF_TYPE mgf, CK_BYTE_PTR label, CK_ULONG labelLen) {
+	CK_MECHANISM_PTR m = malloc(sizeof(CK_MECHANISM) + sizeof(CK_RSA_PKCS_OAEP_PARAMS) + labelLen);
+	if (m == NULL_PTR) {
+		return NULL_PTR;
+	}
+	CK_RSA_PKCS_OAEP_PARAMS_PTR params = (CK_RSA_PKCS_OAEP_PARAMS_PTR)(m + 1);
+	params->hashAlg = hashAlg;
+	params->mgf = mgf;
+	params->source = CKZ_DATA_SPECIFIED;
+	params->pSourceData = NULL_PTR;
+	params->ulSourceDataLen = labelLen;
+	if (labelLen > 0) {
+		params->pSourceData = params + 1;
+		memcpy(params->pSourceData, label, labelLen);
+	}
+	m->mechanism = CKM_RSA_PKCS_OAEP;
+	m->pParameter = params;
+	m->ulParameterLen = sizeof(CK_RSA_PKCS_OAEP_PARAMS);
+	return m;
+}
+
+// p11_ecdh_mechanism returns a CKM_ECDH1_DERIVE mechanism without a key
+// derivation function, whose parameters and peer public key share its
+// allocation, to be released with free.
+static CK_MECHANISM_PTR p11_ecdh_mechanism(CK_BYTE_PTR publicData, CK_ULONG publicDataLen) {
+	CK_MECHANISM_PTR m = malloc(sizeof(CK_MECHANISM) + sizeof(CK_ECDH1_DERIVE_PARAMS) + publicDataLen);
+	if (m == NULL_PTR) {
+		return NULL_PTR;
+	}
+	CK_ECDH1_DERIVE_PARAMS_PTR params = (CK_ECDH1_DERIVE_PARAMS_PTR)(m + 1);
+	params->kdf = CKD_NULL;
+	params->ulSharedDataLen = 0;
+	params->pSharedData = NULL_PTR;
+	params->ulPublicDataLen = publicDataLen;
+	params->pPublicData = (CK_BYTE_PTR)(params + 1);
+	memcpy(params->pPublicData, publicData, publicDataLen);
+	m->mechanism = CKM_ECDH1_DERIVE;
+	m->pParameter = params;
+	m->ulParameterLen = sizeof(CK_ECDH1_DERIVE_PARAMS);
+	return m;
+}
+*/
+// #cgo linux LDFLAGS: -ldl
+import "C"
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// This file reaches the PKCS #11 functions that go-pkcs11 does not wrap. It
+// loads the same module a second time, which only takes another reference to
+// the already loaded library, and relies on go-pkcs11 having called
+// C_Initialize. Since login state is shared by all sessions of an
+// application, the sessions opened here are logged in whenever go-pkcs11's
+// session is.
+
+// Object classes, attribute types and mechanisms used in this package.
+const (
+	classCertificate = uint(C.CKO_CERTIFICATE)
+	classPrivateKey  = uint(C.CKO_PRIVATE_KEY)
+	classSecretKey   = uint(C.CKO_SECRET_KEY)
+
+	attrClass           = uint(C.CKA_CLASS)
+	attrLabel           = uint(C.CKA_LABEL)
+	attrID              = uint(C.CKA_ID)
+	attrValue           = uint(C.CKA_VALUE)
+	attrCertificateType = uint(C.CKA_CERTIFICATE_TYPE)
+	attrToken           = uint(C.CKA_TOKEN)
+	attrPrivate         = uint(C.CKA_PRIVATE)
+	attrSensitive       = uint(C.CKA_SENSITIVE)
+	attrExtractable     = uint(C.CKA_EXTRACTABLE)
+	attrSign            = uint(C.CKA_SIGN)
+	attrVerify          = uint(C.CKA_VERIFY)
+	attrDecrypt         = uint(C.CKA_DECRYPT)
+	attrEncrypt         = uint(C.CKA_ENCRYPT)
+	attrDerive          = uint(C.CKA_DERIVE)
+	attrModulus         = uint(C.CKA_MODULUS)
+	attrModulusBits     = uint(C.CKA_MODULUS_BITS)
+	attrPublicExponent  = uint(C.CKA_PUBLIC_EXPONENT)
+	attrECParams        = uint(C.CKA_EC_PARAMS)
+	attrECPoint         = uint(C.CKA_EC_POINT)
+	attrSubject         = uint(C.CKA_SUBJECT)
+	attrIssuer          = uint(C.CKA_ISSUER)
+	attrSerialNumber    = uint(C.CKA_SERIAL_NUMBER)
+	attrAlwaysAuth      = uint(C.CKA_ALWAYS_AUTHENTICATE)
+	attrKeyType         = uint(C.CKA_KEY_TYPE)
+	attrValueLen        = uint(C.CKA_VALUE_LEN)
+
+	keyTypeGenericSecret = uint(C.CKK_GENERIC_SECRET)
+
+	certificateX509 = uint(C.CKC_X_509)
+
+	mechRSAPKCS    = uint(C.CKM_RSA_PKCS)
+	mechRSAPKCSPSS = uint(C.CKM_RSA_PKCS_PSS)
+	mechRSAX509    = uint(C.CKM_RSA_X_509)
+	mechECDSA      = uint(C.CKM_ECDSA)
+
+	mechRSAKeyPairGen = uint(C.CKM_RSA_PKCS_KEY_PAIR_GEN)
+	mechECKeyPairGen  = uint(C.CKM_EC_KEY_PAIR_GEN)
+)
+
+// rvNames names the return values callers most often see.
+var rvNames = map[uint]string{
+	uint(C.CKR_GENERAL_ERROR):              "CKR_GENERAL_ERROR",
+	uint(C.CKR_ARGUMENTS_BAD):              "CKR_ARGUMENTS_BAD",
+	uint(C.CKR_DEVICE_ERROR):               "CKR_DEVICE_ERROR",
+	uint(C.CKR_DEVICE_MEMORY):              "CKR_DEVICE_MEMORY",
+	uint(C.CKR_DEVICE_REMOVED):             "CKR_DEVICE_REMOVED",
+	uint(C.CKR_ENCRYPTED_DATA_INVALID):     "CKR_ENCRYPTED_DATA_INVALID",
+	uint(C.CKR_ENCRYPTED_DATA_LEN_RANGE):   "CKR_ENCRYPTED_DATA_LEN_RANGE",
+	uint(C.CKR_FUNCTION_NOT_SUPPORTED):     "CKR_FUNCTION_NOT_SUPPORTED",
+	uint(C.CKR_KEY_FUNCTION_NOT_PERMITTED): "CKR_KEY_FUNCTION_NOT_PERMITTED",
+	uint(C.CKR_KEY_HANDLE_INVALID):         "CKR_KEY_HANDLE_INVALID",
+	uint(C.CKR_KEY_TYPE_INCONSISTENT):      "CKR_KEY_TYPE_INCONSISTENT",
+	uint(C.CKR_MECHANISM_INVALID):          "CKR_MECHANISM_INVALID",
+	uint(C.CKR_MECHANISM_PARAM_INVALID):    "CKR_MECHANISM_PARAM_INVALID",
+	uint(C.CKR_OBJECT_HANDLE_INVALID):      "CKR_OBJECT_HANDLE_INVALID",
+	uint(C.CKR_PIN_INCORRECT):              "CKR_PIN_INCORRECT",
+	uint(C.CKR_PIN_LOCKED):                 "CKR_PIN_LOCKED",
+	uint(C.CKR_SESSION_CLOSED):             "CKR_SESSION_CLOSED",
+	uint(C.CKR_SESSION_HANDLE_INVALID):     "CKR_SESSION_HANDLE_INVALID",
+	uint(C.CKR_TOKEN_NOT_PRESENT):          "CKR_TOKEN_NOT_PRESENT",
+	uint(C.CKR_TOKEN_NOT_RECOGNIZED):       "CKR_TOKEN_NOT_RECOGNIZED",
+	uint(C.CKR_TOKEN_WRITE_PROTECTED):      "CKR_TOKEN_WRITE_PROTECTED",
+	uint(C.CKR_TEMPLATE_INCONSISTENT):      "CKR_TEMPLATE_INCONSISTENT",
+	uint(C.CKR_ATTRIBUTE_VALUE_INVALID):    "CKR_ATTRIBUTE_VALUE_INVALID",
+	uint(C.CKR_USER_NOT_LOGGED_IN):         "CKR_USER_NOT_LOGGED_IN",
+	uint(C.CKR_BUFFER_TOO_SMALL):           "CKR_BUFFER_TOO_SMALL",
+	uint(C.CKR_CRYPTOKI_NOT_INITIALIZED):   "CKR_CRYPTOKI_NOT_INITIALIZED",
+}
+
+// ckError is a PKCS #11 function that returned something other than CKR_OK.
+type ckError struct {
+	fn string
+	rv uint
+}
+
+func (e *ckError) Error() string {
+	name, ok := rvNames[e.rv]
+	if !ok {
+		name = fmt.Sprintf("0x%08x", e.rv)
+	}
+	return fmt.Sprintf("pkcs11: %s: %s", e.fn, name)
+}
+
+// sessionLost reports whether err means that the session, the login or the
+// object handles it used are gone, as happens when a token daemon restarts,
+// so that the operation should be retried with a new session.
+func sessionLost(err error) bool {
+	var ckErr *ckError
+	if !errors.As(err, &ckErr) {
+		return false
+	}
+	switch C.CK_RV(ckErr.rv) {
+	case C.CKR_SESSION_HANDLE_INVALID, C.CKR_SESSION_CLOSED, C.CKR_USER_NOT_LOGGED_IN,
+		C.CKR_OBJECT_HANDLE_INVALID, C.CKR_KEY_HANDLE_INVALID:
+		return true
+	}
+	return false
+}
+
+// deviceLost reports whether err means that the token or its reader failed or
+// was removed, or that the module was finalized under the caller, so that the
+// module must be initialized again before retrying.
+func deviceLost(err error) bool {
+	var ckErr *ckError
+	if !errors.As(err, &ckErr) {
+		return false
+	}
+	switch C.CK_RV(ckErr.rv) {
+	case C.CKR_DEVICE_ERROR, C.CKR_DEVICE_REMOVED, C.CKR_TOKEN_NOT_PRESENT, C.CKR_CRYPTOKI_NOT_INITIALIZED:
+		return true
+	}
+	return false
+}
+
+func checkRV(fn string, rv C.CK_RV) error {
+	if rv == C.CKR_OK {
+		return nil
+	}
+	return &ckError{fn: fn, rv: uint(rv)}
+}
+
+// library is a reference to a loaded PKCS #11 module.
+type library struct {
+	handle unsafe.Pointer
+	fl     C.CK_FUNCTION_LIST_PTR
+	// initialized is set when the library initialized the module itself
+	// rather than relying on go-pkcs11, and so must finalize it.
+	initialized bool
+}
+
+// openLibrary takes a reference to the module at path, which must already be
+// initialized.
+func openLibrary(path string) (*library, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	handle := C.dlopen(cPath, C.RTLD_NOW)
+	if handle == nil {
+		return nil, fmt.Errorf("pkcs11: dlopen error: %s", C.GoString(C.dlerror()))
+	}
+
+	cSym := C.CString("C_GetFunctionList")
+	defer C.free(unsafe.Pointer(cSym))
+	getFunctionList := (C.CK_C_GetFunctionList)(C.dlsym(handle, cSym))
+	if getFunctionList == nil {
+		err := fmt.Errorf("pkcs11: lookup function list symbol: %s", C.GoString(C.dlerror()))
+		C.dlclose(handle)
+		return nil, err
+	}
+	var fl C.CK_FUNCTION_LIST_PTR
+	if err := checkRV("C_GetFunctionList", C.p11_get_function_list(getFunctionList, &fl)); err != nil {
+		C.dlclose(handle)
+		return nil, err
+	}
+	return &library{handle: handle, fl: fl}, nil
+}
+
+// initialize initializes the module with the given library parameters, for
+// modules such as NSS softoken that go-pkcs11 cannot configure.
+func (l *library) initialize(params string) error {
+	cParams := C.CString(params)
+	defer C.free(unsafe.Pointer(cParams))
+	if err := checkRV("C_Initialize", C.p11_initialize(l.fl, cParams)); err != nil {
+		return err
+	}
+	l.initialized = true
+	return nil
+}
+
+// close drops the reference to the module, finalizing it only if the
+// library initialized it.
+func (l *library) close() {
+	if l.initialized {
+		C.p11_finalize(l.fl)
+	}
+	C.dlclose(l.handle)
+}
+
+// slots returns the IDs of the slots holding a token.
+func (l *library) slots() ([]uint32, error) {
+	var n C.CK_ULONG
+	if err := checkRV("C_GetSlotList", C.p11_get_slot_list(l.fl, nil, &n)); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	list := make([]C.CK_SLOT_ID, n)
+	if err := checkRV("C_GetSlotList", C.p11_get_slot_list(l.fl, &list[0], &n)); err != nil {
+		return nil, err
+	}
+	ids := make([]uint32, 0, n)
+	for _, id := range list[:n] {
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// mechanisms returns the set of mechanisms the token in slot supports.
+func (l *library) mechanisms(slot uint32) (map[uint]bool, error) {
+	var n C.CK_ULONG
+	if err := checkRV("C_GetMechanismList", C.p11_get_mechanism_list(l.fl, C.CK_SLOT_ID(slot), nil, &n)); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return map[uint]bool{}, nil
+	}
+	list := make([]C.CK_MECHANISM_TYPE, n)
+	if err := checkRV("C_GetMechanismList", C.p11_get_mechanism_list(l.fl, C.CK_SLOT_ID(slot), &list[0], &n)); err != nil {
+		return nil, err
+	}
+	set := make(map[uint]bool, n)
+	for _, m := range list[:n] {
+		set[uint(m)] = true
+	}
+	return set, nil
+}
+
+// tokenInfo is the part of CK_TOKEN_INFO that describes the token.
+type tokenInfo struct {
+	label, manufacturer, model, serial string
+	flags                              uint
+	hardwareVersion, firmwareVersion   string
+	// The memory sizes are in bytes, or -1 if the token does not say.
+	totalPublicMemory, freePublicMemory   int64
+	totalPrivateMemory, freePrivateMemory int64
+}
+
+// tokenInfo returns information about the token in slot.
+func (l *library) tokenInfo(slot uint32) (tokenInfo, error) {
+	var info C.CK_TOKEN_INFO
+	if err := checkRV("C_GetTokenInfo", C.p11_get_token_info(l.fl, C.CK_SLOT_ID(slot), &info)); err != nil {
+		return tokenInfo{}, err
+	}
+	padded := func(b unsafe.Pointer, n int) string {
+		return strings.TrimRight(C.GoStringN((*C.char)(b), C.int(n)), " \x00")
+	}
+	memory := func(v C.CK_ULONG) int64 {
+		if v == C.CK_UNAVAILABLE_INFORMATION {
+			return -1
+		}
+		return int64(v)
+	}
+	version := func(v C.CK_VERSION) string {
+		return fmt.Sprintf("%d.%d", v.major, v.minor)
+	}
+	return tokenInfo{
+		label:              padded(unsafe.Pointer(&info.label[0]), len(info.label)),
+		manufacturer:       padded(unsafe.Pointer(&info.manufacturerID[0]), len(info.manufacturerID)),
+		model:              padded(unsafe.Pointer(&info.model[0]), len(info.model)),
+		serial:             padded(unsafe.Pointer(&info.serialNumber[0]), len(info.serialNumber)),
+		flags:              uint(info.flags),
+		hardwareVersion:    version(info.hardwareVersion),
+		firmwareVersion:    version(info.firmwareVersion),
+		totalPublicMemory:  memory(info.ulTotalPublicMemory),
+		freePublicMemory:   memory(info.ulFreePublicMemory),
+		totalPrivateMemory: memory(info.ulTotalPrivateMemory),
+		freePrivateMemory:  memory(info.ulFreePrivateMemory),
+	}, nil
+}
+
+// tokenFlagNames names the CK_TOKEN_INFO flags, in bit order.
+var tokenFlagNames = []struct {
+	flag uint
+	name string
+}{
+	{uint(C.CKF_RNG), "CKF_RNG"},
+	{uint(C.CKF_WRITE_PROTECTED), "CKF_WRITE_PROTECTED"},
+	{uint(C.CKF_LOGIN_REQUIRED), "CKF_LOGIN_REQUIRED"},
+	{uint(C.CKF_USER_PIN_INITIALIZED), "CKF_USER_PIN_INITIALIZED"},
+	{uint(C.CKF_RESTORE_KEY_NOT_NEEDED), "CKF_RESTORE_KEY_NOT_NEEDED"},
+	{uint(C.CKF_CLOCK_ON_TOKEN), "CKF_CLOCK_ON_TOKEN"},
+	{uint(C.CKF_PROTECTED_AUTHENTICATION_PATH), "CKF_PROTECTED_AUTHENTICATION_PATH"},
+	{uint(C.CKF_DUAL_CRYPTO_OPERATIONS), "CKF_DUAL_CRYPTO_OPERATIONS"},
+	{uint(C.CKF_TOKEN_INITIALIZED), "CKF_TOKEN_INITIALIZED"},
+	{uint(C.CKF_SECONDARY_AUTHENTICATION), "CKF_SECONDARY_AUTHENTICATION"},
+	{uint(C.CKF_USER_PIN_COUNT_LOW), "CKF_USER_PIN_COUNT_LOW"},
+	{uint(C.CKF_USER_PIN_FINAL_TRY), "CKF_USER_PIN_FINAL_TRY"},
+	{uint(C.CKF_USER_PIN_LOCKED), "CKF_USER_PIN_LOCKED"},
+	{uint(C.CKF_USER_PIN_TO_BE_CHANGED), "CKF_USER_PIN_TO_BE_CHANGED"},
+	{uint(C.CKF_SO_PIN_COUNT_LOW), "CKF_SO_PIN_COUNT_LOW"},
+	{uint(C.CKF_SO_PIN_FINAL_TRY), "CKF_SO_PIN_FINAL_TRY"},
+	{uint(C.CKF_SO_PIN_LOCKED), "CKF_SO_PIN_LOCKED"},
+	{uint(C.CKF_SO_PIN_TO_BE_CHANGED), "CKF_SO_PIN_TO_BE_CHANGED"},
+	{uint(C.CKF_ERROR_STATE), "CKF_ERROR_STATE"},
+}
+
+// mechanismNames names the mechanisms most relevant to the signer.
+var mechanismNames = map[uint]string{
+	uint(C.CKM_RSA_PKCS_KEY_PAIR_GEN): "CKM_RSA_PKCS_KEY_PAIR_GEN",
+	uint(C.CKM_RSA_PKCS):              "CKM_RSA_PKCS",
+	uint(C.CKM_RSA_X_509):             "CKM_RSA_X_509",
+	uint(C.CKM_RSA_PKCS_OAEP):         "CKM_RSA_PKCS_OAEP",
+	uint(C.CKM_RSA_PKCS_PSS):          "CKM_RSA_PKCS_PSS",
+	uint(C.CKM_SHA1_RSA_PKCS):         "CKM_SHA1_RSA_PKCS",
+	uint(C.CKM_SHA256_RSA_PKCS):       "CKM_SHA256_RSA_PKCS",
+	uint(C.CKM_SHA384_RSA_PKCS):       "CKM_SHA384_RSA_PKCS",
+	uint(C.CKM_SHA512_RSA_PKCS):       "CKM_SHA512_RSA_PKCS",
+	uint(C.CKM_SHA256_RSA_PKCS_PSS):   "CKM_SHA256_RSA_PKCS_PSS",
+	uint(C.CKM_SHA384_RSA_PKCS_PSS):   "CKM_SHA384_RSA_PKCS_PSS",
+	uint(C.CKM_SHA512_RSA_PKCS_PSS):   "CKM_SHA512_RSA_PKCS_PSS",
+	uint(C.CKM_SHA_1):                 "CKM_SHA_1",
+	uint(C.CKM_SHA256):                "CKM_SHA256",
+	uint(C.CKM_SHA384):                "CKM_SHA384",
+	uint(C.CKM_SHA512):                "CKM_SHA512",
+	uint(C.CKM_EC_KEY_PAIR_GEN):       "CKM_EC_KEY_PAIR_GEN",
+	uint(C.CKM_ECDSA):                 "CKM_ECDSA",
+	uint(C.CKM_ECDSA_SHA1):            "CKM_ECDSA_SHA1",
+	uint(C.CKM_ECDSA_SHA256):          "CKM_ECDSA_SHA256",
+	uint(C.CKM_ECDSA_SHA384):          "CKM_ECDSA_SHA384",
+	uint(C.CKM_ECDSA_SHA512):          "CKM_ECDSA_SHA512",
+	uint(C.CKM_ECDH1_DERIVE):          "CKM_ECDH1_DERIVE",
+}
+
+// session is a PKCS #11 session. Like the sessions themselves, it must not be
+// used by several goroutines at once.
+type session struct {
+	fl  C.CK_FUNCTION_LIST_PTR
+	h   C.CK_SESSION_HANDLE
+	gen uint64 // The sessionPool generation the session belongs to.
+}
+
+// openSession opens a read-only session with the given slot.
+func (l *library) openSession(slot uint32) (*session, error) {
+	return l.openSessionWithFlags(slot, C.CKF_SERIAL_SESSION)
+}
+
+// openRWSession opens a read/write session with the given slot, as is needed
+// to create objects on the token.
+func (l *library) openRWSession(slot uint32) (*session, error) {
+	return l.openSessionWithFlags(slot, C.CKF_SERIAL_SESSION|C.CKF_RW_SESSION)
+}
+
+func (l *library) openSessionWithFlags(slot uint32, flags C.CK_FLAGS) (*session, error) {
+	var h C.CK_SESSION_HANDLE
+	if err := checkRV("C_OpenSession", C.p11_open_session(l.fl, C.CK_SLOT_ID(slot), flags, &h)); err != nil {
+		return nil, err
+	}
+	return &session{fl: l.fl, h: h}, nil
+}
+
+func (s *session) close() error {
+	return checkRV("C_CloseSession", C.p11_close_session(s.fl, s.h))
+}
+
+// loggedIn reports whether the user is logged in to the session's token. It
+// fails if the session is no longer valid.
+func (s *session) loggedIn() (bool, error) {
+	var info C.CK_SESSION_INFO
+	if err := checkRV("C_GetSessionInfo", C.p11_get_session_info(s.fl, s.h, &info)); err != nil {
+		return false, err
+	}
+	switch info.state {
+	case C.CKS_RO_USER_FUNCTIONS, C.CKS_RW_USER_FUNCTIONS:
+		return true, nil
+	}
+	return false, nil
+}
+
+// login logs the user in to the session's token, and so to all sessions with
+// it.
+func (s *session) login(pin string) error {
+	cPIN := C.CBytes([]byte(pin))
+	defer C.free(cPIN)
+	rv := C.p11_login(s.fl, s.h, C.CK_UTF8CHAR_PTR(cPIN), C.CK_ULONG(len(pin)))
+	if rv == C.CKR_USER_ALREADY_LOGGED_IN {
+		return nil
+	}
+	return checkRV("C_Login", rv)
+}
+
+// loginContext logs in for the operation just initialized with s, as keys
+// with CKA_ALWAYS_AUTHENTICATE require.
+func (s *session) loginContext(pin string) error {
+	cPIN := C.CBytes([]byte(pin))
+	defer C.free(cPIN)
+	return checkRV("C_Login", C.p11_login_context(s.fl, s.h, C.CK_UTF8CHAR_PTR(cPIN), C.CK_ULONG(len(pin))))
+}
+
+// attribute is an entry of an object search template.
+type attribute struct {
+	typ   uint
+	value []byte
+}
+
+// ulongAttribute returns an attribute holding a CK_ULONG, such as a class.
+func ulongAttribute(typ, value uint) attribute {
+	v := C.CK_ULONG(value)
+	b := C.GoBytes(unsafe.Pointer(&v), C.int(unsafe.Sizeof(v)))
+	return attribute{typ: typ, value: b}
+}
+
+// boolAttribute returns an attribute holding a CK_BBOOL, such as CKA_TOKEN.
+func boolAttribute(typ uint, value bool) attribute {
+	if value {
+		return attribute{typ: typ, value: []byte{C.CK_TRUE}}
+	}
+	return attribute{typ: typ, value: []byte{C.CK_FALSE}}
+}
+
+// cTemplate copies attrs into C memory, as the template itself holds
+// pointers. The returned function releases it.
+func cTemplate(attrs []attribute) (C.CK_ATTRIBUTE_PTR, func()) {
+	if len(attrs) == 0 {
+		return nil, func() {}
+	}
+	p := (C.CK_ATTRIBUTE_PTR)(C.calloc(C.size_t(len(attrs)), C.size_t(unsafe.Sizeof(C.CK_ATTRIBUTE{}))))
+	template := unsafe.Slice(p, len(attrs))
+	for i, a := range attrs {
+		template[i]._type = C.CK_ATTRIBUTE_TYPE(a.typ)
+		template[i].ulValueLen = C.CK_ULONG(len(a.value))
+		if len(a.value) > 0 {
+			template[i].pValue = C.CK_VOID_PTR(C.CBytes(a.value))
+		}
+	}
+	return p, func() {
+		for _, a := range template {
+			C.free(unsafe.Pointer(a.pValue))
+		}
+		C.free(unsafe.Pointer(p))
+	}
+}
+
+// findObjects returns the handles of the objects matching attrs.
+func (s *session) findObjects(attrs []attribute) ([]uint, error) {
+	template, free := cTemplate(attrs)
+	defer free()
+	if err := checkRV("C_FindObjectsInit", C.p11_find_objects_init(s.fl, s.h, template, C.CK_ULONG(len(attrs)))); err != nil {
+		return nil, err
+	}
+
+	var handles []uint
+	var batch [16]C.CK_OBJECT_HANDLE
+	for {
+		var n C.CK_ULONG
+		if err := checkRV("C_FindObjects", C.p11_find_objects(s.fl, s.h, &batch[0], C.CK_ULONG(len(batch)), &n)); err != nil {
+			C.p11_find_objects_final(s.fl, s.h)
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		for _, h := range batch[:n] {
+			handles = append(handles, uint(h))
+		}
+	}
+	if err := checkRV("C_FindObjectsFinal", C.p11_find_objects_final(s.fl, s.h)); err != nil {
+		return nil, err
+	}
+	return handles, nil
+}
+
+// attributeValue returns the value of the attribute typ of the object obj.
+func (s *session) attributeValue(obj, typ uint) ([]byte, error) {
+	attr := C.CK_ATTRIBUTE{_type: C.CK_ATTRIBUTE_TYPE(typ)}
+	if err := checkRV("C_GetAttributeValue", C.p11_get_attribute_value(s.fl, s.h, C.CK_OBJECT_HANDLE(obj), &attr, 1)); err != nil {
+		return nil, err
+	}
+	if attr.ulValueLen == 0 {
+		return nil, nil
+	}
+	value := C.malloc(C.size_t(attr.ulValueLen))
+	defer C.free(value)
+	attr.pValue = C.CK_VOID_PTR(value)
+	if err := checkRV("C_GetAttributeValue", C.p11_get_attribute_value(s.fl, s.h, C.CK_OBJECT_HANDLE(obj), &attr, 1)); err != nil {
+		return nil, err
+	}
+	return C.GoBytes(value, C.int(attr.ulValueLen)), nil
+}
+
+// generateKeyPair generates a key pair with the mechanism m and returns the
+// handles of the public and private key objects.
+func (s *session) generateKeyPair(m mechanism, public, private []attribute) (uint, uint, error) {
+	pubTemplate, freePub := cTemplate(public)
+	defer freePub()
+	privTemplate, freePriv := cTemplate(private)
+	defer freePriv()
+	var pub, priv C.CK_OBJECT_HANDLE
+	rv := C.p11_generate_key_pair(s.fl, s.h, m.p, pubTemplate, C.CK_ULONG(len(public)), privTemplate, C.CK_ULONG(len(private)), &pub, &priv)
+	if err := checkRV("C_GenerateKeyPair", rv); err != nil {
+		return 0, 0, err
+	}
+	return uint(pub), uint(priv), nil
+}
+
+// createObject creates an object with the given attributes and returns its
+// handle.
+func (s *session) createObject(attrs []attribute) (uint, error) {
+	template, free := cTemplate(attrs)
+	defer free()
+	var h C.CK_OBJECT_HANDLE
+	rv := C.p11_create_object(s.fl, s.h, template, C.CK_ULONG(len(attrs)), &h)
+	if err := checkRV("C_CreateObject", rv); err != nil {
+		return 0, err
+	}
+	return uint(h), nil
+}
+
+// destroyObject destroys the object obj, such as a derived session key.
+func (s *session) destroyObject(obj uint) error {
+	return checkRV("C_DestroyObject", C.p11_destroy_object(s.fl, s.h, C.CK_OBJECT_HANDLE(obj)))
+}
+
+// deriveKey derives a key with the given attributes from the key object key
+// with the mechanism m, and returns its handle.
+func (s *session) deriveKey(key uint, m mechanism, attrs []attribute) (uint, error) {
+	template, free := cTemplate(attrs)
+	defer free()
+	var h C.CK_OBJECT_HANDLE
+	rv := C.p11_derive_key(s.fl, s.h, m.p, C.CK_OBJECT_HANDLE(key), template, C.CK_ULONG(len(attrs)), &h)
+	if err := checkRV("C_DeriveKey", rv); err != nil {
+		return 0, err
+	}
+	return uint(h), nil
+}
+
+// mechanism is a CK_MECHANISM in C memory. It must be freed.
+type mechanism struct {
+	p C.CK_MECHANISM_PTR
+}
+
+func (m mechanism) free() {
+	C.free(unsafe.Pointer(m.p))
+}
+
+// hashMechanisms maps hash functions onto their PKCS #11 mechanism and MGF1
+// variant, as used by RSA-OAEP and RSA-PSS, and onto the signature mechanisms
+// that hash the message on the token.
+var hashMechanisms = map[crypto.Hash]struct{ hash, mgf, rsaPKCS, rsaPSS, ecdsa uint }{
+	crypto.SHA1: {
+		hash: uint(C.CKM_SHA_1), mgf: uint(C.CKG_MGF1_SHA1),
+		rsaPKCS: uint(C.CKM_SHA1_RSA_PKCS), rsaPSS: uint(C.CKM_SHA1_RSA_PKCS_PSS), ecdsa: uint(C.CKM_ECDSA_SHA1),
+	},
+	crypto.SHA224: {
+		hash: uint(C.CKM_SHA224), mgf: uint(C.CKG_MGF1_SHA224),
+		rsaPKCS: uint(C.CKM_SHA224_RSA_PKCS), rsaPSS: uint(C.CKM_SHA224_RSA_PKCS_PSS), ecdsa: uint(C.CKM_ECDSA_SHA224),
+	},
+	crypto.SHA256: {
+		hash: uint(C.CKM_SHA256), mgf: uint(C.CKG_MGF1_SHA256),
+		rsaPKCS: uint(C.CKM_SHA256_RSA_PKCS), rsaPSS: uint(C.CKM_SHA256_RSA_PKCS_PSS), ecdsa: uint(C.CKM_ECDSA_SHA256),
+	},
+	crypto.SHA384: {
+		hash: uint(C.CKM_SHA384), mgf: uint(C.CKG_MGF1_SHA384),
+		rsaPKCS: uint(C.CKM_SHA384_RSA_PKCS), rsaPSS: uint(C.CKM_SHA384_RSA_PKCS_PSS), ecdsa: uint(C.CKM_ECDSA_SHA384),
+	},
+	crypto.SHA512: {
+		hash: uint(C.CKM_SHA512), mgf: uint(C.CKG_MGF1_SHA512),
+		rsaPKCS: uint(C.CKM_SHA512_RSA_PKCS), rsaPSS: uint(C.CKM_SHA512_RSA_PKCS_PSS), ecdsa: uint(C.CKM_ECDSA_SHA512),
+	},
+}
+
+// newMechanism returns a mechanism without parameters, such as mechRSAPKCS.
+func newMechanism(typ uint) (mechanism, error) {
+	p := C.p11_new_mechanism(C.CK_MECHANISM_TYPE(typ), nil, 0)
+	if p == nil {
+		return mechanism{}, errors.New("pkcs11: out of memory")
+	}
+	return mechanism{p: p}, nil
+}
+
+// oaepMechanism returns CKM_RSA_PKCS_OAEP with the given hash function, also
+// used for MGF1, and label.
+func oaepMechanism(hash crypto.Hash, label []byte) (mechanism, error) {
+	h, ok := hashMechanisms[hash]
+	if !ok {
+		return mechanism{}, fmt.Errorf("unsupported OAEP hash function %v", hash)
+	}
+	var cLabel C.CK_BYTE_PTR
+	if len(label) > 0 {
+		cLabel = (C.CK_BYTE_PTR)(unsafe.Pointer(&label[0]))
+	}
+	p := C.p11_oaep_mechanism(C.CK_MECHANISM_TYPE(h.hash), C.CK_RSA_PKCS_MGF_TYPE(h.mgf), cLabel, C.CK_ULONG(len(label)))
+	if p == nil {
+		return mechanism{}, errors.New("pkcs11: out of memory")
+	}
+	return mechanism{p: p}, nil
+}
+
+// ecdhMechanism returns CKM_ECDH1_DERIVE with the peer public key point, an
+// uncompressed point, and no key derivation function.
+func ecdhMechanism(point []byte) (mechanism, error) {
+	if len(point) == 0 {
+		return mechanism{}, errors.New("empty EC point")
+	}
+	p := C.p11_ecdh_mechanism((C.CK_BYTE_PTR)(unsafe.Pointer(&point[0])), C.CK_ULONG(len(point)))
+	if p == nil {
+		return mechanism{}, errors.New("pkcs11: out of memory")
+	}
+	return mechanism{p: p}, nil
+}
+
+// pssMechanism returns CKM_RSA_PKCS_PSS, or a variant such as
+// CKM_SHA256_RSA_PKCS_PSS that also hashes the message, with the given hash
+// function, also used for MGF1, and salt length in bytes.
+func pssMechanism(typ uint, hash crypto.Hash, saltLength int) (mechanism, error) {
+	h, ok := hashMechanisms[hash]
+	if !ok {
+		return mechanism{}, fmt.Errorf("unsupported hash algorithm: %s", hash)
+	}
+	params := C.CK_RSA_PKCS_PSS_PARAMS{
+		hashAlg: C.CK_MECHANISM_TYPE(h.hash),
+		mgf:     C.CK_RSA_PKCS_MGF_TYPE(h.mgf),
+		sLen:    C.CK_ULONG(saltLength),
+	}
+	p := C.p11_new_mechanism(C.CK_MECHANISM_TYPE(typ), C.CK_VOID_PTR(unsafe.Pointer(&params)), C.CK_ULONG(unsafe.Sizeof(params)))
+	if p == nil {
+		return mechanism{}, errors.New("pkcs11: out of memory")
+	}
+	return mechanism{p: p}, nil
+}
+
+// sign signs data with the private key object key. sigLen is the length of
+// the signature the mechanism produces.
+//
+// If login is not nil, it is called between C_SignInit and C_Sign, to log in
+// for keys with CKA_ALWAYS_AUTHENTICATE. C_Sign is called even if it fails,
+// as that ends the operation.
+func (s *session) sign(key uint, m mechanism, data []byte, sigLen int, login func(*session) error) ([]byte, error) {
+	if err := checkRV("C_SignInit", C.p11_sign_init(s.fl, s.h, m.p, C.CK_OBJECT_HANDLE(key))); err != nil {
+		return nil, err
+	}
+	var loginErr error
+	if login != nil {
+		loginErr = login(s)
+	}
+	// Mechanisms that hash on the token may sign an empty message.
+	var in C.CK_BYTE_PTR
+	if len(data) > 0 {
+		in = (C.CK_BYTE_PTR)(unsafe.Pointer(&data[0]))
+	}
+	sig := make([]byte, sigLen)
+	n := C.CK_ULONG(len(sig))
+	err := checkRV("C_Sign", C.p11_sign(s.fl, s.h, in, C.CK_ULONG(len(data)), (C.CK_BYTE_PTR)(unsafe.Pointer(&sig[0])), &n))
+	if loginErr != nil {
+		return nil, loginErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int(n) != len(sig) {
+		return nil, fmt.Errorf("expected signature of length %d, got %d", len(sig), n)
+	}
+	return sig, nil
+}
+
+// decrypt decrypts ciphertext with the private key object key.
+// login is called between C_DecryptInit and C_Decrypt as in sign.
+func (s *session) decrypt(key uint, m mechanism, ciphertext []byte, login func(*session) error) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, errors.New("empty ciphertext")
+	}
+	if err := checkRV("C_DecryptInit", C.p11_decrypt_init(s.fl, s.h, m.p, C.CK_OBJECT_HANDLE(key))); err != nil {
+		return nil, err
+	}
+	var loginErr error
+	if login != nil {
+		loginErr = login(s)
+	}
+	in := (C.CK_BYTE_PTR)(unsafe.Pointer(&ciphertext[0]))
+	// The plaintext is never longer than the ciphertext, so one call with a
+	// buffer of that size finishes the operation whatever the outcome.
+	out := make([]byte, len(ciphertext))
+	n := C.CK_ULONG(len(out))
+	err := checkRV("C_Decrypt", C.p11_decrypt(s.fl, s.h, in, C.CK_ULONG(len(ciphertext)), (C.CK_BYTE_PTR)(unsafe.Pointer(&out[0])), &n))
+	if loginErr != nil {
+		return nil, loginErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
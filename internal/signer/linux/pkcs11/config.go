@@ -0,0 +1,72 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"fmt"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+)
+
+// ConfigOptions converts the pkcs11 section of the ECP config into the options
+// of CredWithOptions, applying its URI and resolving its user PIN.
+func ConfigOptions(config util.PKCS11) (Options, error) {
+	opts := Options{
+		Module:  config.PKCS11Module,
+		Modules: config.Modules,
+		Slot:    config.Slot,
+		Token:   config.TokenLabel,
+		Serial:  config.TokenSerial,
+		Label:   config.Label,
+
+		ChainFile:   config.ChainFile,
+		ExcludeRoot: config.ExcludeRoot,
+		NSSDB:       config.NSSDB,
+		IssuerDN:    config.IssuerDN,
+		RawRSA:      config.RawRSA,
+
+		MaxConcurrentOperations: config.MaxConcurrentOperations,
+	}
+	if config.KeyID != "" {
+		id, err := ParseID(config.KeyID)
+		if err != nil {
+			return Options{}, fmt.Errorf("parsing the PKCS #11 key id: %w", err)
+		}
+		opts.ID = id
+	}
+	pinSource := PINSource{
+		PIN:     config.UserPin,
+		Env:     config.PinEnv,
+		File:    config.PinFile,
+		Command: config.PinCommand,
+
+		SecretService: config.PinSecretService,
+	}
+	if config.URI != "" {
+		uri, err := ParseURI(config.URI)
+		if err != nil {
+			return Options{}, fmt.Errorf("parsing the PKCS #11 URI: %w", err)
+		}
+		opts = uri.Options(opts)
+		if s, ok := uri.PINSource(); ok {
+			pinSource = s
+		}
+	}
+	pin, err := pinSource.Resolve()
+	if err != nil {
+		return Options{}, fmt.Errorf("getting the PKCS #11 user PIN: %w", err)
+	}
+	opts.PIN = pin
+	return opts, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+)
+
+func TestConfigOptions(t *testing.T) {
+	t.Setenv("TEST_PKCS11_PIN", "1234")
+	opts, err := ConfigOptions(util.PKCS11{
+		PKCS11Module: "/usr/lib/softhsm/libsofthsm2.so",
+		Slot:         "0x1739427",
+		Label:        "ecp",
+		KeyID:        "01a2",
+		PinEnv:       "TEST_PKCS11_PIN",
+	})
+	if err != nil {
+		t.Fatalf("ConfigOptions: %v", err)
+	}
+	if opts.Module != "/usr/lib/softhsm/libsofthsm2.so" || opts.Slot != "0x1739427" || opts.Label != "ecp" {
+		t.Errorf("ConfigOptions: got module %q, slot %q, label %q", opts.Module, opts.Slot, opts.Label)
+	}
+	if want := []byte{0x01, 0xa2}; !bytes.Equal(opts.ID, want) {
+		t.Errorf("ID: got %x, want %x", opts.ID, want)
+	}
+	if opts.PIN != "1234" {
+		t.Errorf("PIN: got %q, want %q", opts.PIN, "1234")
+	}
+}
+
+func TestConfigOptionsURI(t *testing.T) {
+	opts, err := ConfigOptions(util.PKCS11{
+		Slot:    "0x1739427",
+		Label:   "ecp",
+		UserPin: "0000",
+		URI:     "pkcs11:token=My%20Token;object=other?pin-value=1234",
+	})
+	if err != nil {
+		t.Fatalf("ConfigOptions: %v", err)
+	}
+	if opts.Slot != "" || opts.Token != "My Token" || opts.Label != "other" {
+		t.Errorf("ConfigOptions: got slot %q, token %q, label %q, want the URI's", opts.Slot, opts.Token, opts.Label)
+	}
+	if opts.PIN != "1234" {
+		t.Errorf("PIN: got %q, want the URI's %q", opts.PIN, "1234")
+	}
+}
+
+func TestConfigOptionsErrors(t *testing.T) {
+	for _, config := range []util.PKCS11{
+		{KeyID: "not hex"},
+		{URI: "token=gecc"},
+		{UserPin: "1234", PinEnv: "TEST_PKCS11_PIN"},
+	} {
+		if _, err := ConfigOptions(config); err == nil {
+			t.Errorf("ConfigOptions(%+v): got nil err, want error", config)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/ecies"
+)
+
+// Encrypt encrypts plaintext in Go with the public key extracted from the
+// token, with the schemes that Decrypt supports. For RSA keys, opts is
+// *rsa.OAEPOptions, *rsa.PKCS1v15DecryptOptions, or nil for RSA-OAEP with
+// SHA-256. EC keys use ECIES, as described in the ecies package, and opts
+// must be nil.
+func (k *Key) Encrypt(plaintext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if pub, ok := k.Public().(*ecdsa.PublicKey); ok {
+		if opts != nil {
+			return nil, fmt.Errorf("unsupported encryption options %T for an EC key", opts)
+		}
+		return ecies.Encrypt(rand.Reader, pub, plaintext)
+	}
+	pub, ok := k.Public().(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type %T", k.Public())
+	}
+	switch opts := opts.(type) {
+	case nil:
+		return rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, plaintext, nil)
+	case *rsa.OAEPOptions:
+		if _, ok := hashMechanisms[opts.Hash]; !ok {
+			return nil, fmt.Errorf("unsupported OAEP hash function %v", opts.Hash)
+		}
+		return rsa.EncryptOAEP(opts.Hash.New(), rand.Reader, pub, plaintext, opts.Label)
+	case *rsa.PKCS1v15DecryptOptions:
+		return rsa.EncryptPKCS1v15(rand.Reader, pub, plaintext)
+	default:
+		return nil, fmt.Errorf("unsupported encryption options %T", opts)
+	}
+}
+
+// Decrypt decrypts ciphertext with the private key on the token. RSA keys use
+// CKM_RSA_PKCS_OAEP or CKM_RSA_PKCS, and opts selects the padding scheme:
+// *rsa.OAEPOptions, *rsa.PKCS1v15DecryptOptions, or nil for RSA-OAEP with
+// SHA-256. EC keys decrypt ECIES ciphertexts with CKM_ECDH1_DERIVE, and opts
+// must be nil.
+func (k *Key) Decrypt(_ io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if pub, ok := k.Public().(*ecdsa.PublicKey); ok {
+		if opts != nil {
+			return nil, fmt.Errorf("unsupported decryption options %T for an EC key", opts)
+		}
+		return ecies.Decrypt(pub, ciphertext, k.KeyAgreement)
+	}
+	if _, ok := k.Public().(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("unsupported public key type %T", k.Public())
+	}
+	m, err := decryptMechanism(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer m.free()
+
+	var plaintext []byte
+	err = k.withPrivateKey(func(s *session, key uint) (err error) {
+		plaintext, err = s.decrypt(key, m, ciphertext, k.contextLogin())
+		return err
+	})
+	return plaintext, err
+}
+
+// KeyAgreement performs ECDH between the private key on the token and peer
+// with CKM_ECDH1_DERIVE, and returns the raw shared secret, the big-endian
+// x-coordinate of the shared point. The secret is derived into a temporary
+// session object, which is destroyed once read.
+func (k *Key) KeyAgreement(peer *ecdsa.PublicKey) ([]byte, error) {
+	pub, ok := k.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type %T, only EC keys support key agreement", k.Public())
+	}
+	if peer == nil || peer.Curve != pub.Curve {
+		return nil, fmt.Errorf("peer public key must be on %s", pub.Curve.Params().Name)
+	}
+	m, err := ecdhMechanism(elliptic.Marshal(peer.Curve, peer.X, peer.Y))
+	if err != nil {
+		return nil, err
+	}
+	defer m.free()
+
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	attrs := []attribute{
+		ulongAttribute(attrClass, classSecretKey),
+		ulongAttribute(attrKeyType, keyTypeGenericSecret),
+		ulongAttribute(attrValueLen, uint(size)),
+		boolAttribute(attrToken, false),
+		boolAttribute(attrSensitive, false),
+		boolAttribute(attrExtractable, true),
+	}
+	var secret []byte
+	err = k.withPrivateKey(func(s *session, key uint) error {
+		obj, err := s.deriveKey(key, m, attrs)
+		if err != nil {
+			return err
+		}
+		defer s.destroyObject(obj)
+		secret, err = s.attributeValue(obj, attrValue)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) != size {
+		return nil, fmt.Errorf("expected shared secret of length %d, got %d", size, len(secret))
+	}
+	return secret, nil
+}
+
+// decryptMechanism returns the mechanism opts selects.
+func decryptMechanism(opts crypto.DecrypterOpts) (mechanism, error) {
+	switch opts := opts.(type) {
+	case nil:
+		return oaepMechanism(crypto.SHA256, nil)
+	case *rsa.OAEPOptions:
+		return oaepMechanism(opts.Hash, opts.Label)
+	case *rsa.PKCS1v15DecryptOptions:
+		if opts.SessionKeyLen != 0 {
+			return mechanism{}, fmt.Errorf("PKCS#1 v1.5 session key decryption is not supported")
+		}
+		return newMechanism(mechRSAPKCS)
+	default:
+		return mechanism{}, fmt.Errorf("unsupported decryption options %T", opts)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/ecies"
+)
+
+func TestEncrypt(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &Key{pub: &priv.PublicKey}
+	plaintext := []byte("Plain text to encrypt")
+
+	ciphertext, err := k.Encrypt(plaintext, nil)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	got, err := rsa.DecryptOAEP(sha256.New(), nil, priv, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("DecryptOAEP: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("DecryptOAEP: got %q, want %q", got, plaintext)
+	}
+
+	ciphertext, err = k.Encrypt(plaintext, &rsa.PKCS1v15DecryptOptions{})
+	if err != nil {
+		t.Fatalf("Encrypt with PKCS #1 v1.5: %v", err)
+	}
+	got, err = rsa.DecryptPKCS1v15(nil, priv, ciphertext)
+	if err != nil {
+		t.Fatalf("DecryptPKCS1v15: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("DecryptPKCS1v15: got %q, want %q", got, plaintext)
+	}
+
+	if _, err := k.Encrypt(plaintext, &rsa.OAEPOptions{Hash: crypto.MD5}); err == nil {
+		t.Error("Encrypt with OAEP and MD5: got nil error, want error")
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCiphertext, err := (&Key{pub: &ecKey.PublicKey}).Encrypt(plaintext, nil)
+	if err != nil {
+		t.Fatalf("Encrypt with an EC key: %v", err)
+	}
+	got, err = ecies.Decrypt(&ecKey.PublicKey, ecCiphertext, func(peer *ecdsa.PublicKey) ([]byte, error) {
+		return ecies.SharedSecret(ecKey, peer)
+	})
+	if err != nil {
+		t.Fatalf("ecies.Decrypt: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("ecies.Decrypt: got %q, want %q", got, plaintext)
+	}
+	if _, err := (&Key{pub: &ecKey.PublicKey}).Encrypt(plaintext, &rsa.PKCS1v15DecryptOptions{}); err == nil {
+		t.Error("Encrypt with an EC key and PKCS #1 v1.5: got nil error, want error")
+	}
+}
+
+func TestDecryptMechanism(t *testing.T) {
+	tests := []struct {
+		opts    crypto.DecrypterOpts
+		wantErr bool
+	}{
+		{opts: nil},
+		{opts: &rsa.OAEPOptions{Hash: crypto.SHA384, Label: []byte("label")}},
+		{opts: &rsa.OAEPOptions{Hash: crypto.MD5}, wantErr: true},
+		{opts: &rsa.PKCS1v15DecryptOptions{}},
+		{opts: &rsa.PKCS1v15DecryptOptions{SessionKeyLen: 16}, wantErr: true},
+		{opts: crypto.SHA256, wantErr: true},
+	}
+	for _, test := range tests {
+		m, err := decryptMechanism(test.opts)
+		if (err != nil) != test.wantErr {
+			t.Errorf("decryptMechanism(%#v): got err %v, want error %v", test.opts, err, test.wantErr)
+		}
+		if err == nil {
+			m.free()
+		}
+	}
+}
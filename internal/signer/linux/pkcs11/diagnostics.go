@@ -0,0 +1,239 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-pkcs11/pkcs11"
+)
+
+// TokenDiagnostics describes a token and the certificates and private keys
+// on it, so that support engineers can tell remotely why no credential
+// matches a config. It holds no secrets.
+type TokenDiagnostics struct {
+	Module       string   `json:"module"`
+	Slot         uint32   `json:"slot"`
+	Label        string   `json:"label"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	Serial       string   `json:"serial"`
+	Flags        []string `json:"flags"`
+	// HardwareVersion and FirmwareVersion are "major.minor".
+	HardwareVersion string `json:"hardware_version"`
+	FirmwareVersion string `json:"firmware_version"`
+	// The memory sizes are in bytes, or -1 if the token does not say.
+	TotalPublicMemory  int64 `json:"total_public_memory"`
+	FreePublicMemory   int64 `json:"free_public_memory"`
+	TotalPrivateMemory int64 `json:"total_private_memory"`
+	FreePrivateMemory  int64 `json:"free_private_memory"`
+	// Mechanisms are the names of the supported mechanisms, or their
+	// hexadecimal values for those without a name here.
+	Mechanisms   []string        `json:"mechanisms"`
+	Certificates []ObjectSummary `json:"certificates"`
+	// PrivateKeys only lists the keys visible without logging in unless a
+	// PIN was given.
+	PrivateKeys []ObjectSummary `json:"private_keys"`
+	// Error says why the token could not be fully described.
+	Error string `json:"error,omitempty"`
+}
+
+// ObjectSummary describes a certificate or private key object.
+type ObjectSummary struct {
+	Label string `json:"label"`
+	ID    string `json:"id"` // CKA_ID as colon-separated hexadecimal bytes.
+	// Subject, Issuer and NotAfter describe certificates.
+	Subject  string     `json:"subject,omitempty"`
+	Issuer   string     `json:"issuer,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+}
+
+// Diagnose describes every token in the modules opts lists, or in the NSS
+// database it names, without requiring any of them to hold a matching
+// credential. Problems with a single module or token are reported in its
+// TokenDiagnostics rather than failing.
+func Diagnose(opts Options) ([]TokenDiagnostics, error) {
+	if opts.NSSDB != "" {
+		lib, path, _, err := openNSS(opts)
+		if err != nil {
+			return nil, err
+		}
+		defer lib.close()
+		return diagnoseLibrary(lib, path, opts.PIN), nil
+	}
+
+	modules, err := modulePaths(opts)
+	if err != nil {
+		return nil, err
+	}
+	var all []TokenDiagnostics
+	for _, path := range modules {
+		all = append(all, diagnoseModule(path, opts.PIN)...)
+	}
+	return all, nil
+}
+
+// diagnoseModule describes the tokens in the module at path.
+func diagnoseModule(path, pin string) []TokenDiagnostics {
+	module, err := pkcs11.Open(path)
+	if err != nil {
+		return []TokenDiagnostics{{Module: path, Error: err.Error()}}
+	}
+	defer module.Close()
+	lib, err := openLibrary(path)
+	if err != nil {
+		return []TokenDiagnostics{{Module: path, Error: err.Error()}}
+	}
+	defer lib.close()
+	return diagnoseLibrary(lib, path, pin)
+}
+
+// diagnoseLibrary describes the tokens reachable through lib, the module at
+// path.
+func diagnoseLibrary(lib *library, path, pin string) []TokenDiagnostics {
+	slots, err := lib.slots()
+	if err != nil {
+		return []TokenDiagnostics{{Module: path, Error: err.Error()}}
+	}
+	if len(slots) == 0 {
+		return []TokenDiagnostics{{Module: path, Error: "no slot holds a token"}}
+	}
+	var all []TokenDiagnostics
+	for _, slot := range slots {
+		d := TokenDiagnostics{Module: path, Slot: slot}
+		pool := newSessionPool(lib, path, slot, pin, 0)
+		if err := d.read(lib, pool); err != nil {
+			d.Error = err.Error()
+		}
+		pool.drain()
+		all = append(all, d)
+	}
+	return all
+}
+
+// Diagnostics describes the token holding the Key.
+func (k *Key) Diagnostics() (TokenDiagnostics, error) {
+	k.pool.mu.Lock()
+	slot := k.pool.slot
+	k.pool.mu.Unlock()
+	d := TokenDiagnostics{Module: k.path, Slot: slot}
+	err := d.read(k.lib, k.pool)
+	return d, err
+}
+
+// read fills in d from the token in d.Slot, using sessions from pool.
+func (d *TokenDiagnostics) read(lib *library, pool *sessionPool) error {
+	info, err := lib.tokenInfo(d.Slot)
+	if err != nil {
+		return err
+	}
+	d.Label = info.label
+	d.Manufacturer = info.manufacturer
+	d.Model = info.model
+	d.Serial = info.serial
+	d.Flags = flagNames(info.flags)
+	d.HardwareVersion = info.hardwareVersion
+	d.FirmwareVersion = info.firmwareVersion
+	d.TotalPublicMemory = info.totalPublicMemory
+	d.FreePublicMemory = info.freePublicMemory
+	d.TotalPrivateMemory = info.totalPrivateMemory
+	d.FreePrivateMemory = info.freePrivateMemory
+
+	mechanisms, err := lib.mechanisms(d.Slot)
+	if err != nil {
+		return err
+	}
+	d.Mechanisms = mechanismList(mechanisms)
+
+	return pool.do(func(s *session) (err error) {
+		if d.Certificates, err = summarizeObjects(s, classCertificate); err != nil {
+			return err
+		}
+		d.PrivateKeys, err = summarizeObjects(s, classPrivateKey)
+		return err
+	})
+}
+
+// flagNames returns the names of the token flags set in flags.
+func flagNames(flags uint) []string {
+	names := []string{}
+	for _, f := range tokenFlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// mechanismList returns the names of the mechanisms in set, sorted by value.
+func mechanismList(set map[uint]bool) []string {
+	mechs := make([]uint, 0, len(set))
+	for m := range set {
+		mechs = append(mechs, m)
+	}
+	sort.Slice(mechs, func(i, j int) bool { return mechs[i] < mechs[j] })
+	names := make([]string, 0, len(mechs))
+	for _, m := range mechs {
+		name, ok := mechanismNames[m]
+		if !ok {
+			name = fmt.Sprintf("0x%08x", m)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// summarizeObjects describes the objects of the given class.
+func summarizeObjects(s *session, class uint) ([]ObjectSummary, error) {
+	handles, err := s.findObjects([]attribute{ulongAttribute(attrClass, class)})
+	if err != nil {
+		return nil, err
+	}
+	summaries := []ObjectSummary{}
+	for _, h := range handles {
+		var o ObjectSummary
+		// Attributes a token does not have or will not reveal are left out.
+		if label, err := s.attributeValue(h, attrLabel); err == nil {
+			o.Label = string(label)
+		}
+		if id, err := s.attributeValue(h, attrID); err == nil {
+			o.ID = colonHex(id)
+		}
+		if class == classCertificate {
+			if der, err := s.attributeValue(h, attrValue); err == nil {
+				if xc, err := x509.ParseCertificate(der); err == nil {
+					o.Subject = xc.Subject.String()
+					o.Issuer = xc.Issuer.String()
+					o.NotAfter = &xc.NotAfter
+				}
+			}
+		}
+		summaries = append(summaries, o)
+	}
+	return summaries, nil
+}
+
+// colonHex formats b as colon-separated hexadecimal bytes, as ParseID
+// accepts.
+func colonHex(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02x", c)
+	}
+	return strings.Join(parts, ":")
+}
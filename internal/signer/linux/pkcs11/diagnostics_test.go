@@ -0,0 +1,61 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlagNames(t *testing.T) {
+	got := flagNames(0x40d) // CKF_RNG, CKF_LOGIN_REQUIRED, CKF_USER_PIN_INITIALIZED and CKF_TOKEN_INITIALIZED.
+	want := []string{"CKF_RNG", "CKF_LOGIN_REQUIRED", "CKF_USER_PIN_INITIALIZED", "CKF_TOKEN_INITIALIZED"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("flagNames: got %q, want %q", got, want)
+	}
+	if got := flagNames(0); got == nil || len(got) != 0 {
+		t.Errorf("flagNames(0): got %#v, want an empty list", got)
+	}
+}
+
+func TestMechanismList(t *testing.T) {
+	got := mechanismList(map[uint]bool{mechECDSA: true, mechRSAPKCS: true, 0x80000001: true})
+	want := []string{"CKM_RSA_PKCS", "CKM_ECDSA", "0x80000001"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mechanismList: got %q, want %q", got, want)
+	}
+}
+
+func TestColonHex(t *testing.T) {
+	if got := colonHex([]byte{0x01, 0xa2}); got != "01:a2" {
+		t.Errorf("colonHex: got %q, want 01:a2", got)
+	}
+	id, err := ParseID(colonHex([]byte{0xde, 0xad}))
+	if err != nil || !reflect.DeepEqual(id, []byte{0xde, 0xad}) {
+		t.Errorf("ParseID(colonHex): got %x, %v, want dead", id, err)
+	}
+}
+
+func TestDiagnoseReportsModuleErrors(t *testing.T) {
+	got, err := Diagnose(Options{Module: "/nonexistent/first.so", Modules: []string{"/nonexistent/second.so"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Module != "/nonexistent/first.so" || got[0].Error == "" || got[1].Module != "/nonexistent/second.so" {
+		t.Errorf("Diagnose of missing modules: got %+v, want an error for each", got)
+	}
+	if _, err := Diagnose(Options{}); err == nil {
+		t.Errorf("Diagnose without modules: got nil error, want error")
+	}
+}
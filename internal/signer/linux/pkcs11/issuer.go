@@ -0,0 +1,244 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// dnAttributeTypes maps the attribute type names of RFC 4514, and a few more
+// that certificates commonly use, onto their OIDs.
+var dnAttributeTypes = map[string]asn1.ObjectIdentifier{
+	"CN":           {2, 5, 4, 3},
+	"SERIALNUMBER": {2, 5, 4, 5},
+	"C":            {2, 5, 4, 6},
+	"L":            {2, 5, 4, 7},
+	"ST":           {2, 5, 4, 8},
+	"STREET":       {2, 5, 4, 9},
+	"O":            {2, 5, 4, 10},
+	"OU":           {2, 5, 4, 11},
+	"POSTALCODE":   {2, 5, 4, 17},
+	"DC":           {0, 9, 2342, 19200300, 100, 1, 25},
+	"UID":          {0, 9, 2342, 19200300, 100, 1, 1},
+	"EMAILADDRESS": {1, 2, 840, 113549, 1, 9, 1},
+	"E":            {1, 2, 840, 113549, 1, 9, 1},
+}
+
+// parseDN parses an RFC 4514 distinguished name such as
+// "CN=Issuing CA,OU=Security,O=Example Corp,C=US". Like the ASN.1 form, and
+// unlike the string, the returned sequence starts with the most significant
+// RDN.
+func parseDN(s string) (pkix.RDNSequence, error) {
+	var seq pkix.RDNSequence
+	var rdn pkix.RelativeDistinguishedNameSET
+	p := dnParser{s: s}
+	for {
+		atv, err := p.attribute()
+		if err != nil {
+			return nil, fmt.Errorf("invalid distinguished name %q: %v", s, err)
+		}
+		rdn = append(rdn, atv)
+		if p.done() {
+			break
+		}
+		switch p.s[p.i] {
+		case '+':
+			p.i++
+			continue
+		case ',', ';':
+			p.i++
+		default:
+			return nil, fmt.Errorf("invalid distinguished name %q: unexpected %q", s, p.s[p.i:])
+		}
+		seq = append(pkix.RDNSequence{rdn}, seq...)
+		rdn = nil
+	}
+	return append(pkix.RDNSequence{rdn}, seq...), nil
+}
+
+// dnParser holds the state of parseDN.
+type dnParser struct {
+	s string
+	i int
+}
+
+func (p *dnParser) done() bool {
+	return p.i == len(p.s)
+}
+
+func (p *dnParser) skipSpaces() {
+	for !p.done() && p.s[p.i] == ' ' {
+		p.i++
+	}
+}
+
+// attribute parses an attributeTypeAndValue.
+func (p *dnParser) attribute() (pkix.AttributeTypeAndValue, error) {
+	p.skipSpaces()
+	end := strings.IndexByte(p.s[p.i:], '=')
+	if end < 0 {
+		return pkix.AttributeTypeAndValue{}, fmt.Errorf("missing '=' after %q", p.s[p.i:])
+	}
+	typ, err := parseAttributeType(strings.TrimSpace(p.s[p.i : p.i+end]))
+	if err != nil {
+		return pkix.AttributeTypeAndValue{}, err
+	}
+	p.i += end + 1
+	p.skipSpaces()
+	var value interface{}
+	if !p.done() && p.s[p.i] == '#' {
+		value, err = p.hexValue()
+	} else {
+		value, err = p.stringValue()
+	}
+	if err != nil {
+		return pkix.AttributeTypeAndValue{}, err
+	}
+	return pkix.AttributeTypeAndValue{Type: typ, Value: value}, nil
+}
+
+// parseAttributeType parses a type name or a dotted OID.
+func parseAttributeType(s string) (asn1.ObjectIdentifier, error) {
+	if oid, ok := dnAttributeTypes[strings.ToUpper(s)]; ok {
+		return oid, nil
+	}
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "OID."), "oid.")
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("unknown attribute type %q", s)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("unknown attribute type %q", s)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+// hexValue parses a '#' followed by the hex encoding of a BER value.
+func (p *dnParser) hexValue() (interface{}, error) {
+	p.i++
+	start := p.i
+	for !p.done() && strings.IndexByte("+,; ", p.s[p.i]) < 0 {
+		p.i++
+	}
+	der, err := hex.DecodeString(p.s[start:p.i])
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex value %q", p.s[start:p.i])
+	}
+	p.skipSpaces()
+	var value interface{}
+	if rest, err := asn1.Unmarshal(der, &value); err != nil || len(rest) > 0 {
+		return nil, fmt.Errorf("invalid BER value #%s", p.s[start:p.i])
+	}
+	return value, nil
+}
+
+// stringValue parses a string value up to the next unescaped separator,
+// resolving escapes and dropping unescaped trailing spaces.
+func (p *dnParser) stringValue() (string, error) {
+	var b []byte
+	keep := 0 // length of b up to its last escaped or non-space byte
+	for !p.done() {
+		c := p.s[p.i]
+		if c == ',' || c == ';' || c == '+' {
+			break
+		}
+		p.i++
+		if c != '\\' {
+			b = append(b, c)
+			if c != ' ' {
+				keep = len(b)
+			}
+			continue
+		}
+		if p.done() {
+			return "", errors.New("trailing '\\'")
+		}
+		if p.i+1 < len(p.s) && isHex(p.s[p.i]) && isHex(p.s[p.i+1]) {
+			v, _ := hex.DecodeString(p.s[p.i : p.i+2])
+			b = append(b, v[0])
+			p.i += 2
+		} else {
+			b = append(b, p.s[p.i])
+			p.i++
+		}
+		keep = len(b)
+	}
+	b = b[:keep]
+	if !utf8.Valid(b) {
+		return "", errors.New("value is not valid UTF-8")
+	}
+	return string(b), nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// matchDN reports whether the DER-encoded name raw equals want. Attribute
+// values are compared ignoring case and repeated spaces, as LDAP does for
+// directory strings, and the attributes of a multi-valued RDN in any order.
+func matchDN(want pkix.RDNSequence, raw []byte) bool {
+	var got pkix.RDNSequence
+	if rest, err := asn1.Unmarshal(raw, &got); err != nil || len(rest) > 0 {
+		return false
+	}
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if !matchRDN(want[i], got[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchRDN(want, got pkix.RelativeDistinguishedNameSET) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	used := make([]bool, len(got))
+outer:
+	for _, w := range want {
+		for j, g := range got {
+			if !used[j] && w.Type.Equal(g.Type) && matchValue(w.Value, g.Value) {
+				used[j] = true
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchValue(want, got interface{}) bool {
+	ws, wok := want.(string)
+	gs, gok := got.(string)
+	if wok && gok {
+		return strings.EqualFold(strings.Join(strings.Fields(ws), " "), strings.Join(strings.Fields(gs), " "))
+	}
+	return fmt.Sprint(want) == fmt.Sprint(got)
+}
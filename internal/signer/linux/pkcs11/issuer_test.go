@@ -0,0 +1,113 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"reflect"
+	"testing"
+)
+
+func TestParseDN(t *testing.T) {
+	cn := asn1.ObjectIdentifier{2, 5, 4, 3}
+	ou := asn1.ObjectIdentifier{2, 5, 4, 11}
+	o := asn1.ObjectIdentifier{2, 5, 4, 10}
+	tests := []struct {
+		dn   string
+		want pkix.RDNSequence
+	}{
+		{
+			dn: "CN=Issuing CA,OU=Security,O=Example Corp",
+			want: pkix.RDNSequence{
+				{{Type: o, Value: "Example Corp"}},
+				{{Type: ou, Value: "Security"}},
+				{{Type: cn, Value: "Issuing CA"}},
+			},
+		},
+		{
+			dn: "cn = Issuing CA ; o=Example\\, Inc.",
+			want: pkix.RDNSequence{
+				{{Type: o, Value: "Example, Inc."}},
+				{{Type: cn, Value: "Issuing CA"}},
+			},
+		},
+		{
+			dn: "OU=Security+OU=PKI,2.5.4.10=Example",
+			want: pkix.RDNSequence{
+				{{Type: o, Value: "Example"}},
+				{{Type: ou, Value: "Security"}, {Type: ou, Value: "PKI"}},
+			},
+		},
+		{
+			dn:   "CN=\\E2\\82\\AC CA\\ ",
+			want: pkix.RDNSequence{{{Type: cn, Value: "€ CA "}}},
+		},
+		{
+			dn:   "CN=#0c024341",
+			want: pkix.RDNSequence{{{Type: cn, Value: "CA"}}},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseDN(test.dn)
+		if err != nil {
+			t.Errorf("parseDN(%q): %v", test.dn, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseDN(%q): got %v, want %v", test.dn, got, test.want)
+		}
+	}
+}
+
+func TestParseDNFailure(t *testing.T) {
+	for _, dn := range []string{"", "Issuing CA", "XX=Issuing CA", "CN=CA,", "CN=CA\\", "CN=#zz", "CN=#0c0241 x"} {
+		if _, err := parseDN(dn); err == nil {
+			t.Errorf("parseDN(%q): got nil error, want error", dn)
+		}
+	}
+}
+
+func TestMatchDN(t *testing.T) {
+	name := pkix.Name{
+		Country:            []string{"US"},
+		Organization:       []string{"Example Corp"},
+		OrganizationalUnit: []string{"Security"},
+		CommonName:         "Issuing CA",
+	}
+	raw, err := asn1.Marshal(name.ToRDNSequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dn   string
+		want bool
+	}{
+		{dn: "CN=Issuing CA,OU=Security,O=Example Corp,C=US", want: true},
+		{dn: "cn=issuing  ca, ou=SECURITY, o=example corp, c=us", want: true},
+		{dn: name.String(), want: true},
+		{dn: "CN=Issuing CA,OU=Finance,O=Example Corp,C=US", want: false},
+		{dn: "CN=Issuing CA,O=Example Corp,C=US", want: false},
+		{dn: "C=US,O=Example Corp,OU=Security,CN=Issuing CA", want: false},
+	}
+	for _, test := range tests {
+		dn, err := parseDN(test.dn)
+		if err != nil {
+			t.Fatalf("parseDN(%q): %v", test.dn, err)
+		}
+		if got := matchDN(dn, raw); got != test.want {
+			t.Errorf("matchDN(%q): got %v, want %v", test.dn, got, test.want)
+		}
+	}
+}
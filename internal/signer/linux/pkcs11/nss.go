@@ -0,0 +1,278 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// nssModulePaths are where distributions install the NSS softoken module.
+var nssModulePaths = []string{
+	"/usr/lib/x86_64-linux-gnu/nss/libsoftokn3.so",
+	"/usr/lib/x86_64-linux-gnu/libsoftokn3.so",
+	"/usr/lib/aarch64-linux-gnu/nss/libsoftokn3.so",
+	"/usr/lib/aarch64-linux-gnu/libsoftokn3.so",
+	"/usr/lib64/libsoftokn3.so",
+	"/usr/lib/nss/libsoftokn3.so",
+	"/usr/lib/libsoftokn3.so",
+}
+
+// findNSSModule returns the path of the installed NSS softoken module.
+func findNSSModule() (string, error) {
+	for _, path := range nssModulePaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("the NSS softoken module libsoftokn3.so was not found, set module to its path")
+}
+
+// findNSSDB returns the directory of the NSS database db names, searching
+// the profiles under home if it is "auto".
+func findNSSDB(db, home string) (string, error) {
+	if db == "auto" {
+		dirs := nssDBDirs(home)
+		if len(dirs) == 0 {
+			return "", fmt.Errorf("no NSS database was found in %s or the Firefox profiles", filepath.Join(home, ".pki", "nssdb"))
+		}
+		return dirs[0], nil
+	}
+	dir := strings.TrimPrefix(db, "sql:")
+	if !hasNSSDB(dir) {
+		return "", fmt.Errorf("%s holds no cert9.db, only NSS sql: databases are supported", dir)
+	}
+	return dir, nil
+}
+
+// hasNSSDB reports whether dir holds an NSS sql: database.
+func hasNSSDB(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "cert9.db"))
+	return err == nil
+}
+
+// nssDBDirs returns the NSS databases under home in order of preference: the
+// shared database Chrome uses, then the Firefox profiles, including those of
+// the snap package.
+func nssDBDirs(home string) []string {
+	candidates := []string{filepath.Join(home, ".pki", "nssdb")}
+	for _, root := range []string{
+		filepath.Join(home, ".mozilla", "firefox"),
+		filepath.Join(home, "snap", "firefox", "common", ".mozilla", "firefox"),
+	} {
+		candidates = append(candidates, firefoxProfiles(root)...)
+	}
+	var dirs []string
+	for _, dir := range candidates {
+		if hasNSSDB(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// firefoxProfiles returns the profile directories listed in root's
+// profiles.ini, those Firefox installs use by default first.
+func firefoxProfiles(root string) []string {
+	data, err := os.ReadFile(filepath.Join(root, "profiles.ini"))
+	if err != nil {
+		return nil
+	}
+	type profile struct {
+		path       string
+		isRelative bool
+		isDefault  bool
+	}
+	var installDefaults []string
+	var profiles []*profile
+	var current *profile
+	var install bool
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			install = strings.HasPrefix(line, "[Install")
+			current = nil
+			if strings.HasPrefix(line, "[Profile") {
+				current = &profile{isRelative: true}
+				profiles = append(profiles, current)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch {
+		case install && key == "Default":
+			installDefaults = append(installDefaults, filepath.Join(root, value))
+		case current != nil && key == "Path":
+			current.path = value
+		case current != nil && key == "IsRelative":
+			current.isRelative = value != "0"
+		case current != nil && key == "Default":
+			current.isDefault = value == "1"
+		}
+	}
+
+	dirs := installDefaults
+	var others []string
+	for _, p := range profiles {
+		if p.path == "" {
+			continue
+		}
+		dir := p.path
+		if p.isRelative {
+			dir = filepath.Join(root, dir)
+		}
+		if p.isDefault {
+			dirs = append(dirs, dir)
+		} else {
+			others = append(others, dir)
+		}
+	}
+	return append(dirs, others...)
+}
+
+// nssInitParams returns the softoken library parameters opening the database
+// in dir read-only.
+func nssInitParams(dir string) string {
+	quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(dir)
+	return fmt.Sprintf("configdir='sql:%s' certPrefix='' keyPrefix='' secmod='secmod.db' flags='readOnly'", quoted)
+}
+
+// nssCred returns a Key wrapping the credential matching opts in an NSS
+// database. NSS softoken cannot be initialized by go-pkcs11, which passes it
+// no configuration, so the Key reaches it only through its own library.
+func nssCred(opts Options, bundle []*x509.Certificate) (_ *Key, err error) {
+	issuer, err := opts.issuer()
+	if err != nil {
+		return nil, err
+	}
+	lib, path, dir, err := openNSS(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			lib.close()
+		}
+	}()
+
+	// Softoken has an internal crypto token besides the database token, so
+	// rather than relying on slot IDs the credential is looked for in each.
+	slots, err := lib.slots()
+	if err != nil {
+		return nil, err
+	}
+	var failures []string
+	for _, slot := range slots {
+		k := &Key{
+			path:   path,
+			opts:   opts,
+			lib:    lib,
+			pool:   newSessionPool(lib, path, slot, opts.PIN, opts.MaxConcurrentOperations),
+			label:  opts.Label,
+			id:     opts.ID,
+			issuer: issuer,
+		}
+		err := k.pool.do(k.selectNSSIdentity)
+		if err == nil {
+			err = k.load(slot, bundle)
+		}
+		if err == nil {
+			return k, nil
+		}
+		k.pool.drain()
+		failures = append(failures, fmt.Sprintf("slot 0x%x: %v", slot, err))
+	}
+	return nil, fmt.Errorf("no credential was found in NSS database %s: %s", dir, strings.Join(failures, "; "))
+}
+
+// openNSS opens the NSS database opts names with the softoken module, and
+// returns the library along with the module and database paths.
+func openNSS(opts Options) (lib *library, path, dir string, err error) {
+	home, err := os.UserHomeDir()
+	if err != nil && opts.NSSDB == "auto" {
+		return nil, "", "", err
+	}
+	if dir, err = findNSSDB(opts.NSSDB, home); err != nil {
+		return nil, "", "", err
+	}
+	path = opts.Module
+	if path == "" {
+		if path, err = findNSSModule(); err != nil {
+			return nil, "", "", err
+		}
+	}
+	if lib, err = openLibrary(path); err != nil {
+		return nil, "", "", err
+	}
+	if err := lib.initialize(nssInitParams(dir)); err != nil {
+		lib.close()
+		return nil, "", "", fmt.Errorf("opening NSS database %s: %w", dir, err)
+	}
+	return lib, path, dir, nil
+}
+
+// selectNSSIdentity picks the first certificate with a private key, from the
+// configured issuer if any, when neither a label nor an id is configured. NSS
+// databases also hold the CA certificates users imported, which would
+// otherwise be picked as often.
+// NSS gives a certificate and its private key the same CKA_ID.
+func (k *Key) selectNSSIdentity(s *session) error {
+	if k.label != "" || k.id != nil {
+		return nil
+	}
+	certs, err := s.findObjects([]attribute{
+		ulongAttribute(attrClass, classCertificate),
+		ulongAttribute(attrCertificateType, certificateX509),
+	})
+	if err != nil {
+		return err
+	}
+	for _, cert := range certs {
+		if k.issuer != nil {
+			xc, err := issuedCertificate(s, cert, k.issuer)
+			if err != nil {
+				return err
+			}
+			if xc == nil {
+				continue
+			}
+		}
+		id, err := s.attributeValue(cert, attrID)
+		if err != nil || len(id) == 0 {
+			continue
+		}
+		keys, err := s.findObjects([]attribute{
+			ulongAttribute(attrClass, classPrivateKey),
+			{typ: attrID, value: id},
+		})
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			k.id = id
+			return nil
+		}
+	}
+	return errors.New("no certificate with a private key was found")
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// makeNSSDB creates an empty NSS sql: database in dir.
+func makeNSSDB(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cert9.db"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFirefoxProfiles(t *testing.T) {
+	root := t.TempDir()
+	ini := `[Install4F96D1932A9F858E]
+Default=abcd.default-release
+Locked=1
+
+[Profile1]
+Name=default
+IsRelative=1
+Path=efgh.default
+
+[Profile0]
+Name=work
+IsRelative=0
+Path=/srv/profiles/work
+Default=1
+
+[General]
+StartWithLastProfile=1
+`
+	if err := os.WriteFile(filepath.Join(root, "profiles.ini"), []byte(ini), 0600); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(root, "abcd.default-release"),
+		"/srv/profiles/work",
+		filepath.Join(root, "efgh.default"),
+	}
+	if got := firefoxProfiles(root); !reflect.DeepEqual(got, want) {
+		t.Errorf("firefoxProfiles: got %q, want %q", got, want)
+	}
+	if got := firefoxProfiles(t.TempDir()); got != nil {
+		t.Errorf("firefoxProfiles without profiles.ini: got %q, want nil", got)
+	}
+}
+
+func TestFindNSSDB(t *testing.T) {
+	home := t.TempDir()
+	if _, err := findNSSDB("auto", home); err == nil {
+		t.Errorf("findNSSDB(auto) without databases: got nil error, want error")
+	}
+
+	firefox := filepath.Join(home, ".mozilla", "firefox")
+	makeNSSDB(t, filepath.Join(firefox, "abcd.default"))
+	ini := "[Profile0]\nName=default\nIsRelative=1\nPath=abcd.default\nDefault=1\n"
+	if err := os.WriteFile(filepath.Join(firefox, "profiles.ini"), []byte(ini), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := findNSSDB("auto", home); err != nil || got != filepath.Join(firefox, "abcd.default") {
+		t.Errorf("findNSSDB(auto): got %q, %v, want the Firefox profile", got, err)
+	}
+
+	chrome := filepath.Join(home, ".pki", "nssdb")
+	makeNSSDB(t, chrome)
+	if got, err := findNSSDB("auto", home); err != nil || got != chrome {
+		t.Errorf("findNSSDB(auto): got %q, %v, want %q", got, err, chrome)
+	}
+	if got, err := findNSSDB("sql:"+chrome, home); err != nil || got != chrome {
+		t.Errorf("findNSSDB(sql:%s): got %q, %v, want %q", chrome, got, err, chrome)
+	}
+	if _, err := findNSSDB(home, home); err == nil {
+		t.Errorf("findNSSDB of a directory without cert9.db: got nil error, want error")
+	}
+}
+
+func TestNSSInitParams(t *testing.T) {
+	got := nssInitParams(`/home/o'brien/.pki/nssdb`)
+	want := `configdir='sql:/home/o\'brien/.pki/nssdb' certPrefix='' keyPrefix='' secmod='secmod.db' flags='readOnly'`
+	if got != want {
+		t.Errorf("nssInitParams: got %s, want %s", got, want)
+	}
+}
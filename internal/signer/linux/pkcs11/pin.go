@@ -0,0 +1,100 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/linux/secretservice"
+)
+
+// pinCommandTimeout bounds how long a PIN command may run.
+const pinCommandTimeout = 30 * time.Second
+
+// PINSource describes where the user PIN comes from, so that it need not be
+// written into the config. At most one field may be set; if none is, C_Login
+// is not called.
+type PINSource struct {
+	PIN  string // The PIN itself.
+	Env  string // Name of an environment variable holding the PIN.
+	File string // Path of a file holding the PIN.
+	// Command is a program and its arguments that print the PIN on standard
+	// output, such as a secrets manager client. It is run without a shell.
+	Command []string
+	// SecretService holds the attributes of the item holding the PIN in the
+	// user's keyring, reached through the freedesktop Secret Service.
+	SecretService map[string]string
+}
+
+// Resolve returns the user PIN. Trailing newlines of files and command output
+// are not part of the PIN.
+func (s PINSource) Resolve() (string, error) {
+	set := 0
+	for _, ok := range []bool{s.PIN != "", s.Env != "", s.File != "", len(s.Command) > 0, len(s.SecretService) > 0} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", errors.New("at most one of user_pin, pin_env, pin_file, pin_command and pin_secret_service may be set")
+	}
+	switch {
+	case s.Env != "":
+		pin, ok := os.LookupEnv(s.Env)
+		if !ok || pin == "" {
+			return "", fmt.Errorf("PIN environment variable %s is not set", s.Env)
+		}
+		return pin, nil
+	case s.File != "":
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("reading PIN file: %w", err)
+		}
+		return nonEmptyPIN(data, "PIN file "+s.File)
+	case len(s.Command) > 0:
+		ctx, cancel := context.WithTimeout(context.Background(), pinCommandTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("running PIN command %s: %w", s.Command[0], err)
+		}
+		return nonEmptyPIN(out, "PIN command "+s.Command[0])
+	case len(s.SecretService) > 0:
+		pin, err := secretservice.Lookup(s.SecretService)
+		if err != nil {
+			return "", fmt.Errorf("looking up the PIN in the keyring: %w", err)
+		}
+		return nonEmptyPIN([]byte(pin), "PIN in the keyring")
+	default:
+		return s.PIN, nil
+	}
+}
+
+// nonEmptyPIN returns data without trailing newlines, failing if nothing is
+// left. source describes where data came from.
+func nonEmptyPIN(data []byte, source string) (string, error) {
+	pin := strings.TrimRight(string(data), "\r\n")
+	if pin == "" {
+		return "", fmt.Errorf("%s is empty", source)
+	}
+	return pin, nil
+}
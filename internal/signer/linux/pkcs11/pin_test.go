@@ -0,0 +1,64 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPINSourceResolve(t *testing.T) {
+	dir := t.TempDir()
+	pinFile := filepath.Join(dir, "pin")
+	if err := os.WriteFile(pinFile, []byte("1234\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ECP_TEST_PIN", "5678")
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path="+filepath.Join(dir, "missing-bus"))
+
+	tests := []struct {
+		name    string
+		source  PINSource
+		want    string
+		wantErr bool
+	}{
+		{name: "none", source: PINSource{}, want: ""},
+		{name: "inline", source: PINSource{PIN: "0000"}, want: "0000"},
+		{name: "env", source: PINSource{Env: "ECP_TEST_PIN"}, want: "5678"},
+		{name: "unset env", source: PINSource{Env: "ECP_TEST_PIN_UNSET"}, wantErr: true},
+		{name: "file", source: PINSource{File: pinFile}, want: "1234"},
+		{name: "empty file", source: PINSource{File: emptyFile}, wantErr: true},
+		{name: "missing file", source: PINSource{File: filepath.Join(dir, "missing")}, wantErr: true},
+		{name: "command", source: PINSource{Command: []string{"echo", "9999"}}, want: "9999"},
+		{name: "failing command", source: PINSource{Command: []string{"false"}}, wantErr: true},
+		{name: "keyring without a session bus", source: PINSource{SecretService: map[string]string{"service": "ecp"}}, wantErr: true},
+		{name: "several", source: PINSource{PIN: "0000", Env: "ECP_TEST_PIN"}, wantErr: true},
+		{name: "keyring and file", source: PINSource{File: pinFile, SecretService: map[string]string{"service": "ecp"}}, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := test.source.Resolve()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: Resolve: got err %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: Resolve: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
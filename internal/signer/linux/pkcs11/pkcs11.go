@@ -17,11 +17,15 @@ package pkcs11
 
 import (
 	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/google/go-pkcs11/pkcs11"
 )
@@ -36,87 +40,382 @@ func ParseHexString(str string) (i uint32, err error) {
 	return uint32(resultUint64), nil
 }
 
+// ParseID parses a hexadecimal CKA_ID, optionally prefixed with 0x or with
+// its bytes separated by colons, as pkcs11-tool and p11tool print them.
+func ParseID(str string) ([]byte, error) {
+	stripped := strings.ReplaceAll(strings.TrimPrefix(str, "0x"), ":", "")
+	id, err := hex.DecodeString(stripped)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key id %q: %w", str, err)
+	}
+	return id, nil
+}
+
+// Options selects the credential to use.
+type Options struct {
+	Module string // The PKCS #11 module library file path.
+	// Modules are further module paths tried in order when Module is empty
+	// or holds no matching credential, so that one config can cover devices
+	// from several vendors.
+	Modules []string
+	Slot    string // The slot ID in hexadecimal.
+	// Token and Serial select the slot by the label and serial number of the
+	// token in it, and take precedence over Slot, whose IDs can change
+	// across reboots and readers.
+	Token  string
+	Serial string
+	// Label and ID select the certificate and private key objects by their
+	// CKA_LABEL and CKA_ID, for tokens holding several identities.
+	Label string
+	ID    []byte
+	PIN   string // The user PIN. If it is empty C_Login is not called.
+	// ChainFile is an optional PEM bundle of intermediate certificates, used
+	// with those stored on the token to build the certificate chain.
+	ChainFile string
+	// ExcludeRoot omits the self-signed root certificate from the chain.
+	ExcludeRoot bool
+	// NSSDB reads the credential from the NSS certificate database in this
+	// directory, optionally prefixed with "sql:", through the NSS softoken
+	// module. If it is "auto", the first database found in the user's Chrome
+	// or Firefox profiles is used. Module then overrides the softoken path,
+	// and PIN is the database password.
+	NSSDB string
+	// RawRSA signs with raw RSA (CKM_RSA_X_509), padding PKCS #1 v1.5 and
+	// PSS signatures in Go, for tokens such as older nShield and Luna
+	// firmware that support no other RSA signature mechanism.
+	RawRSA bool
+	// IssuerDN selects the certificate by its full issuer distinguished
+	// name, in RFC 4514 form such as "CN=Issuing CA,O=Example Corp,C=US",
+	// for tokens holding certificates from issuers with the same common
+	// name. If the private key is found by ID, it is the certificate's CKA_ID.
+	IssuerDN string
+	// MaxConcurrentOperations limits how many operations run on the token at
+	// once, and so how many sessions are open, for tokens that fail under
+	// parallel sessions. Zero means no limit, except for p11-kit-client.so,
+	// which runs one operation at a time by default.
+	MaxConcurrentOperations int
+}
+
 // Cred returns a Key wrapping the first valid certificate in the pkcs11 module
 // matching a given slot and label.
 func Cred(pkcs11Module string, slotUint32Str string, label string, userPin string) (*Key, error) {
-	module, err := pkcs11.Open(pkcs11Module)
-	if err != nil {
+	return CredWithOptions(Options{
+		Module: pkcs11Module,
+		Slot:   slotUint32Str,
+		Label:  label,
+		PIN:    userPin,
+	})
+}
+
+// CredWithOptions returns a Key wrapping the first valid certificate matching
+// opts in the first pkcs11 module that has one.
+func CredWithOptions(opts Options) (*Key, error) {
+	if _, err := opts.issuer(); err != nil {
 		return nil, err
 	}
-	slotUint32, err := ParseHexString(slotUint32Str)
-	if err != nil {
-		return nil, err
+	var bundle []*x509.Certificate
+	if opts.ChainFile != "" {
+		var err error
+		if bundle, err = readCertificates(opts.ChainFile); err != nil {
+			return nil, err
+		}
 	}
-	kslot, err := module.Slot(slotUint32, pkcs11.Options{PIN: userPin})
-	if err != nil {
-		return nil, err
+	if opts.NSSDB != "" {
+		return nssCred(opts, bundle)
 	}
 
-	certs, err := kslot.Objects(pkcs11.Filter{Class: pkcs11.ClassCertificate, Label: label})
+	modules, err := modulePaths(opts)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(certs) < 1 {
-		return nil, fmt.Errorf("No certificate object was found with label %s.", label)
+	var failures []string
+	for _, path := range modules {
+		k, err := credFromModule(path, opts, bundle)
+		if err == nil {
+			return k, nil
+		}
+		if len(modules) == 1 {
+			return nil, err
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", path, err))
+	}
+	return nil, fmt.Errorf("no PKCS #11 module has a matching credential: %s", strings.Join(failures, "; "))
+}
+
+// issuer returns the parsed IssuerDN, or nil if it is empty.
+func (opts Options) issuer() (pkix.RDNSequence, error) {
+	if opts.IssuerDN == "" {
+		return nil, nil
+	}
+	return parseDN(opts.IssuerDN)
+}
+
+// modulePaths returns the module paths opts lists, in the order they are
+// tried.
+func modulePaths(opts Options) ([]string, error) {
+	var modules []string
+	if opts.Module != "" {
+		modules = append(modules, opts.Module)
+	}
+	modules = append(modules, opts.Modules...)
+	if len(modules) == 0 {
+		return nil, errors.New("no PKCS #11 module is configured")
 	}
+	return modules, nil
+}
 
-	cert, err := certs[0].Certificate()
+// credFromModule returns a Key wrapping the first valid certificate matching
+// opts in the pkcs11 module at path. Its chain continues with issuers found on
+// the token or in bundle.
+func credFromModule(path string, opts Options, bundle []*x509.Certificate) (_ *Key, err error) {
+	if isP11KitClient(path) {
+		if err := checkP11KitServer(); err != nil {
+			return nil, err
+		}
+	}
+	module, err := pkcs11.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			module.Close()
+		}
+	}()
+	slotUint32, err := findSlot(module, opts)
 	if err != nil {
 		return nil, err
 	}
-	x509, err := cert.X509()
+	issuer, err := opts.issuer()
 	if err != nil {
 		return nil, err
 	}
-	var kchain [][]byte
-	kchain = append(kchain, x509.Raw)
+	if err := checkTPM2PIN(path, opts.PIN); err != nil {
+		return nil, err
+	}
 
-	pubKeys, err := kslot.Objects(pkcs11.Filter{Class: pkcs11.ClassPublicKey, Label: label})
+	// go-pkcs11 ties its keys to a single session, which is lost for good if
+	// the token daemon restarts, cannot decrypt and cannot search by CKA_ID,
+	// so the Key uses the token through its own sessions with the module.
+	lib, err := openLibrary(path)
 	if err != nil {
 		return nil, err
 	}
+	k := &Key{
+		path:   path,
+		opts:   opts,
+		module: module,
+		lib:    lib,
+		pool:   newSessionPool(lib, path, slotUint32, opts.PIN, opts.MaxConcurrentOperations),
+		label:  opts.Label,
+		id:     opts.ID,
+		issuer: issuer,
+	}
+	defer func() {
+		if err != nil {
+			k.pool.drain()
+			lib.close()
+		}
+	}()
 
-	if len(pubKeys) < 1 {
-		return nil, fmt.Errorf("No public key object was found with label %s.", label)
+	if err := k.load(slotUint32, bundle); err != nil {
+		return nil, err
 	}
+	return k, nil
+}
 
-	pubKey, err := pubKeys[0].PublicKey()
+// load reads the Key's certificate and chain from the token in slot, and
+// checks that its private key is there too. The chain continues with issuers
+// found on the token or in bundle.
+func (k *Key) load(slot uint32, bundle []*x509.Certificate) error {
+	var cert *x509.Certificate
+	var others []*x509.Certificate
+	err := k.pool.do(func(s *session) (err error) {
+		if cert, err = k.certificate(s); err != nil {
+			return err
+		}
+		others, err = tokenCertificates(s)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return err
+	}
+	chain := buildChain(cert, append(others, bundle...))
+	if k.opts.ExcludeRoot {
+		chain = withoutRoot(chain)
+	}
+	k.pub = cert.PublicKey
+	k.mechanisms, _ = k.lib.mechanisms(slot)
+	for _, xc := range chain {
+		k.chain = append(k.chain, xc.Raw)
+	}
+	if err := k.withPrivateKey(func(*session, uint) error { return nil }); err != nil {
+		return err
+	}
+	if isTPM2(k.path) {
+		return k.loadIntoTPM()
+	}
+	return nil
+}
+
+// objectTemplate returns the search template for the Key's objects of the
+// given class.
+func (k *Key) objectTemplate(class uint) []attribute {
+	template := []attribute{ulongAttribute(attrClass, class)}
+	if k.label != "" {
+		template = append(template, attribute{typ: attrLabel, value: []byte(k.label)})
+	}
+	if k.id != nil {
+		template = append(template, attribute{typ: attrID, value: k.id})
+	}
+	return template
+}
+
+// objectName describes the Key's objects in errors.
+func (k *Key) objectName() string {
+	if k.id == nil {
+		return "label " + k.label
+	}
+	if k.label == "" {
+		return fmt.Sprintf("id %x", k.id)
 	}
+	return fmt.Sprintf("label %s and id %x", k.label, k.id)
+}
 
-	privkeys, err := kslot.Objects(pkcs11.Filter{Class: pkcs11.ClassPrivateKey, Label: label})
+// certificate returns the Key's X.509 certificate.
+func (k *Key) certificate(s *session) (*x509.Certificate, error) {
+	template := append(k.objectTemplate(classCertificate), ulongAttribute(attrCertificateType, certificateX509))
+	handles, err := s.findObjects(template)
 	if err != nil {
 		return nil, err
 	}
-
-	if len(privkeys) < 1 {
-		return nil, fmt.Errorf("No private key object was found with label %s.", label)
+	if len(handles) < 1 {
+		return nil, fmt.Errorf("No certificate object was found with %s.", k.objectName())
 	}
+	if k.issuer == nil {
+		der, err := s.attributeValue(handles[0], attrValue)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	}
+	for _, h := range handles {
+		xc, err := issuedCertificate(s, h, k.issuer)
+		if err != nil {
+			return nil, err
+		}
+		if xc == nil {
+			continue
+		}
+		// Find the private key of this certificate rather than the first
+		// one sharing its label.
+		if k.id == nil {
+			if id, err := s.attributeValue(h, attrID); err == nil && len(id) > 0 {
+				k.id = id
+			}
+		}
+		return xc, nil
+	}
+	if k.label == "" && k.id == nil {
+		return nil, fmt.Errorf("No certificate object was found issued by %s.", k.opts.IssuerDN)
+	}
+	return nil, fmt.Errorf("No certificate object was found with %s issued by %s.", k.objectName(), k.opts.IssuerDN)
+}
 
-	privKey, err := privkeys[0].PrivateKey(pubKey)
+// issuedCertificate returns the certificate object h if issuer issued it, or
+// nil if not or if it cannot be parsed.
+func issuedCertificate(s *session, h uint, issuer pkix.RDNSequence) (*x509.Certificate, error) {
+	der, err := s.attributeValue(h, attrValue)
 	if err != nil {
 		return nil, err
 	}
-	ksigner, ok := privKey.(crypto.Signer)
-	if !ok {
-		return nil, errors.New("PrivateKey does not implement crypto.Signer")
+	xc, err := x509.ParseCertificate(der)
+	if err != nil || !matchDN(issuer, xc.RawIssuer) {
+		return nil, nil
+	}
+	return xc, nil
+}
+
+// findSlot returns the ID of the slot opts selects.
+func findSlot(module *pkcs11.Module, opts Options) (uint32, error) {
+	if opts.Token == "" && opts.Serial == "" {
+		return ParseHexString(opts.Slot)
+	}
+	ids, err := module.SlotIDs()
+	if err != nil {
+		return 0, err
 	}
+	return selectSlot(ids, module.SlotInfo, opts.Token, opts.Serial)
+}
+
+// selectSlot returns the one slot among ids holding a token with the given
+// label and serial number, an empty value matching any. Slot IDs and their
+// order can change whenever a reader is plugged in, so rather than picking the
+// first of several matching tokens it fails and names them.
+func selectSlot(ids []uint32, slotInfo func(uint32) (*pkcs11.SlotInfo, error), token, serial string) (uint32, error) {
+	ids = append([]uint32(nil), ids...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
 
-	return &Key{
-		slot:   kslot,
-		signer: ksigner,
-		chain:  kchain,
-	}, nil
+	var matches []uint32
+	var names []string
+	for _, id := range ids {
+		info, err := slotInfo(id)
+		if err != nil {
+			return 0, err
+		}
+		if info.Label == "" && info.Serial == "" {
+			// No token is present.
+			continue
+		}
+		if token != "" && info.Label != token {
+			continue
+		}
+		if serial != "" && info.Serial != serial {
+			continue
+		}
+		matches = append(matches, id)
+		names = append(names, fmt.Sprintf("%q (serial %q) in slot 0x%x", info.Label, info.Serial, id))
+	}
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("no token was found with label %q and serial %q", token, serial)
+	case 1:
+		return matches[0], nil
+	default:
+		return 0, fmt.Errorf("several tokens match label %q and serial %q, set the serial to choose one: %s", token, serial, strings.Join(names, ", "))
+	}
 }
 
 // Key is a wrapper around the pkcs11 module and uses it to
 // implement signing-related methods.
 type Key struct {
-	slot   *pkcs11.Slot
-	signer crypto.Signer
+	path  string  // The module path.
+	opts  Options // The options the Key was found with.
+	lib   *library
+	pool  *sessionPool
+	label string
+	id    []byte
+	// issuer is the issuer name the certificate must have, if not nil.
+	issuer pkix.RDNSequence
+	pub    crypto.PublicKey
 	chain  [][]byte
+	// mechanisms is the set of mechanisms the token supports, or nil if the
+	// module did not say.
+	mechanisms map[uint]bool
+
+	// reinitMu guards module, which is replaced when the module is
+	// initialized again, and gen, which counts those times.
+	reinitMu sync.Mutex
+	module   *pkcs11.Module
+	gen      uint64
+
+	mu         sync.Mutex
+	privateKey uint // The private key object handle, if hasPrivate.
+	hasPrivate bool
+	// alwaysAuth is set if the private key has CKA_ALWAYS_AUTHENTICATE, so
+	// that every operation with it needs a context specific login.
+	alwaysAuth bool
 }
 
 // CertificateChain returns the credential as a raw X509 cert chain. This
@@ -127,15 +426,95 @@ func (k *Key) CertificateChain() [][]byte {
 
 // Close releases resources held by the credential.
 func (k *Key) Close() {
-	k.slot.Close()
+	k.pool.drain()
+	k.reinitMu.Lock()
+	defer k.reinitMu.Unlock()
+	if k.module != nil {
+		k.module.Close()
+	}
+	k.lib.close()
 }
 
 // Public returns the corresponding public key for this Key.
 func (k *Key) Public() crypto.PublicKey {
-	return k.signer.Public()
+	return k.pub
+}
+
+// withPrivateKey runs f with a session and the handle of the private key
+// object in it, initializing the module again and retrying once if the token
+// failed or was removed.
+func (k *Key) withPrivateKey(f func(s *session, key uint) error) error {
+	k.reinitMu.Lock()
+	gen := k.gen
+	k.reinitMu.Unlock()
+
+	err := k.tryPrivateKey(f)
+	if !deviceLost(err) {
+		return err
+	}
+	if err := k.reinitialize(gen); err != nil {
+		return err
+	}
+	err = k.tryPrivateKey(f)
+	if deviceLost(err) {
+		return fmt.Errorf("%w: %v", ErrTokenRemoved, err)
+	}
+	return err
+}
+
+// tryPrivateKey runs f with a session and the handle of the private key
+// object in it. Object handles do not survive a token daemon restart either,
+// so the handle is looked up again whenever the session is lost.
+func (k *Key) tryPrivateKey(f func(s *session, key uint) error) error {
+	return k.pool.do(func(s *session) error {
+		key, err := k.privateKeyHandle(s)
+		if err != nil {
+			return err
+		}
+		err = f(s, key)
+		if sessionLost(err) {
+			k.mu.Lock()
+			k.hasPrivate = false
+			k.mu.Unlock()
+		}
+		return err
+	})
 }
 
-// Sign signs a message.
-func (k *Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	return k.signer.Sign(nil, digest, opts)
+// privateKeyHandle returns the handle of the Key's private key object,
+// searching for it with s if it is not known.
+func (k *Key) privateKeyHandle(s *session) (uint, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.hasPrivate {
+		return k.privateKey, nil
+	}
+	handles, err := s.findObjects(k.objectTemplate(classPrivateKey))
+	if err != nil {
+		return 0, err
+	}
+	if len(handles) < 1 {
+		return 0, fmt.Errorf("No private key object was found with %s.", k.objectName())
+	}
+	k.privateKey, k.hasPrivate = handles[0], true
+	// tpm2-pkcs11 does not know the attribute, and fails the query.
+	k.alwaysAuth = false
+	if !isTPM2(k.path) {
+		v, err := s.attributeValue(k.privateKey, attrAlwaysAuth)
+		k.alwaysAuth = err == nil && len(v) == 1 && v[0] != 0
+	}
+	return k.privateKey, nil
+}
+
+// contextLogin returns the function with which sessions log in for each
+// operation with the private key, or nil if it does not require it.
+func (k *Key) contextLogin() func(*session) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.alwaysAuth {
+		return nil
+	}
+	return func(s *session) error {
+		return s.loginContext(k.pool.pin)
+	}
 }
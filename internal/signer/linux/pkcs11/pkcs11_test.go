@@ -14,7 +14,11 @@
 package pkcs11
 
 import (
+	"bytes"
+	"strings"
 	"testing"
+
+	"github.com/google/go-pkcs11/pkcs11"
 )
 
 func TestParseHexString(t *testing.T) {
@@ -34,3 +38,95 @@ func TestParseHexStringFailure(t *testing.T) {
 		t.Error("Expected error but got nil")
 	}
 }
+
+func TestSelectSlot(t *testing.T) {
+	slots := map[uint32]*pkcs11.SlotInfo{
+		7: {Label: "ECP Token", Serial: "b"},
+		3: {Label: "ECP Token", Serial: "a"},
+		5: {Label: "Other", Serial: "c"},
+		9: {Description: "empty reader"},
+	}
+	slotInfo := func(id uint32) (*pkcs11.SlotInfo, error) { return slots[id], nil }
+	ids := []uint32{9, 7, 5, 3}
+
+	tests := []struct {
+		token, serial string
+		want          uint32
+		wantErr       bool
+	}{
+		{token: "Other", want: 5},
+		{serial: "b", want: 7},
+		{token: "ECP Token", serial: "a", want: 3},
+		{token: "ECP Token", wantErr: true},
+		{token: "Missing", wantErr: true},
+		{token: "Other", serial: "a", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := selectSlot(ids, slotInfo, test.token, test.serial)
+		if (err != nil) != test.wantErr {
+			t.Errorf("selectSlot(%q, %q): got err %v, want error %v", test.token, test.serial, err, test.wantErr)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("selectSlot(%q, %q): got %d, want %d", test.token, test.serial, got, test.want)
+		}
+	}
+}
+
+func TestCredWithOptionsModuleFallback(t *testing.T) {
+	if _, err := CredWithOptions(Options{Label: "ecp"}); err == nil {
+		t.Error("CredWithOptions without modules: got nil error, want error")
+	}
+
+	_, err := CredWithOptions(Options{
+		Module:  "/nonexistent/first.so",
+		Modules: []string{"/nonexistent/second.so"},
+		Slot:    "0x1",
+		Label:   "ecp",
+	})
+	if err == nil {
+		t.Fatal("CredWithOptions with missing modules: got nil error, want error")
+	}
+	for _, path := range []string{"/nonexistent/first.so", "/nonexistent/second.so"} {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("CredWithOptions error %q does not mention %s", err, path)
+		}
+	}
+}
+
+func TestParseID(t *testing.T) {
+	for _, s := range []string{"01a2", "0x01a2", "01:a2", "01:A2"} {
+		got, err := ParseID(s)
+		if err != nil {
+			t.Errorf("ParseID(%q): %v", s, err)
+			continue
+		}
+		if want := []byte{0x01, 0xa2}; !bytes.Equal(got, want) {
+			t.Errorf("ParseID(%q): got %x, want %x", s, got, want)
+		}
+	}
+	if _, err := ParseID("01:a"); err == nil {
+		t.Error("ParseID with an odd number of digits: got nil error, want error")
+	}
+}
+
+func TestObjectTemplate(t *testing.T) {
+	tests := []struct {
+		key      *Key
+		wantLen  int
+		wantName string
+	}{
+		{key: &Key{label: "ecp"}, wantLen: 2, wantName: "label ecp"},
+		{key: &Key{id: []byte{0x01}}, wantLen: 2, wantName: "id 01"},
+		{key: &Key{label: "ecp", id: []byte{0x01}}, wantLen: 3, wantName: "label ecp and id 01"},
+		{key: &Key{}, wantLen: 1, wantName: "label "},
+	}
+	for _, test := range tests {
+		if got := len(test.key.objectTemplate(classPrivateKey)); got != test.wantLen {
+			t.Errorf("objectTemplate for %s: got %d attributes, want %d", test.wantName, got, test.wantLen)
+		}
+		if got := test.key.objectName(); got != test.wantName {
+			t.Errorf("objectName: got %q, want %q", got, test.wantName)
+		}
+	}
+}
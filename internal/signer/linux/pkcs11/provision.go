@@ -0,0 +1,347 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/google/go-pkcs11/pkcs11"
+)
+
+// KeyGenOptions describe a key pair to generate on a token with GenerateKey.
+type KeyGenOptions struct {
+	Module string // The PKCS #11 module library file path.
+	// Slot, Token and Serial select the slot as in Options.
+	Slot   string
+	Token  string
+	Serial string
+	PIN    string // The user PIN. If it is empty C_Login is not called.
+	// Label and ID become the CKA_LABEL and CKA_ID of both key objects. At
+	// least one is needed to find the key again, and the certificate issued
+	// for it should be stored on the token with the same ones.
+	Label string
+	ID    []byte
+	// Algorithm is "RSA" or "ECDSA".
+	Algorithm string
+	// BitSize is the RSA modulus size, between 2048 and 4096 and 2048 by
+	// default, or the ECDSA curve size, one of 256, 384 or 521 and 256 by default.
+	BitSize int
+	// Temporary generates session objects (CKA_TOKEN false) rather than
+	// storing the keys on the token, so that they only live as long as the
+	// Key returned for them.
+	Temporary bool
+	// NotSensitive clears CKA_SENSITIVE on the private key, and Extractable
+	// sets CKA_EXTRACTABLE, allowing it to leave the token. By default it
+	// never can.
+	NotSensitive bool
+	Extractable  bool
+}
+
+// bitSize returns the key size, applying the default for the algorithm.
+func (o KeyGenOptions) bitSize() int {
+	switch {
+	case o.BitSize != 0:
+		return o.BitSize
+	case o.Algorithm == "RSA":
+		return 2048
+	default:
+		return 256
+	}
+}
+
+// validate checks that the options describe a key pair the signer can find
+// and use once generated.
+func (o KeyGenOptions) validate() error {
+	if o.Module == "" {
+		return errors.New("no PKCS #11 module is configured")
+	}
+	if o.Label == "" && len(o.ID) == 0 {
+		return errors.New("a label or an id is needed to find the generated key")
+	}
+	bits := o.bitSize()
+	switch o.Algorithm {
+	case "RSA":
+		if bits < 2048 || bits > 4096 {
+			return fmt.Errorf("unsupported RSA key size %d, want 2048 to 4096 bits", bits)
+		}
+	case "ECDSA":
+		if _, err := curveForBitSize(bits); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported key algorithm %q, want RSA or ECDSA", o.Algorithm)
+	}
+	return nil
+}
+
+// curveForBitSize returns the NIST curve of the given size.
+func curveForBitSize(bits int) (elliptic.Curve, error) {
+	switch bits {
+	case 256:
+		return elliptic.P256(), nil
+	case 384:
+		return elliptic.P384(), nil
+	case 521:
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("unsupported ECDSA key size %d, want 256, 384 or 521 bits", bits)
+	}
+}
+
+// curveOIDs are the named curve identifiers used as CKA_EC_PARAMS.
+var curveOIDs = map[int]asn1.ObjectIdentifier{
+	256: {1, 2, 840, 10045, 3, 1, 7},
+	384: {1, 3, 132, 0, 34},
+	521: {1, 3, 132, 0, 35},
+}
+
+// keyGenTemplates returns the key pair generation mechanism and the public
+// and private key templates for opts, which must be valid.
+func keyGenTemplates(opts KeyGenOptions) (mech uint, public, private []attribute, err error) {
+	public = []attribute{
+		boolAttribute(attrToken, !opts.Temporary),
+		boolAttribute(attrVerify, true),
+	}
+	private = []attribute{
+		boolAttribute(attrToken, !opts.Temporary),
+		boolAttribute(attrPrivate, true),
+		boolAttribute(attrSensitive, !opts.NotSensitive),
+		boolAttribute(attrExtractable, opts.Extractable),
+		boolAttribute(attrSign, true),
+	}
+	for _, template := range []*[]attribute{&public, &private} {
+		if opts.Label != "" {
+			*template = append(*template, attribute{typ: attrLabel, value: []byte(opts.Label)})
+		}
+		if len(opts.ID) > 0 {
+			*template = append(*template, attribute{typ: attrID, value: opts.ID})
+		}
+	}
+
+	if opts.Algorithm == "RSA" {
+		public = append(public,
+			boolAttribute(attrEncrypt, true),
+			ulongAttribute(attrModulusBits, uint(opts.bitSize())),
+			attribute{typ: attrPublicExponent, value: []byte{0x01, 0x00, 0x01}},
+		)
+		private = append(private, boolAttribute(attrDecrypt, true))
+		return mechRSAKeyPairGen, public, private, nil
+	}
+	params, err := asn1.Marshal(curveOIDs[opts.bitSize()])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	public = append(public, attribute{typ: attrECParams, value: params})
+	// CKA_DERIVE lets Decrypt agree on ECIES keys with ECDH.
+	private = append(private, boolAttribute(attrDerive, true))
+	return mechECKeyPairGen, public, private, nil
+}
+
+// rsaPublicKey returns the RSA public key with the given CKA_MODULUS and
+// CKA_PUBLIC_EXPONENT.
+func rsaPublicKey(modulus, exponent []byte) (*rsa.PublicKey, error) {
+	e := new(big.Int).SetBytes(exponent)
+	if len(modulus) == 0 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA public key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(e.Int64())}, nil
+}
+
+// ecPublicKey returns the public key on curve with the given CKA_EC_POINT,
+// which PKCS #11 wraps in a DER OCTET STRING but some modules return bare.
+func ecPublicKey(curve elliptic.Curve, point []byte) (*ecdsa.PublicKey, error) {
+	var unwrapped []byte
+	if rest, err := asn1.Unmarshal(point, &unwrapped); err == nil && len(rest) == 0 {
+		if x, y := elliptic.Unmarshal(curve, unwrapped); x != nil {
+			return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+		}
+	}
+	if x, y := elliptic.Unmarshal(curve, point); x != nil {
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("invalid %s public key", curve.Params().Name)
+}
+
+// GenerateKey generates a key pair on the token as described by opts, for
+// enrollment tooling to request a certificate for with
+// Key.CertificateRequest. The returned Key has no certificate chain.
+func GenerateKey(opts KeyGenOptions) (_ *Key, err error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := checkTPM2PIN(opts.Module, opts.PIN); err != nil {
+		return nil, err
+	}
+	if isP11KitClient(opts.Module) {
+		if err := checkP11KitServer(); err != nil {
+			return nil, err
+		}
+	}
+	module, err := pkcs11.Open(opts.Module)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			module.Close()
+		}
+	}()
+	credOpts := Options{
+		Module: opts.Module,
+		Slot:   opts.Slot,
+		Token:  opts.Token,
+		Serial: opts.Serial,
+		Label:  opts.Label,
+		ID:     opts.ID,
+		PIN:    opts.PIN,
+	}
+	slotUint32, err := findSlot(module, credOpts)
+	if err != nil {
+		return nil, err
+	}
+	lib, err := openLibrary(opts.Module)
+	if err != nil {
+		return nil, err
+	}
+	k := &Key{
+		path:   opts.Module,
+		opts:   credOpts,
+		module: module,
+		lib:    lib,
+		pool:   newSessionPool(lib, opts.Module, slotUint32, opts.PIN, 0),
+		label:  opts.Label,
+		id:     opts.ID,
+	}
+	defer func() {
+		if err != nil {
+			k.pool.drain()
+			lib.close()
+		}
+	}()
+
+	// Temporary keys belong to the session that generated them, so it joins
+	// the pool and is only closed with the Key.
+	s, err := lib.openRWSession(slotUint32)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.pool.check(s); err != nil {
+		s.close()
+		return nil, err
+	}
+	k.pool.put(s)
+
+	mech, public, private, err := keyGenTemplates(opts)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMechanism(mech)
+	if err != nil {
+		return nil, err
+	}
+	defer m.free()
+	pubHandle, privHandle, err := s.generateKeyPair(m, public, private)
+	if err != nil {
+		return nil, err
+	}
+	if k.pub, err = readPublicKey(s, pubHandle, opts); err != nil {
+		return nil, err
+	}
+	k.privateKey, k.hasPrivate = privHandle, true
+	k.mechanisms, _ = lib.mechanisms(slotUint32)
+	return k, nil
+}
+
+// readPublicKey returns the public key of the object pub, generated with opts.
+func readPublicKey(s *session, pub uint, opts KeyGenOptions) (interface{}, error) {
+	if opts.Algorithm == "RSA" {
+		modulus, err := s.attributeValue(pub, attrModulus)
+		if err != nil {
+			return nil, err
+		}
+		exponent, err := s.attributeValue(pub, attrPublicExponent)
+		if err != nil {
+			return nil, err
+		}
+		return rsaPublicKey(modulus, exponent)
+	}
+	curve, err := curveForBitSize(opts.bitSize())
+	if err != nil {
+		return nil, err
+	}
+	point, err := s.attributeValue(pub, attrECPoint)
+	if err != nil {
+		return nil, err
+	}
+	return ecPublicKey(curve, point)
+}
+
+// CertificateRequest returns a DER-encoded PKCS #10 certificate signing
+// request for the key, based on template and signed by the key.
+func (k *Key) CertificateRequest(template *x509.CertificateRequest) ([]byte, error) {
+	return x509.CreateCertificateRequest(rand.Reader, template, k)
+}
+
+// StoreCertificate writes the DER-encoded certificate issued for the key to
+// the token, under the key's label and id, so that the signer selects it
+// like any other credential. It fails if the certificate is for another key.
+func (k *Key) StoreCertificate(der []byte) error {
+	xc, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	if pub, ok := k.pub.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(xc.PublicKey) {
+		return errors.New("the certificate is not for this key")
+	}
+	serial, err := asn1.Marshal(xc.SerialNumber)
+	if err != nil {
+		return err
+	}
+	template := k.objectTemplate(classCertificate)
+	template = append(template,
+		ulongAttribute(attrCertificateType, certificateX509),
+		boolAttribute(attrToken, true),
+		boolAttribute(attrPrivate, false),
+		attribute{typ: attrSubject, value: xc.RawSubject},
+		attribute{typ: attrIssuer, value: xc.RawIssuer},
+		attribute{typ: attrSerialNumber, value: serial},
+		attribute{typ: attrValue, value: der},
+	)
+
+	k.pool.mu.Lock()
+	slot := k.pool.slot
+	k.pool.mu.Unlock()
+	s, err := k.lib.openRWSession(slot)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	if err := k.pool.check(s); err != nil {
+		return err
+	}
+	if _, err := s.createObject(template); err != nil {
+		return err
+	}
+	k.chain = [][]byte{der}
+	return nil
+}
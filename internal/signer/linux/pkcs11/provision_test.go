@@ -0,0 +1,143 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestKeyGenOptionsValidate(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		opts    KeyGenOptions
+		wantErr bool
+	}{
+		{name: "RSA default size", opts: KeyGenOptions{Module: "m.so", Label: "ecp", Algorithm: "RSA"}},
+		{name: "ECDSA P-384 by id", opts: KeyGenOptions{Module: "m.so", ID: []byte{1}, Algorithm: "ECDSA", BitSize: 384}},
+		{name: "no module", opts: KeyGenOptions{Label: "ecp", Algorithm: "RSA"}, wantErr: true},
+		{name: "no label or id", opts: KeyGenOptions{Module: "m.so", Algorithm: "RSA"}, wantErr: true},
+		{name: "small RSA key", opts: KeyGenOptions{Module: "m.so", Label: "ecp", Algorithm: "RSA", BitSize: 1024}, wantErr: true},
+		{name: "unknown curve", opts: KeyGenOptions{Module: "m.so", Label: "ecp", Algorithm: "ECDSA", BitSize: 224}, wantErr: true},
+		{name: "unknown algorithm", opts: KeyGenOptions{Module: "m.so", Label: "ecp", Algorithm: "Ed25519"}, wantErr: true},
+	} {
+		if err := test.opts.validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s: validate() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+// templateValue returns the value of the attribute typ in template.
+func templateValue(template []attribute, typ uint) ([]byte, bool) {
+	for _, a := range template {
+		if a.typ == typ {
+			return a.value, true
+		}
+	}
+	return nil, false
+}
+
+func TestKeyGenTemplates(t *testing.T) {
+	mech, public, private, err := keyGenTemplates(KeyGenOptions{Label: "ecp", ID: []byte{1, 2}, Algorithm: "ECDSA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != mechECKeyPairGen {
+		t.Errorf("keyGenTemplates: got mechanism %#x, want %#x", mech, mechECKeyPairGen)
+	}
+	wantParams, _ := asn1.Marshal(curveOIDs[256])
+	if got, _ := templateValue(public, attrECParams); !bytes.Equal(got, wantParams) {
+		t.Errorf("CKA_EC_PARAMS: got %x, want %x", got, wantParams)
+	}
+	for _, test := range []struct {
+		name     string
+		template []attribute
+		typ      uint
+		want     []byte
+	}{
+		{"public CKA_TOKEN", public, attrToken, []byte{1}},
+		{"public CKA_ID", public, attrID, []byte{1, 2}},
+		{"private CKA_TOKEN", private, attrToken, []byte{1}},
+		{"private CKA_SENSITIVE", private, attrSensitive, []byte{1}},
+		{"private CKA_EXTRACTABLE", private, attrExtractable, []byte{0}},
+		{"private CKA_LABEL", private, attrLabel, []byte("ecp")},
+		{"private CKA_DERIVE", private, attrDerive, []byte{1}},
+	} {
+		if got, _ := templateValue(test.template, test.typ); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %x, want %x", test.name, got, test.want)
+		}
+	}
+
+	mech, public, private, err = keyGenTemplates(KeyGenOptions{Label: "ecp", Algorithm: "RSA", Temporary: true, Extractable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != mechRSAKeyPairGen {
+		t.Errorf("keyGenTemplates: got mechanism %#x, want %#x", mech, mechRSAKeyPairGen)
+	}
+	if _, ok := templateValue(public, attrModulusBits); !ok {
+		t.Errorf("keyGenTemplates: RSA public template lacks CKA_MODULUS_BITS")
+	}
+	if got, _ := templateValue(private, attrToken); !bytes.Equal(got, []byte{0}) {
+		t.Errorf("temporary CKA_TOKEN: got %x, want 00", got)
+	}
+	if got, _ := templateValue(private, attrExtractable); !bytes.Equal(got, []byte{1}) {
+		t.Errorf("extractable CKA_EXTRACTABLE: got %x, want 01", got)
+	}
+	if _, ok := templateValue(public, attrID); ok {
+		t.Errorf("keyGenTemplates: got CKA_ID without an id")
+	}
+}
+
+func TestECPublicKey(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := elliptic.Marshal(elliptic.P256(), priv.X, priv.Y)
+	wrapped, err := asn1.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, point := range [][]byte{wrapped, raw} {
+		pub, err := ecPublicKey(elliptic.P256(), point)
+		if err != nil {
+			t.Errorf("ecPublicKey(%x): %v", point, err)
+			continue
+		}
+		if !pub.Equal(&priv.PublicKey) {
+			t.Errorf("ecPublicKey(%x): got a different key", point)
+		}
+	}
+	if _, err := ecPublicKey(elliptic.P256(), []byte{4, 1, 2}); err == nil {
+		t.Errorf("ecPublicKey: got no error for an invalid point")
+	}
+}
+
+func TestRSAPublicKey(t *testing.T) {
+	pub, err := rsaPublicKey([]byte{0xc3, 0x5d}, []byte{0x01, 0x00, 0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.N.Int64() != 0xc35d || pub.E != 65537 {
+		t.Errorf("rsaPublicKey: got N %v and E %d, want 50013 and 65537", pub.N, pub.E)
+	}
+	if _, err := rsaPublicKey([]byte{0xc3}, nil); err == nil {
+		t.Errorf("rsaPublicKey: got no error without an exponent")
+	}
+}
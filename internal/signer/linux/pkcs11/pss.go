@@ -0,0 +1,107 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+)
+
+// pssEncode returns the EMSA-PSS encoding (RFC 8017, section 9.1.1) of
+// digest for pub, left-padded to the modulus size, ready to be signed with
+// raw RSA (CKM_RSA_X_509) by tokens that lack CKM_RSA_PKCS_PSS.
+func pssEncode(rnd io.Reader, pub *rsa.PublicKey, hash crypto.Hash, digest []byte, saltLength int) ([]byte, error) {
+	if !hash.Available() {
+		return nil, errors.New("unsupported hash function")
+	}
+	hLen := hash.Size()
+	if len(digest) != hLen {
+		return nil, errors.New("input must be hashed")
+	}
+	emBits := pub.N.BitLen() - 1
+	emLen := (emBits + 7) / 8
+	if saltLength < 0 || emLen < hLen+saltLength+2 {
+		return nil, errors.New("key size too small for PSS signature")
+	}
+
+	salt := make([]byte, saltLength)
+	if _, err := io.ReadFull(rnd, salt); err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(make([]byte, 8))
+	h.Write(digest)
+	h.Write(salt)
+	mHash := h.Sum(nil)
+
+	// EM = maskedDB || H || 0xbc, where DB = PS || 0x01 || salt.
+	em := make([]byte, emLen)
+	db := em[:emLen-hLen-1]
+	db[len(db)-saltLength-1] = 0x01
+	copy(db[len(db)-saltLength:], salt)
+	mgf1XOR(db, hash, mHash)
+	db[0] &= 0xff >> (8*emLen - emBits)
+	copy(em[emLen-hLen-1:], mHash)
+	em[emLen-1] = 0xbc
+
+	block := make([]byte, pub.Size())
+	copy(block[len(block)-emLen:], em)
+	return block, nil
+}
+
+// mgf1XOR XORs out with the MGF1 mask generated from seed.
+func mgf1XOR(out []byte, hash crypto.Hash, seed []byte) {
+	var counter [4]byte
+	done := 0
+	for done < len(out) {
+		h := hash.New()
+		h.Write(seed)
+		h.Write(counter[:])
+		for _, b := range h.Sum(nil) {
+			if done == len(out) {
+				break
+			}
+			out[done] ^= b
+			done++
+		}
+		for i := len(counter) - 1; i >= 0; i-- {
+			counter[i]++
+			if counter[i] != 0 {
+				break
+			}
+		}
+	}
+}
+
+// softwarePSS reports whether RSA-PSS signatures must be padded in Go, since
+// the token supports raw RSA but not CKM_RSA_PKCS_PSS, or raw RSA is all the
+// options allow.
+func (k *Key) softwarePSS() bool {
+	if k.opts.RawRSA {
+		return true
+	}
+	return k.mechanisms != nil && !k.mechanisms[mechRSAPKCSPSS] && k.mechanisms[mechRSAX509]
+}
+
+// signPSSRaw signs digest with RSA-PSS padding applied in Go and CKM_RSA_X_509.
+func (k *Key) signPSSRaw(pub *rsa.PublicKey, digest []byte, hash crypto.Hash, saltLength int) ([]byte, error) {
+	block, err := pssEncode(rand.Reader, pub, hash, digest, saltLength)
+	if err != nil {
+		return nil, err
+	}
+	return k.sign(mechRSAX509, block, pub.Size())
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"math/big"
+	"testing"
+)
+
+func TestPSSEncode(t *testing.T) {
+	for _, bits := range []int{2048, 2049} {
+		priv, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			hash       crypto.Hash
+			saltLength int
+		}{
+			{hash: crypto.SHA256, saltLength: 32},
+			{hash: crypto.SHA384, saltLength: 0},
+			{hash: crypto.SHA512, saltLength: (priv.N.BitLen()-1+7)/8 - 2 - 64},
+		} {
+			h := test.hash.New()
+			h.Write([]byte("message"))
+			digest := h.Sum(nil)
+
+			block, err := pssEncode(rand.Reader, &priv.PublicKey, test.hash, digest, test.saltLength)
+			if err != nil {
+				t.Fatalf("pssEncode(%d bits, %v): %v", bits, test.hash, err)
+			}
+			// Sign the block with raw RSA, as CKM_RSA_X_509 does.
+			m := new(big.Int).SetBytes(block)
+			sig := new(big.Int).Exp(m, priv.D, priv.N).FillBytes(make([]byte, priv.Size()))
+			opts := &rsa.PSSOptions{Hash: test.hash, SaltLength: test.saltLength}
+			if err := rsa.VerifyPSS(&priv.PublicKey, test.hash, digest, sig, opts); err != nil {
+				t.Errorf("VerifyPSS(%d bits, %v, salt %d): %v", bits, test.hash, test.saltLength, err)
+			}
+		}
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha512.Sum512([]byte("message"))
+	if _, err := pssEncode(rand.Reader, &priv.PublicKey, crypto.SHA512, digest[:], 128); err == nil {
+		t.Error("pssEncode with an oversized salt: got nil error, want error")
+	}
+	short := sha256.Sum256([]byte("message"))
+	if _, err := pssEncode(rand.Reader, &priv.PublicKey, crypto.SHA512, short[:], 0); err == nil {
+		t.Error("pssEncode with a digest of the wrong size: got nil error, want error")
+	}
+}
+
+func TestSoftwarePSS(t *testing.T) {
+	tests := []struct {
+		mechanisms map[uint]bool
+		rawRSA     bool
+		want       bool
+	}{
+		{mechanisms: nil, want: false},
+		{mechanisms: nil, rawRSA: true, want: true},
+		{mechanisms: map[uint]bool{mechRSAPKCSPSS: true, mechRSAX509: true}, rawRSA: true, want: true},
+		{mechanisms: map[uint]bool{mechRSAPKCSPSS: true, mechRSAX509: true}, want: false},
+		{mechanisms: map[uint]bool{mechRSAPKCS: true, mechRSAX509: true}, want: true},
+		{mechanisms: map[uint]bool{mechRSAPKCS: true}, want: false},
+	}
+	for _, test := range tests {
+		k := &Key{mechanisms: test.mechanisms, opts: Options{RawRSA: test.rawRSA}}
+		if got := k.softwarePSS(); got != test.want {
+			t.Errorf("softwarePSS with %v and RawRSA %v: got %v, want %v", test.mechanisms, test.rawRSA, got, test.want)
+		}
+	}
+}
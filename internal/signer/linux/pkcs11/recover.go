@@ -0,0 +1,72 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/go-pkcs11/pkcs11"
+)
+
+// ErrTokenRemoved is returned when the token is gone from its reader and did
+// not come back when the module was initialized again.
+var ErrTokenRemoved = errors.New("pkcs11: token removed")
+
+// reinitDelay gives a token that was just inserted or reset time to settle
+// before the module is initialized again.
+var reinitDelay = time.Second
+
+// reinitialize finalizes and initializes the module again, as is needed
+// after CKR_DEVICE_ERROR or after the token was removed and inserted, and
+// finds the token's slot again, since a reinserted token may be in another
+// reader. Nothing is done if the module was initialized again since
+// generation gen.
+func (k *Key) reinitialize(gen uint64) error {
+	k.reinitMu.Lock()
+	defer k.reinitMu.Unlock()
+	if k.gen != gen {
+		return nil
+	}
+	if k.lib.initialized {
+		// Only go-pkcs11 can initialize the module again, and it cannot
+		// configure modules such as NSS softoken, which has no device to lose.
+		return fmt.Errorf("pkcs11: %s failed and cannot be initialized again", k.path)
+	}
+	time.Sleep(reinitDelay)
+
+	// Finalizing closes every session, and the library stays loaded as k.lib
+	// holds a reference to it.
+	if k.module != nil {
+		k.module.Close()
+		k.module = nil
+	}
+	module, err := pkcs11.Open(k.path)
+	if err != nil {
+		return fmt.Errorf("initializing PKCS #11 module again: %w", err)
+	}
+	slot, err := findSlot(module, k.opts)
+	if err != nil {
+		module.Close()
+		return fmt.Errorf("%w: %v", ErrTokenRemoved, err)
+	}
+	k.module = module
+	k.pool.reset(slot)
+	k.mu.Lock()
+	k.hasPrivate = false
+	k.mu.Unlock()
+	k.gen++
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isP11KitClient reports whether the module at path is p11-kit-client.so,
+// which forwards every call to a p11-kit server, typically on the host of a
+// container, rather than reaching a token itself.
+func isP11KitClient(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), "p11-kit-client")
+}
+
+// p11KitServerAddress returns the address p11-kit-client.so connects to, as
+// set by p11-kit server's output, or else its default socket in the user's
+// runtime directory.
+func p11KitServerAddress() string {
+	if addr := os.Getenv("P11_KIT_SERVER_ADDRESS"); addr != "" {
+		return addr
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	return "unix:path=" + filepath.Join(runtimeDir, "p11-kit", "pkcs11")
+}
+
+// checkP11KitServer fails if the p11-kit server's socket is missing. Without
+// it p11-kit-client.so loads fine but shows no slots, which would otherwise
+// surface as a confusing missing token.
+func checkP11KitServer() error {
+	addr := p11KitServerAddress()
+	if !strings.HasPrefix(addr, "unix:path=") {
+		// Other transports cannot be checked up front.
+		return nil
+	}
+	path := strings.TrimPrefix(addr, "unix:path=")
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("p11-kit server socket %s is not available, start `p11-kit server` and set P11_KIT_SERVER_ADDRESS: %w", path, err)
+	}
+	return nil
+}
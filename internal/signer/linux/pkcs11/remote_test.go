@@ -0,0 +1,80 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsP11KitClient(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/usr/lib/x86_64-linux-gnu/pkcs11/p11-kit-client.so", want: true},
+		{path: "p11-kit-client.so", want: true},
+		{path: "/usr/lib/x86_64-linux-gnu/p11-kit-proxy.so", want: false},
+		{path: "/usr/lib/softhsm/libsofthsm2.so", want: false},
+	}
+	for _, test := range tests {
+		if got := isP11KitClient(test.path); got != test.want {
+			t.Errorf("isP11KitClient(%q): got %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestP11KitServerAddress(t *testing.T) {
+	t.Setenv("P11_KIT_SERVER_ADDRESS", "")
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if got, want := p11KitServerAddress(), "unix:path=/run/user/1000/p11-kit/pkcs11"; got != want {
+		t.Errorf("p11KitServerAddress: got %q, want %q", got, want)
+	}
+	t.Setenv("P11_KIT_SERVER_ADDRESS", "unix:path=/tmp/p11-kit/pkcs11-42")
+	if got, want := p11KitServerAddress(), "unix:path=/tmp/p11-kit/pkcs11-42"; got != want {
+		t.Errorf("p11KitServerAddress: got %q, want %q", got, want)
+	}
+}
+
+func TestCheckP11KitServer(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "pkcs11")
+	t.Setenv("P11_KIT_SERVER_ADDRESS", "unix:path="+socket)
+	if err := checkP11KitServer(); err == nil {
+		t.Errorf("checkP11KitServer: got no error for a missing socket")
+	}
+	if err := os.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkP11KitServer(); err != nil {
+		t.Errorf("checkP11KitServer: %v", err)
+	}
+	t.Setenv("P11_KIT_SERVER_ADDRESS", "vsock:cid=2;port=5555")
+	if err := checkP11KitServer(); err != nil {
+		t.Errorf("checkP11KitServer of a vsock address: %v", err)
+	}
+}
+
+func TestRemoteSessionPoolSkipsCheck(t *testing.T) {
+	// Checking the idle session would call into the module, which these
+	// sessions lack.
+	p := &sessionPool{remote: true}
+	idle := &session{}
+	p.put(idle)
+	s, err := p.get()
+	if err != nil || s != idle {
+		t.Errorf("get: got %v, %v, want the idle session", s, err)
+	}
+}
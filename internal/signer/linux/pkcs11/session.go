@@ -0,0 +1,169 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"sync"
+)
+
+// sessionPool keeps sessions with a slot for reuse by concurrent operations.
+// A token daemon such as pcscd restarting under a long-lived signer
+// invalidates every session and the login, so sessions are checked before
+// use, and operations that lose their session are retried once with a new
+// one, logging in again if needed.
+type sessionPool struct {
+	lib *library
+	pin string
+	// remote is set for modules that forward each call over a socket, such
+	// as p11-kit-client.so. Their pools skip the round trip checking idle
+	// sessions, relying on the retry instead.
+	remote bool
+	// sem holds a token for each operation running, if the number of
+	// operations, and so of open sessions, is limited.
+	sem chan struct{}
+
+	mu   sync.Mutex
+	slot uint32
+	idle []*session
+	// gen counts resets. Sessions of earlier generations are not reused, as
+	// their handles may since have been given to new sessions.
+	gen uint64
+}
+
+// newSessionPool returns a pool of sessions with slot of the module at path,
+// which runs at most limit operations at once if limit is positive. Remote
+// modules run one at a time by default, as their server serializes the calls
+// anyway.
+func newSessionPool(lib *library, path string, slot uint32, pin string, limit int) *sessionPool {
+	p := &sessionPool{lib: lib, slot: slot, pin: pin, remote: isP11KitClient(path)}
+	if limit <= 0 && p.remote {
+		limit = 1
+	}
+	if limit > 0 {
+		p.sem = make(chan struct{}, limit)
+	}
+	return p
+}
+
+// do runs f with a session from the pool.
+func (p *sessionPool) do(f func(s *session) error) error {
+	if p.sem != nil {
+		p.sem <- struct{}{}
+		defer func() { <-p.sem }()
+	}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var s *session
+		s, err = p.get()
+		if err != nil {
+			return err
+		}
+		err = f(s)
+		if !sessionLost(err) {
+			p.put(s)
+			return err
+		}
+		// The idle sessions are most likely gone too.
+		p.discard(s)
+		p.drain()
+	}
+	return err
+}
+
+// get returns a usable idle session, or else a new one.
+func (p *sessionPool) get() (*session, error) {
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		s := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.remote {
+			return s, nil
+		}
+		if err := p.check(s); err == nil {
+			return s, nil
+		}
+		p.discard(s)
+	}
+
+	p.mu.Lock()
+	slot, gen := p.slot, p.gen
+	p.mu.Unlock()
+	s, err := p.lib.openSession(slot)
+	if err != nil {
+		return nil, err
+	}
+	s.gen = gen
+	if err := p.check(s); err != nil {
+		p.discard(s)
+		return nil, err
+	}
+	return s, nil
+}
+
+// check fails if s is no longer valid, and logs in again if a PIN is
+// configured and the login was lost.
+func (p *sessionPool) check(s *session) error {
+	loggedIn, err := s.loggedIn()
+	if err != nil || loggedIn || p.pin == "" {
+		return err
+	}
+	return s.login(p.pin)
+}
+
+// put returns s to the pool.
+func (p *sessionPool) put(s *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s.gen != p.gen {
+		return
+	}
+	p.idle = append(p.idle, s)
+}
+
+// discard closes s unless it belongs to an earlier generation, whose handle
+// may since have been given to another session.
+func (p *sessionPool) discard(s *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s.gen == p.gen {
+		s.close()
+	}
+}
+
+// reset forgets every session, which the module being finalized has closed,
+// and opens new ones with slot from then on.
+func (p *sessionPool) reset(slot uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle = nil
+	p.slot = slot
+	p.gen++
+}
+
+// drain closes the idle sessions.
+func (p *sessionPool) drain() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, s := range idle {
+		s.close()
+	}
+}
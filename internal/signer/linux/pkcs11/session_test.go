@@ -0,0 +1,140 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionLost(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: fmt.Errorf("signing: %w", &ckError{fn: "C_Sign", rv: 0xb3}), want: true}, // CKR_SESSION_HANDLE_INVALID
+		{err: &ckError{fn: "C_SignInit", rv: 0x101}, want: true},                       // CKR_USER_NOT_LOGGED_IN
+		{err: &ckError{fn: "C_Sign", rv: 0x82}, want: true},                            // CKR_OBJECT_HANDLE_INVALID
+		{err: &ckError{fn: "C_Sign", rv: 0x70}, want: false},                           // CKR_MECHANISM_INVALID
+		{err: fmt.Errorf("CKR_SESSION_HANDLE_INVALID"), want: false},
+	}
+	for _, test := range tests {
+		if got := sessionLost(test.err); got != test.want {
+			t.Errorf("sessionLost(%v): got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestDeviceLost(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: &ckError{fn: "C_Sign", rv: 0x30}, want: true},                            // CKR_DEVICE_ERROR
+		{err: fmt.Errorf("signing: %w", &ckError{fn: "C_Sign", rv: 0x32}), want: true}, // CKR_DEVICE_REMOVED
+		{err: &ckError{fn: "C_OpenSession", rv: 0xe0}, want: true},                     // CKR_TOKEN_NOT_PRESENT
+		{err: &ckError{fn: "C_Sign", rv: 0x190}, want: true},                           // CKR_CRYPTOKI_NOT_INITIALIZED
+		{err: &ckError{fn: "C_Sign", rv: 0xb3}, want: false},                           // CKR_SESSION_HANDLE_INVALID
+	}
+	for _, test := range tests {
+		if got := deviceLost(test.err); got != test.want {
+			t.Errorf("deviceLost(%v): got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestSessionPoolGenerations(t *testing.T) {
+	p := &sessionPool{slot: 1}
+	p.put(&session{gen: 0})
+	if len(p.idle) != 1 {
+		t.Fatalf("put: got %d idle sessions, want 1", len(p.idle))
+	}
+
+	p.reset(2)
+	if len(p.idle) != 0 || p.slot != 2 || p.gen != 1 {
+		t.Errorf("reset: got %d idle sessions, slot %d and generation %d, want 0, 2 and 1", len(p.idle), p.slot, p.gen)
+	}
+	// A session from before the reset must not be reused, or closed, since
+	// its handle may now belong to another session.
+	stale := &session{gen: 0}
+	p.put(stale)
+	p.discard(stale)
+	if len(p.idle) != 0 {
+		t.Errorf("put of a stale session: got %d idle sessions, want 0", len(p.idle))
+	}
+}
+
+func TestReinitializeSkipsAfterOtherReinitialization(t *testing.T) {
+	k := &Key{gen: 1}
+	if err := k.reinitialize(0); err != nil {
+		t.Errorf("reinitialize of an earlier generation: %v", err)
+	}
+}
+
+func TestNewSessionPoolLimit(t *testing.T) {
+	tests := []struct {
+		path  string
+		limit int
+		want  int
+	}{
+		{path: "/usr/lib/softhsm/libsofthsm2.so", limit: 0, want: 0},
+		{path: "/usr/lib/softhsm/libsofthsm2.so", limit: 4, want: 4},
+		{path: "/usr/lib/pkcs11/p11-kit-client.so", limit: 0, want: 1},
+		{path: "/usr/lib/pkcs11/p11-kit-client.so", limit: 3, want: 3},
+	}
+	for _, test := range tests {
+		if got := cap(newSessionPool(nil, test.path, 0, "", test.limit).sem); got != test.want {
+			t.Errorf("newSessionPool(%s, %d): got a limit of %d, want %d", test.path, test.limit, got, test.want)
+		}
+	}
+}
+
+func TestSessionPoolLimitsOperations(t *testing.T) {
+	// Remote pools reuse idle sessions without calling into the module, which
+	// these sessions lack.
+	p := newSessionPool(nil, "p11-kit-client.so", 0, "", 2)
+	p.put(&session{})
+	p.put(&session{})
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.do(func(*session) error {
+				mu.Lock()
+				running++
+				if running > most {
+					most = running
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if most != 2 {
+		t.Errorf("do: got at most %d operations at once, want 2", most)
+	}
+}
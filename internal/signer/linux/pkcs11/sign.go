@@ -0,0 +1,245 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// hashPrefixes are the DER encodings of a PKCS #1 DigestInfo up to the
+// digest, which CKM_RSA_PKCS expects the caller to supply.
+var hashPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA224: {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Sign signs a digest with the private key on the token. RSA keys sign with
+// RSA-PSS if opts is *rsa.PSSOptions, and with PKCS #1 v1.5 otherwise.
+func (k *Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	switch pub := k.pub.(type) {
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			return k.signPSS(pub, digest, pssOpts)
+		}
+		data, err := digestInfo(opts.HashFunc(), digest)
+		if err != nil {
+			return nil, err
+		}
+		if k.opts.RawRSA {
+			block, err := pkcs1v15Encode(data, pub.Size())
+			if err != nil {
+				return nil, err
+			}
+			return k.sign(mechRSAX509, block, pub.Size())
+		}
+		return k.sign(mechRSAPKCS, data, pub.Size())
+	case *ecdsa.PublicKey:
+		m, err := newMechanism(mechECDSA)
+		if err != nil {
+			return nil, err
+		}
+		defer m.free()
+		return k.signECDSA(pub, m, digest)
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", k.pub)
+	}
+}
+
+// SignMessage hashes message with opts.HashFunc() and signs it like Sign.
+// When the token supports a mechanism that hashes as well as signs, such as
+// CKM_SHA256_RSA_PKCS, CKM_SHA256_RSA_PKCS_PSS or CKM_ECDSA_SHA256, the
+// message is hashed on the token, as some FIPS tokens refuse to sign input
+// hashed elsewhere.
+func (k *Key) SignMessage(message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := opts.HashFunc()
+	if m, ok, err := k.hashOnTokenMechanism(opts); err != nil {
+		return nil, err
+	} else if ok {
+		defer m.free()
+		switch pub := k.pub.(type) {
+		case *rsa.PublicKey:
+			return k.signWith(m, message, pub.Size())
+		case *ecdsa.PublicKey:
+			return k.signECDSA(pub, m, message)
+		}
+	}
+	if !hash.Available() {
+		return nil, fmt.Errorf("unsupported hash function: %s", hash)
+	}
+	h := hash.New()
+	h.Write(message)
+	return k.Sign(nil, h.Sum(nil), opts)
+}
+
+// hashOnTokenMechanism returns the mechanism hashing and signing for opts, if
+// the token supports it.
+func (k *Key) hashOnTokenMechanism(opts crypto.SignerOpts) (mechanism, bool, error) {
+	typ, ok := k.hashOnTokenType(opts)
+	if !ok {
+		return mechanism{}, false, nil
+	}
+	var m mechanism
+	var err error
+	if pssOpts, isPSS := opts.(*rsa.PSSOptions); isPSS {
+		saltLength := pssSaltLength(k.pub.(*rsa.PublicKey), pssOpts)
+		if isTPM2(k.path) {
+			if saltLength, err = tpm2SaltLength(pssOpts, saltLength); err != nil {
+				return mechanism{}, false, err
+			}
+		}
+		m, err = pssMechanism(typ, pssOpts.Hash, saltLength)
+	} else {
+		m, err = newMechanism(typ)
+	}
+	if err != nil {
+		return mechanism{}, false, err
+	}
+	return m, true, nil
+}
+
+// hashOnTokenType returns the type of the mechanism hashing and signing for
+// opts, if the token supports one.
+func (k *Key) hashOnTokenType(opts crypto.SignerOpts) (uint, bool) {
+	h, ok := hashMechanisms[opts.HashFunc()]
+	if !ok {
+		return 0, false
+	}
+	var typ uint
+	switch k.pub.(type) {
+	case *rsa.PublicKey:
+		if k.opts.RawRSA {
+			return 0, false
+		}
+		if _, isPSS := opts.(*rsa.PSSOptions); isPSS {
+			typ = h.rsaPSS
+		} else {
+			typ = h.rsaPKCS
+		}
+	case *ecdsa.PublicKey:
+		typ = h.ecdsa
+	default:
+		return 0, false
+	}
+	return typ, k.mechanisms[typ]
+}
+
+// signECDSA signs data with the ECDSA mechanism m.
+func (k *Key) signECDSA(pub *ecdsa.PublicKey, m mechanism, data []byte) ([]byte, error) {
+	byteLen := (pub.Curve.Params().BitSize + 7) / 8
+	sig, err := k.signWith(m, data, 2*byteLen)
+	if err != nil {
+		return nil, err
+	}
+	// The token returns r and s concatenated, Go expects ASN.1.
+	return asn1.Marshal(ecdsaSignature{
+		R: new(big.Int).SetBytes(sig[:byteLen]),
+		S: new(big.Int).SetBytes(sig[byteLen:]),
+	})
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// digestInfo returns the PKCS #1 DigestInfo for digest.
+func digestInfo(hash crypto.Hash, digest []byte) ([]byte, error) {
+	prefix, ok := hashPrefixes[hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function: %s", hash)
+	}
+	if len(digest) != hash.Size() {
+		return nil, errors.New("input must be hashed")
+	}
+	return append(append([]byte(nil), prefix...), digest...), nil
+}
+
+// pkcs1v15Encode returns the EMSA-PKCS1-v1_5 encoding (RFC 8017, section 9.2)
+// of the DigestInfo t for a key of size bytes, ready to be signed with raw RSA
+// (CKM_RSA_X_509) by tokens that lack CKM_RSA_PKCS.
+func pkcs1v15Encode(t []byte, size int) ([]byte, error) {
+	if size < len(t)+11 {
+		return nil, errors.New("key size too small for PKCS #1 v1.5 signature")
+	}
+	// EM = 0x00 || 0x01 || PS || 0x00 || T, where PS is 0xff bytes.
+	em := make([]byte, size)
+	em[1] = 0x01
+	for i := 2; i < size-len(t)-1; i++ {
+		em[i] = 0xff
+	}
+	copy(em[size-len(t):], t)
+	return em, nil
+}
+
+// signPSS signs digest with CKM_RSA_PKCS_PSS, or pads it in Go if the token
+// lacks that mechanism.
+func (k *Key) signPSS(pub *rsa.PublicKey, digest []byte, opts *rsa.PSSOptions) ([]byte, error) {
+	saltLength := pssSaltLength(pub, opts)
+	if k.softwarePSS() {
+		return k.signPSSRaw(pub, digest, opts.Hash, saltLength)
+	}
+	if isTPM2(k.path) {
+		var err error
+		if saltLength, err = tpm2SaltLength(opts, saltLength); err != nil {
+			return nil, err
+		}
+	}
+	m, err := pssMechanism(mechRSAPKCSPSS, opts.Hash, saltLength)
+	if err != nil {
+		return nil, err
+	}
+	defer m.free()
+	return k.signWith(m, digest, pub.Size())
+}
+
+// pssSaltLength returns the salt length in bytes that opts asks for.
+func pssSaltLength(pub *rsa.PublicKey, opts *rsa.PSSOptions) int {
+	switch opts.SaltLength {
+	case rsa.PSSSaltLengthAuto:
+		// Same logic as crypto/rsa.
+		return (pub.N.BitLen()-1+7)/8 - 2 - opts.Hash.Size()
+	case rsa.PSSSaltLengthEqualsHash:
+		return opts.Hash.Size()
+	default:
+		return opts.SaltLength
+	}
+}
+
+// sign signs data with a mechanism without parameters.
+func (k *Key) sign(typ uint, data []byte, sigLen int) ([]byte, error) {
+	m, err := newMechanism(typ)
+	if err != nil {
+		return nil, err
+	}
+	defer m.free()
+	return k.signWith(m, data, sigLen)
+}
+
+func (k *Key) signWith(m mechanism, data []byte, sigLen int) ([]byte, error) {
+	var sig []byte
+	err := k.withPrivateKey(func(s *session, key uint) (err error) {
+		sig, err = s.sign(key, m, data, sigLen, k.contextLogin())
+		return err
+	})
+	return sig, err
+}
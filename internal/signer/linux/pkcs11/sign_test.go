@@ -0,0 +1,125 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+)
+
+func TestDigestInfo(t *testing.T) {
+	oids := map[crypto.Hash]asn1.ObjectIdentifier{
+		crypto.SHA1:   {1, 3, 14, 3, 2, 26},
+		crypto.SHA224: {2, 16, 840, 1, 101, 3, 4, 2, 4},
+		crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+		crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+		crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+	}
+	for hash, oid := range oids {
+		digest := bytes.Repeat([]byte{0xab}, hash.Size())
+		want, err := asn1.Marshal(struct {
+			Algorithm pkix.AlgorithmIdentifier
+			Digest    []byte
+		}{
+			Algorithm: pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.NullRawValue},
+			Digest:    digest,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := digestInfo(hash, digest)
+		if err != nil {
+			t.Errorf("digestInfo(%v): %v", hash, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("digestInfo(%v): got %x, want %x", hash, got, want)
+		}
+	}
+
+	if _, err := digestInfo(crypto.SHA256, []byte("not a digest")); err == nil {
+		t.Error("digestInfo with a short digest: got nil error, want error")
+	}
+	if _, err := digestInfo(crypto.MD5, make([]byte, 16)); err == nil {
+		t.Error("digestInfo with MD5: got nil error, want error")
+	}
+}
+
+func TestPKCS1v15Encode(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("message"))
+	want, err := rsa.SignPKCS1v15(nil, priv, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := digestInfo(crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := pkcs1v15Encode(data, priv.Size())
+	if err != nil {
+		t.Fatalf("pkcs1v15Encode: %v", err)
+	}
+	// Raw RSA, as CKM_RSA_X_509 applies it on the token.
+	got := new(big.Int).Exp(new(big.Int).SetBytes(block), priv.D, priv.N).FillBytes(make([]byte, priv.Size()))
+	if !bytes.Equal(got, want) {
+		t.Errorf("pkcs1v15Encode: signature got %x, want %x", got, want)
+	}
+
+	if _, err := pkcs1v15Encode(data, len(data)+10); err == nil {
+		t.Error("pkcs1v15Encode with a small key: got nil error, want error")
+	}
+}
+
+func TestHashOnTokenType(t *testing.T) {
+	sha256 := hashMechanisms[crypto.SHA256]
+	all := map[uint]bool{sha256.rsaPKCS: true, sha256.rsaPSS: true, sha256.ecdsa: true}
+	pss := &rsa.PSSOptions{Hash: crypto.SHA256}
+	tests := []struct {
+		name       string
+		pub        crypto.PublicKey
+		mechanisms map[uint]bool
+		rawRSA     bool
+		opts       crypto.SignerOpts
+		want       uint
+		wantOK     bool
+	}{
+		{name: "RSA PKCS1", pub: &rsa.PublicKey{}, mechanisms: all, opts: crypto.SHA256, want: sha256.rsaPKCS, wantOK: true},
+		{name: "RSA PSS", pub: &rsa.PublicKey{}, mechanisms: all, opts: pss, want: sha256.rsaPSS, wantOK: true},
+		{name: "ECDSA", pub: &ecdsa.PublicKey{}, mechanisms: all, opts: crypto.SHA256, want: sha256.ecdsa, wantOK: true},
+		{name: "unsupported hash", pub: &rsa.PublicKey{}, mechanisms: all, opts: crypto.SHA384},
+		{name: "MD5", pub: &rsa.PublicKey{}, mechanisms: all, opts: crypto.MD5},
+		{name: "unknown mechanisms", pub: &rsa.PublicKey{}, opts: crypto.SHA256},
+		{name: "raw RSA", pub: &rsa.PublicKey{}, mechanisms: all, rawRSA: true, opts: crypto.SHA256},
+		{name: "PSS only", pub: &rsa.PublicKey{}, mechanisms: map[uint]bool{sha256.rsaPSS: true}, opts: crypto.SHA256},
+	}
+	for _, test := range tests {
+		k := &Key{pub: test.pub, mechanisms: test.mechanisms, opts: Options{RawRSA: test.rawRSA}}
+		got, ok := k.hashOnTokenType(test.opts)
+		if ok != test.wantOK || (ok && got != test.want) {
+			t.Errorf("%s: got %#x, %v, want %#x, %v", test.name, got, ok, test.want, test.wantOK)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// isTPM2 reports whether the module at path is tpm2-pkcs11, which keeps its
+// keys as TPM objects rather than on a token.
+func isTPM2(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), "libtpm2_pkcs11")
+}
+
+// errTPM2PIN reports a tpm2-pkcs11 credential configured without a PIN.
+// Each of its keys has its own TPM auth value, which the module unwraps with
+// the user PIN, so the keys cannot be used, or even found, without logging
+// in.
+var errTPM2PIN = errors.New("tpm2-pkcs11 keys need the user PIN to unwrap their auth values; set user_pin or a PIN source")
+
+// checkTPM2PIN fails for tpm2-pkcs11 modules used without a PIN.
+func checkTPM2PIN(path, pin string) error {
+	if isTPM2(path) && pin == "" {
+		return errTPM2PIN
+	}
+	return nil
+}
+
+// tpm2SaltLength returns the RSA-PSS salt length to ask tpm2-pkcs11 for,
+// given the one opts asks for. TPMs sign with a salt as long as the hash, so
+// automatic lengths get that, and any other length fails here rather than
+// in the TPM with an obscure error.
+func tpm2SaltLength(opts *rsa.PSSOptions, saltLength int) (int, error) {
+	if opts.SaltLength == rsa.PSSSaltLengthAuto || saltLength == opts.Hash.Size() {
+		return opts.Hash.Size(), nil
+	}
+	return 0, fmt.Errorf("tpm2-pkcs11 only signs RSA-PSS with a salt of the hash size, %d bytes, not %d", opts.Hash.Size(), saltLength)
+}
+
+// loadIntoTPM makes tpm2-pkcs11 load the private key into the TPM by
+// signing with it once. The TPM takes seconds for that on first use, which
+// would otherwise be spent in the first TLS handshake, where servers may
+// time out.
+func (k *Key) loadIntoTPM() error {
+	if _, err := k.Sign(nil, make([]byte, crypto.SHA256.Size()), crypto.SHA256); err != nil {
+		return fmt.Errorf("tpm2-pkcs11: loading the key into the TPM: %w", err)
+	}
+	return nil
+}
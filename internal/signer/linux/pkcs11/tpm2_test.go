@@ -0,0 +1,69 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestIsTPM2(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/usr/lib/x86_64-linux-gnu/pkcs11/libtpm2_pkcs11.so", want: true},
+		{path: "libtpm2_pkcs11.so.0", want: true},
+		{path: "/usr/lib/softhsm/libsofthsm2.so", want: false},
+	}
+	for _, test := range tests {
+		if got := isTPM2(test.path); got != test.want {
+			t.Errorf("isTPM2(%q): got %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestCheckTPM2PIN(t *testing.T) {
+	if err := checkTPM2PIN("/usr/lib/pkcs11/libtpm2_pkcs11.so", ""); err != errTPM2PIN {
+		t.Errorf("checkTPM2PIN without a PIN: got %v, want %v", err, errTPM2PIN)
+	}
+	if err := checkTPM2PIN("/usr/lib/pkcs11/libtpm2_pkcs11.so", "1234"); err != nil {
+		t.Errorf("checkTPM2PIN with a PIN: got %v, want nil", err)
+	}
+	if err := checkTPM2PIN("/usr/lib/softhsm/libsofthsm2.so", ""); err != nil {
+		t.Errorf("checkTPM2PIN with SoftHSM: got %v, want nil", err)
+	}
+}
+
+func TestTPM2SaltLength(t *testing.T) {
+	tests := []struct {
+		saltLength int
+		requested  int
+		want       int
+		wantErr    bool
+	}{
+		{saltLength: rsa.PSSSaltLengthAuto, requested: 222, want: 32},
+		{saltLength: rsa.PSSSaltLengthEqualsHash, requested: 32, want: 32},
+		{saltLength: 32, requested: 32, want: 32},
+		{saltLength: 20, requested: 20, wantErr: true},
+	}
+	for _, test := range tests {
+		opts := &rsa.PSSOptions{SaltLength: test.saltLength, Hash: crypto.SHA256}
+		got, err := tpm2SaltLength(opts, test.requested)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("tpm2SaltLength(%d): got %d, %v, want %d, error %v", test.saltLength, got, err, test.want, test.wantErr)
+		}
+	}
+}
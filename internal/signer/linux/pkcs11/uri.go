@@ -0,0 +1,186 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URI holds the attributes of an RFC 7512 PKCS #11 URI that the signer
+// understands, such as
+//
+//	pkcs11:token=gecc;object=ecp?module-path=/usr/lib/softhsm/libsofthsm2.so
+//
+// so that configurations written for OpenSSL or p11-kit can be reused.
+type URI struct {
+	Token   string // token: the token label.
+	Serial  string // serial: the token serial number.
+	SlotID  uint32 // slot-id, only meaningful if HasSlotID is set.
+	Object  string // object: the label of the certificate and key objects.
+	ID      []byte // id: the CKA_ID of the certificate and key objects.
+	Type    string // type: cert, private, public, secret-key or data.
+	Module  string // module-path: the PKCS #11 module library file path.
+	PIN     string // pin-value: the user PIN.
+	PINFile string // pin-source: a file holding the user PIN.
+
+	HasSlotID bool
+}
+
+// ParseURI parses a pkcs11: URI. Attributes the signer cannot honor, such as
+// manufacturer or module-name, are rejected rather than ignored, since ignoring
+// them could select a different credential than the one intended.
+func ParseURI(s string) (*URI, error) {
+	const scheme = "pkcs11:"
+	if len(s) < len(scheme) || !strings.EqualFold(s[:len(scheme)], scheme) {
+		return nil, fmt.Errorf("pkcs11 URI %q does not start with %q", s, scheme)
+	}
+	path, query, _ := strings.Cut(s[len(scheme):], "?")
+
+	u := new(URI)
+	seen := make(map[string]bool)
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+		name, value, err := splitAttribute(attr)
+		if err != nil {
+			return nil, err
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("pkcs11 URI attribute %q appears more than once", name)
+		}
+		seen[name] = true
+		if err := u.setPathAttribute(name, value); err != nil {
+			return nil, err
+		}
+	}
+	for _, attr := range strings.Split(query, "&") {
+		if attr == "" {
+			continue
+		}
+		name, value, err := splitAttribute(attr)
+		if err != nil {
+			return nil, err
+		}
+		if err := u.setQueryAttribute(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// splitAttribute splits a name=value attribute and percent-decodes the value.
+func splitAttribute(attr string) (name, value string, err error) {
+	name, value, ok := strings.Cut(attr, "=")
+	if !ok {
+		return "", "", fmt.Errorf("pkcs11 URI attribute %q has no value", attr)
+	}
+	value, err = url.PathUnescape(value)
+	if err != nil {
+		return "", "", fmt.Errorf("pkcs11 URI attribute %q: %w", name, err)
+	}
+	return name, value, nil
+}
+
+func (u *URI) setPathAttribute(name, value string) error {
+	switch name {
+	case "token":
+		u.Token = value
+	case "serial":
+		u.Serial = value
+	case "slot-id":
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("pkcs11 URI slot-id %q: %w", value, err)
+		}
+		u.SlotID, u.HasSlotID = uint32(id), true
+	case "object":
+		u.Object = value
+	case "id":
+		// The id is binary, written as percent-encoded bytes such as %01%a2.
+		u.ID = []byte(value)
+	case "type":
+		switch value {
+		case "cert", "private", "public", "secret-key", "data":
+			u.Type = value
+		default:
+			return fmt.Errorf("pkcs11 URI type %q is not valid", value)
+		}
+	default:
+		return fmt.Errorf("pkcs11 URI attribute %q is not supported", name)
+	}
+	return nil
+}
+
+func (u *URI) setQueryAttribute(name, value string) error {
+	switch name {
+	case "module-path":
+		u.Module = value
+	case "pin-value":
+		u.PIN = value
+	case "pin-source":
+		if strings.HasPrefix(value, "file:") {
+			f, err := url.Parse(value)
+			if err != nil {
+				return fmt.Errorf("pkcs11 URI pin-source %q: %w", value, err)
+			}
+			value = f.Path
+		}
+		if value == "" || strings.HasPrefix(value, "|") {
+			return fmt.Errorf("pkcs11 URI pin-source %q is not a file", value)
+		}
+		u.PINFile = value
+	default:
+		return fmt.Errorf("pkcs11 URI attribute %q is not supported", name)
+	}
+	return nil
+}
+
+// Options returns opts with the credential selection the URI specifies. The
+// URI takes precedence, but opts supplies whatever the URI leaves out, such as
+// the module path, which OpenSSL-style URIs often omit.
+func (u *URI) Options(opts Options) Options {
+	if u.Module != "" {
+		opts.Module, opts.Modules = u.Module, nil
+	}
+	if u.Token != "" || u.Serial != "" || u.HasSlotID {
+		opts.Slot = ""
+		if u.HasSlotID {
+			opts.Slot = fmt.Sprintf("0x%x", u.SlotID)
+		}
+		opts.Token = u.Token
+		opts.Serial = u.Serial
+	}
+	if u.Object != "" || u.ID != nil {
+		opts.Label = u.Object
+		opts.ID = u.ID
+	}
+	return opts
+}
+
+// PINSource returns where the URI says the PIN comes from, and false if it
+// does not say.
+func (u *URI) PINSource() (PINSource, bool) {
+	switch {
+	case u.PIN != "":
+		return PINSource{PIN: u.PIN}, true
+	case u.PINFile != "":
+		return PINSource{File: u.PINFile}, true
+	default:
+		return PINSource{}, false
+	}
+}
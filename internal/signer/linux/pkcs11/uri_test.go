@@ -0,0 +1,114 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	u, err := ParseURI("pkcs11:token=My%20Token;serial=0123;object=ecp;id=%01%a2;type=private?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=file:/run/secrets/pin")
+	if err != nil {
+		t.Fatalf("ParseURI: %v", err)
+	}
+	if u.Token != "My Token" {
+		t.Errorf("Token: got %q, want %q", u.Token, "My Token")
+	}
+	if u.Serial != "0123" {
+		t.Errorf("Serial: got %q, want %q", u.Serial, "0123")
+	}
+	if u.Object != "ecp" {
+		t.Errorf("Object: got %q, want %q", u.Object, "ecp")
+	}
+	if want := []byte{0x01, 0xa2}; !bytes.Equal(u.ID, want) {
+		t.Errorf("ID: got %x, want %x", u.ID, want)
+	}
+	if u.Type != "private" {
+		t.Errorf("Type: got %q, want %q", u.Type, "private")
+	}
+	if u.Module != "/usr/lib/softhsm/libsofthsm2.so" {
+		t.Errorf("Module: got %q, want %q", u.Module, "/usr/lib/softhsm/libsofthsm2.so")
+	}
+	if u.PINFile != "/run/secrets/pin" {
+		t.Errorf("PINFile: got %q, want %q", u.PINFile, "/run/secrets/pin")
+	}
+}
+
+func TestParseURIErrors(t *testing.T) {
+	for _, uri := range []string{
+		"token=gecc",
+		"pkcs11:token=gecc;token=other",
+		"pkcs11:manufacturer=acme",
+		"pkcs11:object",
+		"pkcs11:slot-id=0x1",
+		"pkcs11:type=key",
+		"pkcs11:object=ecp?module-name=softhsm2",
+		"pkcs11:object=ecp?pin-source=|/bin/get-pin",
+		"pkcs11:object=%zz",
+	} {
+		if _, err := ParseURI(uri); err == nil {
+			t.Errorf("ParseURI(%q): got nil error, want error", uri)
+		}
+	}
+}
+
+func TestURIOptions(t *testing.T) {
+	config := Options{Module: "config.so", Slot: "0x1", Label: "config", PIN: "0000"}
+	tests := []struct {
+		uri  string
+		want Options
+	}{
+		{
+			uri:  "pkcs11:object=ecp",
+			want: Options{Module: "config.so", Slot: "0x1", Label: "ecp", PIN: "0000"},
+		},
+		{
+			uri:  "pkcs11:token=gecc;object=ecp?module-path=uri.so",
+			want: Options{Module: "uri.so", Token: "gecc", Label: "ecp", PIN: "0000"},
+		},
+		{
+			uri:  "pkcs11:slot-id=16",
+			want: Options{Module: "config.so", Slot: "0x10", Label: "config", PIN: "0000"},
+		},
+	}
+	for _, test := range tests {
+		u, err := ParseURI(test.uri)
+		if err != nil {
+			t.Fatalf("ParseURI(%q): %v", test.uri, err)
+		}
+		got := u.Options(config)
+		if got.Module != test.want.Module || got.Slot != test.want.Slot || got.Token != test.want.Token ||
+			got.Serial != test.want.Serial || got.Label != test.want.Label || got.PIN != test.want.PIN {
+			t.Errorf("%s: Options: got %+v, want %+v", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestURIPINSource(t *testing.T) {
+	u, err := ParseURI("pkcs11:object=ecp?pin-value=1234")
+	if err != nil {
+		t.Fatalf("ParseURI: %v", err)
+	}
+	if s, ok := u.PINSource(); !ok || s.PIN != "1234" {
+		t.Errorf("PINSource: got %+v, %v, want PIN 1234", s, ok)
+	}
+	u, err = ParseURI("pkcs11:object=ecp")
+	if err != nil {
+		t.Fatalf("ParseURI: %v", err)
+	}
+	if _, ok := u.PINSource(); ok {
+		t.Error("PINSource: got true for a URI without a PIN, want false")
+	}
+}
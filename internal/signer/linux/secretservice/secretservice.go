@@ -0,0 +1,97 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package secretservice stores and looks up secrets, such as token PINs, in
+// the user's keyring through the freedesktop Secret Service, which
+// gnome-keyring and KWallet implement. It runs secret-tool from libsecret
+// rather than speaking D-Bus itself.
+package secretservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// secretTool is the libsecret command-line client, looked up in PATH.
+var secretTool = "secret-tool"
+
+// timeout bounds a lookup or store, including the time the user takes to
+// answer a prompt unlocking the keyring.
+var timeout = 2 * time.Minute
+
+// ErrNotFound is returned by Lookup when no item has the attributes.
+var ErrNotFound = errors.New("secretservice: no secret matches the attributes")
+
+// Lookup returns the secret of an item with the given attributes, asking the
+// user to unlock the keyring if needed.
+func Lookup(attributes map[string]string) (string, error) {
+	out, err := runSecretTool("", append([]string{"lookup"}, attributeArgs(attributes)...)...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && len(bytes.TrimSpace(exitErr.Stderr)) == 0 {
+		// secret-tool fails silently when no item matches.
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Store saves secret in the default collection under label and the given
+// attributes, replacing an item with the same attributes, and asking the user
+// to unlock the keyring if needed.
+func Store(label string, attributes map[string]string, secret string) error {
+	_, err := runSecretTool(secret, append([]string{"store", "--label=" + label}, attributeArgs(attributes)...)...)
+	return err
+}
+
+// attributeArgs returns attributes as the alternating names and values that
+// secret-tool takes, sorted by name.
+func attributeArgs(attributes map[string]string) []string {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		args = append(args, name, attributes[name])
+	}
+	return args
+}
+
+// runSecretTool runs secret-tool with args and stdin, and returns its output.
+// Errors wrap the *exec.ExitError, which holds what secret-tool printed to
+// stderr.
+func runSecretTool(stdin string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, secretTool, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return out, nil
+	case errors.As(err, &exitErr):
+		return nil, fmt.Errorf("secretservice: secret-tool %s: %w: %s", args[0], err, bytes.TrimSpace(exitErr.Stderr))
+	default:
+		return nil, fmt.Errorf("secretservice: running secret-tool from libsecret: %w", err)
+	}
+}
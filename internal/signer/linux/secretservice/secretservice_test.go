@@ -0,0 +1,85 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secretservice
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeSecretTool installs a secret-tool replacement that holds one item with
+// attribute service=ecp and the given secret, fails as if no keyring were
+// running for service=broken, and records the arguments and input of store.
+// It returns the file receiving the recorded store call.
+func fakeSecretTool(t *testing.T, secret string) string {
+	t.Helper()
+	dir := t.TempDir()
+	record := filepath.Join(dir, "store")
+	script := filepath.Join(dir, "secret-tool")
+	data := `#!/bin/sh
+case "$*" in
+"lookup service ecp") printf '%s' '` + secret + `' ;;
+"lookup service broken") echo "secret-tool: Cannot autolaunch D-Bus without X11 \$DISPLAY" >&2; exit 1 ;;
+lookup*) exit 1 ;;
+store*) { echo "$*"; cat; } > '` + record + `' ;;
+*) exit 2 ;;
+esac
+`
+	if err := os.WriteFile(script, []byte(data), 0700); err != nil {
+		t.Fatal(err)
+	}
+	old := secretTool
+	secretTool = script
+	t.Cleanup(func() { secretTool = old })
+	return record
+}
+
+func TestLookup(t *testing.T) {
+	fakeSecretTool(t, "123456")
+	got, err := Lookup(map[string]string{"service": "ecp"})
+	if err != nil || got != "123456" {
+		t.Errorf("Lookup: got %q, %v, want 123456", got, err)
+	}
+	if _, err := Lookup(map[string]string{"service": "other"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Lookup of a missing item: got %v, want %v", err, ErrNotFound)
+	}
+	if _, err := Lookup(map[string]string{"service": "broken"}); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Lookup without a keyring: got %v, want an error other than %v", err, ErrNotFound)
+	}
+}
+
+func TestLookupWithoutSecretTool(t *testing.T) {
+	old := secretTool
+	secretTool = filepath.Join(t.TempDir(), "missing")
+	defer func() { secretTool = old }()
+	if _, err := Lookup(map[string]string{"service": "ecp"}); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Lookup without secret-tool: got %v, want an error other than %v", err, ErrNotFound)
+	}
+}
+
+func TestStore(t *testing.T) {
+	record := fakeSecretTool(t, "")
+	if err := Store("ECP PIN", map[string]string{"service": "ecp", "slot": "1"}, "123456"); err != nil {
+		t.Fatalf("Store: got %v, want nil err", err)
+	}
+	got, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "store --label=ECP PIN service ecp slot 1\n123456"; string(got) != want {
+		t.Errorf("Store: got secret-tool call %q, want %q", got, want)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/gob"
+	"encoding/json"
 	"io"
 	"log"
 	"net/rpc"
@@ -31,6 +32,7 @@ import (
 
 	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/linux/pkcs11"
 	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+	"github.com/googleapis/enterprise-certificate-proxy/internal/transport"
 )
 
 // If ECP Logging is enabled return true
@@ -49,6 +51,8 @@ func init() {
 	gob.Register(crypto.SHA384)
 	gob.Register(crypto.SHA512)
 	gob.Register(&rsa.PSSOptions{})
+	gob.Register(&rsa.OAEPOptions{})
+	gob.Register(&rsa.PKCS1v15DecryptOptions{})
 }
 
 // SignArgs contains arguments to a crypto Signer.Sign method.
@@ -57,6 +61,23 @@ type SignArgs struct {
 	Opts   crypto.SignerOpts // Options for signing, such as Hash identifier.
 }
 
+// SignMessageArgs contains arguments to a SignMessage method.
+type SignMessageArgs struct {
+	Message []byte            // The message to hash and sign.
+	Opts    crypto.SignerOpts // Options for signing, such as Hash identifier.
+}
+
+// EncryptArgs contains arguments to an Encrypt method.
+type EncryptArgs struct {
+	Plaintext []byte
+}
+
+// DecryptArgs contains arguments to a crypto Decrypter.Decrypt method.
+type DecryptArgs struct {
+	Ciphertext []byte
+	Opts       crypto.DecrypterOpts // nil selects RSA-OAEP with SHA-256.
+}
+
 // A EnterpriseCertSigner exports RPC methods for signing.
 type EnterpriseCertSigner struct {
 	key *pkcs11.Key
@@ -78,6 +99,17 @@ func (c *Connection) Close() error {
 	return werr
 }
 
+// Handshake reports the signer API version and what this signer supports.
+func (k *EnterpriseCertSigner) Handshake(args transport.HandshakeArgs, caps *transport.Capabilities) error {
+	*caps = transport.Capabilities{
+		Version:     transport.APIVersion,
+		Decrypt:     true,
+		SignMessage: true,
+		Hashes:      []crypto.Hash{crypto.SHA1, crypto.SHA224, crypto.SHA256, crypto.SHA384, crypto.SHA512},
+	}
+	return nil
+}
+
 // CertificateChain returns the credential as a raw X509 cert chain. This
 // contains the public key.
 func (k *EnterpriseCertSigner) CertificateChain(ignored struct{}, certificateChain *[][]byte) (err error) {
@@ -97,20 +129,71 @@ func (k *EnterpriseCertSigner) Sign(args SignArgs, resp *[]byte) (err error) {
 	return
 }
 
+// SignMessage hashes and signs a message, on the token when it supports a
+// mechanism doing both.
+func (k *EnterpriseCertSigner) SignMessage(args SignMessageArgs, resp *[]byte) (err error) {
+	*resp, err = k.key.SignMessage(args.Message, args.Opts)
+	return
+}
+
+// Encrypt encrypts a plaintext with RSA-OAEP and SHA-256, or with ECIES for
+// an EC key.
+func (k *EnterpriseCertSigner) Encrypt(args EncryptArgs, ciphertext *[]byte) (err error) {
+	*ciphertext, err = k.key.Encrypt(args.Plaintext, nil)
+	return
+}
+
+// Decrypt decrypts a ciphertext with the padding scheme args.Opts selects.
+func (k *EnterpriseCertSigner) Decrypt(args DecryptArgs, plaintext *[]byte) (err error) {
+	*plaintext, err = k.key.Decrypt(nil, args.Ciphertext, args.Opts)
+	return
+}
+
+// Diagnostics returns a JSON report describing the token holding the
+// credential.
+func (k *EnterpriseCertSigner) Diagnostics(ignored struct{}, report *[]byte) (err error) {
+	d, err := k.key.Diagnostics()
+	if err != nil {
+		return err
+	}
+	*report, err = json.Marshal(d)
+	return
+}
+
 func main() {
-	enableECPLogging()
-	if len(os.Args) != 2 {
+	logging := enableECPLogging()
+	// The signer is invoked as `ecp <config>` by a client, which talks to it
+	// over stdin/stdout, or as `ecp <config> -socket <path>` to serve every
+	// client of the current user on a Unix domain socket. Either may add
+	// `-profile <name>` to use a named credential of the config.
+	args, err := util.ParseArgs(os.Args[1:], "-socket")
+	if err != nil {
 		log.Fatalln("Signer is not meant to be invoked manually, exiting...")
 	}
-	configFilePath := os.Args[1]
-	config, err := util.LoadConfig(configFilePath)
+	config, err := util.LoadConfigProfile(args.ConfigFilePath, args.Profile)
 	if err != nil {
 		log.Fatalf("Failed to load enterprise cert config: %v", err)
 	}
+	if err := util.ApplyResourceLimits(config.ResourceLimits); err != nil {
+		log.Fatalf("Failed to apply signer resource limits: %v", err)
+	}
+
+	opts, err := pkcs11.ConfigOptions(config.CertConfigs.PKCS11)
+	if err != nil {
+		log.Fatalf("Failed to configure the PKCS #11 credential: %v", err)
+	}
 
 	enterpriseCertSigner := new(EnterpriseCertSigner)
-	enterpriseCertSigner.key, err = pkcs11.Cred(config.CertConfigs.PKCS11.PKCS11Module, config.CertConfigs.PKCS11.Slot, config.CertConfigs.PKCS11.Label, config.CertConfigs.PKCS11.UserPin)
+	enterpriseCertSigner.key, err = pkcs11.CredWithOptions(opts)
 	if err != nil {
+		if logging {
+			// Describe what the modules do hold, for debug bundles.
+			if diagnostics, derr := pkcs11.Diagnose(opts); derr == nil {
+				if report, derr := json.Marshal(diagnostics); derr == nil {
+					log.Printf("PKCS #11 tokens: %s", report)
+				}
+			}
+		}
 		log.Fatalf("Failed to initialize enterprise cert signer using pkcs11: %v", err)
 	}
 
@@ -118,6 +201,14 @@ func main() {
 		log.Fatalf("Failed to register enterprise cert signer with net/rpc: %v", err)
 	}
 
+	if args.Listen != "" {
+		// A shared signer outlives the process that started it.
+		if err := transport.ServeUnix(rpc.DefaultServer, args.Listen); err != nil {
+			log.Fatalf("Failed to serve on Unix domain socket: %v", err)
+		}
+		return
+	}
+
 	// If the parent process dies, we should exit.
 	// We can detect this by periodically checking if the PID of the parent
 	// process is 1 (https://stackoverflow.com/a/2035683).
@@ -130,5 +221,5 @@ func main() {
 		}
 	}()
 
-	rpc.ServeConn(&Connection{os.Stdin, os.Stdout})
+	transport.Serve(rpc.DefaultServer, &Connection{os.Stdin, os.Stdout})
 }
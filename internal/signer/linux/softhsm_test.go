@@ -0,0 +1,67 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build softhsm
+
+// The tests in this file provision identities into a SoftHSM2 token and use
+// them through the client and the real signer binary. Run them with
+//
+//	go test -tags=softhsm .
+//
+// with softhsm2-util in PATH. SOFTHSM2_MODULE overrides the path of
+// libsofthsm2.so.
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+}
+
+// newSoftHSM initializes an empty token in a temporary SoftHSM2 store.
+func newSoftHSM(t *testing.T) *testToken {
+	t.Helper()
+	module := findModule(t, "SOFTHSM2_MODULE", softHSMModules)
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := os.WriteFile(conf, []byte("directories.tokendir = "+tokens+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The signer inherits the environment, and so the store.
+	t.Setenv("SOFTHSM2_CONF", conf)
+	cmd := exec.Command("softhsm2-util", "--init-token", "--free", "--label", "ecp-test", "--pin", "1234", "--so-pin", "123456")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("softhsm2-util --init-token: %v: %s", err, out)
+	}
+	return newTestToken(t, module, "ecp-test", "1234", dir)
+}
+
+func TestSoftHSM(t *testing.T) {
+	h := newSoftHSM(t)
+	rsaCert := h.provision(t, "rsa", 1, "RSA")
+	ecCert := h.provision(t, "ec", 2, "ECDSA")
+	t.Run("RSA", func(t *testing.T) { h.testRSA(t, "rsa", rsaCert) })
+	t.Run("ECDSA", func(t *testing.T) { h.testECDSA(t, "ec", ecCert) })
+}
@@ -0,0 +1,295 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build softhsm || tpm2
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/googleapis/enterprise-certificate-proxy/client"
+	"github.com/googleapis/enterprise-certificate-proxy/linux"
+)
+
+// testToken is an initialized PKCS #11 token for integration tests, with a
+// signer binary built to use it and a CA issuing the test identities.
+type testToken struct {
+	module string
+	token  string // The token label.
+	pin    string
+	signer string
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+}
+
+// findModule returns the module path in the environment variable env, or
+// else the first of paths that exists.
+func findModule(t *testing.T, env string, paths []string) string {
+	t.Helper()
+	if module := os.Getenv(env); module != "" {
+		return module
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	t.Fatalf("%s not found; set %s", filepath.Base(paths[0]), env)
+	return ""
+}
+
+// newTestToken builds the signer and creates the test CA for the token
+// with the given label in module, which must already be initialized.
+func newTestToken(t *testing.T, module, token, pin, dir string) *testToken {
+	t.Helper()
+	signer := filepath.Join(dir, "ecp")
+	if out, err := exec.Command("go", "build", "-o", signer, ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v: %s", err, out)
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ECP Test CA", Organization: []string{"ECP"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testToken{module: module, token: token, pin: pin, signer: signer, dir: dir, ca: ca, caKey: caKey}
+}
+
+// provision generates a key pair on the token and stores a certificate for
+// it issued by the test CA, returning the certificate.
+func (h *testToken) provision(t *testing.T, label string, id byte, algorithm string) *x509.Certificate {
+	t.Helper()
+	key, err := linux.GenerateKey(linux.KeyGenOptions{
+		Module:    h.module,
+		Token:     h.token,
+		PIN:       h.pin,
+		Label:     label,
+		ID:        []byte{id},
+		Algorithm: algorithm,
+	})
+	if err != nil {
+		t.Fatalf("GenerateKey(%s): %v", label, err)
+	}
+	defer key.Close()
+	csrDER, err := key.CertificateRequest(&x509.CertificateRequest{Subject: pkix.Name{CommonName: label}})
+	if err != nil {
+		t.Fatalf("CertificateRequest(%s): %v", label, err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Fatalf("CertificateRequest(%s): %v", label, err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(id) + 1),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, h.ca, csr.PublicKey, h.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.StoreCertificate(der); err != nil {
+		t.Fatalf("StoreCertificate(%s): %v", label, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// config writes a config selecting the identity with the given label,
+// logging in with pin, and with the test CA in the chain file. It returns
+// the config's path.
+func (h *testToken) config(t *testing.T, label, pin string) string {
+	t.Helper()
+	chainFile := filepath.Join(h.dir, "ca.pem")
+	if err := os.WriteFile(chainFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: h.ca.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := map[string]interface{}{
+		"cert_configs": map[string]interface{}{
+			"pkcs11": map[string]interface{}{
+				"module":      h.module,
+				"token_label": h.token,
+				"label":       label,
+				"user_pin":    pin,
+				"chain_file":  chainFile,
+			},
+		},
+		"libs": map[string]interface{}{"ecp": h.signer},
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(h.dir, label+".json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// cred starts the signer for the identity with the given label through the
+// client.
+func (h *testToken) cred(t *testing.T, label string) *client.Key {
+	t.Helper()
+	key, err := client.Cred(h.config(t, label, h.pin))
+	if err != nil {
+		t.Fatalf("Cred(%s): %v", label, err)
+	}
+	t.Cleanup(func() { key.Close() })
+	return key
+}
+
+// checkChain checks that key's chain is cert followed by the test CA.
+func (h *testToken) checkChain(t *testing.T, key *client.Key, cert *x509.Certificate) {
+	t.Helper()
+	chain := key.CertificateChain()
+	if len(chain) != 2 || !bytes.Equal(chain[0], cert.Raw) || !bytes.Equal(chain[1], h.ca.Raw) {
+		t.Errorf("CertificateChain: got %d certificates, want the leaf and the test CA", len(chain))
+	}
+}
+
+var testDigest = sha256.Sum256([]byte("message"))
+
+// testRSA exercises the RSA identity with the given label and certificate.
+func (h *testToken) testRSA(t *testing.T, label string, cert *x509.Certificate) {
+	key := h.cred(t, label)
+	h.checkChain(t, key, cert)
+	pub, ok := key.Public().(*rsa.PublicKey)
+	if !ok || !pub.Equal(cert.PublicKey) {
+		t.Fatalf("Public: got %T, want the certificate's RSA key", key.Public())
+	}
+
+	sig, err := key.Sign(nil, testDigest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, testDigest[:], sig); err != nil {
+		t.Errorf("Sign: %v", err)
+	}
+
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	sig, err = key.Sign(nil, testDigest[:], pss)
+	if err != nil {
+		t.Fatalf("Sign with PSS: %v", err)
+	}
+	if err := rsa.VerifyPSS(pub, crypto.SHA256, testDigest[:], sig, pss); err != nil {
+		t.Errorf("Sign with PSS: %v", err)
+	}
+
+	sig, err = key.SignMessage([]byte("message"), crypto.SHA256)
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, testDigest[:], sig); err != nil {
+		t.Errorf("SignMessage: %v", err)
+	}
+
+	plaintext := []byte("Plain text to encrypt")
+	ciphertext, err := key.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	decrypted, err := key.Decrypt(nil, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Decrypt: got %q, want %q", decrypted, plaintext)
+	}
+}
+
+// testECDSA exercises the ECDSA identity with the given label and
+// certificate.
+func (h *testToken) testECDSA(t *testing.T, label string, cert *x509.Certificate) {
+	key := h.cred(t, label)
+	h.checkChain(t, key, cert)
+	pub, ok := key.Public().(*ecdsa.PublicKey)
+	if !ok || !pub.Equal(cert.PublicKey) {
+		t.Fatalf("Public: got %T, want the certificate's ECDSA key", key.Public())
+	}
+
+	sig, err := key.Sign(nil, testDigest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if !ecdsa.VerifyASN1(pub, testDigest[:], sig) {
+		t.Error("Sign: signature does not verify")
+	}
+
+	sig, err = key.SignMessage([]byte("message"), crypto.SHA256)
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	if !ecdsa.VerifyASN1(pub, testDigest[:], sig) {
+		t.Error("SignMessage: signature does not verify")
+	}
+
+	plaintext := []byte("Plain text to encrypt")
+	ciphertext, err := key.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	decrypted, err := key.Decrypt(nil, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Decrypt: got %q, want %q", decrypted, plaintext)
+	}
+	if _, err := key.Decrypt(nil, ciphertext, &rsa.OAEPOptions{Hash: crypto.SHA256}); err == nil {
+		t.Error("Decrypt with an ECDSA key and OAEP options: got nil err, want error")
+	}
+}
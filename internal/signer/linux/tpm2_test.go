@@ -0,0 +1,100 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build tpm2
+
+// The tests in this file provision identities into a tpm2-pkcs11 token
+// backed by a TPM simulator and use them through the client and the real
+// signer binary. Start a simulator, for example with
+//
+//	swtpm socket --tpm2 --tpmstate dir=/tmp/swtpm --server type=tcp,port=2321 --ctrl type=tcp,port=2322 --flags not-need-init,startup-clear
+//
+// and run them with
+//
+//	TPM2_PKCS11_TCTI=swtpm:port=2321 go test -tags=tpm2 .
+//
+// with tpm2_ptool in PATH. TPM2_PKCS11_MODULE overrides the path of
+// libtpm2_pkcs11.so.
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/linux/pkcs11"
+)
+
+var tpm2Modules = []string{
+	"/usr/lib/x86_64-linux-gnu/pkcs11/libtpm2_pkcs11.so",
+	"/usr/lib/pkcs11/libtpm2_pkcs11.so",
+	"/usr/lib64/pkcs11/libtpm2_pkcs11.so",
+	"/usr/local/lib/libtpm2_pkcs11.so",
+}
+
+// newTPM2 creates a token in a temporary tpm2-pkcs11 store on the TPM named
+// by TPM2_PKCS11_TCTI.
+func newTPM2(t *testing.T) *testToken {
+	t.Helper()
+	if os.Getenv("TPM2_PKCS11_TCTI") == "" {
+		t.Fatal("TPM2_PKCS11_TCTI is not set; point it at a TPM simulator")
+	}
+	module := findModule(t, "TPM2_PKCS11_MODULE", tpm2Modules)
+	dir := t.TempDir()
+	// The signer inherits the environment, and so the store.
+	t.Setenv("TPM2_PKCS11_STORE", dir)
+	for _, args := range [][]string{
+		{"init", "--path", dir},
+		{"addtoken", "--pid", "1", "--label", "ecp-test", "--userpin", "1234", "--sopin", "123456", "--path", dir},
+	} {
+		if out, err := exec.Command("tpm2_ptool", args...).CombinedOutput(); err != nil {
+			t.Fatalf("tpm2_ptool %s: %v: %s", args[0], err, out)
+		}
+	}
+	return newTestToken(t, module, "ecp-test", "1234", dir)
+}
+
+func TestTPM2(t *testing.T) {
+	h := newTPM2(t)
+	rsaCert := h.provision(t, "rsa", 1, "RSA")
+	ecCert := h.provision(t, "ec", 2, "ECDSA")
+	t.Run("RSA", func(t *testing.T) { h.testRSA(t, "rsa", rsaCert) })
+	t.Run("ECDSA", func(t *testing.T) { h.testECDSA(t, "ec", ecCert) })
+
+	t.Run("PSSSaltLength", func(t *testing.T) {
+		key := h.cred(t, "rsa")
+		pub := key.Public().(*rsa.PublicKey)
+		auto := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}
+		sig, err := key.Sign(nil, testDigest[:], auto)
+		if err != nil {
+			t.Fatalf("Sign with an automatic salt length: %v", err)
+		}
+		equalsHash := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+		if err := rsa.VerifyPSS(pub, crypto.SHA256, testDigest[:], sig, equalsHash); err != nil {
+			t.Errorf("Sign with an automatic salt length: %v", err)
+		}
+		if _, err := key.Sign(nil, testDigest[:], &rsa.PSSOptions{SaltLength: 20, Hash: crypto.SHA256}); err == nil {
+			t.Error("Sign with a 20 byte salt: got nil err, want error")
+		}
+	})
+
+	t.Run("NoPIN", func(t *testing.T) {
+		_, err := pkcs11.CredWithOptions(pkcs11.Options{Module: h.module, Token: h.token, Label: "rsa"})
+		if err == nil || !strings.Contains(err.Error(), "PIN") {
+			t.Errorf("CredWithOptions without a PIN: got %v, want an error asking for the PIN", err)
+		}
+	})
+}
@@ -11,21 +11,38 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// signer.go is a net/rpc server that listens on stdin/stdout, exposing
+// signer.go is a signer that listens on stdin/stdout, exposing
 // mock methods for testing client.go.
 package main
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/gob"
+	"fmt"
 	"io"
 	"log"
 	"net/rpc"
 	"os"
+	"runtime"
 	"time"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/ecies"
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+	"github.com/googleapis/enterprise-certificate-proxy/internal/transport"
 )
 
+func init() {
+	gob.Register(crypto.SHA256)
+	gob.Register(&rsa.OAEPOptions{})
+	gob.Register(&rsa.PKCS1v15DecryptOptions{})
+}
+
 // SignArgs encapsulate the parameters for the Sign method.
 type SignArgs struct {
 	Digest []byte
@@ -38,11 +55,13 @@ type EncryptArgs struct {
 
 type DecryptArgs struct {
 	Ciphertext []byte
+	Opts       crypto.DecrypterOpts
 }
 
 // EnterpriseCertSigner exports RPC methods for signing.
 type EnterpriseCertSigner struct {
-	cert *tls.Certificate
+	cert    *tls.Certificate
+	profile string // The -profile argument, if any.
 }
 
 // Connection wraps a pair of unidirectional streams as an io.ReadWriteCloser.
@@ -61,6 +80,16 @@ func (c *Connection) Close() error {
 	return werr
 }
 
+// Handshake reports the signer API version and what this signer supports.
+func (k *EnterpriseCertSigner) Handshake(args transport.HandshakeArgs, caps *transport.Capabilities) error {
+	*caps = transport.Capabilities{
+		Version: transport.APIVersion,
+		Decrypt: true,
+		Hashes:  []crypto.Hash{crypto.SHA256},
+	}
+	return nil
+}
+
 // CertificateChain returns the credential as a raw X509 cert chain. This
 // contains the public key.
 func (k *EnterpriseCertSigner) CertificateChain(ignored struct{}, certificateChain *[][]byte) error {
@@ -87,20 +116,62 @@ func (k *EnterpriseCertSigner) Sign(args SignArgs, resp *[]byte) (err error) {
 	return nil
 }
 
-func (k *EnterpriseCertSigner) Encrypt(args EncryptArgs, plaintext *[]byte) (err error) {
-	*plaintext = args.Plaintext
-	return nil
+// Encrypt encrypts a plaintext with the certificate's key, using RSA-OAEP and
+// SHA-256 or ECIES like the platform signers.
+func (k *EnterpriseCertSigner) Encrypt(args EncryptArgs, ciphertext *[]byte) (err error) {
+	switch priv := k.cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		*ciphertext, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, &priv.PublicKey, args.Plaintext, nil)
+	case *ecdsa.PrivateKey:
+		*ciphertext, err = ecies.Encrypt(rand.Reader, &priv.PublicKey, args.Plaintext)
+	default:
+		err = fmt.Errorf("unsupported key type %T", priv)
+	}
+	return
+}
+
+// Decrypt decrypts a ciphertext with the certificate's key. args.Opts selects
+// the RSA padding scheme, and nil selects RSA-OAEP with SHA-256.
+func (k *EnterpriseCertSigner) Decrypt(args DecryptArgs, plaintext *[]byte) (err error) {
+	switch priv := k.cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		opts := args.Opts
+		if opts == nil {
+			opts = &rsa.OAEPOptions{Hash: crypto.SHA256}
+		}
+		*plaintext, err = priv.Decrypt(rand.Reader, args.Ciphertext, opts)
+	case *ecdsa.PrivateKey:
+		*plaintext, err = ecies.Decrypt(&priv.PublicKey, args.Ciphertext, func(peer *ecdsa.PublicKey) ([]byte, error) {
+			return ecies.SharedSecret(priv, peer)
+		})
+	default:
+		err = fmt.Errorf("unsupported key type %T", priv)
+	}
+	return
 }
 
-func (k *EnterpriseCertSigner) Decrypt(args DecryptArgs, ciphertext *[]byte) (err error) {
-	*ciphertext = args.Ciphertext
+// Diagnostics returns a fixed JSON report, naming the profile the signer was
+// invoked with, if any.
+func (k *EnterpriseCertSigner) Diagnostics(ignored struct{}, report *[]byte) (err error) {
+	if k.profile != "" {
+		*report = []byte(fmt.Sprintf(`{"label":"test","profile":%q}`, k.profile))
+		return nil
+	}
+	*report = []byte(`{"label":"test"}`)
 	return nil
 }
 
 func main() {
 	enterpriseCertSigner := new(EnterpriseCertSigner)
 
-	data, err := os.ReadFile(os.Args[1])
+	// The test signer is given a certificate in place of the config.
+	args, err := util.ParseArgs(os.Args[1:], "")
+	if err != nil {
+		log.Fatalf("Error parsing arguments: %v", err)
+	}
+	enterpriseCertSigner.profile = args.Profile
+
+	data, err := os.ReadFile(args.ConfigFilePath)
 	if err != nil {
 		log.Fatalf("Error reading certificate: %v", err)
 	}
@@ -114,15 +185,19 @@ func main() {
 
 	// If the parent process dies, we should exit.
 	// We can detect this by periodically checking if the PID of the parent
-	// process is 1 (https://stackoverflow.com/a/2035683).
-	go func() {
-		for {
-			if os.Getppid() == 1 {
-				log.Fatalln("Parent process died, exiting...")
+	// process is 1 (https://stackoverflow.com/a/2035683). Orphans are not
+	// reparented on Windows, where the client kills the signer through a job
+	// object instead.
+	if runtime.GOOS != "windows" {
+		go func() {
+			for {
+				if os.Getppid() == 1 {
+					log.Fatalln("Parent process died, exiting...")
+				}
+				time.Sleep(time.Second)
 			}
-			time.Sleep(time.Second)
-		}
-	}()
+		}()
+	}
 
-	rpc.ServeConn(&Connection{os.Stdin, os.Stdout})
+	transport.Serve(rpc.DefaultServer, &Connection{os.Stdin, os.Stdout})
 }
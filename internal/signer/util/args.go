@@ -0,0 +1,54 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import "errors"
+
+// Args are the command line arguments with which the signer is invoked:
+// `ecp <config> [-profile <name>] [<listen flag> <address>]`.
+type Args struct {
+	ConfigFilePath string // The config file, or the certificate for the test signer.
+	Profile        string // The credential profile in the config, or empty for the top-level one.
+	// Listen is the address given with the listen flag, such as the Unix
+	// domain socket of a shared signer, or empty to serve the client on
+	// stdin/stdout.
+	Listen string
+}
+
+// errManualInvocation is returned for arguments that no client passes.
+var errManualInvocation = errors.New("signer is not meant to be invoked manually")
+
+// ParseArgs parses the signer's command line arguments, excluding the program
+// name. listenFlag names the flag for a shared signer's address, such as
+// "-socket" or "-pipe", or is empty if the signer cannot be shared.
+func ParseArgs(args []string, listenFlag string) (Args, error) {
+	if len(args) == 0 || args[0] == "" {
+		return Args{}, errManualInvocation
+	}
+	parsed := Args{ConfigFilePath: args[0]}
+	for rest := args[1:]; len(rest) > 0; rest = rest[2:] {
+		if len(rest) < 2 || rest[1] == "" {
+			return Args{}, errManualInvocation
+		}
+		switch {
+		case rest[0] == "-profile" && parsed.Profile == "":
+			parsed.Profile = rest[1]
+		case rest[0] == listenFlag && listenFlag != "" && parsed.Listen == "":
+			parsed.Listen = rest[1]
+		default:
+			return Args{}, errManualInvocation
+		}
+	}
+	return parsed, nil
+}
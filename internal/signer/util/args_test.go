@@ -0,0 +1,55 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want Args
+	}{
+		{[]string{"config.json"}, Args{ConfigFilePath: "config.json"}},
+		{[]string{"config.json", "-socket", "ecp.sock"}, Args{ConfigFilePath: "config.json", Listen: "ecp.sock"}},
+		{[]string{"config.json", "-profile", "backend"}, Args{ConfigFilePath: "config.json", Profile: "backend"}},
+		{[]string{"config.json", "-profile", "backend", "-socket", "ecp.sock"}, Args{ConfigFilePath: "config.json", Profile: "backend", Listen: "ecp.sock"}},
+	} {
+		got, err := ParseArgs(tc.args, "-socket")
+		if err != nil {
+			t.Errorf("ParseArgs(%q) error: %q", tc.args, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseArgs(%q): expected %+v, got: %+v", tc.args, tc.want, got)
+		}
+	}
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{""},
+		{"config.json", "-socket"},
+		{"config.json", "-socket", ""},
+		{"config.json", "-pipe", "ecp"},
+		{"config.json", "-profile", "a", "-profile", "b"},
+		{"config.json", "extra"},
+	} {
+		if _, err := ParseArgs(args, "-socket"); err == nil {
+			t.Errorf("ParseArgs(%q): expected an error", args)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package util
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// ApplyResourceLimits applies the configured limits to the current process
+// using setrlimit(2) and setpriority(2).
+func ApplyResourceLimits(limits ResourceLimits) error {
+	if limits.MaxMemoryBytes != 0 {
+		if err := setRlimit(unix.RLIMIT_AS, limits.MaxMemoryBytes); err != nil {
+			return fmt.Errorf("setting memory limit: %w", err)
+		}
+	}
+	if limits.MaxOpenFiles != 0 {
+		if err := setRlimit(unix.RLIMIT_NOFILE, limits.MaxOpenFiles); err != nil {
+			return fmt.Errorf("setting open file limit: %w", err)
+		}
+	}
+	if limits.Nice != 0 {
+		if limits.Nice < 0 || limits.Nice > 19 {
+			return fmt.Errorf("nice must be in the range [1, 19], got %d", limits.Nice)
+		}
+		if err := setNice(limits.Nice); err != nil {
+			return fmt.Errorf("setting nice value: %w", err)
+		}
+	}
+	return nil
+}
+
+// setRlimit lowers both the soft and hard limit of resource to max. Limits
+// are never raised above the current hard limit.
+func setRlimit(resource int, max uint64) error {
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(resource, &rlim); err != nil {
+		return err
+	}
+	if uint64(rlim.Max) < max {
+		max = uint64(rlim.Max)
+	}
+	rlim.Cur = max
+	rlim.Max = max
+	return unix.Setrlimit(resource, &rlim)
+}
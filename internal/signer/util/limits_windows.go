@@ -0,0 +1,77 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// ApplyResourceLimits applies the configured limits to the current process.
+// The memory limit is enforced by assigning the process to a job object.
+func ApplyResourceLimits(limits ResourceLimits) error {
+	if limits.MaxOpenFiles != 0 {
+		return errors.New("max_open_files is not supported on Windows")
+	}
+	if limits.MaxMemoryBytes != 0 {
+		if err := limitJobMemory(uintptr(limits.MaxMemoryBytes)); err != nil {
+			return fmt.Errorf("setting memory limit: %w", err)
+		}
+	}
+	if limits.Nice != 0 {
+		if limits.Nice < 0 || limits.Nice > 19 {
+			return fmt.Errorf("nice must be in the range [1, 19], got %d", limits.Nice)
+		}
+		class := uint32(windows.BELOW_NORMAL_PRIORITY_CLASS)
+		if limits.Nice >= 10 {
+			class = windows.IDLE_PRIORITY_CLASS
+		}
+		if err := windows.SetPriorityClass(windows.CurrentProcess(), class); err != nil {
+			return fmt.Errorf("setting priority class: %w", err)
+		}
+	}
+	return nil
+}
+
+// limitJobMemory creates an anonymous job object with a per-process memory
+// limit and assigns the current process to it. The job handle is intentionally
+// kept open for the lifetime of the process.
+func limitJobMemory(max uintptr) error {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return err
+	}
+	var info windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_PROCESS_MEMORY
+	info.ProcessMemoryLimit = max
+	if _, err := windows.SetInformationJobObject(
+		job,
+		windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)),
+		uint32(unsafe.Sizeof(info))); err != nil {
+		windows.CloseHandle(job)
+		return err
+	}
+	if err := windows.AssignProcessToJobObject(job, windows.CurrentProcess()); err != nil {
+		windows.CloseHandle(job)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"errors"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// setNice sets the niceness of every thread of the process. On Linux,
+// setpriority(2) with PRIO_PROCESS changes a single thread, and the Go runtime
+// has started several by the time the signer applies its limits. New threads
+// inherit the niceness of the thread that creates them, so passes over
+// /proc/self/task repeat until one finds no thread left to renice.
+func setNice(nice int) error {
+	reniced := make(map[int]bool)
+	for {
+		tasks, err := os.ReadDir("/proc/self/task")
+		if err != nil {
+			return err
+		}
+		changed := false
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(task.Name())
+			if err != nil || reniced[tid] {
+				continue
+			}
+			// ESRCH means the thread has exited since the directory was read.
+			if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil && !errors.Is(err, unix.ESRCH) {
+				return err
+			}
+			reniced[tid] = true
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+	}
+}
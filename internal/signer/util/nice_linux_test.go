@@ -0,0 +1,58 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// niceTestEnv makes TestSetNice renice its own process, which cannot be undone
+// without privileges, so the test runs that part in a child process.
+const niceTestEnv = "ECP_TEST_SET_NICE"
+
+func TestSetNice(t *testing.T) {
+	if os.Getenv(niceTestEnv) == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSetNice$")
+		cmd.Env = append(os.Environ(), niceTestEnv+"=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("TestSetNice in child process: %v\n%s", err, out)
+		}
+		return
+	}
+
+	if err := setNice(19); err != nil {
+		t.Fatalf("setNice: got %v, want nil err", err)
+	}
+	stats, err := filepath.Glob("/proc/self/task/*/stat")
+	if err != nil || len(stats) < 2 {
+		t.Fatalf("Glob: got %d threads (err %v), want several", len(stats), err)
+	}
+	for _, stat := range stats {
+		data, err := os.ReadFile(stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The nice value is the 19th field, the 17th after the parenthesized
+		// command name.
+		fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+		if got, err := strconv.Atoi(fields[16]); err != nil || got != 19 {
+			t.Errorf("%s: got nice %s, want 19", stat, fields[16])
+		}
+	}
+}
@@ -16,12 +16,23 @@ package util
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 )
 
 // EnterpriseCertificateConfig contains parameters for initializing signer.
 type EnterpriseCertificateConfig struct {
+	CertConfigs    CertConfigs    `json:"cert_configs"`
+	ResourceLimits ResourceLimits `json:"resource_limits"`
+	// Profiles holds named credentials in addition to CertConfigs, for
+	// programs that talk to several backends. The signer's -profile argument
+	// selects one.
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+// Profile is a named credential in the config.
+type Profile struct {
 	CertConfigs CertConfigs `json:"cert_configs"`
 }
 
@@ -34,14 +45,61 @@ type CertConfigs struct {
 
 // MacOSKeychain contains keychain parameters describing the certificate to use.
 type MacOSKeychain struct {
-	Issuer string `json:"issuer"`
+	Issuer       string   `json:"issuer"`
+	Issuers      []string `json:"issuers"`       // Optional additional issuer common names, in decreasing order of preference after Issuer.
+	IssuerGlob   string   `json:"issuer_glob"`   // Optional issuer common name glob pattern, such as "Corp Issuing CA *".
+	IssuerRegexp string   `json:"issuer_regexp"` // Optional issuer common name regular expression.
+	Subject      string   `json:"subject"`       // Optional common name of the subject of the leaf certificate.
+	Fingerprint  string   `json:"fingerprint"`   // Optional hex-encoded SHA-256 fingerprint of the leaf certificate.
+	Serial       string   `json:"serial"`        // Optional hex-encoded serial number of the leaf certificate.
+	SANDNSName   string   `json:"san_dns_name"`  // Optional DNS name Subject Alternative Name of the leaf certificate.
+	SANEmail     string   `json:"san_email"`     // Optional email Subject Alternative Name of the leaf certificate.
+	SANURI       string   `json:"san_uri"`       // Optional URI Subject Alternative Name of the leaf certificate.
+	SANUPN       string   `json:"san_upn"`       // Optional User Principal Name Subject Alternative Name of the leaf certificate.
+
+	PreferredIdentity string `json:"preferred_identity"` // Optional name of a keychain identity preference, usually a hostname or URL, selected before other identities.
+
+	RequireClientAuth bool   `json:"require_client_auth"` // Only consider leaf certificates with the TLS client authentication EKU.
+	SelectionPolicy   string `json:"selection_policy"`    // Optional tie-breaker when several identities match: "latest_not_after", "latest_not_before", "largest_key" or "hardware_backed".
+	Keychain          string `json:"keychain"`            // Optional keychain to search instead of the default search list: "login", "system" or an absolute path.
+	AccessGroup       string `json:"access_group"`        // Optional keychain access group of the data protection keychain to search instead.
+
+	AuthReuseSeconds   int    `json:"auth_reuse_seconds"`   // Optional seconds for which a Touch ID unlock also authorizes the key, at most 300.
+	AuthTimeoutSeconds int    `json:"auth_timeout_seconds"` // Optional seconds to wait for a Touch ID prompt before failing.
+	AuthPrompt         string `json:"auth_prompt"`          // Optional reason shown in the Touch ID prompt.
+	NonInteractive     bool   `json:"non_interactive"`      // Fail instead of showing keychain or Touch ID prompts.
+
+	AllowLegacyHashes  bool `json:"allow_legacy_hashes"` // Allow SHA-1 ECDSA and RSA PKCS #1 v1.5 signatures.
+	FetchIntermediates bool `json:"fetch_intermediates"` // Download issuing certificates missing from the keychain.
+	ExcludeRoot        bool `json:"exclude_root"`        // Omit the self-signed root from the certificate chain.
 }
 
 // WindowsStore contains Windows key store parameters describing the certificate to use.
 type WindowsStore struct {
-	Issuer   string `json:"issuer"`
-	Store    string `json:"store"`
-	Provider string `json:"provider"`
+	Issuer string `json:"issuer"`
+	// Optional additional issuer names, in decreasing order of preference after Issuer.
+	Issuers  []string `json:"issuers"`
+	Store    string   `json:"store"`    // The system store name (ex: MY). Defaults to MY.
+	Provider string   `json:"provider"` // The store location (ex: current_user, local_machine). Defaults to current_user.
+	// Optional hex-encoded SHA-1 or SHA-256 thumbprint of the certificate. It
+	// may be given instead of, or in addition to, the issuer.
+	Thumbprint string `json:"thumbprint"`
+	Template   string `json:"template"` // Optional ADCS certificate template OID or name (ex: Workstation Authentication).
+	// Optional extended key usage OIDs of which the certificate must carry one.
+	// Defaults to TLS client authentication (1.3.6.1.5.5.7.3.2).
+	ExtKeyUsages      []string `json:"ext_key_usages"`
+	Silent            bool     `json:"silent"`              // Fail instead of showing PIN or smart card dialogs.
+	ExcludeRoot       bool     `json:"exclude_root"`        // Omit the self-signed root from the certificate chain.
+	AllowLegacyHashes bool     `json:"allow_legacy_hashes"` // Permit SHA-1 signatures for legacy TLS-inspection appliances.
+	// Optional name of the key storage provider through which to open the key
+	// (ex: Microsoft Smart Card Key Storage Provider).
+	KeyProvider string `json:"key_provider"`
+	// Optional smart card PIN. If it is empty, the PIN is read from the
+	// ENTERPRISE_CERTIFICATE_SMART_CARD_PIN environment variable, if set.
+	PIN string `json:"pin"`
+	// Let the user choose between several matching certificates in a dialog.
+	// The choice is remembered until the certificate stops matching.
+	PickCertificate bool `json:"pick_certificate"`
 }
 
 // PKCS11 contains PKCS#11 parameters describing the certificate to use.
@@ -50,6 +108,56 @@ type PKCS11 struct {
 	Label        string `json:"label"`    // The token label (ex: gecc)
 	PKCS11Module string `json:"module"`   // The path to the pkcs11 module (shared lib)
 	UserPin      string `json:"user_pin"` // Optional user pin to unlock the PKCS #11 module. If it is not defined or empty C_Login will not be called.
+	// Optional alternatives to UserPin, so that the PIN need not be written
+	// into the config. At most one of UserPin, PinEnv, PinFile, PinCommand
+	// and PinSecretService may be set.
+	PinEnv     string   `json:"pin_env"`     // Name of an environment variable holding the PIN.
+	PinFile    string   `json:"pin_file"`    // Path of a file holding the PIN.
+	PinCommand []string `json:"pin_command"` // Program and arguments that print the PIN, run without a shell.
+	// Attributes of the item holding the PIN in the user's keyring, looked up
+	// through the freedesktop Secret Service.
+	PinSecretService map[string]string `json:"pin_secret_service"`
+	// Optional alternatives to Slot selecting the slot by the token in it,
+	// since slot IDs can change across reboots and readers. They take
+	// precedence over Slot.
+	TokenLabel  string `json:"token_label"`  // The token label.
+	TokenSerial string `json:"token_serial"` // The token serial number.
+	// Optional hexadecimal CKA_ID of the certificate and private key, for
+	// tokens holding several identities with the same label.
+	KeyID string `json:"key_id"`
+	// Optional PEM bundle of intermediate certificates for the chain, in
+	// addition to those stored on the token.
+	ChainFile   string `json:"chain_file"`
+	ExcludeRoot bool   `json:"exclude_root"` // Omit the self-signed root from the certificate chain.
+	// Optional further module paths tried in order when Module is empty or
+	// holds no matching credential.
+	Modules []string `json:"modules"`
+	// Optional RFC 7512 pkcs11: URI selecting the credential. Its attributes
+	// take precedence over the fields above.
+	URI string `json:"uri"`
+	// Optional NSS certificate database directory, or "auto" to find the one
+	// of the user's Chrome or Firefox profile, read through the NSS softoken
+	// module. UserPin and its alternatives give the database password.
+	NSSDB string `json:"nss_db"`
+	// Optional limit on the operations running on the token at once, and so
+	// on its open sessions, for tokens that fail under parallel sessions.
+	MaxConcurrentOperations int `json:"max_concurrent_operations"`
+	// Optional RFC 4514 distinguished name of the certificate's issuer, such
+	// as "CN=Issuing CA,O=Example Corp,C=US", for tokens holding certificates
+	// from issuers with the same common name.
+	IssuerDN string `json:"issuer_dn"`
+	// Sign with raw RSA (CKM_RSA_X_509), padding signatures in the signer, for
+	// tokens that support no other RSA signature mechanism.
+	RawRSA bool `json:"raw_rsa"`
+}
+
+// ResourceLimits contains optional limits the signer applies to itself on startup,
+// so that a misbehaving keystore module cannot exhaust the workstation. Zero values
+// leave the corresponding limit untouched.
+type ResourceLimits struct {
+	MaxMemoryBytes uint64 `json:"max_memory_bytes"` // Maximum virtual memory (RLIMIT_AS) or job memory (Windows) in bytes.
+	MaxOpenFiles   uint64 `json:"max_open_files"`   // Maximum number of open file descriptors (RLIMIT_NOFILE). Not supported on Windows.
+	Nice           int    `json:"nice"`             // Scheduling niceness in the range [1, 19]. On Windows a positive value lowers the priority class.
 }
 
 // LoadConfig retrieves the ECP config file.
@@ -69,3 +177,19 @@ func LoadConfig(configFilePath string) (config EnterpriseCertificateConfig, err
 	}
 	return config, nil
 }
+
+// LoadConfigProfile retrieves the ECP config file, replacing its cert configs
+// with those of the named profile. An empty profile selects the top-level
+// cert configs, as LoadConfig does.
+func LoadConfigProfile(configFilePath, profile string) (EnterpriseCertificateConfig, error) {
+	config, err := LoadConfig(configFilePath)
+	if err != nil || profile == "" {
+		return config, err
+	}
+	p, ok := config.Profiles[profile]
+	if !ok {
+		return EnterpriseCertificateConfig{}, fmt.Errorf("profile %q is not defined in %s", profile, configFilePath)
+	}
+	config.CertConfigs = p.CertConfigs
+	return config, nil
+}
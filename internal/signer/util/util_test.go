@@ -27,6 +27,66 @@ func TestLoadConfig(t *testing.T) {
 	if config.CertConfigs.MacOSKeychain.Issuer != want {
 		t.Errorf("Expected issuer is %q, got: %q", want, config.CertConfigs.MacOSKeychain.Issuer)
 	}
+	if got := config.CertConfigs.MacOSKeychain.Issuers; len(got) != 1 || got[0] != "Legacy Endpoint Verification" {
+		t.Errorf("Expected issuers are %q, got: %q", []string{"Legacy Endpoint Verification"}, got)
+	}
+	want = "Endpoint Verification CA *"
+	if config.CertConfigs.MacOSKeychain.IssuerGlob != want {
+		t.Errorf("Expected issuer glob is %q, got: %q", want, config.CertConfigs.MacOSKeychain.IssuerGlob)
+	}
+	want = "device-1234"
+	if config.CertConfigs.MacOSKeychain.Subject != want {
+		t.Errorf("Expected subject is %q, got: %q", want, config.CertConfigs.MacOSKeychain.Subject)
+	}
+	want = "1f:a0"
+	if config.CertConfigs.MacOSKeychain.Serial != want {
+		t.Errorf("Expected serial is %q, got: %q", want, config.CertConfigs.MacOSKeychain.Serial)
+	}
+	want = "device-1234.corp.example.com"
+	if config.CertConfigs.MacOSKeychain.SANDNSName != want {
+		t.Errorf("Expected SAN DNS name is %q, got: %q", want, config.CertConfigs.MacOSKeychain.SANDNSName)
+	}
+	want = "https://accounts.google.com"
+	if config.CertConfigs.MacOSKeychain.PreferredIdentity != want {
+		t.Errorf("Expected preferred identity is %q, got: %q", want, config.CertConfigs.MacOSKeychain.PreferredIdentity)
+	}
+	if !config.CertConfigs.MacOSKeychain.RequireClientAuth {
+		t.Error("Expected require_client_auth to be true")
+	}
+	want = "latest_not_after"
+	if config.CertConfigs.MacOSKeychain.SelectionPolicy != want {
+		t.Errorf("Expected selection policy is %q, got: %q", want, config.CertConfigs.MacOSKeychain.SelectionPolicy)
+	}
+	want = "login"
+	if config.CertConfigs.MacOSKeychain.Keychain != want {
+		t.Errorf("Expected keychain is %q, got: %q", want, config.CertConfigs.MacOSKeychain.Keychain)
+	}
+	want = "ABCDE12345.com.example.mdm"
+	if config.CertConfigs.MacOSKeychain.AccessGroup != want {
+		t.Errorf("Expected access group is %q, got: %q", want, config.CertConfigs.MacOSKeychain.AccessGroup)
+	}
+	if got, want := config.CertConfigs.MacOSKeychain.AuthReuseSeconds, 60; got != want {
+		t.Errorf("Expected auth reuse seconds is %d, got: %d", want, got)
+	}
+	if got, want := config.CertConfigs.MacOSKeychain.AuthTimeoutSeconds, 30; got != want {
+		t.Errorf("Expected auth timeout seconds is %d, got: %d", want, got)
+	}
+	if !config.CertConfigs.MacOSKeychain.NonInteractive {
+		t.Error("Expected non_interactive to be true")
+	}
+	if !config.CertConfigs.MacOSKeychain.AllowLegacyHashes {
+		t.Error("Expected allow_legacy_hashes to be true")
+	}
+	if !config.CertConfigs.MacOSKeychain.FetchIntermediates {
+		t.Error("Expected fetch_intermediates to be true")
+	}
+	if !config.CertConfigs.MacOSKeychain.ExcludeRoot {
+		t.Error("Expected exclude_root to be true")
+	}
+	want = "3a:7b:9c:00:11:22:33:44:55:66:77:88:99:aa:bb:cc:dd:ee:ff:00:11:22:33:44:55:66:77:88:99:aa:bb:cc"
+	if config.CertConfigs.MacOSKeychain.Fingerprint != want {
+		t.Errorf("Expected fingerprint is %q, got: %q", want, config.CertConfigs.MacOSKeychain.Fingerprint)
+	}
 
 	// windows
 	want = "enterprise_v1_corp_client"
@@ -41,6 +101,40 @@ func TestLoadConfig(t *testing.T) {
 	if config.CertConfigs.WindowsStore.Provider != want {
 		t.Errorf("Expected provider is %q, got: %q", want, config.CertConfigs.WindowsStore.Provider)
 	}
+	want = "2f:1e:3d:4c:5b:6a:79:88:97:a6:b5:c4:d3:e2:f1:00:11:22:33:44"
+	if config.CertConfigs.WindowsStore.Thumbprint != want {
+		t.Errorf("Expected thumbprint is %q, got: %q", want, config.CertConfigs.WindowsStore.Thumbprint)
+	}
+	want = "Workstation Authentication"
+	if config.CertConfigs.WindowsStore.Template != want {
+		t.Errorf("Expected template is %q, got: %q", want, config.CertConfigs.WindowsStore.Template)
+	}
+	if got := config.CertConfigs.WindowsStore.ExtKeyUsages; len(got) != 1 || got[0] != "1.3.6.1.5.5.7.3.2" {
+		t.Errorf("Expected ext_key_usages is [1.3.6.1.5.5.7.3.2], got: %q", got)
+	}
+	if !config.CertConfigs.WindowsStore.Silent {
+		t.Error("Expected silent to be true")
+	}
+	if !config.CertConfigs.WindowsStore.ExcludeRoot {
+		t.Error("Expected exclude_root to be true")
+	}
+	if !config.CertConfigs.WindowsStore.AllowLegacyHashes {
+		t.Error("Expected allow_legacy_hashes to be true")
+	}
+	want = "Microsoft Smart Card Key Storage Provider"
+	if config.CertConfigs.WindowsStore.KeyProvider != want {
+		t.Errorf("Expected key_provider is %q, got: %q", want, config.CertConfigs.WindowsStore.KeyProvider)
+	}
+	want = "0000"
+	if config.CertConfigs.WindowsStore.PIN != want {
+		t.Errorf("Expected pin is %q, got: %q", want, config.CertConfigs.WindowsStore.PIN)
+	}
+	if !config.CertConfigs.WindowsStore.PickCertificate {
+		t.Error("Expected pick_certificate to be true")
+	}
+	if got := config.CertConfigs.WindowsStore.Issuers; len(got) != 1 || got[0] != "enterprise_v2_corp_client" {
+		t.Errorf("Expected issuers is [enterprise_v2_corp_client], got: %q", got)
+	}
 
 	// pkcs11
 	want = "0x1739427"
@@ -59,6 +153,118 @@ func TestLoadConfig(t *testing.T) {
 	if config.CertConfigs.PKCS11.UserPin != want {
 		t.Errorf("Expected user pin is %v, got: %v", want, config.CertConfigs.PKCS11.UserPin)
 	}
+	want = "ECP_PKCS11_PIN"
+	if config.CertConfigs.PKCS11.PinEnv != want {
+		t.Errorf("Expected pin_env is %v, got: %v", want, config.CertConfigs.PKCS11.PinEnv)
+	}
+	want = "/run/secrets/pkcs11_pin"
+	if config.CertConfigs.PKCS11.PinFile != want {
+		t.Errorf("Expected pin_file is %v, got: %v", want, config.CertConfigs.PKCS11.PinFile)
+	}
+	if got := config.CertConfigs.PKCS11.PinCommand; len(got) != 4 || got[0] != "secret-tool" {
+		t.Errorf("Expected pin_command is [secret-tool lookup service ecp], got: %q", got)
+	}
+	if got := config.CertConfigs.PKCS11.PinSecretService; len(got) != 1 || got["service"] != "ecp" {
+		t.Errorf("Expected pin_secret_service is map[service:ecp], got: %q", got)
+	}
+	want = "ECP Token"
+	if config.CertConfigs.PKCS11.TokenLabel != want {
+		t.Errorf("Expected token_label is %v, got: %v", want, config.CertConfigs.PKCS11.TokenLabel)
+	}
+	want = "0123456789abcdef"
+	if config.CertConfigs.PKCS11.TokenSerial != want {
+		t.Errorf("Expected token_serial is %v, got: %v", want, config.CertConfigs.PKCS11.TokenSerial)
+	}
+	want = "01:a2"
+	if config.CertConfigs.PKCS11.KeyID != want {
+		t.Errorf("Expected key_id is %v, got: %v", want, config.CertConfigs.PKCS11.KeyID)
+	}
+	want = "/etc/ecp/intermediates.pem"
+	if config.CertConfigs.PKCS11.ChainFile != want {
+		t.Errorf("Expected chain_file is %v, got: %v", want, config.CertConfigs.PKCS11.ChainFile)
+	}
+	if !config.CertConfigs.PKCS11.ExcludeRoot {
+		t.Error("Expected exclude_root to be true")
+	}
+	if got := config.CertConfigs.PKCS11.Modules; len(got) != 2 || got[1] != "/usr/lib/libykcs11.so" {
+		t.Errorf("Expected modules is [/usr/lib/x86_64-linux-gnu/opensc-pkcs11.so /usr/lib/libykcs11.so], got: %q", got)
+	}
+	want = "pkcs11:token=gecc;object=ecp?module-path=/usr/lib/softhsm/libsofthsm2.so"
+	if config.CertConfigs.PKCS11.URI != want {
+		t.Errorf("Expected uri is %v, got: %v", want, config.CertConfigs.PKCS11.URI)
+	}
+	if config.CertConfigs.PKCS11.NSSDB != "auto" {
+		t.Errorf("Expected nss_db is auto, got: %v", config.CertConfigs.PKCS11.NSSDB)
+	}
+	if config.CertConfigs.PKCS11.MaxConcurrentOperations != 4 {
+		t.Errorf("Expected max_concurrent_operations is 4, got: %v", config.CertConfigs.PKCS11.MaxConcurrentOperations)
+	}
+	want = "CN=Issuing CA,OU=Security,O=Example Corp,C=US"
+	if config.CertConfigs.PKCS11.IssuerDN != want {
+		t.Errorf("Expected issuer_dn is %v, got: %v", want, config.CertConfigs.PKCS11.IssuerDN)
+	}
+	if !config.CertConfigs.PKCS11.RawRSA {
+		t.Error("Expected raw_rsa to be true")
+	}
+}
+
+func TestLoadConfigResourceLimits(t *testing.T) {
+	config, err := LoadConfig("./test_data/certificate_config.json")
+	if err != nil {
+		t.Fatalf("LoadConfig error: %q", err)
+	}
+	want := ResourceLimits{
+		MaxMemoryBytes: 1 << 30,
+		MaxOpenFiles:   256,
+		Nice:           10,
+	}
+	if config.ResourceLimits != want {
+		t.Errorf("Expected resource limits are %+v, got: %+v", want, config.ResourceLimits)
+	}
+}
+
+func TestLoadConfigProfile(t *testing.T) {
+	config, err := LoadConfigProfile("./test_data/certificate_config.json", "backend")
+	if err != nil {
+		t.Fatalf("LoadConfigProfile error: %q", err)
+	}
+	want := "Backend CA"
+	if config.CertConfigs.WindowsStore.Issuer != want {
+		t.Errorf("Expected issuer is %q, got: %q", want, config.CertConfigs.WindowsStore.Issuer)
+	}
+	if config.CertConfigs.MacOSKeychain.Issuer != "" {
+		t.Errorf("Expected no macOS issuer in the profile, got: %q", config.CertConfigs.MacOSKeychain.Issuer)
+	}
+	if config.ResourceLimits.Nice != 10 {
+		t.Errorf("Expected the top-level resource limits, got: %+v", config.ResourceLimits)
+	}
+
+	config, err = LoadConfigProfile("./test_data/certificate_config.json", "")
+	if err != nil {
+		t.Fatalf("LoadConfigProfile error: %q", err)
+	}
+	want = "Google Endpoint Verification"
+	if config.CertConfigs.MacOSKeychain.Issuer != want {
+		t.Errorf("Expected issuer is %q, got: %q", want, config.CertConfigs.MacOSKeychain.Issuer)
+	}
+
+	if _, err := LoadConfigProfile("./test_data/certificate_config.json", "missing"); err == nil {
+		t.Error("Expected error for an undefined profile but got nil")
+	}
+}
+
+func TestApplyResourceLimitsEmpty(t *testing.T) {
+	if err := ApplyResourceLimits(ResourceLimits{}); err != nil {
+		t.Errorf("ApplyResourceLimits with no limits: got %v, want nil err", err)
+	}
+}
+
+func TestApplyResourceLimitsNiceRange(t *testing.T) {
+	for _, nice := range []int{-1, 20} {
+		if err := ApplyResourceLimits(ResourceLimits{Nice: nice}); err == nil {
+			t.Errorf("ApplyResourceLimits with nice %d: got nil err, want error", nice)
+		}
+	}
 }
 
 func TestLoadConfigMissing(t *testing.T) {
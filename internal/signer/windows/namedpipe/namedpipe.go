@@ -0,0 +1,245 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+// Package namedpipe provides a named pipe transport between the client and a
+// shared signer, restricted to the user that started the signer.
+package namedpipe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// bufferSize is the size of the pipe's input and output buffers.
+const bufferSize = 64 * 1024
+
+// Path returns the path of the pipe called name, such as `\\.\pipe\ecp`.
+func Path(name string) string {
+	if strings.HasPrefix(name, `\\.\pipe\`) {
+		return name
+	}
+	return `\\.\pipe\` + name
+}
+
+// Listener accepts connections on a named pipe. Only the user running the
+// listener can connect, and only from the local machine.
+type Listener struct {
+	path *uint16
+	sa   *windows.SecurityAttributes
+
+	mu   sync.Mutex
+	next windows.Handle // Pipe instance awaiting the next client.
+}
+
+// Listen creates the pipe called name. It fails if the pipe already exists, so
+// that another process cannot squat on the name and receive the clients.
+func Listen(name string) (*Listener, error) {
+	path, err := windows.UTF16PtrFromString(Path(name))
+	if err != nil {
+		return nil, err
+	}
+	sa, err := userOnly()
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{path: path, sa: sa}
+	if l.next, err = l.createInstance(true); err != nil {
+		return nil, fmt.Errorf("creating named pipe %s: %w", Path(name), err)
+	}
+	return l, nil
+}
+
+// userOnly returns security attributes that grant the current user, and
+// nobody else, access to the pipe.
+func userOnly() (*windows.SecurityAttributes, error) {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, fmt.Errorf("getting current user: %w", err)
+	}
+	sid := user.User.Sid.String()
+	sd, err := windows.SecurityDescriptorFromString("O:" + sid + "D:P(A;;GA;;;" + sid + ")")
+	if err != nil {
+		return nil, fmt.Errorf("creating pipe security descriptor: %w", err)
+	}
+	sa := &windows.SecurityAttributes{SecurityDescriptor: sd}
+	sa.Length = uint32(unsafe.Sizeof(*sa))
+	return sa, nil
+}
+
+func (l *Listener) createInstance(first bool) (windows.Handle, error) {
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	return windows.CreateNamedPipe(l.path, flags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES, bufferSize, bufferSize, 0, l.sa)
+}
+
+// Accept waits for a client to connect and returns the connection.
+func (l *Listener) Accept() (io.ReadWriteCloser, error) {
+	l.mu.Lock()
+	h := l.next
+	l.mu.Unlock()
+	if h == 0 {
+		return nil, errors.New("named pipe listener closed")
+	}
+	c := &conn{h: h}
+	if err := c.overlapped(func(o *windows.Overlapped) error {
+		err := windows.ConnectNamedPipe(h, o)
+		if err == windows.ERROR_PIPE_CONNECTED {
+			// The client connected between creation and this call.
+			return nil
+		}
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("waiting for a named pipe client: %w", err)
+	}
+
+	next, err := l.createInstance(false)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.next == 0 {
+		// Closed while waiting.
+		if err == nil {
+			windows.CloseHandle(next)
+		}
+		return nil, errors.New("named pipe listener closed")
+	}
+	if err != nil {
+		l.next = 0
+		return nil, fmt.Errorf("creating named pipe instance: %w", err)
+	}
+	l.next = next
+	return c, nil
+}
+
+// Close stops listening. Established connections are not affected.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.next == 0 {
+		return nil
+	}
+	windows.CancelIoEx(l.next, nil)
+	err := windows.CloseHandle(l.next)
+	l.next = 0
+	return err
+}
+
+// Dial connects to the pipe called name, waiting up to timeout for a free
+// pipe instance. The server may only identify, not impersonate, the client.
+func Dial(name string, timeout time.Duration) (io.ReadWriteCloser, error) {
+	path, err := windows.UTF16PtrFromString(Path(name))
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		h, err := windows.CreateFile(path, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING,
+			windows.FILE_FLAG_OVERLAPPED|windows.SECURITY_SQOS_PRESENT|windows.SECURITY_IDENTIFICATION, 0)
+		if err == nil {
+			return &conn{h: h}, nil
+		}
+		if err != windows.ERROR_PIPE_BUSY || time.Now().After(deadline) {
+			return nil, fmt.Errorf("connecting to named pipe %s: %w", Path(name), err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// conn is a connection on an overlapped pipe handle. Overlapped I/O lets a
+// read and a write be pending at the same time, which synchronous handles
+// serialize.
+type conn struct {
+	h windows.Handle
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// overlapped starts an overlapped operation with op and waits for it.
+func (c *conn) overlapped(op func(*windows.Overlapped) error) error {
+	_, err := c.transfer(func(_ *uint32, o *windows.Overlapped) error { return op(o) })
+	return err
+}
+
+// transfer starts an overlapped operation that transfers bytes with op, waits
+// for it, and returns the number of bytes transferred.
+func (c *conn) transfer(op func(*uint32, *windows.Overlapped) error) (int, error) {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(event)
+	o := &windows.Overlapped{HEvent: event}
+	var n uint32
+	err = op(&n, o)
+	if err == windows.ERROR_IO_PENDING {
+		err = windows.GetOverlappedResult(c.h, o, &n, true)
+	}
+	switch err {
+	case nil:
+		return int(n), nil
+	case windows.ERROR_BROKEN_PIPE, windows.ERROR_PIPE_NOT_CONNECTED, windows.ERROR_NO_DATA:
+		return int(n), io.EOF
+	case windows.ERROR_OPERATION_ABORTED, windows.ERROR_INVALID_HANDLE:
+		return int(n), io.ErrClosedPipe
+	default:
+		return int(n), err
+	}
+}
+
+// Read reads from the pipe.
+func (c *conn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return c.transfer(func(n *uint32, o *windows.Overlapped) error {
+		return windows.ReadFile(c.h, p, n, o)
+	})
+}
+
+// Write writes p to the pipe.
+func (c *conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := c.transfer(func(n *uint32, o *windows.Overlapped) error {
+			return windows.WriteFile(c.h, p[written:], n, o)
+		})
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close closes the connection, cancelling pending reads and writes.
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		windows.CancelIoEx(c.h, nil)
+		c.closeErr = windows.CloseHandle(c.h)
+	})
+	return c.closeErr
+}
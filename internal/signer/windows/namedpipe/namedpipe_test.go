@@ -0,0 +1,77 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package namedpipe
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPath(t *testing.T) {
+	for _, name := range []string{"ecp", `\\.\pipe\ecp`} {
+		if got, want := Path(name), `\\.\pipe\ecp`; got != want {
+			t.Errorf("Path(%q): got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestListenDial(t *testing.T) {
+	name := fmt.Sprintf("ecp-test-%d", os.Getpid())
+	l, err := Listen(name)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	if _, err := Listen(name); err == nil {
+		t.Error("Listen on an existing pipe: got nil error, want error")
+	}
+
+	// Echo every connection's input back, as an RPC server would.
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := Dial(name, time.Second)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		want := bytes.Repeat([]byte{byte(i)}, 2*bufferSize)
+		go c.Write(want)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Fatalf("ReadFull: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("client %d: echoed data does not match", i)
+		}
+		c.Close()
+	}
+}
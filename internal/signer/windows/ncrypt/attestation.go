@@ -0,0 +1,211 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package ncrypt
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	nCryptClaimAuthorityAndSubject       = 0x00000003 // NCRYPT_CLAIM_AUTHORITY_AND_SUBJECT
+	nCryptBufferClaimKeyAttestationNonce = 49         // NCRYPTBUFFER_CLAIM_KEYATTESTATION_NONCE
+	nCryptBufferVersion                  = 0          // NCRYPTBUFFER_VERSION
+
+	bcryptRSAPublicMagic = 0x31415352 // BCRYPT_RSAPUBLIC_MAGIC
+)
+
+var (
+	nCryptCreateClaim = nCrypt.MustFindProc("NCryptCreateClaim")
+	nCryptExportKey   = nCrypt.MustFindProc("NCryptExportKey")
+)
+
+// nCryptBuffer is the NCryptBuffer structure.
+type nCryptBuffer struct {
+	cbBuffer   uint32
+	bufferType uint32
+	pvBuffer   unsafe.Pointer
+}
+
+// nCryptBufferDesc is the NCryptBufferDesc structure.
+type nCryptBufferDesc struct {
+	version  uint32
+	cBuffers uint32
+	pBuffers *nCryptBuffer
+}
+
+// AttestOptions selects the attestation identity key (AIK) that certifies a
+// key held by the TPM.
+type AttestOptions struct {
+	// AIK is the name of the attestation identity key in the Platform Crypto
+	// Provider, such as one created during device enrollment.
+	AIK string
+	// MachineAIK opens AIK among the machine's keys rather than the user's.
+	MachineAIK bool
+	// Nonce is a fresh value from the relying party, bound into the claim so
+	// that it cannot be replayed.
+	Nonce []byte
+}
+
+// KeyAttestation is a statement by the TPM that it holds a key.
+type KeyAttestation struct {
+	// Claim is the key attestation claim of NCryptCreateClaim: the TPM's
+	// certification of the key's public area, signed by the AIK.
+	Claim []byte
+	// AIKPublic is the public key of the AIK, which relying parties verify
+	// the claim with once they trust it through its certificate.
+	AIKPublic crypto.PublicKey
+}
+
+// Attest returns a claim, signed by the attestation identity key that opts
+// names, that the private key is held by the TPM. Only keys of the
+// PlatformCryptoProvider can be attested.
+func (k *Key) Attest(opts AttestOptions) (*KeyAttestation, error) {
+	if k.provider != PlatformCryptoProvider {
+		return nil, fmt.Errorf("only keys of the %s can be attested, the key is held by %q", PlatformCryptoProvider, k.provider)
+	}
+	if opts.AIK == "" {
+		return nil, errors.New("an attestation identity key is required")
+	}
+	aik, err := OpenKey(PlatformCryptoProvider, opts.AIK, opts.MachineAIK, k.silent)
+	if err != nil {
+		return nil, fmt.Errorf("opening attestation identity key %q: %w", opts.AIK, err)
+	}
+	defer FreeKey(aik)
+	aikPublic, err := exportRSAPublicKey(aik)
+	if err != nil {
+		return nil, fmt.Errorf("exporting attestation identity key: %w", err)
+	}
+	var claim []byte
+	err = k.withPrivateKey(func(key windows.Handle, _ uint32) (err error) {
+		claim, err = createClaim(key, aik, opts.Nonce)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KeyAttestation{Claim: claim, AIKPublic: aikPublic}, nil
+}
+
+// createClaim wraps NCryptCreateClaim to certify subject with the AIK
+// authority, binding nonce into the claim.
+//
+// https://learn.microsoft.com/en-us/windows/win32/api/ncrypt/nf-ncrypt-ncryptcreateclaim
+func createClaim(subject, authority windows.Handle, nonce []byte) ([]byte, error) {
+	var params *nCryptBufferDesc
+	if len(nonce) > 0 {
+		params = &nCryptBufferDesc{
+			version:  nCryptBufferVersion,
+			cBuffers: 1,
+			pBuffers: &nCryptBuffer{
+				cbBuffer:   uint32(len(nonce)),
+				bufferType: nCryptBufferClaimKeyAttestationNonce,
+				pvBuffer:   unsafe.Pointer(&nonce[0]),
+			},
+		}
+	}
+	var size uint32
+	r, _, _ := nCryptCreateClaim.Call(
+		/* hSubjectKey */ uintptr(subject),
+		/* hAuthorityKey */ uintptr(authority),
+		/* dwClaimType */ nCryptClaimAuthorityAndSubject,
+		/* pParameterList */ uintptr(unsafe.Pointer(params)),
+		/* pbClaimBlob */ 0,
+		/* cbClaimBlob */ 0,
+		/* pcbResult */ uintptr(unsafe.Pointer(&size)),
+		/* dwFlags */ 0)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptCreateClaim: failed to get claim length: %w", statusError(r))
+	}
+	claim := make([]byte, size)
+	r, _, _ = nCryptCreateClaim.Call(
+		/* hSubjectKey */ uintptr(subject),
+		/* hAuthorityKey */ uintptr(authority),
+		/* dwClaimType */ nCryptClaimAuthorityAndSubject,
+		/* pParameterList */ uintptr(unsafe.Pointer(params)),
+		/* pbClaimBlob */ uintptr(unsafe.Pointer(&claim[0])),
+		/* cbClaimBlob */ uintptr(size),
+		/* pcbResult */ uintptr(unsafe.Pointer(&size)),
+		/* dwFlags */ 0)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptCreateClaim: failed to get claim: %w", statusError(r))
+	}
+	return claim[:size], nil
+}
+
+// exportRSAPublicKey wraps NCryptExportKey to return the public key of the
+// RSA key handle key.
+func exportRSAPublicKey(key windows.Handle) (*rsa.PublicKey, error) {
+	blobType, err := windows.UTF16PtrFromString("RSAPUBLICBLOB") // BCRYPT_RSAPUBLIC_BLOB
+	if err != nil {
+		return nil, err
+	}
+	var size uint32
+	r, _, _ := nCryptExportKey.Call(
+		/* hKey */ uintptr(key),
+		/* hExportKey */ 0,
+		/* pszBlobType */ uintptr(unsafe.Pointer(blobType)),
+		/* pParameterList */ 0,
+		/* pbOutput */ 0,
+		/* cbOutput */ 0,
+		/* pcbResult */ uintptr(unsafe.Pointer(&size)),
+		/* dwFlags */ 0)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptExportKey: failed to get public key length: %w", statusError(r))
+	}
+	blob := make([]byte, size)
+	r, _, _ = nCryptExportKey.Call(
+		/* hKey */ uintptr(key),
+		/* hExportKey */ 0,
+		/* pszBlobType */ uintptr(unsafe.Pointer(blobType)),
+		/* pParameterList */ 0,
+		/* pbOutput */ uintptr(unsafe.Pointer(&blob[0])),
+		/* cbOutput */ uintptr(size),
+		/* pcbResult */ uintptr(unsafe.Pointer(&size)),
+		/* dwFlags */ 0)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptExportKey: failed to get public key: %w", statusError(r))
+	}
+	return parseRSAPublicBlob(blob[:size])
+}
+
+// parseRSAPublicBlob parses a BCRYPT_RSAKEY_BLOB header followed by the
+// big-endian public exponent and modulus.
+func parseRSAPublicBlob(blob []byte) (*rsa.PublicKey, error) {
+	const headerLen = 24
+	if len(blob) < headerLen {
+		return nil, errors.New("RSA public key blob too short")
+	}
+	if magic := binary.LittleEndian.Uint32(blob[0:]); magic != bcryptRSAPublicMagic {
+		return nil, fmt.Errorf("unsupported public key blob magic %#x, only RSA keys are supported", magic)
+	}
+	expLen := int(binary.LittleEndian.Uint32(blob[8:]))
+	modLen := int(binary.LittleEndian.Uint32(blob[12:]))
+	if expLen == 0 || expLen > 4 || len(blob) < headerLen+expLen+modLen {
+		return nil, errors.New("malformed RSA public key blob")
+	}
+	exp := new(big.Int).SetBytes(blob[headerLen : headerLen+expLen])
+	mod := new(big.Int).SetBytes(blob[headerLen+expLen : headerLen+expLen+modLen])
+	return &rsa.PublicKey{N: mod, E: int(exp.Int64())}, nil
+}
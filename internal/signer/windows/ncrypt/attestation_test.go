@@ -0,0 +1,62 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package ncrypt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"math/big"
+	"testing"
+)
+
+// rsaPublicBlob encodes pub as a BCRYPT_RSAKEY_BLOB.
+func rsaPublicBlob(pub *rsa.PublicKey) []byte {
+	exp := big.NewInt(int64(pub.E)).Bytes()
+	mod := pub.N.Bytes()
+	blob := make([]byte, 24, 24+len(exp)+len(mod))
+	binary.LittleEndian.PutUint32(blob[0:], bcryptRSAPublicMagic)
+	binary.LittleEndian.PutUint32(blob[4:], uint32(pub.N.BitLen()))
+	binary.LittleEndian.PutUint32(blob[8:], uint32(len(exp)))
+	binary.LittleEndian.PutUint32(blob[12:], uint32(len(mod)))
+	blob = append(blob, exp...)
+	return append(blob, mod...)
+}
+
+func TestParseRSAPublicBlob(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := rsaPublicBlob(&priv.PublicKey)
+	got, err := parseRSAPublicBlob(blob)
+	if err != nil {
+		t.Fatalf("parseRSAPublicBlob: %v", err)
+	}
+	if !got.Equal(&priv.PublicKey) {
+		t.Errorf("parseRSAPublicBlob: got %v, want %v", got, &priv.PublicKey)
+	}
+
+	if _, err := parseRSAPublicBlob(blob[:len(blob)-1]); err == nil {
+		t.Error("parseRSAPublicBlob(truncated): got nil error, want error")
+	}
+	ecc := append([]byte{}, blob...)
+	copy(ecc, "ECS1")
+	if _, err := parseRSAPublicBlob(ecc); err == nil {
+		t.Error("parseRSAPublicBlob(ECC blob): got nil error, want error")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+// Capi provides signing and decryption with keys held by legacy CryptoAPI
+// cryptographic service providers via advapi32.dll.
+
+package ncrypt
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// wincrypt.h constants
+	atKeyExchange    = 1      // AT_KEYEXCHANGE
+	atSignature      = 2      // AT_SIGNATURE
+	hpHashVal        = 2      // HP_HASHVAL
+	ppKeyExchangePIN = 32     // PP_KEYEXCHANGE_PIN
+	ppSignaturePIN   = 33     // PP_SIGNATURE_PIN
+	cryptOAEP        = 0x40   // CRYPT_OAEP
+	calgSHA1         = 0x8004 // CALG_SHA1
+	calgSHA256       = 0x800c // CALG_SHA_256
+	calgSHA384       = 0x800d // CALG_SHA_384
+	calgSHA512       = 0x800e // CALG_SHA_512
+)
+
+var (
+	advapi32 = windows.MustLoadDLL("advapi32.dll")
+
+	cryptCreateHash   = advapi32.MustFindProc("CryptCreateHash")
+	cryptSetHashParam = advapi32.MustFindProc("CryptSetHashParam")
+	cryptSignHash     = advapi32.MustFindProc("CryptSignHashW")
+	cryptDestroyHash  = advapi32.MustFindProc("CryptDestroyHash")
+	cryptGetUserKey   = advapi32.MustFindProc("CryptGetUserKey")
+	cryptDestroyKey   = advapi32.MustFindProc("CryptDestroyKey")
+	cryptDecrypt      = advapi32.MustFindProc("CryptDecrypt")
+	cryptSetProvParam = advapi32.MustFindProc("CryptSetProvParam")
+)
+
+// capiAlgID returns the CryptoAPI algorithm identifier of hash.
+func capiAlgID(hash crypto.Hash) (uint32, bool) {
+	algID, ok := map[crypto.Hash]uint32{
+		crypto.SHA1:   calgSHA1,
+		crypto.SHA256: calgSHA256,
+		crypto.SHA384: calgSHA384,
+		crypto.SHA512: calgSHA512,
+	}[hash]
+	return algID, ok
+}
+
+// capiError converts the error of a failed advapi32 call, so that silent
+// failures match ErrInteractionRequired.
+func capiError(err error) error {
+	if errno, ok := err.(syscall.Errno); ok {
+		return statusError(errno)
+	}
+	return err
+}
+
+// capiSignHash signs digest with the key of type keySpec in the CryptoAPI
+// provider prov. CryptoAPI only supports RSASSA-PKCS1 signatures.
+//
+// https://learn.microsoft.com/en-us/windows/win32/api/wincrypt/nf-wincrypt-cryptsignhashw
+func capiSignHash(prov windows.Handle, keySpec uint32, pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := pub.(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("unsupported public key type %T, legacy CryptoAPI providers only hold RSA keys", pub)
+	}
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, errors.New("RSA-PSS is not supported by legacy CryptoAPI providers")
+	}
+	algID, ok := capiAlgID(opts.HashFunc())
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function %v", opts.HashFunc())
+	}
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, fmt.Errorf("invalid digest length %d for %v", len(digest), opts.HashFunc())
+	}
+
+	var hash windows.Handle
+	r, _, err := cryptCreateHash.Call(uintptr(prov), uintptr(algID), 0, 0, uintptr(unsafe.Pointer(&hash)))
+	if r == 0 {
+		return nil, fmt.Errorf("CryptCreateHash: %w", capiError(err))
+	}
+	defer cryptDestroyHash.Call(uintptr(hash))
+	r, _, err = cryptSetHashParam.Call(uintptr(hash), hpHashVal, uintptr(unsafe.Pointer(&digest[0])), 0)
+	if r == 0 {
+		return nil, fmt.Errorf("CryptSetHashParam: %w", capiError(err))
+	}
+
+	var size uint32
+	r, _, err = cryptSignHash.Call(uintptr(hash), uintptr(keySpec), 0, 0, 0, uintptr(unsafe.Pointer(&size)))
+	if r == 0 {
+		return nil, fmt.Errorf("CryptSignHash: failed to get signature length: %w", capiError(err))
+	}
+	sig := make([]byte, size)
+	r, _, err = cryptSignHash.Call(uintptr(hash), uintptr(keySpec), 0, 0, uintptr(unsafe.Pointer(&sig[0])), uintptr(unsafe.Pointer(&size)))
+	if r == 0 {
+		return nil, fmt.Errorf("CryptSignHash: failed to get signature: %w", capiError(err))
+	}
+	// CryptoAPI returns signatures in little-endian byte order.
+	return reverse(sig[:size]), nil
+}
+
+// capiDecrypt decrypts ciphertext with the key of type keySpec in the
+// CryptoAPI provider prov. CryptoAPI supports RSAES-PKCS1-v1_5, and RSAES-OAEP
+// with SHA-1 and no label only.
+//
+// https://learn.microsoft.com/en-us/windows/win32/api/wincrypt/nf-wincrypt-cryptdecrypt
+func capiDecrypt(prov windows.Handle, keySpec uint32, pub crypto.PublicKey, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if _, ok := pub.(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("unsupported public key type %T, only RSA keys support decryption", pub)
+	}
+	if len(ciphertext) == 0 {
+		return nil, errors.New("empty ciphertext")
+	}
+	var flags uint32
+	switch opts := opts.(type) {
+	case *rsa.PKCS1v15DecryptOptions:
+		if opts.SessionKeyLen != 0 {
+			return nil, errors.New("PKCS #1 v1.5 session key decryption is not supported")
+		}
+	case *rsa.OAEPOptions:
+		if opts.Hash != crypto.SHA1 || len(opts.Label) > 0 {
+			return nil, errors.New("legacy CryptoAPI providers only support RSA-OAEP with SHA-1 and no label")
+		}
+		flags = cryptOAEP
+	default:
+		return nil, fmt.Errorf("unsupported decryption options %T for legacy CryptoAPI providers", opts)
+	}
+
+	var key windows.Handle
+	r, _, err := cryptGetUserKey.Call(uintptr(prov), uintptr(keySpec), uintptr(unsafe.Pointer(&key)))
+	if r == 0 {
+		return nil, fmt.Errorf("CryptGetUserKey: %w", capiError(err))
+	}
+	defer cryptDestroyKey.Call(uintptr(key))
+
+	// CryptoAPI expects ciphertexts in little-endian byte order, and decrypts in place.
+	data := reverse(ciphertext)
+	size := uint32(len(data))
+	r, _, err = cryptDecrypt.Call(uintptr(key), 0, 1, uintptr(flags), uintptr(unsafe.Pointer(&data[0])), uintptr(unsafe.Pointer(&size)))
+	if r == 0 {
+		return nil, fmt.Errorf("CryptDecrypt: %w", capiError(err))
+	}
+	return data[:size], nil
+}
+
+// capiSetPIN supplies the smart card PIN for the key of type keySpec in the
+// CryptoAPI provider prov.
+func capiSetPIN(prov windows.Handle, keySpec uint32, pin string) error {
+	param := uint32(ppSignaturePIN)
+	if keySpec == atKeyExchange {
+		param = ppKeyExchangePIN
+	}
+	value, err := windows.ByteSliceFromString(pin)
+	if err != nil {
+		return err
+	}
+	r, _, err := cryptSetProvParam.Call(uintptr(prov), uintptr(param), uintptr(unsafe.Pointer(&value[0])), 0)
+	for i := range value {
+		value[i] = 0
+	}
+	if r == 0 {
+		return fmt.Errorf("CryptSetProvParam(PIN): %w", capiError(err))
+	}
+	return nil
+}
@@ -19,14 +19,20 @@
 package ncrypt
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha1"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
 	"syscall"
 	"unsafe"
 
+	"github.com/googleapis/enterprise-certificate-proxy/internal/ecies"
 	"golang.org/x/sys/windows"
 )
 
@@ -35,25 +41,38 @@ const (
 	encodingX509ASN                   = 1                                              // X509_ASN_ENCODING
 	certStoreCurrentUserID            = 1                                              // CERT_SYSTEM_STORE_CURRENT_USER_ID
 	certStoreLocalMachineID           = 2                                              // CERT_SYSTEM_STORE_LOCAL_MACHINE_ID
+	certStoreCurrentUserGPID          = 7                                              // CERT_SYSTEM_STORE_CURRENT_USER_GROUP_POLICY_ID
+	certStoreLocalMachineGPID         = 8                                              // CERT_SYSTEM_STORE_LOCAL_MACHINE_GROUP_POLICY_ID
+	certStoreLocalMachineEnterpriseID = 9                                              // CERT_SYSTEM_STORE_LOCAL_MACHINE_ENTERPRISE_ID
 	infoIssuerFlag                    = 4                                              // CERT_INFO_ISSUER_FLAG
 	compareNameStrW                   = 8                                              // CERT_COMPARE_NAME_STR_A
 	certStoreProvSystem               = 10                                             // CERT_STORE_PROV_SYSTEM
 	compareShift                      = 16                                             // CERT_COMPARE_SHIFT
+	findAny                           = 0                                              // CERT_FIND_ANY
 	locationShift                     = 16                                             // CERT_SYSTEM_STORE_LOCATION_SHIFT
 	findIssuerStr                     = compareNameStrW<<compareShift | infoIssuerFlag // CERT_FIND_ISSUER_STR_W
 	certStoreLocalMachine             = certStoreLocalMachineID << locationShift       // CERT_SYSTEM_STORE_LOCAL_MACHINE
 	certStoreCurrentUser              = certStoreCurrentUserID << locationShift        // CERT_SYSTEM_STORE_CURRENT_USER
+	certStoreOpenExisting             = 0x4000                                         // CERT_STORE_OPEN_EXISTING_FLAG
+	certStoreReadOnly                 = 0x8000                                         // CERT_STORE_READONLY_FLAG
 	signatureKeyUsage                 = 0x80                                           // CERT_DIGITAL_SIGNATURE_KEY_USAGE
 	acquireCached                     = 0x1                                            // CRYPT_ACQUIRE_CACHE_FLAG
 	acquireSilent                     = 0x40                                           // CRYPT_ACQUIRE_SILENT_FLAG
-	acquireOnlyNCryptKey              = 0x40000                                        // CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG
+	acquirePreferNCryptKey            = 0x20000                                        // CRYPT_ACQUIRE_PREFER_NCRYPT_KEY_FLAG
+	certKeyProvInfoPropID             = 2                                              // CERT_KEY_PROV_INFO_PROP_ID
+	certKeyContextPropID              = 5                                              // CERT_KEY_CONTEXT_PROP_ID
+	cryptMachineKeyset                = 0x20                                           // CRYPT_MACHINE_KEYSET
 	ncryptKeySpec                     = 0xFFFFFFFF                                     // CERT_NCRYPT_KEY_SPEC
 	certChainCacheOnlyURLRetrieval    = 0x00000004                                     // CERT_CHAIN_CACHE_ONLY_URL_RETRIEVAL
 	certChainDisableAIA               = 0x00002000                                     // CERT_CHAIN_DISABLE_AIA
 	certChainRevocationCheckCacheOnly = 0x80000000                                     // CERT_CHAIN_REVOCATION_CHECK_CACHE_ONLY
 
+	hcceCurrentUser  = windows.Handle(0x00) // HCCE_CURRENT_USER
 	hcceLocalMachine = windows.Handle(0x01) // HCCE_LOCAL_MACHINE
 
+	cryptOIDInfoOIDKey      = 1 // CRYPT_OID_INFO_OID_KEY
+	cryptTemplateOIDGroupID = 9 // CRYPT_TEMPLATE_OID_GROUP_ID
+
 	// winerror.h constants
 	cryptENotFound = 0x80092004 // CRYPT_E_NOT_FOUND
 )
@@ -65,7 +84,10 @@ var (
 
 	certFindCertificateInStore        = crypt32.MustFindProc("CertFindCertificateInStore")
 	certGetIntendedKeyUsage           = crypt32.MustFindProc("CertGetIntendedKeyUsage")
+	certGetContextProperty            = crypt32.MustFindProc("CertGetCertificateContextProperty")
+	certSetContextProperty            = crypt32.MustFindProc("CertSetCertificateContextProperty")
 	cryptAcquireCertificatePrivateKey = crypt32.MustFindProc("CryptAcquireCertificatePrivateKey")
+	cryptFindOIDInfo                  = crypt32.MustFindProc("CryptFindOIDInfo")
 )
 
 // findCert wraps the CertFindCertificateInStore call. Note that any cert context passed
@@ -93,7 +115,7 @@ func findCert(store windows.Handle, enc uint32, findFlags uint32, findType uint3
 	return (*windows.CertContext)(unsafe.Pointer(h)), nil
 }
 
-// extractSimpleChain extracts the final certificate chain from a CertSimpleChain.
+// extractSimpleChain extracts the certificate chain from the CertSimpleChains of a chain context.
 // Adapted from crypto.x509.root_windows
 func extractSimpleChain(simpleChain **windows.CertSimpleChain, chainCount int) ([]*x509.Certificate, error) {
 	if simpleChain == nil || chainCount == 0 {
@@ -104,10 +126,12 @@ func extractSimpleChain(simpleChain **windows.CertSimpleChain, chainCount int) (
 	simpleChains := (*[1 << 20]*windows.CertSimpleChain)(unsafe.Pointer(simpleChain))[:chainCount:chainCount]
 	// Each simple chain contains the chain of certificates, summary trust information
 	// about the chain, and trust information about each certificate element in the chain.
-	// Select the last chain since only expect to encounter one chain.
-	lastChain := simpleChains[chainCount-1]
-	chainLen := int(lastChain.NumElements)
-	elements := (*[1 << 20]*windows.CertChainElement)(unsafe.Pointer(lastChain.Elements))[:chainLen:chainLen]
+	// Select the first chain, which starts at the end certificate. Further simple
+	// chains only appear when trust is established through certificate trust
+	// lists, and start at the signer of the list rather than an issuer.
+	firstChain := simpleChains[0]
+	chainLen := int(firstChain.NumElements)
+	elements := (*[1 << 20]*windows.CertChainElement)(unsafe.Pointer(firstChain.Elements))[:chainLen:chainLen]
 	chain := make([]*x509.Certificate, 0, chainLen)
 	for _, element := range elements {
 		xc, err := certContextToX509(element.CertContext)
@@ -119,8 +143,10 @@ func extractSimpleChain(simpleChain **windows.CertSimpleChain, chainCount int) (
 	return chain, nil
 }
 
-// findCertChain builds a chain from a given certificate using the local machine store.
-func findCertChain(cert *windows.CertContext) ([]*x509.Certificate, error) {
+// findCertChain builds a chain from a given certificate with the chain engine
+// engine, so that the intermediate and root stores, cross-certificates and
+// enterprise chain policy of the user or machine are applied.
+func findCertChain(cert *windows.CertContext, engine windows.Handle) ([]*x509.Certificate, error) {
 	var (
 		chainPara windows.CertChainPara
 		chainCtx  *windows.CertChainContext
@@ -133,7 +159,7 @@ func findCertChain(cert *windows.CertContext) ([]*x509.Certificate, error) {
 	// See https://golang.org/pkg/unsafe/#Pointer for valid unsafe package patterns.
 	chainPara.Size = uint32(unsafe.Sizeof(chainPara))
 	err := windows.CertGetCertificateChain(
-		hcceLocalMachine,
+		engine,
 		cert,
 		nil,
 		cert.Store,
@@ -161,31 +187,83 @@ func intendedKeyUsage(enc uint32, cert *windows.CertContext) (usage uint16) {
 	return
 }
 
-// acquirePrivateKey wraps CryptAcquireCertificatePrivateKey.
-func acquirePrivateKey(cert *windows.CertContext) (windows.Handle, error) {
-	var (
-		key      windows.Handle
-		keySpec  uint32
-		mustFree int
-	)
+// acquirePrivateKey wraps CryptAcquireCertificatePrivateKey. When silent is
+// set, it fails with an error matching ErrInteractionRequired instead of
+// prompting to insert a smart card. The returned handle is an NCrypt key handle
+// if keySpec is ncryptKeySpec, or else a CryptoAPI provider handle for keys
+// held by legacy CSPs, such as older smart card middleware.
+func acquirePrivateKey(cert *windows.CertContext, silent bool) (key windows.Handle, keySpec uint32, err error) {
+	var mustFree int
+	flags := acquireCached | acquirePreferNCryptKey
+	if silent {
+		flags |= acquireSilent
+	}
 	r, _, err := cryptAcquireCertificatePrivateKey.Call(
 		uintptr(unsafe.Pointer(cert)),
-		acquireCached|acquireSilent|acquireOnlyNCryptKey,
+		uintptr(flags),
 		null,
 		uintptr(unsafe.Pointer(&key)),
 		uintptr(unsafe.Pointer(&keySpec)),
 		uintptr(unsafe.Pointer(&mustFree)),
 	)
 	if r == 0 {
-		return 0, fmt.Errorf("acquiring private key: %x %w", r, err)
+		if errno, ok := err.(syscall.Errno); ok {
+			switch errno {
+			case nteSilentContext, ntePerm, nteBadKeyset, eAccessDenied:
+				err = statusError(errno)
+			case windows.ERROR_ACCESS_DENIED:
+				err = statusError(eAccessDenied)
+			}
+		}
+		return 0, 0, fmt.Errorf("acquiring private key: %x %w", r, err)
 	}
 	if mustFree != 0 {
-		return 0, fmt.Errorf("wrong mustFree [%d != 0]", mustFree)
+		return 0, 0, fmt.Errorf("wrong mustFree [%d != 0]", mustFree)
 	}
-	if keySpec != ncryptKeySpec {
-		return 0, fmt.Errorf("wrong keySpec [%d != %d]", keySpec, ncryptKeySpec)
+	switch keySpec {
+	case ncryptKeySpec, atKeyExchange, atSignature:
+		return key, keySpec, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported keySpec %d", keySpec)
 	}
-	return key, nil
+}
+
+// forgetPrivateKey releases the private key handle that acquirePrivateKey
+// cached on cert, so that the next call acquires a fresh one.
+func forgetPrivateKey(cert *windows.CertContext) error {
+	r, _, err := certSetContextProperty.Call(uintptr(unsafe.Pointer(cert)), certKeyContextPropID, 0, null)
+	if r == 0 {
+		return fmt.Errorf("releasing cached private key: %w", err)
+	}
+	return nil
+}
+
+// cryptKeyProvInfo is the CRYPT_KEY_PROV_INFO structure.
+type cryptKeyProvInfo struct {
+	containerName *uint16
+	provName      *uint16
+	provType      uint32
+	flags         uint32
+	provParamLen  uint32
+	provParams    uintptr
+	keySpec       uint32
+}
+
+// keyContainer wraps CertGetCertificateContextProperty to return the name of
+// the key container associated with cert, and whether it holds a machine key.
+func keyContainer(cert *windows.CertContext) (string, bool, error) {
+	var size uint32
+	r, _, err := certGetContextProperty.Call(uintptr(unsafe.Pointer(cert)), certKeyProvInfoPropID, 0, uintptr(unsafe.Pointer(&size)))
+	if r == 0 {
+		return "", false, fmt.Errorf("getting key provider information: %w", err)
+	}
+	buf := make([]byte, size)
+	r, _, err = certGetContextProperty.Call(uintptr(unsafe.Pointer(cert)), certKeyProvInfoPropID, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if r == 0 {
+		return "", false, fmt.Errorf("getting key provider information: %w", err)
+	}
+	info := (*cryptKeyProvInfo)(unsafe.Pointer(&buf[0]))
+	return windows.UTF16PtrToString(info.containerName), info.flags&cryptMachineKeyset != 0, nil
 }
 
 // certContextToX509 extracts the x509 certificate from the cert context.
@@ -202,68 +280,284 @@ func certContextToX509(ctx *windows.CertContext) (*x509.Certificate, error) {
 	return xc, nil
 }
 
-// Cred returns a Key wrapping the first valid certificate in the system store
-// matching a given issuer string.
-func Cred(issuer string, storeName string, provider string) (*Key, error) {
-	var certStore uint32
-	if provider == "local_machine" {
-		certStore = uint32(certStoreLocalMachine)
-	} else if provider == "current_user" {
-		certStore = uint32(certStoreCurrentUser)
-	} else {
-		return nil, errors.New("provider must be local_machine or current_user")
+// DefaultStoreName is the system store searched when no store name is given.
+const DefaultStoreName = "MY"
+
+// storeLocations maps the provider names accepted by Cred to system store locations.
+var storeLocations = map[string]uint32{
+	"current_user":               certStoreCurrentUser,
+	"local_machine":              certStoreLocalMachine,
+	"current_user_group_policy":  certStoreCurrentUserGPID << locationShift,
+	"local_machine_group_policy": certStoreLocalMachineGPID << locationShift,
+	"local_machine_enterprise":   certStoreLocalMachineEnterpriseID << locationShift,
+}
+
+// storeLocation returns the system store location flag for provider, which
+// defaults to current_user.
+func storeLocation(provider string) (uint32, error) {
+	if provider == "" {
+		provider = "current_user"
+	}
+	location, ok := storeLocations[provider]
+	if !ok {
+		return 0, fmt.Errorf("unsupported provider %q: must be one of current_user, local_machine, current_user_group_policy, local_machine_group_policy or local_machine_enterprise", provider)
+	}
+	return location, nil
+}
+
+// chainEngine returns the chain engine for certificates in the store location
+// selected by provider: the machine's for local machine stores and the user's
+// otherwise.
+func chainEngine(provider string) windows.Handle {
+	if machineStore(provider) {
+		return hcceLocalMachine
+	}
+	return hcceCurrentUser
+}
+
+// machineStore reports whether provider selects a local machine store, whose
+// certificates have machine keys.
+func machineStore(provider string) bool {
+	return strings.HasPrefix(provider, "local_machine")
+}
+
+// withoutRoot removes the self-signed root certificate from the end of chain.
+func withoutRoot(chain []*x509.Certificate) []*x509.Certificate {
+	if n := len(chain); n > 1 && bytes.Equal(chain[n-1].RawIssuer, chain[n-1].RawSubject) && chain[n-1].CheckSignatureFrom(chain[n-1]) == nil {
+		return chain[:n-1]
+	}
+	return chain
+}
+
+// openStore opens the named system store at the location selected by provider
+// for reading. The store must already exist.
+func openStore(storeName string, provider string) (windows.Handle, error) {
+	location, err := storeLocation(provider)
+	if err != nil {
+		return 0, err
+	}
+	if storeName == "" {
+		storeName = DefaultStoreName
+	}
+	if provider == "" {
+		provider = "current_user"
 	}
 	storeNamePtr, err := windows.UTF16PtrFromString(storeName)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	store, err := windows.CertOpenStore(certStoreProvSystem, 0, null, certStore, uintptr(unsafe.Pointer(storeNamePtr)))
+	store, err := windows.CertOpenStore(certStoreProvSystem, 0, null, location|certStoreOpenExisting|certStoreReadOnly, uintptr(unsafe.Pointer(storeNamePtr)))
 	if err != nil {
-		return nil, fmt.Errorf("opening certificate store: %w", err)
+		return 0, fmt.Errorf("opening certificate store %q of %s: %w", storeName, provider, err)
+	}
+	return store, nil
+}
+
+// Cred returns a Key wrapping the first valid certificate in the system store
+// matching a given issuer string. storeName names the system store, such as
+// "MY", and defaults to DefaultStoreName. provider selects the store
+// location, such as "current_user" or "local_machine" for machine
+// certificates used by service accounts, and defaults to "current_user".
+func Cred(issuer string, storeName string, provider string) (*Key, error) {
+	return CredWithOptions(Options{Issuer: issuer, Store: storeName, Provider: provider})
+}
+
+// CredWithOptions returns a Key wrapping the first valid certificate in the
+// system store matching opts.
+func CredWithOptions(opts Options) (*Key, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
 	}
-	i, err := windows.UTF16PtrFromString(issuer)
+	if opts.PickCertificate && opts.Thumbprint == "" {
+		thumbprint, err := pickCertificate(opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.Thumbprint = thumbprint
+	}
+	store, err := openStore(opts.Store, opts.Provider)
 	if err != nil {
 		return nil, err
 	}
-	var prev *windows.CertContext
-	for {
-		nc, err := findCert(store, encodingX509ASN, 0, findIssuerStr, i, prev)
+	// A service identity that may not read the key of an otherwise matching
+	// certificate gets a clear error rather than "no certificate found".
+	var key *Key
+	var accessErr error
+	machine := machineStore(opts.Provider)
+	err = opts.forEachCandidate(store, func(nc *windows.CertContext, xc *x509.Certificate) bool {
+		if !opts.eligible(nc, xc) {
+			return true
+		}
+		chain, err := findCertChain(nc, chainEngine(opts.Provider))
 		if err != nil {
-			return nil, fmt.Errorf("finding certificates: %w", err)
+			return true
+		}
+		if opts.ExcludeRoot {
+			chain = withoutRoot(chain)
 		}
-		if nc == nil {
-			return nil, errors.New("no certificate found")
+		// When a key storage provider is pinned, the key is opened through it
+		// rather than the provider the certificate names.
+		var container string
+		machine := machine
+		provider := opts.KeyProvider
+		if provider != "" {
+			if container, machine, err = keyContainer(nc); err != nil {
+				return true
+			}
+			// Only candidates whose key the pinned provider holds qualify.
+			pinned, err := OpenKey(provider, container, machine, opts.Silent)
+			if err != nil {
+				if machine && accessErr == nil {
+					accessErr = accessDenied(err)
+				}
+				return true
+			}
+			FreeKey(pinned)
+		} else {
+			// Check that the service identity can read machine keys now
+			// rather than on the first signature.
+			if machine {
+				if _, _, err := acquirePrivateKey(nc, true); err != nil {
+					if err := accessDenied(err); err != nil {
+						if accessErr == nil {
+							accessErr = err
+						}
+						return true
+					}
+				}
+			}
+			// Keys held by the TPM are opened like any other key; only their
+			// provider's restrictions differ.
+			provider = keyProvider(nc)
 		}
-		prev = nc
-		if (intendedKeyUsage(encodingX509ASN, nc) & signatureKeyUsage) == 0 {
-			continue
+		key = &Key{
+			cert:              xc,
+			ctx:               nc,
+			store:             store,
+			chain:             chain,
+			provider:          provider,
+			container:         container,
+			machine:           machine,
+			silent:            opts.Silent,
+			allowLegacyHashes: opts.AllowLegacyHashes,
+			pin:               opts.pinFunc(),
+			prompt:            opts.PromptMessage,
 		}
+		return false
+	})
+	if err == nil && key == nil {
+		err = accessErr
+	}
+	if err == nil && key == nil {
+		err = errors.New("no certificate found")
+	}
+	if err != nil {
+		windows.CertCloseStore(store, 0)
+		return nil, err
+	}
+	return key, nil
+}
+
+// findParam is a CertFindCertificateInStore search type and parameter.
+type findParam struct {
+	findType uint32
+	para     *uint16
+}
 
-		xc, err := certContextToX509(nc)
+// findParams returns the searches that select the candidate certificates for
+// opts, one per issuer in order of preference.
+func (opts Options) findParams() ([]findParam, error) {
+	issuers := opts.issuers()
+	if len(issuers) == 0 {
+		return []findParam{{findType: findAny}}, nil
+	}
+	params := make([]findParam, len(issuers))
+	for i, issuer := range issuers {
+		para, err := windows.UTF16PtrFromString(issuer)
 		if err != nil {
-			continue
+			return nil, err
 		}
+		params[i] = findParam{findIssuerStr, para}
+	}
+	return params, nil
+}
 
-		machineChain, err := findCertChain(nc)
-		if err != nil {
-			continue
+// forEachCandidate calls f with the candidate certificates in store that opts
+// select, and their parsed form, until f returns false. Candidates from more
+// preferred issuers come first, and a certificate matching several issuers is
+// visited once. The context passed to the last call of f is not freed.
+func (opts Options) forEachCandidate(store windows.Handle, f func(nc *windows.CertContext, xc *x509.Certificate) bool) error {
+	params, err := opts.findParams()
+	if err != nil {
+		return err
+	}
+	seen := make(map[[sha1.Size]byte]bool)
+	for _, p := range params {
+		var prev *windows.CertContext
+		for {
+			nc, err := findCert(store, encodingX509ASN, 0, p.findType, p.para, prev)
+			if err != nil {
+				return fmt.Errorf("finding certificates: %w", err)
+			}
+			if nc == nil {
+				break
+			}
+			prev = nc
+			xc, err := certContextToX509(nc)
+			if err != nil {
+				continue
+			}
+			tp := sha1.Sum(xc.Raw)
+			if seen[tp] {
+				continue
+			}
+			seen[tp] = true
+			if !f(nc, xc) {
+				return nil
+			}
 		}
-		return &Key{
-			cert:  xc,
-			ctx:   nc,
-			store: store,
-			chain: machineChain,
-		}, nil
 	}
+	return nil
+}
+
+// eligible reports whether the candidate certificate nc, parsed as xc, can
+// sign and satisfies the criteria of opts.
+func (opts Options) eligible(nc *windows.CertContext, xc *x509.Certificate) bool {
+	return intendedKeyUsage(encodingX509ASN, nc)&signatureKeyUsage != 0 && opts.matches(xc)
+}
+
+// keyProvider returns the name of the key storage provider holding the
+// private key of nc, or "" if it is unknown or a legacy CryptoAPI provider.
+func keyProvider(nc *windows.CertContext) string {
+	key, keySpec, err := acquirePrivateKey(nc, true)
+	if err != nil || keySpec != ncryptKeySpec {
+		return ""
+	}
+	provider, _ := ProviderName(key)
+	return provider
 }
 
 // Key is a wrapper around the certificate store and context that uses it to
 // implement signing-related methods with CryptoNG functionality.
 type Key struct {
-	cert  *x509.Certificate
-	ctx   *windows.CertContext
-	store windows.Handle
-	chain []*x509.Certificate
+	cert              *x509.Certificate
+	ctx               *windows.CertContext
+	store             windows.Handle
+	chain             []*x509.Certificate
+	provider          string // Name of the key storage provider, if known.
+	silent            bool   // Fail instead of showing PIN or smart card dialogs.
+	allowLegacyHashes bool   // Whether SHA-1 signatures are permitted.
+	pin               func() (string, error)
+	container         string // Key container opened through Options.KeyProvider, if set.
+	machine           bool   // Whether the private key is a machine key.
+	prompt            string // Message of Windows Hello prompts.
+
+	// The private key handle is opened on first use and kept for the Key's
+	// lifetime, as acquiring it and supplying the PIN dominate the cost of a
+	// signature. Operations hold mu for reading while they use the handle.
+	mu      sync.RWMutex
+	handle  windows.Handle // 0 until first use and after a failed operation.
+	keySpec uint32         // As in acquirePrivateKey.
 }
 
 // CertificateChain returns the credential as a raw X509 cert chain. This
@@ -279,22 +573,213 @@ func (k *Key) CertificateChain() [][]byte {
 
 // Close releases resources held by the credential.
 func (k *Key) Close() error {
+	k.mu.Lock()
+	k.releaseKey()
+	k.mu.Unlock()
 	if err := windows.CertFreeCertificateContext(k.ctx); err != nil {
 		return err
 	}
 	return windows.CertCloseStore(k.store, 0)
 }
 
+// Provider returns the name of the key storage provider holding the private
+// key, such as PlatformCryptoProvider, or "" if it is unknown.
+func (k *Key) Provider() string {
+	return k.provider
+}
+
 // Public returns the corresponding public key for this Key.
 func (k *Key) Public() crypto.PublicKey {
 	return k.cert.PublicKey
 }
 
+// openKey opens the private key and supplies the smart card PIN to it, if one
+// is configured. The caller must hold k.mu for writing.
+func (k *Key) openKey() error {
+	var key windows.Handle
+	var keySpec uint32
+	var err error
+	if k.container != "" {
+		keySpec = ncryptKeySpec
+		key, err = OpenKey(k.provider, k.container, k.machine, k.silent)
+	} else {
+		key, keySpec, err = acquirePrivateKey(k.ctx, k.silent)
+	}
+	if err != nil {
+		if k.machine {
+			err = machineKeyError(err)
+		}
+		return fmt.Errorf("cannot acquire private key handle: %w", err)
+	}
+	k.handle, k.keySpec = key, keySpec
+	if k.pin != nil {
+		pin, err := k.pin()
+		if err != nil {
+			k.releaseKey()
+			return fmt.Errorf("cannot get smart card PIN: %w", err)
+		}
+		if keySpec == ncryptKeySpec {
+			err = SetPIN(key, pin)
+		} else {
+			err = capiSetPIN(key, keySpec, pin)
+		}
+		if err != nil {
+			k.releaseKey()
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseKey releases the cached private key handle, if any. The caller must
+// hold k.mu for writing.
+func (k *Key) releaseKey() {
+	if k.handle == 0 {
+		return
+	}
+	if k.container != "" {
+		FreeKey(k.handle)
+	} else {
+		// The handle belongs to the certificate context, which would hand
+		// it out again.
+		forgetPrivateKey(k.ctx)
+	}
+	k.handle = 0
+}
+
+// withPrivateKey calls op with the cached private key handle, opening it first
+// if needed. keySpec is as in acquirePrivateKey. The handle is released when op
+// fails, other than because of the user, so that a handle broken by a smart
+// card removal or a provider restart is not reused.
+func (k *Key) withPrivateKey(op func(key windows.Handle, keySpec uint32) error) error {
+	k.mu.RLock()
+	for k.handle == 0 {
+		k.mu.RUnlock()
+		k.mu.Lock()
+		if k.handle == 0 {
+			if err := k.openKey(); err != nil {
+				k.mu.Unlock()
+				return err
+			}
+		}
+		k.mu.Unlock()
+		k.mu.RLock()
+	}
+	key, keySpec := k.handle, k.keySpec
+	err := k.preparePrompt(key)
+	if err == nil {
+		err = op(key, keySpec)
+	}
+	k.mu.RUnlock()
+	if err != nil && !userError(err) {
+		k.mu.Lock()
+		if k.handle == key {
+			k.releaseKey()
+		}
+		k.mu.Unlock()
+	}
+	return err
+}
+
+// preparePrompt shows the Windows Hello prompt for key in front of the user's
+// active window, which may change between operations.
+func (k *Key) preparePrompt(key windows.Handle) error {
+	if k.provider != PassportProvider || k.silent {
+		return nil
+	}
+	return SetPromptOwner(key, windows.GetForegroundWindow(), k.prompt)
+}
+
+// userError reports whether err was caused by the user or by the absence of
+// one, rather than by a broken key handle.
+func userError(err error) bool {
+	return errors.Is(err, ErrUserCancelled) || errors.Is(err, ErrInteractionRequired) || errors.Is(err, ErrUserConfirmationRequired)
+}
+
 // Sign signs a message digest. Here, we pass off the signing to the Windows CryptoNG library.
+// Signing with keys held by the TPM can take hundreds of milliseconds.
 func (k *Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	key, err := acquirePrivateKey(k.ctx)
+	if opts.HashFunc() == crypto.SHA1 && !k.allowLegacyHashes {
+		return nil, errors.New("SHA-1 signatures are disabled, set allow_legacy_hashes to permit them")
+	}
+	if err := checkProviderSignOpts(k.provider, opts); err != nil {
+		return nil, err
+	}
+	var sig []byte
+	err := k.withPrivateKey(func(key windows.Handle, keySpec uint32) (err error) {
+		if keySpec != ncryptKeySpec {
+			sig, err = capiSignHash(key, keySpec, k.Public(), digest, opts)
+			return err
+		}
+		sig, err = SignHash(key, k.Public(), digest, opts, k.silent)
+		return providerError(k.provider, err)
+	})
+	return sig, err
+}
+
+// Encrypt encrypts plaintext with the public key. opts selects the padding
+// scheme as in Decrypt.
+func (k *Key) Encrypt(plaintext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return Encrypt(k.Public(), plaintext, opts)
+}
+
+// KeyAgreement performs ECDH between the private key and peer using the
+// Windows CryptoNG library, and returns the raw shared secret for use with a
+// key derivation function, such as in hybrid decryption schemes.
+func (k *Key) KeyAgreement(peer *ecdsa.PublicKey) ([]byte, error) {
+	var secret []byte
+	err := k.withPrivateKey(func(key windows.Handle, keySpec uint32) (err error) {
+		if keySpec != ncryptKeySpec {
+			return errors.New("key agreement is not supported for keys held by legacy CryptoAPI providers")
+		}
+		secret, err = SecretAgreement(key, k.Public(), peer, k.silent)
+		return providerError(k.provider, err)
+	})
+	return secret, err
+}
+
+// Decrypt decrypts ciphertext with the private key using the Windows CryptoNG
+// library. For RSA keys opts selects the padding scheme: *rsa.OAEPOptions,
+// *rsa.PKCS1v15DecryptOptions, or nil for RSA-OAEP with SHA-256. EC keys
+// decrypt the ECIES ciphertexts Encrypt produces, and opts must be nil.
+func (k *Key) Decrypt(_ io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if pub, ok := k.Public().(*ecdsa.PublicKey); ok {
+		if opts != nil {
+			return nil, fmt.Errorf("unsupported decryption options %T for an EC key", opts)
+		}
+		return ecies.Decrypt(pub, ciphertext, k.KeyAgreement)
+	}
+	var plaintext []byte
+	err := k.withPrivateKey(func(key windows.Handle, keySpec uint32) (err error) {
+		if keySpec != ncryptKeySpec {
+			plaintext, err = capiDecrypt(key, keySpec, k.Public(), ciphertext, opts)
+			return err
+		}
+		plaintext, err = Decrypt(key, k.Public(), ciphertext, opts, k.silent)
+		return providerError(k.provider, err)
+	})
+	return plaintext, err
+}
+
+// cryptOIDInfo is the start of a CRYPT_OID_INFO structure.
+type cryptOIDInfo struct {
+	size    uint32
+	oid     *byte
+	name    *uint16
+	groupID uint32
+}
+
+// lookupTemplateName wraps CryptFindOIDInfo to return the display name of the
+// certificate template with the given OID, or "" if it is not registered.
+func lookupTemplateName(oid string) string {
+	oidPtr, err := windows.BytePtrFromString(oid)
 	if err != nil {
-		return nil, fmt.Errorf("cannot acquire private key handle: %w", err)
+		return ""
+	}
+	r, _, _ := cryptFindOIDInfo.Call(cryptOIDInfoOIDKey, uintptr(unsafe.Pointer(oidPtr)), cryptTemplateOIDGroupID)
+	if r == 0 {
+		return ""
 	}
-	return SignHash(key, k.Public(), digest, opts)
+	info := *(**cryptOIDInfo)(unsafe.Pointer(&r))
+	return windows.UTF16PtrToString(info.name)
 }
@@ -17,9 +17,16 @@
 package ncrypt
 
 import (
+	"crypto"
+	"crypto/sha256"
+	"os"
 	"testing"
 )
 
+// benchmarkIssuerEnv names the environment variable holding the issuer of a
+// certificate in the current user's MY store to benchmark signing with.
+const benchmarkIssuerEnv = "ECP_BENCHMARK_ISSUER"
+
 func TestCredProviderNotSupported(t *testing.T) {
 	_, err := Cred("issuer", "store", "unsupported_provider")
 	if err == nil {
@@ -30,3 +37,38 @@ func TestCredProviderNotSupported(t *testing.T) {
 		t.Errorf("Expected error is %q, got: %q", want, err.Error())
 	}
 }
+
+// benchmarkSign signs with a certificate selected by benchmarkIssuerEnv. When
+// uncached is set, the private key handle is released before every signature,
+// as if it were acquired for each operation.
+func benchmarkSign(b *testing.B, uncached bool) {
+	issuer := os.Getenv(benchmarkIssuerEnv)
+	if issuer == "" {
+		b.Skipf("%s is not set", benchmarkIssuerEnv)
+	}
+	key, err := Cred(issuer, DefaultStoreName, "current_user")
+	if err != nil {
+		b.Fatalf("Cred: got %v, want nil err", err)
+	}
+	defer key.Close()
+	digest := sha256.Sum256([]byte("Plain text to sign"))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if uncached {
+			key.mu.Lock()
+			key.releaseKey()
+			key.mu.Unlock()
+		}
+		if _, err := key.Sign(nil, digest[:], crypto.SHA256); err != nil {
+			b.Fatalf("Sign: got %v, want nil err", err)
+		}
+	}
+}
+
+func BenchmarkSign(b *testing.B) {
+	benchmarkSign(b, false)
+}
+
+func BenchmarkSignUncached(b *testing.B) {
+	benchmarkSign(b, true)
+}
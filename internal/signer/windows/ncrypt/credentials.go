@@ -0,0 +1,117 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package ncrypt
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// CredentialInfo describes a candidate certificate in the Windows certificate
+// store, so that administrators can see which certificate would be selected.
+type CredentialInfo struct {
+	Subject    string // Common name of the subject.
+	Issuer     string // Common name of the issuer.
+	Thumbprint string // Hex-encoded SHA-1 thumbprint, as shown by the certificate manager.
+	// Template is the name of the ADCS certificate template that issued the
+	// certificate, or its OID if the name is unknown.
+	Template string
+	Provider string // Name of the key storage provider, if known.
+	NotAfter time.Time
+	// Eligible reports whether the certificate can sign and satisfies the
+	// selection criteria.
+	Eligible bool
+	// Selected reports whether CredWithOptions would select the certificate.
+	Selected bool
+}
+
+// ListCredentials describes the candidate certificates in the store that opts
+// select, in the order in which CredWithOptions considers them. Candidates
+// are all certificates from the issuers of opts, or all certificates in the
+// store if no issuer is set.
+func ListCredentials(opts Options) ([]CredentialInfo, error) {
+	if err := opts.validateCriteria(); err != nil {
+		return nil, err
+	}
+	store, err := openStore(opts.Store, opts.Provider)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CertCloseStore(store, 0)
+	var (
+		infos    []CredentialInfo
+		selected bool
+	)
+	err = opts.forEachCandidate(store, func(nc *windows.CertContext, xc *x509.Certificate) bool {
+		info := newCredentialInfo(xc, keyProvider(nc))
+		info.Eligible = opts.eligible(nc, xc)
+		if info.Eligible && !selected {
+			if _, err := findCertChain(nc, chainEngine(opts.Provider)); err == nil {
+				info.Selected, selected = true, true
+			}
+		}
+		infos = append(infos, info)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// newCredentialInfo describes the certificate xc whose private key is held by
+// the key storage provider named provider.
+func newCredentialInfo(xc *x509.Certificate, provider string) CredentialInfo {
+	tp := sha1.Sum(xc.Raw)
+	return CredentialInfo{
+		Subject:    xc.Subject.CommonName,
+		Issuer:     xc.Issuer.CommonName,
+		Thumbprint: hex.EncodeToString(tp[:]),
+		Template:   templateOf(xc),
+		Provider:   provider,
+		NotAfter:   xc.NotAfter,
+	}
+}
+
+// templateOf returns the name of the ADCS certificate template that issued xc,
+// its OID if the name is unknown, or "" if xc names no template.
+func templateOf(xc *x509.Certificate) string {
+	for _, ext := range xc.Extensions {
+		switch {
+		case ext.Id.Equal(oidCertificateTemplate):
+			var ct certificateTemplate
+			if _, err := asn1.Unmarshal(ext.Value, &ct); err != nil {
+				continue
+			}
+			if name := templateName(ct.ID.String()); name != "" {
+				return name
+			}
+			return ct.ID.String()
+		case ext.Id.Equal(oidEnrollCertType):
+			var name string
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &name, "bmp"); err == nil {
+				return name
+			}
+		}
+	}
+	return ""
+}
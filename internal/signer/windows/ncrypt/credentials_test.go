@@ -0,0 +1,66 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package ncrypt
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestNewCredentialInfo(t *testing.T) {
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 21, 8, 1, 2, 3}
+	ext, err := asn1.Marshal(certificateTemplate{ID: oid, MajorVersion: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(f func(string) string) { templateName = f }(templateName)
+	templateName = func(string) string { return "" }
+
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	xc := &x509.Certificate{
+		Raw:        []byte("certificate"),
+		Subject:    pkix.Name{CommonName: "device.corp.example.com"},
+		Issuer:     pkix.Name{CommonName: "Corp Issuing CA"},
+		NotAfter:   notAfter,
+		Extensions: []pkix.Extension{{Id: oidCertificateTemplate, Value: ext}},
+	}
+	tp := sha1.Sum(xc.Raw)
+	want := CredentialInfo{
+		Subject:    "device.corp.example.com",
+		Issuer:     "Corp Issuing CA",
+		Thumbprint: hex.EncodeToString(tp[:]),
+		Template:   oid.String(),
+		Provider:   "Microsoft Software Key Storage Provider",
+		NotAfter:   notAfter,
+	}
+	if got := newCredentialInfo(xc, "Microsoft Software Key Storage Provider"); got != want {
+		t.Errorf("newCredentialInfo: got %+v, want %+v", got, want)
+	}
+
+	templateName = func(string) string { return "Workstation Authentication" }
+	if got, want := templateOf(xc), "Workstation Authentication"; got != want {
+		t.Errorf("templateOf: got %q, want %q", got, want)
+	}
+	if got := templateOf(&x509.Certificate{}); got != "" {
+		t.Errorf("templateOf without template: got %q, want \"\"", got)
+	}
+}
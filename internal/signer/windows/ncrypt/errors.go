@@ -0,0 +1,151 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package ncrypt
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// winerror.h status codes that map to the sentinel errors below.
+const (
+	nteSilentContext = 0x80090022 // NTE_SILENT_CONTEXT
+	nteUserCancelled = 0x80090036 // NTE_USER_CANCELLED
+	ntePerm          = 0x80090010 // NTE_PERM
+	nteBadKeyset     = 0x80090016 // NTE_BAD_KEYSET
+	eAccessDenied    = 0x80070005 // E_ACCESSDENIED
+)
+
+// ErrInteractionRequired matches errors from operations that needed to show a
+// PIN or smart card dialog while running silently.
+var ErrInteractionRequired = errors.New("ncrypt: user interaction required")
+
+// ErrUserConfirmationRequired matches errors from operations with Windows
+// Hello for Business keys that needed biometric or PIN confirmation while
+// running silently. Such errors also match ErrInteractionRequired.
+var ErrUserConfirmationRequired = errors.New("ncrypt: Windows Hello confirmation required")
+
+// ErrUserCancelled matches errors from operations whose confirmation prompt
+// or certificate selection dialog the user dismissed.
+var ErrUserCancelled = errors.New("ncrypt: operation cancelled by the user")
+
+// ErrKeyAccessDenied matches errors from opening a machine private key that
+// the identity of the signer, such as NETWORK SERVICE or a virtual service
+// account, is not permitted to read.
+var ErrKeyAccessDenied = errors.New("ncrypt: access to the private key denied")
+
+// confirmationError wraps an error that requires Windows Hello confirmation.
+type confirmationError struct {
+	err error
+}
+
+func (e *confirmationError) Error() string {
+	return ErrUserConfirmationRequired.Error() + ": " + e.err.Error()
+}
+
+func (e *confirmationError) Is(target error) bool {
+	return target == ErrUserConfirmationRequired
+}
+
+func (e *confirmationError) Unwrap() error {
+	return e.err
+}
+
+// statusError is an error status returned by a CNG or CryptoAPI function.
+type statusError uint32
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("%#x", uint32(e))
+}
+
+// Is reports whether the status maps to target.
+func (e statusError) Is(target error) bool {
+	switch target {
+	case ErrInteractionRequired:
+		return e == nteSilentContext
+	case ErrUserCancelled:
+		return e == nteUserCancelled
+	case ErrKeyAccessDenied:
+		return e == ntePerm || e == eAccessDenied
+	default:
+		return false
+	}
+}
+
+// providerError distinguishes errors of operations with keys of the key
+// storage provider named provider, such as when a Windows Hello key needed
+// confirmation.
+func providerError(provider string, err error) error {
+	if provider == PassportProvider && errors.Is(err, ErrInteractionRequired) {
+		return &confirmationError{err}
+	}
+	return err
+}
+
+// keyAccessError reports that identity may not read a machine private key.
+type keyAccessError struct {
+	identity string
+	err      error
+}
+
+func (e *keyAccessError) Error() string {
+	return fmt.Sprintf("%s cannot read the private key, grant it Read access with \"Manage Private Keys\" in the local computer certificate manager: %v", e.identity, e.err)
+}
+
+func (e *keyAccessError) Is(target error) bool {
+	return target == ErrKeyAccessDenied
+}
+
+func (e *keyAccessError) Unwrap() error {
+	return e.err
+}
+
+// machineKeyError names the identity of the signer in err from opening a
+// machine private key, if err stems from missing permissions. Windows reports
+// those as NTE_BAD_KEYSET as often as access denied.
+func machineKeyError(err error) error {
+	var status statusError
+	if errors.Is(err, ErrKeyAccessDenied) || (errors.As(err, &status) && status == nteBadKeyset) {
+		return &keyAccessError{identity: currentIdentity(), err: err}
+	}
+	return err
+}
+
+// accessDenied returns the error of machineKeyError for err if err stems from
+// missing permissions, or nil otherwise.
+func accessDenied(err error) error {
+	if err = machineKeyError(err); errors.Is(err, ErrKeyAccessDenied) {
+		return err
+	}
+	return nil
+}
+
+// currentIdentity returns the account name of the current process, such as
+// `NT AUTHORITY\NETWORK SERVICE` or `NT SERVICE\MyService`.
+func currentIdentity() string {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return "the current user"
+	}
+	account, domain, _, err := user.User.Sid.LookupAccount("")
+	if err != nil {
+		return user.User.Sid.String()
+	}
+	return domain + `\` + account
+}
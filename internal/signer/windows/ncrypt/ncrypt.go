@@ -21,11 +21,16 @@ package ncrypt
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"math/big"
 	"unsafe"
 
+	"github.com/googleapis/enterprise-certificate-proxy/internal/ecies"
 	"golang.org/x/crypto/cryptobyte"
 	"golang.org/x/crypto/cryptobyte/asn1"
 	"golang.org/x/sys/windows"
@@ -34,15 +39,40 @@ import (
 const (
 	// bcrypt.h constants
 	bcryptPadPKCS1 = 0x00000002 // BCRYPT_PAD_PKCS1
+	bcryptPadOAEP  = 0x00000004 // BCRYPT_PAD_OAEP
 	bcryptPadPSS   = 0x00000008 // BCRYPT_PAD_PSS
 
+	// bcrypt.h ECDH public key blob magic numbers
+	bcryptECDHPublicP256Magic = 0x314B4345 // BCRYPT_ECDH_PUBLIC_P256_MAGIC
+	bcryptECDHPublicP384Magic = 0x334B4345 // BCRYPT_ECDH_PUBLIC_P384_MAGIC
+	bcryptECDHPublicP521Magic = 0x354B4345 // BCRYPT_ECDH_PUBLIC_P521_MAGIC
+
 	// ncrypt.h constants
-	nCryptSilentFlag = 0x00000040 // NCRYPT_SILENT_FLAG
+	nCryptMachineKeyFlag = 0x00000020 // NCRYPT_MACHINE_KEY_FLAG
+	nCryptSilentFlag     = 0x00000040 // NCRYPT_SILENT_FLAG
+
+	// PlatformCryptoProvider is the key storage provider of keys held by the TPM.
+	PlatformCryptoProvider = "Microsoft Platform Crypto Provider" // MS_PLATFORM_CRYPTO_PROVIDER
+	// PassportProvider is the key storage provider of Windows Hello for
+	// Business keys, whose use requires a biometric or PIN gesture.
+	PassportProvider = "Microsoft Passport Key Storage Provider" // MS_NGC_KEY_STORAGE_PROVIDER
 )
 
 var (
 	nCrypt         = windows.MustLoadDLL("ncrypt.dll")
 	nCryptSignHash = nCrypt.MustFindProc("NCryptSignHash")
+	nCryptDecrypt  = nCrypt.MustFindProc("NCryptDecrypt")
+
+	nCryptOpenStorageProvider = nCrypt.MustFindProc("NCryptOpenStorageProvider")
+	nCryptOpenKey             = nCrypt.MustFindProc("NCryptOpenKey")
+
+	nCryptGetProperty = nCrypt.MustFindProc("NCryptGetProperty")
+	nCryptSetProperty = nCrypt.MustFindProc("NCryptSetProperty")
+	nCryptFreeObject  = nCrypt.MustFindProc("NCryptFreeObject")
+
+	nCryptImportKey       = nCrypt.MustFindProc("NCryptImportKey")
+	nCryptSecretAgreement = nCrypt.MustFindProc("NCryptSecretAgreement")
+	nCryptDeriveKey       = nCrypt.MustFindProc("NCryptDeriveKey")
 )
 
 // bcypt.h structs.
@@ -53,40 +83,79 @@ type pssPaddingInfo struct {
 	algID      *uint16
 	saltLength uint32
 }
+type oaepPaddingInfo struct {
+	algID   *uint16
+	label   *byte
+	labelSz uint32
+}
+
+// sha1AlgID is BCRYPT_SHA1_ALGORITHM. SHA-1 is only used for signatures, and
+// only when Options.AllowLegacyHashes is set.
+var sha1AlgID = []uint16{'S', 'H', 'A', '1', 0}
+
+// signAlgID returns the algorithm identifier of hashFunc for signing.
+func signAlgID(hashFunc crypto.Hash) (*uint16, bool) {
+	if hashFunc == crypto.SHA1 {
+		return &sha1AlgID[0], true
+	}
+	return algID(hashFunc)
+}
 
 func algID(hashFunc crypto.Hash) (*uint16, bool) {
 	algID, ok := map[crypto.Hash][]uint16{
 		crypto.SHA256: {'S', 'H', 'A', '2', '5', '6', 0}, // BCRYPT_SHA256_ALGORITHM
+		crypto.SHA384: {'S', 'H', 'A', '3', '8', '4', 0}, // BCRYPT_SHA384_ALGORITHM
+		crypto.SHA512: {'S', 'H', 'A', '5', '1', '2', 0}, // BCRYPT_SHA512_ALGORITHM
 	}[hashFunc]
+	if !ok {
+		return nil, false
+	}
 	return &algID[0], ok
 }
 
-func rsaPadding(opts crypto.SignerOpts, flags *int) (paddingInfo unsafe.Pointer, err error) {
+// pssSaltLength returns the RSASSA-PSS salt length in bytes that opts select
+// for signatures by pub. As in crypto/rsa, PSSSaltLengthAuto selects the
+// longest salt that fits.
+func pssSaltLength(pub *rsa.PublicKey, opts *rsa.PSSOptions) (uint32, error) {
+	hashLen := opts.HashFunc().Size()
+	// The encoded message is one bit shorter than the modulus.
+	maxSaltLength := (pub.N.BitLen()-1+7)/8 - hashLen - 2
+	saltLength := opts.SaltLength
+	switch saltLength {
+	case rsa.PSSSaltLengthAuto:
+		saltLength = maxSaltLength
+	case rsa.PSSSaltLengthEqualsHash:
+		saltLength = hashLen
+	}
+	if saltLength < 0 || saltLength > maxSaltLength {
+		return 0, fmt.Errorf("invalid RSA-PSS salt length %d for a %d-bit key and %v", opts.SaltLength, pub.N.BitLen(), opts.HashFunc())
+	}
+	return uint32(saltLength), nil
+}
+
+func rsaPadding(pub *rsa.PublicKey, opts crypto.SignerOpts, flags *int) (paddingInfo unsafe.Pointer, err error) {
 	if o, ok := opts.(*rsa.PSSOptions); ok {
-		algID, ok := algID(o.HashFunc())
+		algID, ok := signAlgID(o.HashFunc())
 		if !ok {
-			err = fmt.Errorf("unsupported hash function %T", o.HashFunc())
+			err = fmt.Errorf("unsupported hash function %v", o.HashFunc())
 			return
 		}
-		saltLength := o.SaltLength
-		switch saltLength {
-		case rsa.PSSSaltLengthAuto:
-			err = fmt.Errorf("rsa.PSSSaltLengthAuto is not supported")
+		var saltLength uint32
+		saltLength, err = pssSaltLength(pub, o)
+		if err != nil {
 			return
-		case rsa.PSSSaltLengthEqualsHash:
-			saltLength = o.HashFunc().Size()
 		}
 		paddingInfo = unsafe.Pointer(&pssPaddingInfo{
 			algID:      algID,
-			saltLength: uint32(saltLength),
+			saltLength: saltLength,
 		})
 		*flags |= bcryptPadPSS
 		return
 	}
 
-	algID, ok := algID(opts.HashFunc())
+	algID, ok := signAlgID(opts.HashFunc())
 	if !ok {
-		err = fmt.Errorf("unsupported hash function %T", opts.HashFunc())
+		err = fmt.Errorf("unsupported hash function %v", opts.HashFunc())
 		return
 	}
 	paddingInfo = unsafe.Pointer(&pkcs1PaddingInfo{
@@ -96,6 +165,14 @@ func rsaPadding(opts crypto.SignerOpts, flags *int) (paddingInfo unsafe.Pointer,
 	return
 }
 
+// silentFlag returns NCRYPT_SILENT_FLAG if silent is set.
+func silentFlag(silent bool) int {
+	if silent {
+		return nCryptSilentFlag
+	}
+	return 0
+}
+
 func signHashInternal(priv windows.Handle, pub crypto.PublicKey, digest []byte, flags int, paddingInfo unsafe.Pointer) ([]byte, error) {
 	var size uint32
 	r, _, _ := nCryptSignHash.Call(
@@ -108,7 +185,7 @@ func signHashInternal(priv windows.Handle, pub crypto.PublicKey, digest []byte,
 		/* *pcbResult */ uintptr(unsafe.Pointer(&size)),
 		/* dwFlagss */ uintptr(flags))
 	if r != 0 {
-		return nil, fmt.Errorf("NCryptSignHash: failed to get signature length: %#x", r)
+		return nil, fmt.Errorf("NCryptSignHash: failed to get signature length: %w", statusError(r))
 	}
 
 	sig := make([]byte, size)
@@ -122,7 +199,7 @@ func signHashInternal(priv windows.Handle, pub crypto.PublicKey, digest []byte,
 		/* *pcbResult */ uintptr(unsafe.Pointer(&size)),
 		/* dwFlagss */ uintptr(flags))
 	if r != 0 {
-		return nil, fmt.Errorf("NCryptSignHash: failed to get signature: %#x", r)
+		return nil, fmt.Errorf("NCryptSignHash: failed to get signature: %w", statusError(r))
 	}
 	if len(sig) != int(size) {
 		return nil, fmt.Errorf("invalid length sig = %d, size = %d", sig, size)
@@ -147,18 +224,22 @@ func signHashInternal(priv windows.Handle, pub crypto.PublicKey, digest []byte,
 // subset of well-supported cryptographic primitives.
 //
 // Signature algorithms: ECDSA, RSA.
-// Hash functions: SHA-256.
-// RSA schemes: RSASSA-PKCS1 and RSASSA-PSS.
+// Hash functions: SHA-256, SHA-384, SHA-512, and SHA-1 for legacy peers.
+// RSA schemes: RSASSA-PKCS1 and RSASSA-PSS with any salt length that
+// rsa.PSSOptions can select.
+//
+// When silent is set, operations that need to show a PIN or smart card dialog
+// fail with an error matching ErrInteractionRequired instead.
 //
 // https://docs.microsoft.com/en-us/windows/win32/api/ncrypt/nf-ncrypt-ncryptsignhash
-func SignHash(priv windows.Handle, pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+func SignHash(priv windows.Handle, pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts, silent bool) ([]byte, error) {
 	var paddingInfo unsafe.Pointer
-	flags := nCryptSilentFlag
+	flags := silentFlag(silent)
 	switch pub := pub.(type) {
 	case *ecdsa.PublicKey:
 	case *rsa.PublicKey:
 		var err error
-		paddingInfo, err = rsaPadding(opts, &flags)
+		paddingInfo, err = rsaPadding(pub, opts, &flags)
 		if err != nil {
 			return nil, err
 		}
@@ -168,3 +249,424 @@ func SignHash(priv windows.Handle, pub crypto.PublicKey, digest []byte, opts cry
 
 	return signHashInternal(priv, pub, digest, flags, paddingInfo)
 }
+
+// decryptPadding returns the NCryptDecrypt padding information and flags for
+// opts: *rsa.OAEPOptions, *rsa.PKCS1v15DecryptOptions, or nil for RSA-OAEP
+// with SHA-256.
+func decryptPadding(opts crypto.DecrypterOpts) (paddingInfo unsafe.Pointer, flags int, err error) {
+	switch opts := opts.(type) {
+	case nil:
+		return decryptPadding(&rsa.OAEPOptions{Hash: crypto.SHA256})
+	case *rsa.OAEPOptions:
+		algID, ok := algID(opts.Hash)
+		if !ok {
+			return nil, 0, fmt.Errorf("unsupported OAEP hash function %v", opts.Hash)
+		}
+		info := &oaepPaddingInfo{algID: algID}
+		if len(opts.Label) > 0 {
+			info.label = &opts.Label[0]
+			info.labelSz = uint32(len(opts.Label))
+		}
+		return unsafe.Pointer(info), bcryptPadOAEP, nil
+	case *rsa.PKCS1v15DecryptOptions:
+		if opts.SessionKeyLen != 0 {
+			return nil, 0, fmt.Errorf("PKCS #1 v1.5 session key decryption is not supported")
+		}
+		return nil, bcryptPadPKCS1, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported decryption options %T", opts)
+	}
+}
+
+// Decrypt is a wrapper for the NCryptDecrypt function that decrypts RSA
+// ciphertexts.
+//
+// RSA schemes: RSAES-OAEP with SHA-256, SHA-384 or SHA-512, and RSAES-PKCS1-v1_5.
+//
+// silent is as in SignHash.
+//
+// https://learn.microsoft.com/en-us/windows/win32/api/ncrypt/nf-ncrypt-ncryptdecrypt
+func Decrypt(priv windows.Handle, pub crypto.PublicKey, ciphertext []byte, opts crypto.DecrypterOpts, silent bool) ([]byte, error) {
+	if _, ok := pub.(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("unsupported public key type %T, only RSA keys support decryption", pub)
+	}
+	if len(ciphertext) == 0 {
+		return nil, fmt.Errorf("empty ciphertext")
+	}
+	paddingInfo, flags, err := decryptPadding(opts)
+	if err != nil {
+		return nil, err
+	}
+	flags |= silentFlag(silent)
+
+	var size uint32
+	r, _, _ := nCryptDecrypt.Call(
+		/* hKey */ uintptr(priv),
+		/* pbInput */ uintptr(unsafe.Pointer(&ciphertext[0])),
+		/* cbInput */ uintptr(len(ciphertext)),
+		/* *pPaddingInfo */ uintptr(paddingInfo),
+		/* pbOutput */ 0,
+		/* cbOutput */ 0,
+		/* *pcbResult */ uintptr(unsafe.Pointer(&size)),
+		/* dwFlags */ uintptr(flags))
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptDecrypt: failed to get plaintext length: %w", statusError(r))
+	}
+	if size == 0 {
+		return []byte{}, nil
+	}
+
+	plaintext := make([]byte, size)
+	r, _, _ = nCryptDecrypt.Call(
+		/* hKey */ uintptr(priv),
+		/* pbInput */ uintptr(unsafe.Pointer(&ciphertext[0])),
+		/* cbInput */ uintptr(len(ciphertext)),
+		/* *pPaddingInfo */ uintptr(paddingInfo),
+		/* pbOutput */ uintptr(unsafe.Pointer(&plaintext[0])),
+		/* cbOutput */ uintptr(size),
+		/* *pcbResult */ uintptr(unsafe.Pointer(&size)),
+		/* dwFlags */ uintptr(flags))
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptDecrypt: failed to decrypt: %w", statusError(r))
+	}
+	return plaintext[:size], nil
+}
+
+// Encrypt encrypts plaintext with a public key in Go. For RSA keys it uses the
+// padding schemes that Decrypt supports, and opts is *rsa.OAEPOptions,
+// *rsa.PKCS1v15DecryptOptions, or nil for RSA-OAEP with SHA-256. EC keys use
+// ECIES, which Key.Decrypt undoes with SecretAgreement, and opts must be nil.
+func Encrypt(pub crypto.PublicKey, plaintext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if ecPub, ok := pub.(*ecdsa.PublicKey); ok {
+		if opts != nil {
+			return nil, fmt.Errorf("unsupported encryption options %T for an EC key", opts)
+		}
+		return ecies.Encrypt(rand.Reader, ecPub, plaintext)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	switch opts := opts.(type) {
+	case nil:
+		return rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPub, plaintext, nil)
+	case *rsa.OAEPOptions:
+		if _, ok := algID(opts.Hash); !ok {
+			return nil, fmt.Errorf("unsupported OAEP hash function %v", opts.Hash)
+		}
+		return rsa.EncryptOAEP(opts.Hash.New(), rand.Reader, rsaPub, plaintext, opts.Label)
+	case *rsa.PKCS1v15DecryptOptions:
+		return rsa.EncryptPKCS1v15(rand.Reader, rsaPub, plaintext)
+	default:
+		return nil, fmt.Errorf("unsupported encryption options %T", opts)
+	}
+}
+
+// getProperty wraps NCryptGetProperty, returning the raw value of the named
+// property of a key or provider handle.
+func getProperty(h windows.Handle, name string) ([]byte, error) {
+	namePtr, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	var size uint32
+	r, _, _ := nCryptGetProperty.Call(
+		/* hObject */ uintptr(h),
+		/* pszProperty */ uintptr(unsafe.Pointer(namePtr)),
+		/* pbOutput */ 0,
+		/* cbOutput */ 0,
+		/* *pcbResult */ uintptr(unsafe.Pointer(&size)),
+		/* dwFlags */ nCryptSilentFlag)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptGetProperty(%s): failed to get property length: %#x", name, r)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	r, _, _ = nCryptGetProperty.Call(
+		/* hObject */ uintptr(h),
+		/* pszProperty */ uintptr(unsafe.Pointer(namePtr)),
+		/* pbOutput */ uintptr(unsafe.Pointer(&buf[0])),
+		/* cbOutput */ uintptr(size),
+		/* *pcbResult */ uintptr(unsafe.Pointer(&size)),
+		/* dwFlags */ nCryptSilentFlag)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptGetProperty(%s): failed to get property: %#x", name, r)
+	}
+	return buf[:size], nil
+}
+
+// OpenKey wraps NCryptOpenStorageProvider and NCryptOpenKey to open the key in
+// container through the key storage provider named provider. machine selects
+// a machine rather than a user key. The caller must free the returned handle
+// with FreeKey.
+//
+// https://learn.microsoft.com/en-us/windows/win32/api/ncrypt/nf-ncrypt-ncryptopenkey
+func OpenKey(provider, container string, machine, silent bool) (windows.Handle, error) {
+	providerPtr, err := windows.UTF16PtrFromString(provider)
+	if err != nil {
+		return 0, err
+	}
+	containerPtr, err := windows.UTF16PtrFromString(container)
+	if err != nil {
+		return 0, err
+	}
+	var prov windows.Handle
+	r, _, _ := nCryptOpenStorageProvider.Call(
+		/* *phProvider */ uintptr(unsafe.Pointer(&prov)),
+		/* pszProviderName */ uintptr(unsafe.Pointer(providerPtr)),
+		/* dwFlags */ 0)
+	if r != 0 {
+		return 0, fmt.Errorf("NCryptOpenStorageProvider(%s): %w", provider, statusError(r))
+	}
+	defer nCryptFreeObject.Call(uintptr(prov))
+
+	flags := silentFlag(silent)
+	if machine {
+		flags |= nCryptMachineKeyFlag
+	}
+	var key windows.Handle
+	r, _, _ = nCryptOpenKey.Call(
+		/* hProvider */ uintptr(prov),
+		/* *phKey */ uintptr(unsafe.Pointer(&key)),
+		/* pszKeyName */ uintptr(unsafe.Pointer(containerPtr)),
+		/* dwLegacyKeySpec */ 0,
+		/* dwFlags */ uintptr(flags))
+	if r != 0 {
+		return 0, fmt.Errorf("NCryptOpenKey(%s): %w", container, statusError(r))
+	}
+	return key, nil
+}
+
+// FreeKey releases a key handle returned by OpenKey.
+func FreeKey(key windows.Handle) {
+	nCryptFreeObject.Call(uintptr(key))
+}
+
+// setProperty wraps NCryptSetProperty to set the named property of a key to
+// the value of size bytes at value.
+func setProperty(h windows.Handle, name string, value unsafe.Pointer, size int) error {
+	namePtr, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	r, _, _ := nCryptSetProperty.Call(
+		/* hObject */ uintptr(h),
+		/* pszProperty */ uintptr(unsafe.Pointer(namePtr)),
+		/* pbInput */ uintptr(value),
+		/* cbInput */ uintptr(size),
+		/* dwFlags */ 0)
+	if r != 0 {
+		return fmt.Errorf("NCryptSetProperty(%s): %w", name, statusError(r))
+	}
+	return nil
+}
+
+// SetPIN wraps NCryptSetProperty to supply the smart card PIN for subsequent
+// operations with the private key, so that they need not show a PIN dialog.
+func SetPIN(priv windows.Handle, pin string) error {
+	value, err := windows.UTF16FromString(pin)
+	if err != nil {
+		return err
+	}
+	err = setProperty(priv, "SmartCardPin", unsafe.Pointer(&value[0]), 2*len(value)) // NCRYPT_PIN_PROPERTY
+	// Do not leave the PIN in memory longer than needed.
+	for i := range value {
+		value[i] = 0
+	}
+	return err
+}
+
+// SetPromptOwner sets the window that owns the Windows Hello or PIN prompt of
+// subsequent operations with the private key, so that the prompt appears in
+// front of it, and the message that the prompt shows, if not empty.
+func SetPromptOwner(priv windows.Handle, hwnd windows.HWND, message string) error {
+	if err := setProperty(priv, "HWND Handle", unsafe.Pointer(&hwnd), int(unsafe.Sizeof(hwnd))); err != nil { // NCRYPT_WINDOW_HANDLE_PROPERTY
+		return err
+	}
+	if message == "" {
+		return nil
+	}
+	value, err := windows.UTF16FromString(message)
+	if err != nil {
+		return err
+	}
+	return setProperty(priv, "Use Context", unsafe.Pointer(&value[0]), 2*len(value)) // NCRYPT_USE_CONTEXT_PROPERTY
+}
+
+// ProviderName returns the name of the key storage provider holding the
+// private key, such as PlatformCryptoProvider for keys held by the TPM.
+func ProviderName(priv windows.Handle) (string, error) {
+	prov, err := providerHandle(priv)
+	if err != nil {
+		return "", err
+	}
+	defer nCryptFreeObject.Call(uintptr(prov))
+	name, err := getProperty(prov, "Name") // NCRYPT_NAME_PROPERTY
+	if err != nil {
+		return "", err
+	}
+	return utf16BytesToString(name), nil
+}
+
+// providerHandle returns a handle to the key storage provider holding the
+// private key. The caller must free it with NCryptFreeObject.
+func providerHandle(priv windows.Handle) (windows.Handle, error) {
+	buf, err := getProperty(priv, "Provider Handle") // NCRYPT_PROVIDER_HANDLE_PROPERTY
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) != int(unsafe.Sizeof(uintptr(0))) {
+		return 0, fmt.Errorf("invalid provider handle of %d bytes", len(buf))
+	}
+	return *(*windows.Handle)(unsafe.Pointer(&buf[0])), nil
+}
+
+// utf16BytesToString decodes a NUL-terminated UTF-16 string.
+func utf16BytesToString(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i]) | uint16(b[2*i+1])<<8
+	}
+	return windows.UTF16ToString(u)
+}
+
+// checkProviderSignOpts rejects signing options that the key storage provider
+// is known not to support, with a clearer error than the provider's status
+// code. The Platform Crypto Provider only produces RSASSA-PSS signatures whose
+// salt is as long as the hash.
+func checkProviderSignOpts(provider string, opts crypto.SignerOpts) error {
+	if provider != PlatformCryptoProvider {
+		return nil
+	}
+	if o, ok := opts.(*rsa.PSSOptions); ok {
+		if o.SaltLength != rsa.PSSSaltLengthEqualsHash && o.SaltLength != o.HashFunc().Size() {
+			return fmt.Errorf("the %s only supports RSA-PSS salts as long as the hash", provider)
+		}
+	}
+	return nil
+}
+
+// eccPublicBlob encodes pub as a BCRYPT_ECCPUBLIC_BLOB for ECDH.
+func eccPublicBlob(pub *ecdsa.PublicKey) ([]byte, error) {
+	var magic uint32
+	switch pub.Curve {
+	case elliptic.P256():
+		magic = bcryptECDHPublicP256Magic
+	case elliptic.P384():
+		magic = bcryptECDHPublicP384Magic
+	case elliptic.P521():
+		magic = bcryptECDHPublicP521Magic
+	default:
+		return nil, fmt.Errorf("unsupported curve %s", pub.Curve.Params().Name)
+	}
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	blob := make([]byte, 8+2*size)
+	binary.LittleEndian.PutUint32(blob[0:4], magic)
+	binary.LittleEndian.PutUint32(blob[4:8], uint32(size))
+	pub.X.FillBytes(blob[8 : 8+size])
+	pub.Y.FillBytes(blob[8+size:])
+	return blob, nil
+}
+
+// reverse returns b in reverse byte order.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+// SecretAgreement wraps NCryptSecretAgreement and NCryptDeriveKey to perform
+// ECDH between the private key and peer. It returns the raw shared secret,
+// the big-endian x-coordinate of the shared point, for use with a key
+// derivation function. The key must allow key agreement, and peer must be on
+// the same curve.
+//
+// silent is as in SignHash.
+//
+// https://learn.microsoft.com/en-us/windows/win32/api/ncrypt/nf-ncrypt-ncryptsecretagreement
+func SecretAgreement(priv windows.Handle, pub crypto.PublicKey, peer *ecdsa.PublicKey, silent bool) ([]byte, error) {
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type %T, only EC keys support key agreement", pub)
+	}
+	if peer == nil || peer.Curve != ecPub.Curve {
+		return nil, fmt.Errorf("peer public key must be on %s", ecPub.Curve.Params().Name)
+	}
+	blob, err := eccPublicBlob(peer)
+	if err != nil {
+		return nil, err
+	}
+	prov, err := providerHandle(priv)
+	if err != nil {
+		return nil, err
+	}
+	defer nCryptFreeObject.Call(uintptr(prov))
+
+	blobType, err := windows.UTF16PtrFromString("ECCPUBLICBLOB") // BCRYPT_ECCPUBLIC_BLOB
+	if err != nil {
+		return nil, err
+	}
+	var peerKey windows.Handle
+	r, _, _ := nCryptImportKey.Call(
+		/* hProvider */ uintptr(prov),
+		/* hImportKey */ 0,
+		/* pszBlobType */ uintptr(unsafe.Pointer(blobType)),
+		/* pParameterList */ 0,
+		/* *phKey */ uintptr(unsafe.Pointer(&peerKey)),
+		/* pbData */ uintptr(unsafe.Pointer(&blob[0])),
+		/* cbData */ uintptr(len(blob)),
+		/* dwFlags */ 0)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptImportKey: failed to import peer public key: %w", statusError(r))
+	}
+	defer nCryptFreeObject.Call(uintptr(peerKey))
+
+	var secret windows.Handle
+	r, _, _ = nCryptSecretAgreement.Call(
+		/* hPrivKey */ uintptr(priv),
+		/* hPubKey */ uintptr(peerKey),
+		/* *phAgreedSecret */ uintptr(unsafe.Pointer(&secret)),
+		/* dwFlags */ uintptr(silentFlag(silent)))
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptSecretAgreement: %w", statusError(r))
+	}
+	defer nCryptFreeObject.Call(uintptr(secret))
+
+	kdf, err := windows.UTF16PtrFromString("TRUNCATE") // BCRYPT_KDF_RAW_SECRET
+	if err != nil {
+		return nil, err
+	}
+	var size uint32
+	r, _, _ = nCryptDeriveKey.Call(
+		/* hSharedSecret */ uintptr(secret),
+		/* pwszKDF */ uintptr(unsafe.Pointer(kdf)),
+		/* pParameterList */ 0,
+		/* pbDerivedKey */ 0,
+		/* cbDerivedKey */ 0,
+		/* *pcbResult */ uintptr(unsafe.Pointer(&size)),
+		/* dwFlags */ 0)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptDeriveKey: failed to get secret length: %w", statusError(r))
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("NCryptDeriveKey: empty secret")
+	}
+	raw := make([]byte, size)
+	r, _, _ = nCryptDeriveKey.Call(
+		/* hSharedSecret */ uintptr(secret),
+		/* pwszKDF */ uintptr(unsafe.Pointer(kdf)),
+		/* pParameterList */ 0,
+		/* pbDerivedKey */ uintptr(unsafe.Pointer(&raw[0])),
+		/* cbDerivedKey */ uintptr(size),
+		/* *pcbResult */ uintptr(unsafe.Pointer(&size)),
+		/* dwFlags */ 0)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptDeriveKey: failed to get secret: %w", statusError(r))
+	}
+	// The raw secret is returned in little-endian byte order.
+	return reverse(raw[:size]), nil
+}
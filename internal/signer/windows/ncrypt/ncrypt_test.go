@@ -0,0 +1,360 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package ncrypt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestDecryptPadding(t *testing.T) {
+	tests := []struct {
+		opts      crypto.DecrypterOpts
+		wantFlags int
+		wantErr   bool
+	}{
+		{opts: nil, wantFlags: bcryptPadOAEP},
+		{opts: &rsa.OAEPOptions{Hash: crypto.SHA384, Label: []byte("label")}, wantFlags: bcryptPadOAEP},
+		{opts: &rsa.OAEPOptions{Hash: crypto.SHA1}, wantErr: true},
+		{opts: &rsa.PKCS1v15DecryptOptions{}, wantFlags: bcryptPadPKCS1},
+		{opts: &rsa.PKCS1v15DecryptOptions{SessionKeyLen: 32}, wantErr: true},
+		{opts: crypto.SHA256, wantErr: true},
+	}
+	for _, test := range tests {
+		_, flags, err := decryptPadding(test.opts)
+		if (err != nil) != test.wantErr {
+			t.Errorf("decryptPadding(%#v): got err %v, want error %v", test.opts, err, test.wantErr)
+			continue
+		}
+		if flags != test.wantFlags {
+			t.Errorf("decryptPadding(%#v): got flags %#x, want %#x", test.opts, flags, test.wantFlags)
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("payload")
+	for _, opts := range []crypto.DecrypterOpts{
+		nil,
+		&rsa.OAEPOptions{Hash: crypto.SHA512, Label: []byte("label")},
+		&rsa.PKCS1v15DecryptOptions{},
+	} {
+		ciphertext, err := Encrypt(priv.Public(), plaintext, opts)
+		if err != nil {
+			t.Errorf("Encrypt(%#v): got %v, want nil err", opts, err)
+			continue
+		}
+		if opts == nil {
+			opts = &rsa.OAEPOptions{Hash: crypto.SHA256}
+		}
+		got, err := priv.Decrypt(rand.Reader, ciphertext, opts)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("Decrypt(%#v): got %q, %v, want %q", opts, got, err, plaintext)
+		}
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Encrypt(ecKey.Public(), plaintext, nil); err == nil {
+		t.Error("Encrypt with an ECDSA key: got nil err, want error")
+	}
+}
+
+func TestCheckProviderSignOpts(t *testing.T) {
+	tests := []struct {
+		provider string
+		opts     crypto.SignerOpts
+		wantErr  bool
+	}{
+		{provider: PlatformCryptoProvider, opts: crypto.SHA256},
+		{provider: PlatformCryptoProvider, opts: &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: rsa.PSSSaltLengthEqualsHash}},
+		{provider: PlatformCryptoProvider, opts: &rsa.PSSOptions{Hash: crypto.SHA384, SaltLength: 48}},
+		{provider: PlatformCryptoProvider, opts: &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: 20}, wantErr: true},
+		{provider: "Microsoft Software Key Storage Provider", opts: &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: 20}},
+	}
+	for _, test := range tests {
+		if err := checkProviderSignOpts(test.provider, test.opts); (err != nil) != test.wantErr {
+			t.Errorf("checkProviderSignOpts(%q, %#v): got %v, want error %v", test.provider, test.opts, err, test.wantErr)
+		}
+	}
+}
+
+func TestUTF16BytesToString(t *testing.T) {
+	b := []byte{'T', 0, 'P', 0, 'M', 0, 0, 0}
+	if got, want := utf16BytesToString(b), "TPM"; got != want {
+		t.Errorf("utf16BytesToString: got %q, want %q", got, want)
+	}
+}
+
+func TestStoreLocation(t *testing.T) {
+	tests := []struct {
+		provider string
+		want     uint32
+		wantErr  bool
+	}{
+		{provider: "", want: certStoreCurrentUser},
+		{provider: "current_user", want: certStoreCurrentUser},
+		{provider: "local_machine", want: certStoreLocalMachine},
+		{provider: "local_machine_enterprise", want: 9 << 16},
+		{provider: "machine", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := storeLocation(test.provider)
+		if (err != nil) != test.wantErr {
+			t.Errorf("storeLocation(%q): got error %v, want error %v", test.provider, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("storeLocation(%q): got %#x, want %#x", test.provider, got, test.want)
+		}
+	}
+}
+
+func TestStatusErrorIs(t *testing.T) {
+	err := fmt.Errorf("NCryptSignHash: failed to get signature: %w", statusError(nteSilentContext))
+	if !errors.Is(err, ErrInteractionRequired) {
+		t.Errorf("errors.Is(%v, ErrInteractionRequired): got false, want true", err)
+	}
+	err = fmt.Errorf("NCryptSignHash: failed to get signature: %w", statusError(0x80090016)) // NTE_BAD_KEYSET
+	if errors.Is(err, ErrInteractionRequired) {
+		t.Errorf("errors.Is(%v, ErrInteractionRequired): got true, want false", err)
+	}
+	for _, status := range []statusError{ntePerm, eAccessDenied} {
+		if err := fmt.Errorf("acquiring private key: %w", status); !errors.Is(err, ErrKeyAccessDenied) {
+			t.Errorf("errors.Is(%v, ErrKeyAccessDenied): got false, want true", err)
+		}
+	}
+}
+
+func TestMachineKeyError(t *testing.T) {
+	tests := []struct {
+		status statusError
+		want   bool
+	}{
+		{status: nteBadKeyset, want: true},
+		{status: ntePerm, want: true},
+		{status: eAccessDenied, want: true},
+		{status: nteSilentContext, want: false},
+	}
+	for _, test := range tests {
+		err := machineKeyError(fmt.Errorf("acquiring private key: %w", test.status))
+		if got := errors.Is(err, ErrKeyAccessDenied); got != test.want {
+			t.Errorf("errors.Is(machineKeyError(%v), ErrKeyAccessDenied): got %v, want %v", test.status, got, test.want)
+		}
+		if got := accessDenied(err) != nil; got != test.want {
+			t.Errorf("accessDenied(%v) != nil: got %v, want %v", err, got, test.want)
+		}
+	}
+}
+
+func TestPSSSaltLength(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		opts    *rsa.PSSOptions
+		want    uint32
+		wantErr bool
+	}{
+		{opts: &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: rsa.PSSSaltLengthEqualsHash}, want: 32},
+		{opts: &rsa.PSSOptions{Hash: crypto.SHA384, SaltLength: rsa.PSSSaltLengthEqualsHash}, want: 48},
+		{opts: &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: rsa.PSSSaltLengthAuto}, want: 256 - 32 - 2},
+		{opts: &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: 20}, want: 20},
+		{opts: &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: 0}, want: 0},
+		{opts: &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: 223}, wantErr: true},
+		{opts: &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: -2}, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := pssSaltLength(&priv.PublicKey, test.opts)
+		if (err != nil) != test.wantErr {
+			t.Errorf("pssSaltLength(%+v): got error %v, want error %v", test.opts, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("pssSaltLength(%+v): got %d, want %d", test.opts, got, test.want)
+		}
+	}
+}
+
+func TestECCPublicBlob(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := eccPublicBlob(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("eccPublicBlob: %v", err)
+	}
+	want := []byte{'E', 'C', 'K', '3', 48, 0, 0, 0}
+	if !bytes.Equal(blob[:8], want) {
+		t.Errorf("eccPublicBlob header: got %x, want %x", blob[:8], want)
+	}
+	if got, want := blob[8:], elliptic.Marshal(elliptic.P384(), priv.X, priv.Y)[1:]; !bytes.Equal(got, want) {
+		t.Errorf("eccPublicBlob coordinates: got %x, want %x", got, want)
+	}
+
+	p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eccPublicBlob(&p224.PublicKey); err == nil {
+		t.Error("eccPublicBlob(P-224): got nil error, want error")
+	}
+}
+
+func TestReverse(t *testing.T) {
+	if got, want := reverse([]byte{1, 2, 3}), []byte{3, 2, 1}; !bytes.Equal(got, want) {
+		t.Errorf("reverse: got %v, want %v", got, want)
+	}
+}
+
+func TestCAPIAlgID(t *testing.T) {
+	tests := []struct {
+		hash   crypto.Hash
+		want   uint32
+		wantOK bool
+	}{
+		{hash: crypto.SHA1, want: calgSHA1, wantOK: true},
+		{hash: crypto.SHA256, want: calgSHA256, wantOK: true},
+		{hash: crypto.SHA512, want: calgSHA512, wantOK: true},
+		{hash: crypto.MD5, wantOK: false},
+	}
+	for _, test := range tests {
+		got, ok := capiAlgID(test.hash)
+		if ok != test.wantOK || got != test.want {
+			t.Errorf("capiAlgID(%v): got %#x, %v, want %#x, %v", test.hash, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestChainEngine(t *testing.T) {
+	tests := []struct {
+		provider string
+		want     windows.Handle
+	}{
+		{provider: "", want: hcceCurrentUser},
+		{provider: "current_user", want: hcceCurrentUser},
+		{provider: "current_user_group_policy", want: hcceCurrentUser},
+		{provider: "local_machine", want: hcceLocalMachine},
+		{provider: "local_machine_enterprise", want: hcceLocalMachine},
+	}
+	for _, test := range tests {
+		if got := chainEngine(test.provider); got != test.want {
+			t.Errorf("chainEngine(%q): got %v, want %v", test.provider, got, test.want)
+		}
+	}
+}
+
+func TestWithoutRoot(t *testing.T) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Root"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Leaf"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, root, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := withoutRoot([]*x509.Certificate{leaf, root}); len(got) != 1 || got[0] != leaf {
+		t.Errorf("withoutRoot(leaf, root): got %d certificates, want the leaf", len(got))
+	}
+	if got := withoutRoot([]*x509.Certificate{leaf}); len(got) != 1 {
+		t.Errorf("withoutRoot(leaf): got %d certificates, want 1", len(got))
+	}
+	if got := withoutRoot([]*x509.Certificate{root}); len(got) != 1 {
+		t.Errorf("withoutRoot(root): got %d certificates, want 1", len(got))
+	}
+}
+
+func TestSignAlgID(t *testing.T) {
+	for _, hash := range []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		if _, ok := signAlgID(hash); !ok {
+			t.Errorf("signAlgID(%v): got false, want true", hash)
+		}
+	}
+	if _, ok := signAlgID(crypto.MD5); ok {
+		t.Error("signAlgID(MD5): got true, want false")
+	}
+	if _, ok := algID(crypto.SHA1); ok {
+		t.Error("algID(SHA1): got true, want false")
+	}
+}
+
+func TestProviderError(t *testing.T) {
+	silent := fmt.Errorf("NCryptSignHash: failed to get signature: %w", statusError(nteSilentContext))
+	err := providerError(PassportProvider, silent)
+	if !errors.Is(err, ErrUserConfirmationRequired) || !errors.Is(err, ErrInteractionRequired) {
+		t.Errorf("providerError(PassportProvider, %v): got %v, want ErrUserConfirmationRequired and ErrInteractionRequired", silent, err)
+	}
+	if err := providerError(PlatformCryptoProvider, silent); errors.Is(err, ErrUserConfirmationRequired) {
+		t.Errorf("providerError(PlatformCryptoProvider, %v): got %v, want ErrInteractionRequired only", silent, err)
+	}
+	if err := providerError(PassportProvider, nil); err != nil {
+		t.Errorf("providerError(PassportProvider, nil): got %v, want nil", err)
+	}
+	cancelled := fmt.Errorf("NCryptSignHash: failed to get signature: %w", statusError(nteUserCancelled))
+	if err := providerError(PassportProvider, cancelled); !errors.Is(err, ErrUserCancelled) || errors.Is(err, ErrUserConfirmationRequired) {
+		t.Errorf("providerError(PassportProvider, %v): got %v, want ErrUserCancelled", cancelled, err)
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package ncrypt
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+)
+
+var (
+	oidCertificateTemplate = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 21, 7} // szOID_CERTIFICATE_TEMPLATE
+	oidEnrollCertType      = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2} // szOID_ENROLL_CERTTYPE_EXTENSION
+	oidExtKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// Extended key usage OIDs accepted by Options.ExtKeyUsages.
+const (
+	ExtKeyUsageClientAuth = "1.3.6.1.5.5.7.3.2" // szOID_PKIX_KP_CLIENT_AUTH
+	ExtKeyUsageAny        = "2.5.29.37.0"       // szOID_ANY_ENHANCED_KEY_USAGE
+)
+
+// templateName resolves the OID of a certificate template to its display
+// name. It is a variable so that tests need not register templates.
+var templateName = lookupTemplateName
+
+// Options selects the certificate that CredWithOptions uses.
+type Options struct {
+	Issuer string // Issuer name of the certificate, matched as by CERT_FIND_ISSUER_STR.
+	// Issuers lists additional issuer names accepted during a CA migration, in
+	// decreasing order of preference after Issuer. A certificate from a more
+	// preferred issuer is selected over one from a less preferred issuer.
+	Issuers  []string
+	Store    string // System store name, such as "MY". Defaults to DefaultStoreName.
+	Provider string // Store location, such as "current_user" or "local_machine". Defaults to "current_user".
+	// Thumbprint is the hex-encoded SHA-1 or SHA-256 thumbprint of the
+	// certificate. Spaces and colons are ignored, so thumbprints may be copied
+	// from the certificate manager or from device management reports.
+	Thumbprint string
+	// Template is the Active Directory Certificate Services template that
+	// issued the certificate, given as its OID or its name, such as
+	// "Workstation Authentication". Names of version 2 and later templates are
+	// resolved through the template information that domain members cache.
+	Template string
+	// ExtKeyUsages lists the extended key usage OIDs of which the certificate
+	// must carry at least one, so that EFS, smart card logon and code signing
+	// certificates from the same issuer are never selected. It defaults to
+	// ExtKeyUsageClientAuth. Certificates without the extension, or with
+	// ExtKeyUsageAny, are valid for any usage; including ExtKeyUsageAny in the
+	// list disables the filter.
+	ExtKeyUsages []string
+	// Silent makes signing and decryption fail with an error matching
+	// ErrInteractionRequired instead of showing PIN or smart card dialogs,
+	// which nobody would see when running as a headless service.
+	Silent bool
+	// KeyProvider names the key storage provider through which the private
+	// key is opened, such as "Microsoft Smart Card Key Storage Provider", when
+	// the certificate's key is reachable through several providers.
+	// Certificates whose key the provider cannot open are skipped.
+	KeyProvider string
+	// AllowLegacyHashes permits SHA-1 signatures, such as rsa_pkcs1_sha1,
+	// for legacy TLS-inspection appliances that still negotiate them.
+	AllowLegacyHashes bool
+	// ExcludeRoot omits the self-signed root certificate from the chain, since
+	// relying parties already have it.
+	ExcludeRoot bool
+	// PromptMessage is shown by the Windows Hello prompt that keys of the
+	// PassportProvider require, unless Silent is set.
+	PromptMessage string
+	// PIN is the smart card PIN, supplied to the key when it is opened so
+	// that automated pipelines can use PIV cards without a PIN dialog.
+	PIN string
+	// PINFunc returns the smart card PIN, such as from a credential provider.
+	// It takes precedence over PIN and is called whenever the key is opened:
+	// on first use, and again after an operation fails.
+	PINFunc func() (string, error)
+	// PickCertificate lets desktop users choose between several matching
+	// certificates in the Windows certificate selection dialog. The choice is
+	// remembered for these options until the certificate stops matching. The
+	// dialog is not shown when Thumbprint or Silent is set.
+	PickCertificate bool
+}
+
+// pinFunc returns the function that supplies the smart card PIN, or nil if no
+// PIN is configured.
+func (opts Options) pinFunc() func() (string, error) {
+	if opts.PINFunc != nil {
+		return opts.PINFunc
+	}
+	if opts.PIN != "" {
+		pin := opts.PIN
+		return func() (string, error) { return pin, nil }
+	}
+	return nil
+}
+
+// issuers returns the issuers whose certificates are candidates, in decreasing
+// order of preference.
+func (opts Options) issuers() []string {
+	var issuers []string
+	if opts.Issuer != "" {
+		issuers = append(issuers, opts.Issuer)
+	}
+	for _, issuer := range opts.Issuers {
+		if issuer != "" {
+			issuers = append(issuers, issuer)
+		}
+	}
+	return issuers
+}
+
+// validate checks that opts select a certificate.
+func (opts Options) validate() error {
+	if len(opts.issuers()) == 0 && opts.Thumbprint == "" {
+		return errors.New("an issuer or a thumbprint is required")
+	}
+	return opts.validateCriteria()
+}
+
+// validateCriteria checks the format of the selection criteria that are set.
+func (opts Options) validateCriteria() error {
+	for _, eku := range opts.ExtKeyUsages {
+		if _, err := parseOID(eku); err != nil {
+			return fmt.Errorf("invalid extended key usage %q: %w", eku, err)
+		}
+	}
+	if opts.Thumbprint != "" {
+		tp, err := hex.DecodeString(normalizeThumbprint(opts.Thumbprint))
+		if err != nil || (len(tp) != sha1.Size && len(tp) != sha256.Size) {
+			return fmt.Errorf("invalid SHA-1 or SHA-256 thumbprint %q", opts.Thumbprint)
+		}
+	}
+	return nil
+}
+
+// matches reports whether xc satisfies the criteria that the certificate
+// store search does not apply.
+func (opts Options) matches(xc *x509.Certificate) bool {
+	if opts.Template != "" && !matchesTemplate(xc, opts.Template) {
+		return false
+	}
+	if !matchesExtKeyUsage(xc, opts.extKeyUsages()) {
+		return false
+	}
+	if opts.Thumbprint == "" {
+		return true
+	}
+	want := normalizeThumbprint(opts.Thumbprint)
+	var got []byte
+	if len(want) == 2*sha1.Size {
+		sum := sha1.Sum(xc.Raw)
+		got = sum[:]
+	} else {
+		sum := sha256.Sum256(xc.Raw)
+		got = sum[:]
+	}
+	return hex.EncodeToString(got) == want
+}
+
+// normalizeThumbprint strips separators, and the invisible left-to-right mark
+// that the certificate dialog prepends, from a hex thumbprint and lowercases it.
+func normalizeThumbprint(tp string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", ":", "", "\u200e", "").Replace(tp))
+}
+
+// certificateTemplate describes the szOID_CERTIFICATE_TEMPLATE extension of
+// certificates issued from version 2 and later templates.
+type certificateTemplate struct {
+	ID           asn1.ObjectIdentifier
+	MajorVersion int
+	MinorVersion int `asn1:"optional"`
+}
+
+// matchesTemplate reports whether xc was issued from template, which is an OID
+// or a template name.
+func matchesTemplate(xc *x509.Certificate, template string) bool {
+	for _, ext := range xc.Extensions {
+		switch {
+		case ext.Id.Equal(oidCertificateTemplate):
+			var ct certificateTemplate
+			if _, err := asn1.Unmarshal(ext.Value, &ct); err != nil {
+				continue
+			}
+			oid := ct.ID.String()
+			if oid == template {
+				return true
+			}
+			if name := templateName(oid); name != "" && strings.EqualFold(name, template) {
+				return true
+			}
+		case ext.Id.Equal(oidEnrollCertType):
+			// Version 1 templates, such as "Machine", are identified by name.
+			var name string
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &name, "bmp"); err != nil {
+				continue
+			}
+			if strings.EqualFold(name, template) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extKeyUsages returns the acceptable extended key usages.
+func (opts Options) extKeyUsages() []string {
+	if len(opts.ExtKeyUsages) == 0 {
+		return []string{ExtKeyUsageClientAuth}
+	}
+	return opts.ExtKeyUsages
+}
+
+// matchesExtKeyUsage reports whether xc may be used for one of the extended
+// key usages in ekus.
+func matchesExtKeyUsage(xc *x509.Certificate, ekus []string) bool {
+	for _, eku := range ekus {
+		if eku == ExtKeyUsageAny {
+			return true
+		}
+	}
+	for _, ext := range xc.Extensions {
+		if !ext.Id.Equal(oidExtKeyUsage) {
+			continue
+		}
+		var usages []asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(ext.Value, &usages); err != nil {
+			return false
+		}
+		for _, usage := range usages {
+			if usage.String() == ExtKeyUsageAny {
+				return true
+			}
+			for _, eku := range ekus {
+				if usage.String() == eku {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	// Without the extension, the certificate is valid for any usage.
+	return true
+}
+
+// parseOID parses a dotted decimal object identifier.
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, errors.New("too few components")
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid component %q", part)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+// smartCardPINEnv names the environment variable that supplies the smart card
+// PIN when the config does not.
+const smartCardPINEnv = "ENTERPRISE_CERTIFICATE_SMART_CARD_PIN"
+
+// ConfigOptions converts the Windows store section of the ECP config into
+// certificate selection options. The smart card PIN falls back to the
+// ENTERPRISE_CERTIFICATE_SMART_CARD_PIN environment variable.
+func ConfigOptions(config util.WindowsStore) Options {
+	pin := config.PIN
+	if pin == "" {
+		pin = os.Getenv(smartCardPINEnv)
+	}
+	return Options{
+		Issuer:            config.Issuer,
+		Issuers:           config.Issuers,
+		Store:             config.Store,
+		Provider:          config.Provider,
+		Thumbprint:        config.Thumbprint,
+		Template:          config.Template,
+		ExtKeyUsages:      config.ExtKeyUsages,
+		Silent:            config.Silent,
+		ExcludeRoot:       config.ExcludeRoot,
+		AllowLegacyHashes: config.AllowLegacyHashes,
+		KeyProvider:       config.KeyProvider,
+		PIN:               pin,
+		PickCertificate:   config.PickCertificate,
+	}
+}
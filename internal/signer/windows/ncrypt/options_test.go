@@ -0,0 +1,175 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package ncrypt
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOptionsMatchesThumbprint(t *testing.T) {
+	xc := &x509.Certificate{Raw: []byte("certificate")}
+	sha1Sum := sha1.Sum(xc.Raw)
+	sha256Sum := sha256.Sum256(xc.Raw)
+	sha1Hex := hex.EncodeToString(sha1Sum[:])
+	sha256Hex := hex.EncodeToString(sha256Sum[:])
+
+	tests := []struct {
+		thumbprint string
+		want       bool
+	}{
+		{thumbprint: "", want: true},
+		{thumbprint: sha1Hex, want: true},
+		{thumbprint: strings.ToUpper(sha1Hex), want: true},
+		{thumbprint: "\u200e" + sha1Hex[:2] + " " + sha1Hex[2:], want: true},
+		{thumbprint: sha256Hex, want: true},
+		{thumbprint: sha256Hex[:2] + ":" + sha256Hex[2:], want: true},
+		{thumbprint: strings.Repeat("00", sha1.Size), want: false},
+		{thumbprint: strings.Repeat("00", sha256.Size), want: false},
+	}
+	for _, test := range tests {
+		opts := Options{Thumbprint: test.thumbprint}
+		if got := opts.matches(xc); got != test.want {
+			t.Errorf("matches(%q): got %v, want %v", test.thumbprint, got, test.want)
+		}
+	}
+}
+
+func TestOptionsIssuers(t *testing.T) {
+	opts := Options{Issuer: "Corp CA", Issuers: []string{"", "New Corp CA"}}
+	got, want := opts.issuers(), []string{"Corp CA", "New Corp CA"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("issuers: got %q, want %q", got, want)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts    Options
+		wantErr bool
+	}{
+		{opts: Options{Issuer: "Corp CA"}},
+		{opts: Options{Thumbprint: strings.Repeat("ab", sha1.Size)}},
+		{opts: Options{Thumbprint: strings.Repeat("ab", sha256.Size)}},
+		{opts: Options{Issuers: []string{"New Corp CA"}}},
+		{opts: Options{}, wantErr: true},
+		{opts: Options{Issuers: []string{""}}, wantErr: true},
+		{opts: Options{Thumbprint: "abcd"}, wantErr: true},
+		{opts: Options{Thumbprint: strings.Repeat("zz", sha1.Size)}, wantErr: true},
+		{opts: Options{Issuer: "Corp CA", ExtKeyUsages: []string{ExtKeyUsageClientAuth, "1.3.6.1.4.1.311.20.2.2"}}},
+		{opts: Options{Issuer: "Corp CA", ExtKeyUsages: []string{"client_auth"}}, wantErr: true},
+	}
+	for _, test := range tests {
+		if err := test.opts.validate(); (err != nil) != test.wantErr {
+			t.Errorf("validate(%+v): got %v, want error %v", test.opts, err, test.wantErr)
+		}
+	}
+}
+
+func TestMatchesTemplate(t *testing.T) {
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 21, 8, 1, 2, 3}
+	v2, err := asn1.Marshal(certificateTemplate{ID: oid, MajorVersion: 100, MinorVersion: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := asn1.MarshalWithParams("Machine", "bmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(f func(string) string) { templateName = f }(templateName)
+	templateName = func(s string) string {
+		if s == oid.String() {
+			return "Workstation Authentication"
+		}
+		return ""
+	}
+
+	v2Cert := &x509.Certificate{Extensions: []pkix.Extension{{Id: oidCertificateTemplate, Value: v2}}}
+	v1Cert := &x509.Certificate{Extensions: []pkix.Extension{{Id: oidEnrollCertType, Value: v1}}}
+	tests := []struct {
+		xc       *x509.Certificate
+		template string
+		want     bool
+	}{
+		{xc: v2Cert, template: oid.String(), want: true},
+		{xc: v2Cert, template: "workstation authentication", want: true},
+		{xc: v2Cert, template: "Machine", want: false},
+		{xc: v1Cert, template: "Machine", want: true},
+		{xc: v1Cert, template: "Workstation Authentication", want: false},
+		{xc: &x509.Certificate{}, template: "Machine", want: false},
+	}
+	for i, test := range tests {
+		if got := matchesTemplate(test.xc, test.template); got != test.want {
+			t.Errorf("matchesTemplate(%d, %q): got %v, want %v", i, test.template, got, test.want)
+		}
+	}
+}
+
+func TestMatchesExtKeyUsage(t *testing.T) {
+	ekuExtension := func(oids ...asn1.ObjectIdentifier) *x509.Certificate {
+		value, err := asn1.Marshal(oids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &x509.Certificate{Extensions: []pkix.Extension{{Id: oidExtKeyUsage, Value: value}}}
+	}
+	clientAuth := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}
+	codeSigning := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3}
+	efs := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 10, 3, 4}
+	anyUsage := asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+
+	tests := []struct {
+		name string
+		xc   *x509.Certificate
+		ekus []string
+		want bool
+	}{
+		{name: "client auth", xc: ekuExtension(clientAuth), ekus: []string{ExtKeyUsageClientAuth}, want: true},
+		{name: "code signing", xc: ekuExtension(codeSigning), ekus: []string{ExtKeyUsageClientAuth}, want: false},
+		{name: "efs and client auth", xc: ekuExtension(efs, clientAuth), ekus: []string{ExtKeyUsageClientAuth}, want: true},
+		{name: "any usage", xc: ekuExtension(anyUsage), ekus: []string{ExtKeyUsageClientAuth}, want: true},
+		{name: "no extension", xc: &x509.Certificate{}, ekus: []string{ExtKeyUsageClientAuth}, want: true},
+		{name: "custom list", xc: ekuExtension(efs), ekus: []string{ExtKeyUsageClientAuth, efs.String()}, want: true},
+		{name: "filter disabled", xc: ekuExtension(codeSigning), ekus: []string{ExtKeyUsageAny}, want: true},
+	}
+	for _, test := range tests {
+		if got := matchesExtKeyUsage(test.xc, test.ekus); got != test.want {
+			t.Errorf("matchesExtKeyUsage(%s): got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOptionsPINFunc(t *testing.T) {
+	if f := (Options{}).pinFunc(); f != nil {
+		t.Error("pinFunc without a PIN: got a function, want nil")
+	}
+	f := (Options{PIN: "123456"}).pinFunc()
+	if pin, err := f(); pin != "123456" || err != nil {
+		t.Errorf("pinFunc with PIN: got %q, %v, want %q", pin, err, "123456")
+	}
+	f = (Options{PIN: "123456", PINFunc: func() (string, error) { return "654321", nil }}).pinFunc()
+	if pin, err := f(); pin != "654321" || err != nil {
+		t.Errorf("pinFunc with PINFunc: got %q, %v, want %q", pin, err, "654321")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows && tpm2
+// +build windows,tpm2
+
+// The tests in this file provision a key in the Microsoft Platform Crypto
+// Provider and sign with it through CredWithOptions. They need a TPM, such as
+// the virtual TPM of a Windows VM backed by a TPM simulator:
+//
+//	swtpm socket --tpm2 --tpmstate dir=/tmp/swtpm --ctrl type=unixio,path=/tmp/swtpm/sock
+//	qemu-system-x86_64 ... -chardev socket,id=chrtpm,path=/tmp/swtpm/sock -tpmdev emulator,id=tpm0,chardev=chrtpm -device tpm-tis,tpmdev=tpm0
+//
+// Run them in the VM with
+//
+//	go test -tags=tpm2 .
+package ncrypt
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// powershell runs script and returns its trimmed output.
+func powershell(t *testing.T, script string) string {
+	t.Helper()
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("powershell %q: %v: %s", script, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newPCPCertificate creates a self-signed client authentication certificate
+// in the current user's MY store whose RSA key is generated by the Platform
+// Crypto Provider, and returns its thumbprint. The certificate and key are
+// deleted when the test ends.
+func newPCPCertificate(t *testing.T) string {
+	t.Helper()
+	thumbprint := powershell(t, fmt.Sprintf(`(New-SelfSignedCertificate -Subject "CN=ecp-pcp-test-%d" -Provider "%s" `+
+		`-KeyAlgorithm RSA -KeyLength 2048 -KeyExportPolicy NonExportable -CertStoreLocation Cert:\CurrentUser\My `+
+		`-TextExtension @("2.5.29.37={text}1.3.6.1.5.5.7.3.2")).Thumbprint`, time.Now().UnixNano(), PlatformCryptoProvider))
+	t.Cleanup(func() {
+		powershell(t, fmt.Sprintf(`Remove-Item -DeleteKey Cert:\CurrentUser\My\%s`, thumbprint))
+	})
+	return thumbprint
+}
+
+func TestPlatformCryptoProvider(t *testing.T) {
+	k, err := CredWithOptions(Options{Thumbprint: newPCPCertificate(t), Silent: true})
+	if err != nil {
+		t.Fatalf("CredWithOptions: got %v, want nil err", err)
+	}
+	defer k.Close()
+	if got, want := k.Provider(), PlatformCryptoProvider; got != want {
+		t.Fatalf("Provider: got %q, want %q", got, want)
+	}
+	pub := k.Public().(*rsa.PublicKey)
+	digest := sha256.Sum256([]byte("message to sign"))
+
+	tests := []struct {
+		name    string
+		opts    crypto.SignerOpts
+		wantErr bool
+	}{
+		{name: "PKCS1v15", opts: crypto.SHA256},
+		{name: "PSS salt equals hash", opts: &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}},
+		{name: "PSS salt length 32", opts: &rsa.PSSOptions{SaltLength: 32, Hash: crypto.SHA256}},
+		// The TPM cannot produce longer salts.
+		{name: "PSS auto salt", opts: &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			sig, err := k.Sign(nil, digest[:], test.opts)
+			if test.wantErr {
+				if err == nil {
+					t.Error("Sign: got nil err, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Sign: got %v, want nil err", err)
+			}
+			t.Logf("Sign took %v", time.Since(start))
+			if pss, ok := test.opts.(*rsa.PSSOptions); ok {
+				err = rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, pss)
+			} else {
+				err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+			}
+			if err != nil {
+				t.Errorf("Sign: signature does not verify: %v", err)
+			}
+		})
+	}
+
+	// The TPM handles one command at a time, so concurrent signatures queue
+	// up behind each other and must all still succeed.
+	t.Run("Concurrent", func(t *testing.T) {
+		const n = 4
+		var wg sync.WaitGroup
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sig, err := k.Sign(nil, digest[:], crypto.SHA256)
+				if err == nil {
+					err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("concurrent Sign: got %v, want nil err", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,224 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package ncrypt
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	certStoreProvMemory = 2 // CERT_STORE_PROV_MEMORY
+	certStoreAddAlways  = 4 // CERT_STORE_ADD_ALWAYS
+
+	pickerTitle   = "Select a certificate"
+	pickerMessage = "Several certificates can be used to authenticate. Choose the one to use."
+)
+
+var (
+	// cryptui.dll is absent from Server Core, so it is only loaded when the
+	// picker is shown.
+	cryptui                              = windows.NewLazySystemDLL("cryptui.dll")
+	cryptUIDlgSelectCertificateFromStore = cryptui.NewProc("CryptUIDlgSelectCertificateFromStore")
+)
+
+// choicesPath returns the path of the file that remembers the certificates
+// chosen in the picker. It is a variable so that tests can redirect it.
+var choicesPath = func() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "enterprise-certificate-proxy", "certificate_choices.json"), nil
+}
+
+// choiceKey identifies the selection criteria of opts, so that a choice made
+// for one configuration is not applied to another.
+func choiceKey(opts Options) string {
+	store := opts.Store
+	if store == "" {
+		store = DefaultStoreName
+	}
+	provider := opts.Provider
+	if provider == "" {
+		provider = "current_user"
+	}
+	return strings.Join([]string{
+		provider,
+		store,
+		strings.Join(opts.issuers(), ","),
+		opts.Template,
+		strings.Join(opts.extKeyUsages(), ","),
+		opts.KeyProvider,
+	}, "|")
+}
+
+// loadChoices reads the remembered choices, mapping choice keys to SHA-1
+// thumbprints. A missing file holds no choices.
+func loadChoices() (map[string]string, error) {
+	path, err := choicesPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	choices := map[string]string{}
+	if err := json.Unmarshal(data, &choices); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return choices, nil
+}
+
+// saveChoice remembers that thumbprint was chosen for opts.
+func saveChoice(opts Options, thumbprint string) error {
+	choices, err := loadChoices()
+	if err != nil {
+		// Start over rather than keep a corrupt file.
+		choices = map[string]string{}
+	}
+	choices[choiceKey(opts)] = thumbprint
+	data, err := json.MarshalIndent(choices, "", "  ")
+	if err != nil {
+		return err
+	}
+	path, err := choicesPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// pickCertificate returns the SHA-1 thumbprint of the certificate to use
+// among those that opts select, asking the user through the certificate
+// selection dialog when there are several and none was chosen before. It
+// returns "" when there is nothing to choose from, leaving the selection to
+// CredWithOptions. The dialog is never shown when opts.Silent is set.
+func pickCertificate(opts Options) (string, error) {
+	store, err := openStore(opts.Store, opts.Provider)
+	if err != nil {
+		return "", err
+	}
+	defer windows.CertCloseStore(store, 0)
+
+	// Collect the candidates into a memory store for the dialog.
+	candidates, err := windows.CertOpenStore(certStoreProvMemory, 0, 0, 0, 0)
+	if err != nil {
+		return "", fmt.Errorf("creating certificate store: %w", err)
+	}
+	defer windows.CertCloseStore(candidates, 0)
+	var thumbprints []string
+	var addErr error
+	err = opts.forEachCandidate(store, func(nc *windows.CertContext, xc *x509.Certificate) bool {
+		if !opts.eligible(nc, xc) {
+			return true
+		}
+		if _, err := findCertChain(nc, chainEngine(opts.Provider)); err != nil {
+			return true
+		}
+		if addErr = windows.CertAddCertificateContextToStore(candidates, nc, certStoreAddAlways, nil); addErr != nil {
+			windows.CertFreeCertificateContext(nc)
+			return false
+		}
+		tp := sha1.Sum(xc.Raw)
+		thumbprints = append(thumbprints, hex.EncodeToString(tp[:]))
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	if addErr != nil {
+		return "", fmt.Errorf("collecting certificates: %w", addErr)
+	}
+	if len(thumbprints) < 2 {
+		return "", nil
+	}
+
+	if choices, err := loadChoices(); err == nil {
+		chosen := choices[choiceKey(opts)]
+		for _, tp := range thumbprints {
+			if tp == chosen {
+				return chosen, nil
+			}
+		}
+	}
+	if opts.Silent {
+		return "", nil
+	}
+
+	thumbprint, err := showPicker(candidates)
+	if err != nil {
+		return "", err
+	}
+	if err := saveChoice(opts, thumbprint); err != nil {
+		return "", fmt.Errorf("remembering the chosen certificate: %w", err)
+	}
+	return thumbprint, nil
+}
+
+// showPicker shows the certificate selection dialog for the certificates in
+// store in front of the user's active window, and returns the SHA-1
+// thumbprint of the chosen certificate.
+func showPicker(store windows.Handle) (string, error) {
+	if err := cryptUIDlgSelectCertificateFromStore.Find(); err != nil {
+		return "", fmt.Errorf("certificate selection dialog unavailable: %w", err)
+	}
+	title, err := windows.UTF16PtrFromString(pickerTitle)
+	if err != nil {
+		return "", err
+	}
+	message, err := windows.UTF16PtrFromString(pickerMessage)
+	if err != nil {
+		return "", err
+	}
+	r, _, _ := cryptUIDlgSelectCertificateFromStore.Call(
+		uintptr(store),
+		uintptr(windows.GetForegroundWindow()),
+		uintptr(unsafe.Pointer(title)),
+		uintptr(unsafe.Pointer(message)),
+		0,
+		0,
+		null,
+	)
+	if r == 0 {
+		return "", fmt.Errorf("no certificate chosen: %w", ErrUserCancelled)
+	}
+	nc := *(**windows.CertContext)(unsafe.Pointer(&r))
+	defer windows.CertFreeCertificateContext(nc)
+	xc, err := certContextToX509(nc)
+	if err != nil {
+		return "", err
+	}
+	tp := sha1.Sum(xc.Raw)
+	return hex.EncodeToString(tp[:]), nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package ncrypt
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestChoiceKey(t *testing.T) {
+	base := Options{Issuer: "Corp CA"}
+	if got, want := choiceKey(base), choiceKey(Options{Issuer: "Corp CA", Store: DefaultStoreName, Provider: "current_user"}); got != want {
+		t.Errorf("choiceKey with defaults: got %q, want %q", got, want)
+	}
+	if got := choiceKey(Options{Issuer: "Corp CA", PickCertificate: true, Silent: true}); got != choiceKey(base) {
+		t.Errorf("choiceKey depends on options other than selection criteria: got %q, want %q", got, choiceKey(base))
+	}
+	for _, opts := range []Options{
+		{Issuer: "Other CA"},
+		{Issuer: "Corp CA", Provider: "local_machine"},
+		{Issuer: "Corp CA", Template: "Workstation Authentication"},
+		{Issuer: "Corp CA", ExtKeyUsages: []string{ExtKeyUsageAny}},
+	} {
+		if choiceKey(opts) == choiceKey(base) {
+			t.Errorf("choiceKey(%+v): got the key of %+v", opts, base)
+		}
+	}
+}
+
+func TestSaveChoice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ecp", "choices.json")
+	orig := choicesPath
+	choicesPath = func() (string, error) { return path, nil }
+	defer func() { choicesPath = orig }()
+
+	choices, err := loadChoices()
+	if err != nil || len(choices) != 0 {
+		t.Fatalf("loadChoices without a file: got %v, %v, want no choices", choices, err)
+	}
+	a, b := Options{Issuer: "A"}, Options{Issuer: "B"}
+	if err := saveChoice(a, "aa"); err != nil {
+		t.Fatalf("saveChoice: %v", err)
+	}
+	if err := saveChoice(b, "bb"); err != nil {
+		t.Fatalf("saveChoice: %v", err)
+	}
+	if err := saveChoice(a, "cc"); err != nil {
+		t.Fatalf("saveChoice: %v", err)
+	}
+	if choices, err = loadChoices(); err != nil {
+		t.Fatalf("loadChoices: %v", err)
+	}
+	if got, want := choices[choiceKey(a)], "cc"; got != want {
+		t.Errorf("choice for A: got %q, want %q", got, want)
+	}
+	if got, want := choices[choiceKey(b)], "bb"; got != want {
+		t.Errorf("choice for B: got %q, want %q", got, want)
+	}
+}
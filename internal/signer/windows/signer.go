@@ -28,7 +28,9 @@ import (
 	"os"
 
 	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/util"
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/windows/namedpipe"
 	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/windows/ncrypt"
+	"github.com/googleapis/enterprise-certificate-proxy/internal/transport"
 )
 
 // If ECP Logging is enabled return true
@@ -43,10 +45,13 @@ func enableECPLogging() bool {
 }
 
 func init() {
+	gob.Register(crypto.SHA1)
 	gob.Register(crypto.SHA256)
 	gob.Register(crypto.SHA384)
 	gob.Register(crypto.SHA512)
 	gob.Register(&rsa.PSSOptions{})
+	gob.Register(&rsa.OAEPOptions{})
+	gob.Register(&rsa.PKCS1v15DecryptOptions{})
 }
 
 // SignArgs contains arguments to a crypto Signer.Sign method.
@@ -55,9 +60,21 @@ type SignArgs struct {
 	Opts   crypto.SignerOpts // Options for signing, such as Hash identifier.
 }
 
+// EncryptArgs contains arguments to an Encrypt method.
+type EncryptArgs struct {
+	Plaintext []byte
+}
+
+// DecryptArgs contains arguments to a crypto Decrypter.Decrypt method.
+type DecryptArgs struct {
+	Ciphertext []byte
+	Opts       crypto.DecrypterOpts // nil selects RSA-OAEP with SHA-256.
+}
+
 // A EnterpriseCertSigner exports RPC methods for signing.
 type EnterpriseCertSigner struct {
-	key *ncrypt.Key
+	key               *ncrypt.Key
+	allowLegacyHashes bool // Whether key signs SHA-1 digests.
 }
 
 // A Connection wraps a pair of unidirectional streams as an io.ReadWriteCloser.
@@ -76,6 +93,16 @@ func (c *Connection) Close() error {
 	return werr
 }
 
+// Handshake reports the signer API version and what this signer supports.
+func (k *EnterpriseCertSigner) Handshake(args transport.HandshakeArgs, caps *transport.Capabilities) error {
+	hashes := []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512}
+	if k.allowLegacyHashes {
+		hashes = append(hashes, crypto.SHA1)
+	}
+	*caps = transport.Capabilities{Version: transport.APIVersion, Decrypt: true, Hashes: hashes}
+	return nil
+}
+
 // CertificateChain returns the credential as a raw X509 cert chain. This
 // contains the public key.
 func (k *EnterpriseCertSigner) CertificateChain(ignored struct{}, certificateChain *[][]byte) error {
@@ -95,26 +122,61 @@ func (k *EnterpriseCertSigner) Sign(args SignArgs, resp *[]byte) (err error) {
 	return
 }
 
+// Encrypt encrypts a plaintext with RSA-OAEP and SHA-256, or with ECIES for
+// an EC key.
+func (k *EnterpriseCertSigner) Encrypt(args EncryptArgs, ciphertext *[]byte) (err error) {
+	*ciphertext, err = k.key.Encrypt(args.Plaintext, nil)
+	return
+}
+
+// Decrypt decrypts a ciphertext with the padding scheme args.Opts selects.
+func (k *EnterpriseCertSigner) Decrypt(args DecryptArgs, plaintext *[]byte) (err error) {
+	*plaintext, err = k.key.Decrypt(nil, args.Ciphertext, args.Opts)
+	return
+}
+
 func main() {
 	enableECPLogging()
-	if len(os.Args) != 2 {
+	// The signer is invoked as `ecp.exe <config>` by a client, which talks to it
+	// over stdin/stdout, or as `ecp.exe <config> -pipe <name>` to serve every
+	// client of the current user on a named pipe. Either may add
+	// `-profile <name>` to use a named credential of the config.
+	args, err := util.ParseArgs(os.Args[1:], "-pipe")
+	if err != nil {
 		log.Fatalln("Signer is not meant to be invoked manually, exiting...")
 	}
-	configFilePath := os.Args[1]
-	config, err := util.LoadConfig(configFilePath)
+	config, err := util.LoadConfigProfile(args.ConfigFilePath, args.Profile)
 	if err != nil {
 		log.Fatalf("Failed to load enterprise cert config: %v", err)
 	}
+	if err := util.ApplyResourceLimits(config.ResourceLimits); err != nil {
+		log.Fatalf("Failed to apply signer resource limits: %v", err)
+	}
 
 	enterpriseCertSigner := new(EnterpriseCertSigner)
-	enterpriseCertSigner.key, err = ncrypt.Cred(config.CertConfigs.WindowsStore.Issuer, config.CertConfigs.WindowsStore.Store, config.CertConfigs.WindowsStore.Provider)
+	enterpriseCertSigner.key, err = ncrypt.CredWithOptions(ncrypt.ConfigOptions(config.CertConfigs.WindowsStore))
 	if err != nil {
 		log.Fatalf("Failed to initialize enterprise cert signer using ncrypt: %v", err)
 	}
+	enterpriseCertSigner.allowLegacyHashes = config.CertConfigs.WindowsStore.AllowLegacyHashes
 
 	if err := rpc.Register(enterpriseCertSigner); err != nil {
 		log.Fatalf("Failed to register enterprise cert signer with net/rpc: %v", err)
 	}
 
-	rpc.ServeConn(&Connection{os.Stdin, os.Stdout})
+	if args.Listen == "" {
+		transport.Serve(rpc.DefaultServer, &Connection{os.Stdin, os.Stdout})
+		return
+	}
+	l, err := namedpipe.Listen(args.Listen)
+	if err != nil {
+		log.Fatalf("Failed to listen on named pipe: %v", err)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatalf("Failed to accept named pipe client: %v", err)
+		}
+		go transport.Serve(rpc.DefaultServer, conn)
+	}
 }
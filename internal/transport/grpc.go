@@ -0,0 +1,439 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/transport/signerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	// The bridge round-trips signer options through gob.
+	gob.Register(crypto.SHA256)
+	gob.Register(&rsa.PSSOptions{})
+	gob.Register(&rsa.OAEPOptions{})
+	gob.Register(&rsa.PKCS1v15DecryptOptions{})
+}
+
+// The signer API's argument types, as the signers' net/rpc methods decode them.
+type signArgs struct {
+	Digest []byte
+	Opts   crypto.SignerOpts
+}
+
+type signMessageArgs struct {
+	Message []byte
+	Opts    crypto.SignerOpts
+}
+
+type encryptArgs struct {
+	Plaintext []byte
+}
+
+type decryptArgs struct {
+	Ciphertext []byte
+	Opts       crypto.DecrypterOpts
+}
+
+// bridge serves the gRPC Signer service by calling the methods registered
+// with a net/rpc server.
+type bridge struct {
+	signerpb.UnimplementedSignerServer
+	server *rpc.Server
+}
+
+func (b *bridge) Handshake(ctx context.Context, req *signerpb.HandshakeRequest) (*signerpb.HandshakeResponse, error) {
+	var caps Capabilities
+	if err := b.call("Handshake", HandshakeArgs{Version: int(req.GetVersion())}, &caps); err != nil {
+		return nil, err
+	}
+	resp, err := CapabilitiesToProto(caps)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return resp, nil
+}
+
+func (b *bridge) CertificateChain(ctx context.Context, req *signerpb.CertificateChainRequest) (*signerpb.CertificateChainResponse, error) {
+	var chain [][]byte
+	if err := b.call("CertificateChain", struct{}{}, &chain); err != nil {
+		return nil, err
+	}
+	return &signerpb.CertificateChainResponse{Certificates: chain}, nil
+}
+
+func (b *bridge) Public(ctx context.Context, req *signerpb.PublicRequest) (*signerpb.PublicResponse, error) {
+	var pub []byte
+	if err := b.call("Public", struct{}{}, &pub); err != nil {
+		return nil, err
+	}
+	return &signerpb.PublicResponse{PublicKey: pub}, nil
+}
+
+func (b *bridge) Sign(ctx context.Context, req *signerpb.SignRequest) (*signerpb.SignResponse, error) {
+	opts, err := OptsFromProto(req.GetOpts())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var sig []byte
+	if err := b.call("Sign", signArgs{Digest: req.GetDigest(), Opts: opts}, &sig); err != nil {
+		return nil, err
+	}
+	return &signerpb.SignResponse{Signature: sig}, nil
+}
+
+func (b *bridge) SignMessage(ctx context.Context, req *signerpb.SignMessageRequest) (*signerpb.SignResponse, error) {
+	opts, err := OptsFromProto(req.GetOpts())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var sig []byte
+	if err := b.call("SignMessage", signMessageArgs{Message: req.GetMessage(), Opts: opts}, &sig); err != nil {
+		return nil, err
+	}
+	return &signerpb.SignResponse{Signature: sig}, nil
+}
+
+func (b *bridge) Encrypt(ctx context.Context, req *signerpb.EncryptRequest) (*signerpb.EncryptResponse, error) {
+	var ciphertext []byte
+	if err := b.call("Encrypt", encryptArgs{Plaintext: req.GetPlaintext()}, &ciphertext); err != nil {
+		return nil, err
+	}
+	return &signerpb.EncryptResponse{Ciphertext: ciphertext}, nil
+}
+
+func (b *bridge) Decrypt(ctx context.Context, req *signerpb.DecryptRequest) (*signerpb.DecryptResponse, error) {
+	opts, err := DecrypterOptsFromProto(req.GetOpts())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var plaintext []byte
+	if err := b.call("Decrypt", decryptArgs{Ciphertext: req.GetCiphertext(), Opts: opts}, &plaintext); err != nil {
+		return nil, err
+	}
+	return &signerpb.DecryptResponse{Plaintext: plaintext}, nil
+}
+
+func (b *bridge) Diagnostics(ctx context.Context, req *signerpb.DiagnosticsRequest) (*signerpb.DiagnosticsResponse, error) {
+	var report []byte
+	if err := b.call("Diagnostics", struct{}{}, &report); err != nil {
+		return nil, err
+	}
+	return &signerpb.DiagnosticsResponse{Report: report}, nil
+}
+
+// call calls the EnterpriseCertSigner method named method on b.server,
+// returning its error as a gRPC status.
+func (b *bridge) call(method string, args, reply interface{}) error {
+	c := &requestCodec{method: "EnterpriseCertSigner." + method, args: args, reply: reply}
+	err := b.server.ServeRequest(c)
+	if err == nil {
+		err = c.err
+	}
+	switch {
+	case err == nil:
+		return nil
+	case strings.HasPrefix(err.Error(), "rpc: can't find"):
+		return status.Error(codes.Unimplemented, err.Error())
+	default:
+		return status.Error(codes.Unknown, err.Error())
+	}
+}
+
+// requestCodec is an rpc.ServerCodec for a single request, whose arguments
+// and reply are converted to and from the method's own types through gob.
+type requestCodec struct {
+	method      string
+	args, reply interface{}
+	err         error // The method's error, if any.
+}
+
+func (c *requestCodec) ReadRequestHeader(r *rpc.Request) error {
+	r.ServiceMethod = c.method
+	return nil
+}
+
+func (c *requestCodec) ReadRequestBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return convert(c.args, body)
+}
+
+func (c *requestCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if r.Error != "" {
+		c.err = errors.New(r.Error)
+		return nil
+	}
+	return convert(body, c.reply)
+}
+
+func (c *requestCodec) Close() error {
+	return nil
+}
+
+// convert copies from into to, which must be a pointer, matching struct
+// fields by name as gob does.
+func convert(from, to interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(from); err != nil {
+		return err
+	}
+	return gob.NewDecoder(&buf).Decode(to)
+}
+
+// serveGRPC serves the gRPC Signer service on conn until the client hangs up.
+func serveGRPC(server *rpc.Server, conn io.ReadWriteCloser) {
+	s := grpc.NewServer()
+	signerpb.RegisterSignerServer(s, &bridge{server: server})
+	_ = s.Serve(newListener(newPipeConn(conn)))
+}
+
+// DialGRPC returns a gRPC client for the Signer service over conn, which
+// Connect negotiated.
+func DialGRPC(conn io.ReadWriteCloser) (*grpc.ClientConn, error) {
+	pc := newPipeConn(conn)
+	var once sync.Once
+	dialer := func(context.Context, string) (net.Conn, error) {
+		var c net.Conn
+		once.Do(func() { c = pc })
+		if c == nil {
+			// A signer connection cannot be reestablished.
+			return nil, errors.New("signer connection closed")
+		}
+		return c, nil
+	}
+	return grpc.Dial("passthrough:///signer",
+		grpc.WithContextDialer(dialer),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+// pipeConn adapts a stream, such as a signer's stdin and stdout, to a
+// net.Conn. It ignores deadlines; gRPC enforces its own.
+type pipeConn struct {
+	io.ReadWriteCloser
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newPipeConn(rwc io.ReadWriteCloser) *pipeConn {
+	return &pipeConn{ReadWriteCloser: rwc, closed: make(chan struct{})}
+}
+
+func (c *pipeConn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		err = c.ReadWriteCloser.Close()
+		close(c.closed)
+	})
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr               { return pipeAddr{} }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// listener is a net.Listener that accepts a single connection, and then
+// blocks until that connection closes so that the gRPC server keeps serving
+// it.
+type listener struct {
+	conns chan *pipeConn
+	conn  *pipeConn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newListener(conn *pipeConn) *listener {
+	l := &listener{conns: make(chan *pipeConn, 1), conn: conn, done: make(chan struct{})}
+	l.conns <- conn
+	return l
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	default:
+	}
+	select {
+	case <-l.conn.closed:
+	case <-l.done:
+	}
+	return nil, net.ErrClosed
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// OptsToProto converts signer options to their protobuf form.
+func OptsToProto(opts crypto.SignerOpts) (*signerpb.SignerOpts, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	hash, err := hashToProto(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	p := &signerpb.SignerOpts{Hash: hash}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		p.Pss = &signerpb.PSSOptions{SaltLength: int32(pss.SaltLength)}
+	}
+	return p, nil
+}
+
+// OptsFromProto converts signer options from their protobuf form.
+func OptsFromProto(p *signerpb.SignerOpts) (crypto.SignerOpts, error) {
+	if p == nil {
+		return nil, nil
+	}
+	hash, err := hashFromProto(p.GetHash())
+	if err != nil {
+		return nil, err
+	}
+	if p.GetPss() != nil {
+		return &rsa.PSSOptions{Hash: hash, SaltLength: int(p.GetPss().GetSaltLength())}, nil
+	}
+	return hash, nil
+}
+
+// DecrypterOptsToProto converts decryption options to their protobuf form.
+func DecrypterOptsToProto(opts crypto.DecrypterOpts) (*signerpb.DecrypterOpts, error) {
+	switch opts := opts.(type) {
+	case nil:
+		return nil, nil
+	case *rsa.OAEPOptions:
+		hash, err := hashToProto(opts.Hash)
+		if err != nil {
+			return nil, err
+		}
+		return &signerpb.DecrypterOpts{Scheme: &signerpb.DecrypterOpts_Oaep{
+			Oaep: &signerpb.OAEPOptions{Hash: hash, Label: opts.Label},
+		}}, nil
+	case *rsa.PKCS1v15DecryptOptions:
+		return &signerpb.DecrypterOpts{Scheme: &signerpb.DecrypterOpts_Pkcs1V15{
+			Pkcs1V15: &signerpb.PKCS1V15Options{SessionKeyLength: int32(opts.SessionKeyLen)},
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported decryption options %T", opts)
+	}
+}
+
+// DecrypterOptsFromProto converts decryption options from their protobuf form.
+func DecrypterOptsFromProto(p *signerpb.DecrypterOpts) (crypto.DecrypterOpts, error) {
+	switch scheme := p.GetScheme().(type) {
+	case nil:
+		return nil, nil
+	case *signerpb.DecrypterOpts_Oaep:
+		hash, err := hashFromProto(scheme.Oaep.GetHash())
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.OAEPOptions{Hash: hash, Label: scheme.Oaep.GetLabel()}, nil
+	case *signerpb.DecrypterOpts_Pkcs1V15:
+		return &rsa.PKCS1v15DecryptOptions{SessionKeyLen: int(scheme.Pkcs1V15.GetSessionKeyLength())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported decryption scheme %T", scheme)
+	}
+}
+
+// CapabilitiesToProto converts a Handshake reply to its protobuf form.
+func CapabilitiesToProto(caps Capabilities) (*signerpb.HandshakeResponse, error) {
+	p := &signerpb.HandshakeResponse{
+		Version:     int32(caps.Version),
+		Decrypt:     caps.Decrypt,
+		SignMessage: caps.SignMessage,
+		Batch:       caps.Batch,
+	}
+	for _, h := range caps.Hashes {
+		hash, err := hashToProto(h)
+		if err != nil {
+			return nil, err
+		}
+		p.Hashes = append(p.Hashes, hash)
+	}
+	return p, nil
+}
+
+// CapabilitiesFromProto converts a Handshake reply from its protobuf form.
+// Hash functions this tree does not know are left out.
+func CapabilitiesFromProto(p *signerpb.HandshakeResponse) Capabilities {
+	caps := Capabilities{
+		Version:     int(p.GetVersion()),
+		Decrypt:     p.GetDecrypt(),
+		SignMessage: p.GetSignMessage(),
+		Batch:       p.GetBatch(),
+	}
+	for _, hash := range p.GetHashes() {
+		if h, err := hashFromProto(hash); err == nil && h != 0 {
+			caps.Hashes = append(caps.Hashes, h)
+		}
+	}
+	return caps
+}
+
+var hashes = map[crypto.Hash]signerpb.Hash{
+	0:             signerpb.Hash_HASH_UNSPECIFIED,
+	crypto.SHA1:   signerpb.Hash_HASH_SHA1,
+	crypto.SHA224: signerpb.Hash_HASH_SHA224,
+	crypto.SHA256: signerpb.Hash_HASH_SHA256,
+	crypto.SHA384: signerpb.Hash_HASH_SHA384,
+	crypto.SHA512: signerpb.Hash_HASH_SHA512,
+}
+
+func hashToProto(h crypto.Hash) (signerpb.Hash, error) {
+	p, ok := hashes[h]
+	if !ok {
+		return 0, fmt.Errorf("unsupported hash function %v", h)
+	}
+	return p, nil
+}
+
+func hashFromProto(p signerpb.Hash) (crypto.Hash, error) {
+	for h, q := range hashes {
+		if q == p {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported hash function %v", p)
+}
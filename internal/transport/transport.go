@@ -0,0 +1,238 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package transport carries the signer API between the client and the signer
+// binaries. Signers serve the net/rpc gob protocol by default; clients may
+// negotiate the gRPC protocol defined in the signerpb package instead, which
+// supports deadlines, cancellation and signers written in other languages.
+//
+// Negotiation happens in the gob protocol, so that signers and clients that
+// predate it keep working: the client's first call is Protocols, offering the
+// protocols it speaks. A signer that does not know the call answers with
+// net/rpc's "can't find method" error and both sides stay on gob; otherwise
+// the signer answers with its choice and both sides switch to it.
+package transport
+
+import (
+	"bufio"
+	"crypto"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"strings"
+)
+
+// ProtocolsMethod is the net/rpc method that negotiates the protocol.
+const ProtocolsMethod = "EnterpriseCertSigner.Protocols"
+
+// Protocols a client can offer.
+const (
+	ProtocolGob  = "gob"
+	ProtocolGRPC = "grpc"
+)
+
+// ProtocolsArgs contains the arguments to the Protocols method.
+type ProtocolsArgs struct {
+	Offer []string // Protocols the client speaks, in order of preference.
+}
+
+// HandshakeMethod is the net/rpc method that exchanges the signer API version
+// and the signer's capabilities. Signers that predate it answer with net/rpc's
+// "can't find method" error, and are taken to be version 0.
+const HandshakeMethod = "EnterpriseCertSigner.Handshake"
+
+// APIVersion is the version of the signer API spoken by this tree's signers.
+// Version 1 added Handshake, decryption options and ECIES.
+const APIVersion = 1
+
+// HandshakeArgs contains the arguments to the Handshake method.
+type HandshakeArgs struct {
+	Version int // The signer API version the client speaks.
+}
+
+// Capabilities is the reply to the Handshake method, describing the signer.
+type Capabilities struct {
+	Version     int           // The signer API version the signer speaks.
+	Decrypt     bool          // Whether Encrypt and Decrypt are supported.
+	SignMessage bool          // Whether SignMessage is supported.
+	Batch       bool          // Whether several digests can be signed in one call.
+	Hashes      []crypto.Hash // The hash functions Sign accepts.
+}
+
+// gobCodec implements rpc.ServerCodec and rpc.ClientCodec like net/rpc's own
+// gob codecs, but lets the connection outlive it once negotiation switches
+// protocols.
+type gobCodec struct {
+	rwc    io.ReadWriteCloser
+	r      *bufio.Reader
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	// pending is a request header that was read during negotiation and not
+	// yet handed to the rpc.Server.
+	pending *rpc.Request
+}
+
+func newGobCodec(rwc io.ReadWriteCloser) *gobCodec {
+	r := bufio.NewReader(rwc)
+	w := bufio.NewWriter(rwc)
+	return &gobCodec{rwc: rwc, r: r, dec: gob.NewDecoder(r), enc: gob.NewEncoder(w), encBuf: w}
+}
+
+func (c *gobCodec) ReadRequestHeader(r *rpc.Request) error {
+	if c.pending != nil {
+		*r = *c.pending
+		c.pending = nil
+		return nil
+	}
+	return c.dec.Decode(r)
+}
+
+func (c *gobCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.write(r, body); err != nil {
+		// As net/rpc's gob codec does, give up on a connection whose
+		// responses no longer encode.
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *gobCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.write(r, body)
+}
+
+func (c *gobCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobCodec) write(header, body interface{}) error {
+	if err := c.enc.Encode(header); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// buffered is the connection left over after negotiation. Reads drain any
+// bytes the negotiation buffered before reaching the connection.
+type buffered struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func (c *gobCodec) buffered() io.ReadWriteCloser {
+	return &buffered{c.r, c.rwc}
+}
+
+// Serve serves server's methods on conn until the client hangs up, in
+// whichever protocol the client negotiates.
+func Serve(server *rpc.Server, conn io.ReadWriteCloser) {
+	codec := newGobCodec(conn)
+	var req rpc.Request
+	if err := codec.ReadRequestHeader(&req); err != nil {
+		codec.Close()
+		return
+	}
+	if req.ServiceMethod != ProtocolsMethod {
+		// The client predates negotiation.
+		codec.pending = &req
+		server.ServeCodec(codec)
+		return
+	}
+	var args ProtocolsArgs
+	if err := codec.ReadRequestBody(&args); err != nil {
+		codec.Close()
+		return
+	}
+	protocol := choose(args.Offer)
+	if err := codec.WriteResponse(&rpc.Response{ServiceMethod: req.ServiceMethod, Seq: req.Seq}, protocol); err != nil {
+		return
+	}
+	switch protocol {
+	case ProtocolGRPC:
+		serveGRPC(server, codec.buffered())
+	default:
+		server.ServeCodec(codec)
+	}
+}
+
+// choose returns the first protocol in offer that Serve speaks.
+func choose(offer []string) string {
+	for _, p := range offer {
+		if p == ProtocolGob || p == ProtocolGRPC {
+			return p
+		}
+	}
+	return ProtocolGob
+}
+
+// A Conn is a client connection after negotiation. Exactly one of RPC and
+// GRPC is set, depending on Protocol.
+type Conn struct {
+	Protocol string
+	RPC      *rpc.Client
+	GRPC     io.ReadWriteCloser // The raw connection, to pass to DialGRPC.
+}
+
+// Connect negotiates a protocol with the signer at the other end of conn,
+// offering the protocols in offer in order of preference. Signers that
+// predate negotiation are spoken to in gob.
+func Connect(conn io.ReadWriteCloser, offer []string) (*Conn, error) {
+	codec := newGobCodec(conn)
+	if err := codec.WriteRequest(&rpc.Request{ServiceMethod: ProtocolsMethod}, &ProtocolsArgs{Offer: offer}); err != nil {
+		return nil, fmt.Errorf("negotiating signer protocol: %w", err)
+	}
+	var resp rpc.Response
+	if err := codec.ReadResponseHeader(&resp); err != nil {
+		return nil, fmt.Errorf("negotiating signer protocol: %w", err)
+	}
+	if resp.Error != "" {
+		// Discard the placeholder body that accompanies errors.
+		if err := codec.ReadResponseBody(nil); err != nil {
+			return nil, fmt.Errorf("negotiating signer protocol: %w", err)
+		}
+		if !strings.HasPrefix(resp.Error, "rpc: can't find") {
+			return nil, fmt.Errorf("negotiating signer protocol: %w", errors.New(resp.Error))
+		}
+		return &Conn{Protocol: ProtocolGob, RPC: rpc.NewClientWithCodec(codec)}, nil
+	}
+	var protocol string
+	if err := codec.ReadResponseBody(&protocol); err != nil {
+		return nil, fmt.Errorf("negotiating signer protocol: %w", err)
+	}
+	switch protocol {
+	case ProtocolGob:
+		return &Conn{Protocol: protocol, RPC: rpc.NewClientWithCodec(codec)}, nil
+	case ProtocolGRPC:
+		return &Conn{Protocol: protocol, GRPC: codec.buffered()}, nil
+	default:
+		return nil, fmt.Errorf("signer chose unknown protocol %q", protocol)
+	}
+}
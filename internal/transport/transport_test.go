@@ -0,0 +1,288 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"net/rpc"
+	"reflect"
+	"testing"
+
+	"github.com/googleapis/enterprise-certificate-proxy/internal/transport/signerpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SignArgs mirrors the signers' own argument type.
+type SignArgs struct {
+	Digest []byte
+	Opts   crypto.SignerOpts
+}
+
+// testSigner is a minimal EnterpriseCertSigner.
+type testSigner struct{}
+
+func (testSigner) CertificateChain(ignored struct{}, chain *[][]byte) error {
+	*chain = [][]byte{[]byte("leaf"), []byte("root")}
+	return nil
+}
+
+// Sign returns the digest followed by the hash function's size and, for
+// RSA-PSS, the salt length.
+func (testSigner) Sign(args SignArgs, sig *[]byte) error {
+	if args.Opts == nil {
+		return errors.New("no signer options")
+	}
+	*sig = append(args.Digest, byte(args.Opts.HashFunc().Size()))
+	if pss, ok := args.Opts.(*rsa.PSSOptions); ok {
+		*sig = append(*sig, byte(pss.SaltLength))
+	}
+	return nil
+}
+
+var testCapabilities = Capabilities{Version: APIVersion, Decrypt: true, Hashes: []crypto.Hash{crypto.SHA256, crypto.SHA384}}
+
+func (testSigner) Handshake(args HandshakeArgs, caps *Capabilities) error {
+	*caps = testCapabilities
+	return nil
+}
+
+func newTestServer(t *testing.T) *rpc.Server {
+	server := rpc.NewServer()
+	if err := server.RegisterName("EnterpriseCertSigner", testSigner{}); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// testCalls exercises a gob client of testSigner.
+func testCalls(t *testing.T, client *rpc.Client) {
+	t.Helper()
+	var chain [][]byte
+	if err := client.Call("EnterpriseCertSigner.CertificateChain", struct{}{}, &chain); err != nil {
+		t.Fatalf("CertificateChain: %v", err)
+	}
+	if len(chain) != 2 || string(chain[0]) != "leaf" {
+		t.Errorf("CertificateChain: got %q, want [leaf root]", chain)
+	}
+	var sig []byte
+	if err := client.Call("EnterpriseCertSigner.Sign", SignArgs{Digest: []byte("digest"), Opts: crypto.SHA256}, &sig); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if want := append([]byte("digest"), 32); !bytes.Equal(sig, want) {
+		t.Errorf("Sign: got %q, want %q", sig, want)
+	}
+}
+
+func TestServe_Gob(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	go Serve(newTestServer(t), sconn)
+	conn, err := Connect(cconn, []string{ProtocolGob})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer conn.RPC.Close()
+	if conn.Protocol != ProtocolGob {
+		t.Errorf("Connect: got protocol %q, want %q", conn.Protocol, ProtocolGob)
+	}
+	testCalls(t, conn.RPC)
+}
+
+func TestServe_LegacyClient(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	go Serve(newTestServer(t), sconn)
+	client := rpc.NewClient(cconn)
+	defer client.Close()
+	testCalls(t, client)
+}
+
+func TestConnect_LegacyServer(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	go newTestServer(t).ServeConn(sconn)
+	conn, err := Connect(cconn, []string{ProtocolGRPC, ProtocolGob})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer conn.RPC.Close()
+	if conn.Protocol != ProtocolGob {
+		t.Errorf("Connect: got protocol %q, want %q", conn.Protocol, ProtocolGob)
+	}
+	testCalls(t, conn.RPC)
+}
+
+func TestServe_GRPC(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		Serve(newTestServer(t), sconn)
+		close(done)
+	}()
+	conn, err := Connect(cconn, []string{ProtocolGRPC, ProtocolGob})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if conn.Protocol != ProtocolGRPC {
+		t.Fatalf("Connect: got protocol %q, want %q", conn.Protocol, ProtocolGRPC)
+	}
+	cc, err := DialGRPC(conn.GRPC)
+	if err != nil {
+		t.Fatalf("DialGRPC: %v", err)
+	}
+	client := signerpb.NewSignerClient(cc)
+	ctx := context.Background()
+
+	chain, err := client.CertificateChain(ctx, &signerpb.CertificateChainRequest{})
+	if err != nil {
+		t.Fatalf("CertificateChain: %v", err)
+	}
+	if got := chain.GetCertificates(); len(got) != 2 || string(got[1]) != "root" {
+		t.Errorf("CertificateChain: got %q, want [leaf root]", got)
+	}
+
+	hs, err := client.Handshake(ctx, &signerpb.HandshakeRequest{Version: APIVersion})
+	if err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	if got := CapabilitiesFromProto(hs); !reflect.DeepEqual(got, testCapabilities) {
+		t.Errorf("Handshake: got %+v, want %+v", got, testCapabilities)
+	}
+
+	opts, err := OptsToProto(&rsa.PSSOptions{Hash: crypto.SHA384, SaltLength: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := client.Sign(ctx, &signerpb.SignRequest{Digest: []byte("digest"), Opts: opts})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if got, want := sig.GetSignature(), append([]byte("digest"), 48, 7); !bytes.Equal(got, want) {
+		t.Errorf("Sign: got %q, want %q", got, want)
+	}
+
+	_, err = client.Sign(ctx, &signerpb.SignRequest{Digest: []byte("digest")})
+	if got := status.Convert(err); got.Code() != codes.Unknown || got.Message() != "no signer options" {
+		t.Errorf("Sign without options: got %v, want Unknown: no signer options", err)
+	}
+	_, err = client.Diagnostics(ctx, &signerpb.DiagnosticsRequest{})
+	if got := status.Code(err); got != codes.Unimplemented {
+		t.Errorf("Diagnostics: got %v, want Unimplemented", err)
+	}
+
+	cc.Close()
+	<-done
+}
+
+func TestOptsProto(t *testing.T) {
+	tests := []crypto.SignerOpts{
+		nil,
+		crypto.Hash(0),
+		crypto.SHA1,
+		crypto.SHA256,
+		crypto.SHA512,
+		&rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: rsa.PSSSaltLengthEqualsHash},
+		&rsa.PSSOptions{Hash: crypto.SHA384, SaltLength: 20},
+	}
+	for _, opts := range tests {
+		p, err := OptsToProto(opts)
+		if err != nil {
+			t.Errorf("OptsToProto(%v): %v", opts, err)
+			continue
+		}
+		got, err := OptsFromProto(p)
+		if err != nil {
+			t.Errorf("OptsFromProto(%v): %v", p, err)
+			continue
+		}
+		switch want := opts.(type) {
+		case *rsa.PSSOptions:
+			if pss, ok := got.(*rsa.PSSOptions); !ok || *pss != *want {
+				t.Errorf("OptsFromProto(OptsToProto(%v)): got %v, want %v", want, got, want)
+			}
+		default:
+			if got != opts {
+				t.Errorf("OptsFromProto(OptsToProto(%v)): got %v, want %v", opts, got, opts)
+			}
+		}
+	}
+
+	if _, err := OptsToProto(crypto.MD5); err == nil {
+		t.Error("OptsToProto(MD5): got nil error, want error")
+	}
+	if _, err := OptsFromProto(&signerpb.SignerOpts{Hash: 42}); err == nil {
+		t.Error("OptsFromProto with an unknown hash: got nil error, want error")
+	}
+}
+
+func TestDecrypterOptsProto(t *testing.T) {
+	tests := []crypto.DecrypterOpts{
+		nil,
+		&rsa.OAEPOptions{Hash: crypto.SHA256},
+		&rsa.OAEPOptions{Hash: crypto.SHA1, Label: []byte("label")},
+		&rsa.PKCS1v15DecryptOptions{},
+		&rsa.PKCS1v15DecryptOptions{SessionKeyLen: 32},
+	}
+	for _, opts := range tests {
+		p, err := DecrypterOptsToProto(opts)
+		if err != nil {
+			t.Errorf("DecrypterOptsToProto(%v): %v", opts, err)
+			continue
+		}
+		got, err := DecrypterOptsFromProto(p)
+		if err != nil {
+			t.Errorf("DecrypterOptsFromProto(%v): %v", p, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, opts) {
+			t.Errorf("DecrypterOptsFromProto(DecrypterOptsToProto(%v)): got %v, want %v", opts, got, opts)
+		}
+	}
+
+	if _, err := DecrypterOptsToProto(&rsa.OAEPOptions{Hash: crypto.MD5}); err == nil {
+		t.Error("DecrypterOptsToProto with MD5: got nil error, want error")
+	}
+	if _, err := DecrypterOptsToProto(crypto.SHA256); err == nil {
+		t.Error("DecrypterOptsToProto(SHA256): got nil error, want error")
+	}
+}
+
+func TestCapabilitiesProto(t *testing.T) {
+	tests := []Capabilities{
+		{},
+		{Version: 1, SignMessage: true, Batch: true},
+		{Version: 2, Decrypt: true, Hashes: []crypto.Hash{crypto.SHA1, crypto.SHA224, crypto.SHA512}},
+	}
+	for _, caps := range tests {
+		p, err := CapabilitiesToProto(caps)
+		if err != nil {
+			t.Errorf("CapabilitiesToProto(%+v): %v", caps, err)
+			continue
+		}
+		if got := CapabilitiesFromProto(p); !reflect.DeepEqual(got, caps) {
+			t.Errorf("CapabilitiesFromProto(CapabilitiesToProto(%+v)): got %+v", caps, got)
+		}
+	}
+
+	if _, err := CapabilitiesToProto(Capabilities{Hashes: []crypto.Hash{crypto.MD5}}); err == nil {
+		t.Error("CapabilitiesToProto with MD5: got nil error, want error")
+	}
+	p := &signerpb.HandshakeResponse{Version: 3, Hashes: []signerpb.Hash{signerpb.Hash_HASH_SHA256, 42}}
+	if got, want := CapabilitiesFromProto(p), (Capabilities{Version: 3, Hashes: []crypto.Hash{crypto.SHA256}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("CapabilitiesFromProto with an unknown hash: got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ListenUnix listens on a Unix domain socket at path that only the current
+// user can connect to. A socket left behind by a signer that exited without
+// cleaning up is replaced; one that a running signer is serving on is not.
+func ListenUnix(path string) (net.Listener, error) {
+	l, err := listenUnix(path)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return l, err
+	}
+	if conn, derr := net.DialTimeout("unix", path, time.Second); derr == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a signer is already serving on %s", path)
+	}
+	if info, serr := os.Lstat(path); serr != nil || info.Mode()&os.ModeSocket == 0 {
+		// Not a socket; leave it alone.
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	return listenUnix(path)
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	// Create the socket without group or other permissions, rather than
+	// tightening them after other users had a chance to connect.
+	mask := syscall.Umask(0177)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", path)
+}
+
+// ServeListener serves server's methods on every connection l accepts, until
+// l is closed.
+func ServeListener(server *rpc.Server, l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go Serve(server, conn)
+	}
+}
+
+// ServeUnix serves server's methods on a Unix domain socket at path until the
+// process is interrupted or terminated, and then removes the socket.
+func ServeUnix(server *rpc.Server, path string) error {
+	l, err := ListenUnix(path)
+	if err != nil {
+		return err
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		l.Close()
+	}()
+	return ServeListener(server, l)
+}
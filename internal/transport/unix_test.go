@@ -0,0 +1,86 @@
+// Copyright 2022 Google LLC.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package transport
+
+import (
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ecp.sock")
+	l, err := ListenUnix(path)
+	if err != nil {
+		t.Fatalf("ListenUnix: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- ServeListener(newTestServer(t), l) }()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("ListenUnix: got permissions %v, want none for group or other", perm)
+	}
+	if _, err := ListenUnix(path); err == nil {
+		t.Error("ListenUnix on a served socket: got nil error, want error")
+	}
+
+	for i := 0; i < 2; i++ {
+		client, err := rpc.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		testCalls(t, client)
+		client.Close()
+	}
+
+	l.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServeListener: got %v, want nil", err)
+	}
+}
+
+func TestListenUnix_Stale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ecp.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	l, err := ListenUnix(path)
+	if err != nil {
+		t.Fatalf("ListenUnix over a stale file: %v", err)
+	}
+	l.Close()
+
+	other := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(other, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenUnix(other); err == nil {
+		t.Error("ListenUnix over a regular file: got nil error, want error")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("ListenUnix over a regular file: %v", err)
+	}
+}
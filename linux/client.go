@@ -17,9 +17,11 @@ package linux
 
 import (
 	"crypto"
+	"crypto/x509"
 	"io"
 
 	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/linux/pkcs11"
+	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/linux/secretservice"
 )
 
 // SecureKey is a public wrapper for the internal PKCS#11 implementation.
@@ -42,6 +44,43 @@ func (sk *SecureKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) (s
 	return sk.key.Sign(nil, digest, opts)
 }
 
+// SignMessage hashes message with opts.HashFunc() and signs it, letting the
+// token hash the message when it supports a mechanism such as
+// CKM_SHA256_RSA_PKCS.
+func (sk *SecureKey) SignMessage(message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return sk.key.SignMessage(message, opts)
+}
+
+// Encrypt encrypts plaintext with the public key, with the schemes that
+// Decrypt supports.
+func (sk *SecureKey) Encrypt(plaintext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return sk.key.Encrypt(plaintext, opts)
+}
+
+// Decrypt decrypts ciphertext with the private key. For RSA keys opts selects
+// the padding scheme: *rsa.OAEPOptions, *rsa.PKCS1v15DecryptOptions, or nil for
+// RSA-OAEP with SHA-256. EC keys decrypt ECIES ciphertexts, and opts must be nil.
+func (sk *SecureKey) Decrypt(_ io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return sk.key.Decrypt(nil, ciphertext, opts)
+}
+
+// CertificateRequest returns a DER-encoded PKCS #10 certificate signing
+// request based on template and signed by the key.
+func (sk *SecureKey) CertificateRequest(template *x509.CertificateRequest) ([]byte, error) {
+	return sk.key.CertificateRequest(template)
+}
+
+// StoreCertificate writes the DER-encoded certificate issued for the key to
+// the token, under the key's label and id.
+func (sk *SecureKey) StoreCertificate(der []byte) error {
+	return sk.key.StoreCertificate(der)
+}
+
+// Diagnostics describes the token holding the key, for debugging.
+func (sk *SecureKey) Diagnostics() (TokenDiagnostics, error) {
+	return sk.key.Diagnostics()
+}
+
 // Close frees up resources associated with the underlying key.
 func (sk *SecureKey) Close() {
 	sk.key.Close()
@@ -56,3 +95,35 @@ func NewSecureKey(pkcs11Module string, slotUint32Str string, label string, userP
 	}
 	return &SecureKey{key: k}, nil
 }
+
+// KeyGenOptions describe a key pair to generate with GenerateKey.
+type KeyGenOptions = pkcs11.KeyGenOptions
+
+// GenerateKey generates an RSA or ECDSA key pair on a PKCS #11 token, so that
+// enrollment tooling can request a certificate for it with
+// CertificateRequest.
+func GenerateKey(opts KeyGenOptions) (*SecureKey, error) {
+	k, err := pkcs11.GenerateKey(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureKey{key: k}, nil
+}
+
+// StorePIN saves a token PIN in the user's keyring, such as gnome-keyring or
+// KWallet, through the freedesktop Secret Service, under the given
+// attributes. Setting pin_secret_service to the same attributes in the config
+// then lets the signer look the PIN up.
+func StorePIN(attributes map[string]string, pin string) error {
+	return secretservice.Store("Enterprise Certificate Proxy PKCS #11 PIN", attributes, pin)
+}
+
+// TokenDiagnostics describes a PKCS #11 token and the objects on it.
+type TokenDiagnostics = pkcs11.TokenDiagnostics
+
+// Diagnose describes every token in the given PKCS #11 modules, logging in
+// with userPin if it is not empty, to debug why NewSecureKey finds no
+// credential.
+func Diagnose(modules []string, userPin string) ([]TokenDiagnostics, error) {
+	return pkcs11.Diagnose(pkcs11.Options{Modules: modules, PIN: userPin})
+}
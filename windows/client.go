@@ -17,6 +17,7 @@ package windows
 
 import (
 	"crypto"
+	"crypto/ecdsa"
 	"io"
 
 	"github.com/googleapis/enterprise-certificate-proxy/internal/signer/windows/ncrypt"
@@ -42,6 +43,38 @@ func (sk *SecureKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) (s
 	return sk.key.Sign(nil, digest, opts)
 }
 
+// Encrypt encrypts plaintext with the public key, with the schemes that
+// Decrypt supports.
+func (sk *SecureKey) Encrypt(plaintext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return sk.key.Encrypt(plaintext, opts)
+}
+
+// Decrypt decrypts ciphertext with the private key. For RSA keys opts selects
+// the padding scheme: *rsa.OAEPOptions, *rsa.PKCS1v15DecryptOptions, or nil for
+// RSA-OAEP with SHA-256. EC keys decrypt ECIES ciphertexts, and opts must be nil.
+func (sk *SecureKey) Decrypt(_ io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return sk.key.Decrypt(nil, ciphertext, opts)
+}
+
+// KeyAgreement performs ECDH between the private key and peer, and returns
+// the raw shared secret, the x-coordinate of the shared point.
+func (sk *SecureKey) KeyAgreement(peer *ecdsa.PublicKey) ([]byte, error) {
+	return sk.key.KeyAgreement(peer)
+}
+
+// AttestOptions selects the attestation identity key that certifies a TPM key.
+type AttestOptions = ncrypt.AttestOptions
+
+// KeyAttestation is a statement by the TPM that it holds a key.
+type KeyAttestation = ncrypt.KeyAttestation
+
+// Attest returns a claim, signed by the attestation identity key that opts
+// names, that the private key is held by the TPM, so that relying parties can
+// verify that the key is hardware-bound.
+func (sk *SecureKey) Attest(opts AttestOptions) (*KeyAttestation, error) {
+	return sk.key.Attest(opts)
+}
+
 // Close frees up resources associated with the underlying key.
 func (sk *SecureKey) Close() {
 	sk.key.Close()
@@ -56,3 +89,26 @@ func NewSecureKey(issuer string, store string, provider string) (*SecureKey, err
 	}
 	return &SecureKey{key: k}, nil
 }
+
+// CredentialInfo describes a candidate certificate in the Windows certificate store.
+type CredentialInfo = ncrypt.CredentialInfo
+
+// ListCredentials describes the candidate certificates in the store that opts
+// select, and which of them NewSecureKeyWithOptions would use.
+func ListCredentials(opts Options) ([]CredentialInfo, error) {
+	return ncrypt.ListCredentials(opts)
+}
+
+// Options selects the certificate that NewSecureKeyWithOptions uses.
+type Options = ncrypt.Options
+
+// NewSecureKeyWithOptions returns a handle to the first available certificate
+// and private key pair in the Windows key store matching opts, such as a
+// certificate with a given SHA-1 or SHA-256 thumbprint.
+func NewSecureKeyWithOptions(opts Options) (*SecureKey, error) {
+	k, err := ncrypt.CredWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureKey{key: k}, nil
+}